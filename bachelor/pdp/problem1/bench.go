@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// benchConfig is the grid swept by the benchmark: every strategy is run with
+// every thread count on every number of accounts
+type benchConfig struct {
+	strategies []string
+	threads    []int
+	accounts   []int
+	workload   workloadConfig // threads and accounts are overwritten by the grid
+}
+
+var benchHeader = []string{"strategy", "accounts", "threads", "transfers", "succeeded", "failed", "queries", "elapsed_ms", "ops_per_sec", "consistent"}
+
+// runBenchmark runs the whole grid and writes one CSV row per run to w
+func runBenchmark(b benchConfig, w io.Writer) error {
+	out := csv.NewWriter(w)
+	if err := out.Write(benchHeader); err != nil {
+		return err
+	}
+	for _, name := range b.strategies {
+		for _, n := range b.accounts {
+			for _, threads := range b.threads {
+				c := b.workload
+				c.accounts, c.threads = n, threads
+				c.hotAccounts = min(c.hotAccounts, n)
+				if err := c.validate(); err != nil {
+					return fmt.Errorf("%s with %d accounts and %d threads: %w", name, n, threads, err)
+				}
+				// every run starts from fresh accounts and an empty ledger
+				accounts := newAccounts(n, c.initialBalance)
+				ledger := newLedger()
+				strategy, err := newStrategy(name, accounts, ledger)
+				if err != nil {
+					return err
+				}
+				result := runWorkload(c, accounts, strategy)
+				// money is neither created nor lost, whatever the strategy,
+				// and the logs match the ledger when there are logs
+				consistent := checkTotal(strategy, accounts) == nil
+				if _, ok := strategy.(*atomicBalances); !ok && consistent {
+					consistent = checkAllAccountsConsistency(accounts, ledger) == nil
+				}
+				err = out.Write([]string{
+					name,
+					strconv.Itoa(n),
+					strconv.Itoa(threads),
+					strconv.FormatInt(result.attempted, 10),
+					strconv.FormatInt(result.succeeded, 10),
+					strconv.FormatInt(result.failed, 10),
+					strconv.FormatInt(result.queries, 10),
+					strconv.FormatFloat(float64(result.elapsed.Microseconds())/1000, 'f', 3, 64),
+					strconv.FormatFloat(result.throughput(), 'f', 0, 64),
+					strconv.FormatBool(consistent),
+				})
+				if err != nil {
+					return err
+				}
+				out.Flush()
+			}
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// parseIntList parses "1,2,4,8"
+func parseIntList(list string) ([]int, error) {
+	var values []int
+	for _, item := range strings.Split(list, ",") {
+		value, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil || value < 1 {
+			return nil, fmt.Errorf("invalid number %q in %q", item, list)
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// parseStrategies parses a comma separated list of strategy names, or "all"
+func parseStrategies(list string) ([]string, error) {
+	if list == "all" {
+		return strategyNames, nil
+	}
+	names := strings.Split(list, ",")
+	for i, name := range names {
+		names[i] = strings.TrimSpace(name)
+		if _, err := newStrategy(names[i], nil, nil); err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// violation is a broken invariant found by the online checker
+type violation struct {
+	serial  int // the offending operation, 0 if there is none in particular
+	account int // the account concerned, 0 for the ledger itself
+	problem string
+}
+
+func (v violation) String() string {
+	switch {
+	case v.account == 0:
+		return fmt.Sprintf("serial %d: %s", v.serial, v.problem)
+	case v.serial == 0:
+		return fmt.Sprintf("account %d: %s", v.account, v.problem)
+	}
+	return fmt.Sprintf("serial %d, account %d: %s", v.serial, v.account, v.problem)
+}
+
+// accountCheck is what the online checker already verified of one account
+type accountCheck struct {
+	cursor int   // records at the start of the log that were verified
+	last   int   // serial of the last verified record
+	sum    Money // initial balance plus the legs of the verified records
+}
+
+// onlineChecker validates the invariants while transactions keep running,
+// without stopping them. Each round uses a consistent cut of the history: the
+// serial S last issued by the ledger when the round starts. Every transaction
+// up to S has recorded its ledger entry and, since it held the locks of its
+// accounts until it was done, it is in the log of any account read afterwards
+// under that account's lock. So the round checks, against the ledger entries
+// up to S:
+//   - every entry is a valid transaction (which conserves the total money);
+//   - every account logs exactly the entries up to S with a leg on it, in
+//     serial order, with the same legs;
+//   - every account's balance is its initial balance plus its legs in its log,
+//     both read under the same lock.
+//
+// The checker remembers how far it got, so a round only looks at the entries
+// and records after the previous cut (plus the few records after S, for the
+// balance): its cost grows with the new operations, not with the history.
+// Rounds must not run concurrently.
+type onlineChecker struct {
+	accounts []*BankAccount // accounts[i] has id i+1
+	strategy lockStrategy   // one that keeps logs, not atomic
+	ledger   *ledger
+	checked  int // serial up to which everything was verified
+	states   []accountCheck
+
+	processed int // ledger entries and log records verified so far, each once
+}
+
+func newOnlineChecker(accounts []*BankAccount, strategy lockStrategy, ledger *ledger) *onlineChecker {
+	c := &onlineChecker{
+		accounts: accounts,
+		strategy: strategy,
+		ledger:   ledger,
+		checked:  ledger.base,
+		states:   make([]accountCheck, len(accounts)),
+	}
+	for i, account := range accounts {
+		c.states[i].sum = account.initialBalance
+	}
+	return c
+}
+
+// addAccounts makes the checker verify accounts created after it, which have
+// no operation yet; not while a round runs
+func (c *onlineChecker) addAccounts(accounts ...*BankAccount) {
+	for _, account := range accounts {
+		c.accounts = append(c.accounts, account)
+		c.states = append(c.states, accountCheck{sum: account.initialBalance})
+	}
+}
+
+// check runs one round, returning the serial up to which the history is now
+// verified and the violations found in the operations since the last round
+func (c *onlineChecker) check() (int, []violation) {
+	var violations []violation
+	report := func(serial, account int, format string, args ...any) {
+		violations = append(violations, violation{serial, account, fmt.Sprintf(format, args...)})
+	}
+
+	// the cut first, then the accounts, one lock at a time
+	cut := c.ledger.last()
+	balances := make([]Money, len(c.accounts))
+	logs := make([][]OperationRecord, len(c.accounts))
+	for i, account := range c.accounts {
+		balances[i], logs[i] = c.strategy.view(account)
+	}
+
+	// the new ledger entries up to the cut, by account
+	expected := make(map[int][]ledgerEntry)
+	for i, entry := range c.ledger.since(c.checked) {
+		if entry.serial > cut {
+			break
+		}
+		if entry.serial != c.checked+i+1 {
+			report(entry.serial, 0, "ledger entry in position %d", c.checked+i+1)
+		}
+		if err := checkTransaction(entry.legs, len(c.accounts)); err != nil {
+			report(entry.serial, 0, "invalid transaction: %v", err)
+		}
+		for _, leg := range entry.legs {
+			if leg.accountId >= 1 && leg.accountId <= len(c.accounts) {
+				expected[leg.accountId] = append(expected[leg.accountId], entry)
+			}
+		}
+		c.processed++
+	}
+
+	for i, account := range c.accounts {
+		state, log, want := &c.states[i], logs[i], expected[account.id]
+		// merge the new records up to the cut with the entries of the account
+		k := 0
+		for ; state.cursor < len(log) && log[state.cursor].id <= cut; state.cursor++ {
+			record := log[state.cursor]
+			if record.id <= state.last {
+				report(record.id, account.id, "logged after serial %d", state.last)
+			}
+			for ; k < len(want) && want[k].serial < record.id; k++ {
+				report(want[k].serial, account.id, "in the ledger but missing from the log")
+			}
+			if k < len(want) && want[k].serial == record.id {
+				if !slices.Equal(record.legs, want[k].legs) {
+					report(record.id, account.id, "logged as %v but the ledger has %v", record.legs, want[k].legs)
+				}
+				k++
+			} else {
+				report(record.id, account.id, "logged but not in the ledger with a leg on the account")
+			}
+			var err error
+			if state.sum, err = state.sum.add(amountFor(record.legs, account.id)); err != nil {
+				report(record.id, account.id, "%v", err)
+			}
+			state.last = max(state.last, record.id)
+			c.processed++
+		}
+		for ; k < len(want); k++ {
+			report(want[k].serial, account.id, "in the ledger but missing from the log")
+		}
+
+		// the balance was read with the whole log, records after the cut included
+		total := state.sum
+		for _, record := range log[state.cursor:] {
+			total, _ = total.add(amountFor(record.legs, account.id))
+		}
+		if total != balances[i] {
+			report(state.last, account.id, "balance %v but the log adds up to %v", balances[i], total)
+			// report the difference only once
+			if diff, err := balances[i].sub(total); err == nil {
+				state.sum, _ = state.sum.add(diff)
+			}
+		}
+	}
+	c.checked = cut
+	return cut, violations
+}
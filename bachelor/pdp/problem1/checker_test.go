@@ -0,0 +1,140 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestOnlineChecker_WhileTransfersRun(t *testing.T) {
+	c := workloadConfig{
+		accounts:       16,
+		initialBalance: mustMoney(t, "100"),
+		threads:        8,
+		opsPerThread:   5000,
+		minAmount:      mustMoney(t, "0.01"),
+		maxAmount:      mustMoney(t, "30"),
+		distribution:   "uniform",
+		hotAccounts:    4,
+		hotFraction:    0.5,
+		txFraction:     0.3,
+		seed:           11,
+	}
+	for _, name := range []string{"global", "per-account", "striped", "rwmutex", "stm"} {
+		accounts := newAccounts(c.accounts, c.initialBalance)
+		ledger := newLedger()
+		strategy, err := newStrategy(name, accounts, ledger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checker := newOnlineChecker(accounts, strategy, ledger)
+
+		var wg sync.WaitGroup
+		done := make(chan bool)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runWorkload(c, accounts, strategy)
+			close(done)
+		}()
+		rounds := 0
+		for running := true; running; rounds++ {
+			select {
+			case <-done:
+				running = false
+			default:
+			}
+			if _, violations := checker.check(); len(violations) > 0 {
+				t.Fatalf("%s: %v", name, violations)
+			}
+		}
+		wg.Wait()
+
+		// a last round sees everything, and has visited every entry and record once
+		serial, violations := checker.check()
+		if len(violations) > 0 {
+			t.Fatalf("%s: %v", name, violations)
+		}
+		if serial != ledger.length() {
+			t.Errorf("%s: checked up to %d of %d", name, serial, ledger.length())
+		}
+		records := 0
+		for _, account := range accounts {
+			records += len(account.operations)
+		}
+		if checker.processed != ledger.length()+records {
+			t.Errorf("%s: %d entries and records processed in %d rounds, want %d", name, checker.processed, rounds, ledger.length()+records)
+		}
+	}
+}
+
+// tamperedBank returns a bank of 4 accounts after 3 transactions, checked once
+func tamperedBank(t *testing.T) ([]*BankAccount, *ledger, *onlineChecker) {
+	t.Helper()
+	accounts := newAccounts(4, mustMoney(t, "100"))
+	ledger := newLedger()
+	strategy, _ := newStrategy("per-account", accounts, ledger)
+	checker := newOnlineChecker(accounts, strategy, ledger)
+	if _, violations := checker.check(); len(violations) > 0 {
+		t.Fatal(violations)
+	}
+	for _, legs := range [][]Leg{
+		Transfer{1, 2, mustMoney(t, "10")}.legs(),
+		{{3, mustMoney(t, "-6")}, {1, mustMoney(t, "2")}, {4, mustMoney(t, "4")}},
+		Transfer{4, 3, mustMoney(t, "1.5")}.legs(),
+	} {
+		if _, err := strategy.transact(accounts, legs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return accounts, ledger, checker
+}
+
+func checkViolations(t *testing.T, checker *onlineChecker, want ...string) {
+	t.Helper()
+	_, violations := checker.check()
+	if len(violations) != len(want) {
+		t.Fatalf("violations %v, want %d", violations, len(want))
+	}
+	for i, v := range violations {
+		if !strings.HasPrefix(v.String(), want[i]) {
+			t.Errorf("violation %q, want %q...", v, want[i])
+		}
+	}
+}
+
+func TestOnlineChecker_Violations(t *testing.T) {
+	t.Run("consistent", func(t *testing.T) {
+		_, _, checker := tamperedBank(t)
+		checkViolations(t, checker)
+	})
+	t.Run("record missing", func(t *testing.T) {
+		accounts, _, checker := tamperedBank(t)
+		accounts[3].operations = accounts[3].operations[1:] // drop serial 2
+		checkViolations(t, checker,
+			"serial 2, account 4: in the ledger but missing from the log",
+			"serial 3, account 4: balance")
+	})
+	t.Run("record changed", func(t *testing.T) {
+		accounts, _, checker := tamperedBank(t)
+		accounts[1].operations[0].legs = Transfer{1, 2, mustMoney(t, "11")}.legs()
+		checkViolations(t, checker,
+			"serial 1, account 2: logged as",
+			"serial 1, account 2: balance 110.00 EUR but the log adds up to 111.00 EUR")
+	})
+	t.Run("balance changed", func(t *testing.T) {
+		accounts, _, checker := tamperedBank(t)
+		accounts[2].balance = mustMoney(t, "1000")
+		checkViolations(t, checker, "serial 3, account 3: balance 1000.00 EUR")
+		// reported once
+		checkViolations(t, checker)
+	})
+	t.Run("invalid ledger entry", func(t *testing.T) {
+		_, ledger, checker := tamperedBank(t)
+		ledger.entries[2].legs = Transfer{4, 3, mustMoney(t, "1.5")}.legs()[:1]
+		checkViolations(t, checker,
+			"serial 3: invalid transaction",
+			"serial 3, account 3: logged but not in the ledger",
+			"serial 3, account 4: logged as")
+	})
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Durable mode keeps the bank in a directory:
+//   - snapshot:           the balances of all accounts after some serial S
+//   - wal-<first>.log:    write-ahead log segments, the transfers from serial
+//     <first> on, one segment per checkpoint
+//
+// Every file is a sequence of frames: a 4 byte length, the CRC-32 of the
+// payload and the payload. A frame cut short or with a bad checksum at the end
+// of the last segment is a torn write of a process that died while appending:
+// recovery drops it, with everything after it.
+
+const (
+	snapshotFile  = "snapshot"
+	walPrefix     = "wal-"
+	walSuffix     = ".log"
+	frameHeader   = 8
+	legSize       = 4 + 8 // account, cents
+	maxFramedSize = 1 << 30
+)
+
+var errTornWrite = errors.New("torn write")
+
+// store is the durable side of a ledger. append and rotate are called under
+// the ledger's mutex; writeSnapshot only by the one goroutine doing checkpoints.
+type store struct {
+	dir     string
+	fsync   bool     // sync every record to the disk, not only to the OS
+	segment *os.File // the WAL segment being appended to
+	frame   []byte   // reused buffer of append
+
+	serial   int     // serial of the snapshot on disk
+	balances []Money // balances in the snapshot, balances[id-1]
+}
+
+func segmentName(first int) string {
+	return fmt.Sprintf("%s%020d%s", walPrefix, first, walSuffix)
+}
+
+// appendFrame appends a frame holding payload to buf
+func appendFrame(buf, payload []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(payload)))
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(payload))
+	return append(buf, payload...)
+}
+
+// readFrame reads the next frame of r, returning io.EOF at a clean end and
+// errTornWrite if the frame is incomplete or its checksum does not match
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [frameHeader]byte
+	if n, err := io.ReadFull(r, header[:]); err != nil {
+		if n == 0 && err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, errTornWrite
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length > maxFramedSize {
+		return nil, errTornWrite
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, errTornWrite
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, errTornWrite
+	}
+	return payload, nil
+}
+
+// encodeRecord encodes a transaction: the serial, the currency, the number of
+// legs and, for every leg, the account and the signed amount in cents
+func encodeRecord(serial int, legs []Leg) []byte {
+	b := make([]byte, 0, 8+3+2+legSize*len(legs))
+	b = binary.BigEndian.AppendUint64(b, uint64(serial))
+	b = append(b, legs[0].amount.currency...)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(legs)))
+	for _, leg := range legs {
+		b = binary.BigEndian.AppendUint32(b, uint32(leg.accountId))
+		b = binary.BigEndian.AppendUint64(b, uint64(leg.amount.units))
+	}
+	return b
+}
+
+func decodeRecord(b []byte) (int, []Leg, error) {
+	if len(b) < 8+3+2 || len(b) != 8+3+2+legSize*int(binary.BigEndian.Uint16(b[11:])) {
+		return 0, nil, fmt.Errorf("WAL record of %d bytes", len(b))
+	}
+	serial := int(binary.BigEndian.Uint64(b))
+	currency := string(b[8:11])
+	legs := make([]Leg, binary.BigEndian.Uint16(b[11:]))
+	for i := range legs {
+		leg := b[13+legSize*i:]
+		legs[i] = Leg{
+			accountId: int(binary.BigEndian.Uint32(leg)),
+			amount:    newMoney(int64(binary.BigEndian.Uint64(leg[4:])), currency),
+		}
+	}
+	return serial, legs, nil
+}
+
+// append writes the record of a transaction to the WAL, in a single write
+func (s *store) append(serial int, legs []Leg) error {
+	s.frame = appendFrame(s.frame[:0], encodeRecord(serial, legs))
+	if _, err := s.segment.Write(s.frame); err != nil {
+		return fmt.Errorf("WAL: %w", err)
+	}
+	if s.fsync {
+		if err := s.segment.Sync(); err != nil {
+			return fmt.Errorf("WAL: %w", err)
+		}
+	}
+	return nil
+}
+
+// rotate closes the current segment and starts a new one at serial first
+func (s *store) rotate(first int) error {
+	if err := s.close(); err != nil {
+		return err
+	}
+	return s.openSegment(first)
+}
+
+func (s *store) openSegment(first int) error {
+	f, err := os.OpenFile(filepath.Join(s.dir, segmentName(first)), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("WAL: %w", err)
+	}
+	s.segment = f
+	return nil
+}
+
+func (s *store) close() error {
+	if s.segment == nil {
+		return nil
+	}
+	err := s.segment.Sync()
+	if closeErr := s.segment.Close(); err == nil {
+		err = closeErr
+	}
+	s.segment = nil
+	return err
+}
+
+// writeSnapshot applies entries, the transactions after the snapshot on disk
+// up to serial, to its balances, replaces the snapshot with the result and
+// removes the segments it makes useless
+func (s *store) writeSnapshot(serial int, entries []ledgerEntry) error {
+	for _, entry := range entries {
+		for _, leg := range entry.legs {
+			var err error
+			if s.balances[leg.accountId-1], err = s.balances[leg.accountId-1].add(leg.amount); err != nil {
+				return fmt.Errorf("snapshot: serial %d: %w", entry.serial, err)
+			}
+		}
+	}
+	s.serial = serial
+	if err := writeSnapshotFile(s.dir, serial, s.balances); err != nil {
+		return err
+	}
+
+	// the segments before the one starting at serial+1 are in the snapshot
+	segments, err := listSegments(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, first := range segments {
+		if first <= serial {
+			if err := os.Remove(filepath.Join(s.dir, segmentName(first))); err != nil {
+				return fmt.Errorf("snapshot: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// writeSnapshotFile writes the snapshot to a temporary file and renames it,
+// so that the snapshot on disk is always a complete one
+func writeSnapshotFile(dir string, serial int, balances []Money) error {
+	payload := binary.BigEndian.AppendUint64(nil, uint64(serial))
+	payload = append(payload, balances[0].currency...)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(len(balances)))
+	for _, balance := range balances {
+		payload = binary.BigEndian.AppendUint64(payload, uint64(balance.units))
+	}
+
+	tmp := filepath.Join(dir, snapshotFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("snapshot: %w", err)
+	}
+	_, err = f.Write(appendFrame(nil, payload))
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(dir, snapshotFile))
+	}
+	if err != nil {
+		return fmt.Errorf("snapshot: %w", err)
+	}
+	return nil
+}
+
+func readSnapshotFile(dir string) (int, []Money, error) {
+	f, err := os.Open(filepath.Join(dir, snapshotFile))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+	payload, err := readFrame(f)
+	if err != nil || len(payload) < 8+3+4 {
+		return 0, nil, errors.New("snapshot: corrupted")
+	}
+	serial := int(binary.BigEndian.Uint64(payload))
+	currency := string(payload[8:11])
+	n := int(binary.BigEndian.Uint32(payload[11:]))
+	if n < 2 || len(payload) != 15+8*n {
+		return 0, nil, errors.New("snapshot: corrupted")
+	}
+	balances := make([]Money, n)
+	for i := range balances {
+		balances[i] = newMoney(int64(binary.BigEndian.Uint64(payload[15+8*i:])), currency)
+	}
+	return serial, balances, nil
+}
+
+// listSegments returns the first serials of the WAL segments in dir, sorted
+func listSegments(dir string) ([]int, error) {
+	names, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []int
+	for _, entry := range names {
+		name := entry.Name()
+		if !strings.HasPrefix(name, walPrefix) || !strings.HasSuffix(name, walSuffix) {
+			continue
+		}
+		first, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, walPrefix), walSuffix))
+		if err != nil {
+			continue
+		}
+		segments = append(segments, first)
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+// recovery tells what openDurable found in an existing directory
+type recovery struct {
+	snapshotSerial int   // serial of the snapshot the balances were loaded from
+	replayed       int   // transactions replayed from the WAL after the snapshot
+	tornBytes      int64 // bytes dropped at the end of the WAL
+}
+
+// openDurable opens the bank kept in dir. A new directory gets accounts as
+// described by c and a first snapshot; an existing one is recovered: the
+// snapshot is loaded, the WAL after it is replayed and the result must pass
+// checkAllAccountsConsistency. The returned recovery is nil for a new bank.
+func openDurable(dir string, c workloadConfig, fsync bool) ([]*BankAccount, *ledger, *recovery, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, nil, nil, err
+	}
+	serial, balances, err := readSnapshotFile(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		if segments, err := listSegments(dir); err != nil || len(segments) > 0 {
+			return nil, nil, nil, fmt.Errorf("%s: WAL without a snapshot", dir)
+		}
+		accounts := newAccounts(c.accounts, c.initialBalance)
+		s := &store{dir: dir, fsync: fsync, balances: make([]Money, len(accounts))}
+		for i, account := range accounts {
+			s.balances[i] = account.balance
+		}
+		if err := writeSnapshotFile(dir, 0, s.balances); err != nil {
+			return nil, nil, nil, err
+		}
+		if err := s.openSegment(1); err != nil {
+			return nil, nil, nil, err
+		}
+		ledger := newLedger()
+		ledger.store = s
+		return accounts, ledger, nil, nil
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// the snapshot balances are the initial balances of the recovered accounts
+	accounts := make([]*BankAccount, len(balances))
+	for i, balance := range balances {
+		accounts[i] = newBankAccount(i+1, balance)
+	}
+	ledger := newLedger()
+	ledger.base = serial
+	r := &recovery{snapshotSerial: serial}
+	if err := replay(dir, accounts, ledger, r); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := checkAllAccountsConsistency(accounts, ledger); err != nil {
+		return nil, nil, nil, fmt.Errorf("recovery: %w", err)
+	}
+
+	// from now on, append to the WAL
+	s := &store{dir: dir, fsync: fsync, serial: serial, balances: balances}
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	first := serial + 1
+	if len(segments) > 0 {
+		first = segments[len(segments)-1]
+	}
+	if err := s.openSegment(first); err != nil {
+		return nil, nil, nil, err
+	}
+	ledger.store = s
+	return accounts, ledger, r, nil
+}
+
+// replay applies the WAL records after the ledger's base to the accounts, in
+// serial order. A torn write at the end of the last segment is cut off.
+func replay(dir string, accounts []*BankAccount, ledger *ledger, r *recovery) error {
+	segments, err := listSegments(dir)
+	if err != nil {
+		return err
+	}
+	for i, first := range segments {
+		path := filepath.Join(dir, segmentName(first))
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		good, err := replaySegment(f, accounts, ledger, r)
+		f.Close()
+		if !errors.Is(err, errTornWrite) {
+			if err != nil {
+				return fmt.Errorf("recovery: %s: %w", path, err)
+			}
+			continue
+		}
+		if i != len(segments)-1 {
+			return fmt.Errorf("recovery: %s: %w before the last segment", path, err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		r.tornBytes = info.Size() - good
+		if err := os.Truncate(path, good); err != nil {
+			return fmt.Errorf("recovery: %w", err)
+		}
+	}
+	return nil
+}
+
+// replaySegment replays the records of one segment, returning the offset
+// after the last good one
+func replaySegment(f *os.File, accounts []*BankAccount, ledger *ledger, r *recovery) (int64, error) {
+	var good int64
+	for {
+		payload, err := readFrame(f)
+		if err == io.EOF {
+			return good, nil
+		}
+		if err != nil {
+			return good, err
+		}
+		serial, legs, err := decodeRecord(payload)
+		if err != nil {
+			return good, err
+		}
+		good += frameHeader + int64(len(payload))
+		// records already in the snapshot
+		if serial <= ledger.base {
+			continue
+		}
+		if serial != ledger.base+ledger.length()+1 {
+			return good, fmt.Errorf("serial %d after %d", serial, ledger.base+ledger.length())
+		}
+		involved, _, err := transactionAccounts(accounts, legs)
+		if err != nil {
+			return good, fmt.Errorf("serial %d: %w", serial, err)
+		}
+		// the ledger has no store yet, so this records serial again in memory only
+		if _, err := applyTransaction(ledger, involved, legs); err != nil {
+			return good, fmt.Errorf("serial %d: %w", serial, err)
+		}
+		r.replayed++
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func durableConfig(t *testing.T) workloadConfig {
+	t.Helper()
+	return workloadConfig{
+		accounts:       10,
+		initialBalance: mustMoney(t, "100"),
+		threads:        4,
+		opsPerThread:   500,
+		minAmount:      mustMoney(t, "0.01"),
+		maxAmount:      mustMoney(t, "20"),
+		distribution:   "uniform",
+		seed:           7,
+	}
+}
+
+// runDurable opens the bank in dir and runs c on it with per-account locking
+func runDurable(t *testing.T, dir string, c workloadConfig) ([]*BankAccount, *ledger) {
+	t.Helper()
+	accounts, ledger, _, err := openDurable(dir, c, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strategy, err := newStrategy("per-account", accounts, ledger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runWorkload(c, accounts, strategy)
+	return accounts, ledger
+}
+
+// lastSegment returns the path of the WAL segment being appended to
+func lastSegment(t *testing.T, dir string) string {
+	t.Helper()
+	segments, err := listSegments(dir)
+	if err != nil || len(segments) == 0 {
+		t.Fatalf("no WAL segment in %s: %v", dir, err)
+	}
+	return filepath.Join(dir, segmentName(segments[len(segments)-1]))
+}
+
+func checkSameBalances(t *testing.T, got, want []*BankAccount) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%d accounts, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i].balance != want[i].balance {
+			t.Errorf("account %d: balance %v, want %v", want[i].id, got[i].balance, want[i].balance)
+		}
+	}
+}
+
+func TestDurable_RecoverAfterClose(t *testing.T) {
+	dir := t.TempDir()
+	c := durableConfig(t)
+	accounts, ledger := runDurable(t, dir, c)
+	if err := ledger.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered, _, r, err := openDurable(dir, c, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r == nil || r.snapshotSerial != ledger.length() || r.replayed != 0 {
+		t.Errorf("recovery %+v, want everything in the snapshot at serial %d", r, ledger.length())
+	}
+	checkSameBalances(t, recovered, accounts)
+}
+
+func TestDurable_ReplayWAL(t *testing.T) {
+	dir := t.TempDir()
+	c := durableConfig(t)
+	// a checkpoint in the middle: the rest is only in the WAL
+	accounts, ledger := runDurable(t, dir, c)
+	if err := ledger.checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	first := ledger.length()
+	strategy, _ := newStrategy("per-account", accounts, ledger)
+	runWorkload(c, accounts, strategy)
+
+	// the process dies without closing anything
+	recovered, recoveredLedger, r, err := openDurable(dir, c, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.snapshotSerial != first || r.replayed != ledger.length()-first || r.tornBytes != 0 {
+		t.Errorf("recovery %+v, want snapshot at %d and %d replayed", r, first, ledger.length()-first)
+	}
+	checkSameBalances(t, recovered, accounts)
+
+	// the recovered bank goes on with the next serials
+	strategy, _ = newStrategy("per-account", recovered, recoveredLedger)
+	runWorkload(c, recovered, strategy)
+	if err := recoveredLedger.close(); err != nil {
+		t.Fatal(err)
+	}
+	again, _, _, err := openDurable(dir, c, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameBalances(t, again, recovered)
+}
+
+func TestDurable_TornWrite(t *testing.T) {
+	tests := []struct {
+		name string
+		tear func(t *testing.T, path string, size int64)
+		lost int // transfers lost with the torn write
+	}{
+		{"cut in the header", func(t *testing.T, path string, size int64) {
+			truncate(t, path, size-frameHeader-(8+3+2+2*legSize)+3)
+		}, 1},
+		{"cut in the record", func(t *testing.T, path string, size int64) {
+			truncate(t, path, size-5)
+		}, 1},
+		{"bad checksum", func(t *testing.T, path string, size int64) {
+			flipByte(t, path, size-1)
+		}, 1},
+		{"half of a new record", func(t *testing.T, path string, size int64) {
+			appendBytes(t, path, appendFrame(nil, encodeRecord(1<<40, Transfer{1, 2, mustMoney(t, "1")}.legs()))[:20])
+		}, 0},
+		{"garbage length", func(t *testing.T, path string, size int64) {
+			appendBytes(t, path, []byte{0xff, 0xff, 0xff, 0xff, 1, 2, 3})
+		}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			c := durableConfig(t)
+			_, ledger := runDurable(t, dir, c)
+			written := ledger.length()
+			path := lastSegment(t, dir)
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.tear(t, path, info.Size())
+
+			recovered, recoveredLedger, r, err := openDurable(dir, c, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.replayed != written-tt.lost || r.tornBytes == 0 {
+				t.Errorf("recovery %+v, want %d replayed and a torn write", r, written-tt.lost)
+			}
+			if err := checkTotal(perAccountLock{}, recovered); err != nil {
+				t.Error(err)
+			}
+
+			// the torn write is gone: new records follow the good ones
+			strategy, _ := newStrategy("per-account", recovered, recoveredLedger)
+			runWorkload(c, recovered, strategy)
+			again, _, r, err := openDurable(dir, c, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.tornBytes != 0 {
+				t.Errorf("torn write of %d bytes after the recovery", r.tornBytes)
+			}
+			checkSameBalances(t, again, recovered)
+		})
+	}
+}
+
+func truncate(t *testing.T, path string, size int64) {
+	t.Helper()
+	if err := os.Truncate(path, size); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func flipByte(t *testing.T, path string, offset int64) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, offset); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err := f.WriteAt(b, offset); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func appendBytes(t *testing.T, path string, b []byte) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDurable_CrashHelper is the process killed by TestDurable_KillMidRun:
+// it transfers money forever, with frequent checkpoints
+func TestDurable_CrashHelper(t *testing.T) {
+	dir := os.Getenv("PROBLEM1_CRASH_DIR")
+	if dir == "" {
+		t.Skip("only run by TestDurable_KillMidRun")
+	}
+	c := durableConfig(t)
+	c.opsPerThread = 1 << 30
+	accounts, ledger, _, err := openDurable(dir, c, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go startCheckpoints(ledger, 5*time.Millisecond, make(chan bool), make(chan bool))
+	strategy, _ := newStrategy("per-account", accounts, ledger)
+	runWorkload(c, accounts, strategy)
+}
+
+func TestDurable_KillMidRun(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a process")
+	}
+	dir := t.TempDir()
+	for run := 0; run < 3; run++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestDurable_CrashHelper$")
+		cmd.Env = append(os.Environ(), "PROBLEM1_CRASH_DIR="+dir)
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		// let it write some snapshots and WAL records, then kill it
+		time.Sleep(300 * time.Millisecond)
+		if err := cmd.Process.Kill(); err != nil {
+			t.Fatal(err)
+		}
+		cmd.Wait()
+		// the kill can land anywhere; make sure the WAL also ends with a torn write
+		appendBytes(t, lastSegment(t, dir), appendFrame(nil, encodeRecord(1<<40, Transfer{1, 2, mustMoney(t, "1")}.legs()))[:11])
+
+		accounts, ledger, r, err := openDurable(dir, durableConfig(t), false)
+		if err != nil {
+			t.Fatalf("run %d: %v", run, err)
+		}
+		if r == nil || r.snapshotSerial+r.replayed == 0 || r.tornBytes != 11 {
+			t.Errorf("run %d: recovery %+v, want transfers and a torn write of 11 bytes", run, r)
+		}
+		t.Logf("run %d: recovery %+v", run, r)
+		if err := checkTotal(perAccountLock{}, accounts); err != nil {
+			t.Errorf("run %d: %v", run, err)
+		}
+		var total Money
+		for i, account := range accounts {
+			if i == 0 {
+				total = account.balance
+			} else {
+				total, _ = total.add(account.balance)
+			}
+		}
+		if want := mustMoney(t, "1000"); total != want {
+			t.Errorf("run %d: %v in the bank, want %v", run, total, want)
+		}
+		ledger.store.close()
+	}
+}
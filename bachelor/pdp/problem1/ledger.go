@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// ledgerEntry is one transfer or transaction in the audit log, under its
+// bank-wide serial
+type ledgerEntry struct {
+	serial int
+	legs   []Leg
+}
+
+// ledger issues the bank-wide serial numbers and keeps the audit log of all
+// the transfers and transactions. Its mutex protects both, so an entry's serial is also its
+// position in the log: serials are base+1, base+2, ... in the order of the log.
+// The ledger is always locked last, inside the locks of the accounts.
+//
+// In durable mode every transfer is first appended to the store's write-ahead
+// log, still under the ledger's mutex, so the WAL is in serial order too.
+type ledger struct {
+	mutex   orderedMutex
+	base    int // serial of the snapshot the bank was recovered from, 0 for a new bank
+	entries []ledgerEntry
+	store   *store // nil when the bank only lives in memory
+
+	checkpointed int // entries already folded into the store's snapshot
+}
+
+func newLedger() *ledger {
+	return &ledger{mutex: orderedMutex{name: "ledger"}}
+}
+
+// record appends the legs of a transfer or transaction to the audit log,
+// after writing them to the WAL in durable mode, and returns their serial.
+// Nothing is recorded if the WAL cannot be written.
+func (l *ledger) record(legs []Leg) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	serial := l.base + len(l.entries) + 1
+	if l.store != nil {
+		if err := l.store.append(serial, legs); err != nil {
+			return 0, err
+		}
+	}
+	l.entries = append(l.entries, ledgerEntry{serial, legs})
+	return serial, nil
+}
+
+// read returns the base serial and a copy of the audit log, which can be
+// used while transfers keep being recorded
+func (l *ledger) read() (int, []ledgerEntry) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.base, append([]ledgerEntry(nil), l.entries...)
+}
+
+// since returns a copy of the entries after serial, which must not be
+// before the base
+func (l *ledger) since(serial int) []ledgerEntry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]ledgerEntry(nil), l.entries[serial-l.base:]...)
+}
+
+// last returns the last serial issued, the base if there is none yet
+func (l *ledger) last() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.base + len(l.entries)
+}
+
+// length returns the number of transfers and transactions recorded so far
+func (l *ledger) length() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.entries)
+}
+
+// checkpoint writes a snapshot of the balances after the last recorded
+// transaction. Only the switch to a new WAL segment stops the transfers; the
+// snapshot itself is computed from the entries, without locking any account.
+// Checkpoints must not run concurrently.
+func (l *ledger) checkpoint() error {
+	l.mutex.Lock()
+	if l.store == nil || l.checkpointed == len(l.entries) {
+		l.mutex.Unlock()
+		return nil
+	}
+	entries := append([]ledgerEntry(nil), l.entries[l.checkpointed:]...)
+	serial := l.base + len(l.entries)
+	err := l.store.rotate(serial + 1)
+	if err == nil {
+		l.checkpointed = len(l.entries)
+	}
+	l.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return l.store.writeSnapshot(serial, entries)
+}
+
+// close writes a last snapshot and closes the WAL
+func (l *ledger) close() error {
+	if l.store == nil {
+		return nil
+	}
+	err := l.checkpoint()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if closeErr := l.store.close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// checkAgainstLedger cross-checks the logs of the accounts with the audit
+// log starting after serial base: every record of an account must be the
+// ledger entry with the same serial and have a leg on that account, and every
+// ledger entry must appear under its serial in the logs of all its accounts.
+// The caller makes sure no transaction runs meanwhile (all accounts locked,
+// or all threads done).
+func checkAgainstLedger(accounts []*BankAccount, base int, entries []ledgerEntry) error {
+	byId := make(map[int]*BankAccount, len(accounts))
+	for _, account := range accounts {
+		byId[account.id] = account
+	}
+	// the serials are base+1..base+n, in order
+	for i, entry := range entries {
+		if entry.serial != base+i+1 {
+			return fmt.Errorf("ledger entry %d has serial %d", base+i+1, entry.serial)
+		}
+	}
+
+	// the serials found in every account's log
+	logs := make(map[int]map[int]bool, len(accounts))
+	for _, account := range accounts {
+		log := make(map[int]bool, len(account.operations))
+		last := 0
+		for _, operation := range account.operations {
+			if operation.id <= last {
+				return fmt.Errorf("account %d: serial %d after %d", account.id, operation.id, last)
+			}
+			last = operation.id
+			if operation.id <= base || operation.id > base+len(entries) {
+				return fmt.Errorf("account %d: serial %d is not in the ledger", account.id, operation.id)
+			}
+			entry := entries[operation.id-base-1]
+			if !slices.Equal(operation.legs, entry.legs) {
+				return fmt.Errorf("account %d: serial %d is %v but the ledger has %v",
+					account.id, operation.id, operation.legs, entry.legs)
+			}
+			if amountFor(entry.legs, account.id).units == 0 {
+				return fmt.Errorf("account %d: serial %d has no leg on the account", account.id, operation.id)
+			}
+			log[operation.id] = true
+		}
+		logs[account.id] = log
+	}
+
+	for _, entry := range entries {
+		for _, leg := range entry.legs {
+			if byId[leg.accountId] == nil {
+				return fmt.Errorf("serial %d: unknown account %d", entry.serial, leg.accountId)
+			}
+			if !logs[leg.accountId][entry.serial] {
+				return fmt.Errorf("serial %d: missing from the log of account %d", entry.serial, leg.accountId)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"testing"
+)
+
+// runTransfers makes n transfers of 1.00 EUR from threads goroutines, transfer i
+// going from account i to the next one (modulo the number of accounts)
+func runTransfers(t *testing.T, strategy lockStrategy, accounts []*BankAccount, threads, n int) {
+	t.Helper()
+	var wg sync.WaitGroup
+	for thread := range threads {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := thread; i < n; i += threads {
+				from, to := accounts[i%len(accounts)], accounts[(i+1)%len(accounts)]
+				if ok, err := strategy.transfer(from, to, Transfer{from.id, to.id, newMoney(100, "EUR")}); !ok {
+					t.Errorf("transfer %d: %v", i, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestLedger_ConcurrentTransfers(t *testing.T) {
+	const n = 2000
+	for _, name := range []string{"global", "per-account", "striped", "rwmutex"} {
+		t.Run(name, func(t *testing.T) {
+			accounts := newAccounts(10, newMoney(100000, "EUR"))
+			ledger := newLedger()
+			strategy, err := newStrategy(name, accounts, ledger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			runTransfers(t, strategy, accounts, 8, n)
+
+			// every transfer got its own serial, with no gap
+			base, entries := ledger.read()
+			if len(entries) != n {
+				t.Fatalf("ledger has %d entries, want %d", len(entries), n)
+			}
+			for i, entry := range entries {
+				if entry.serial != i+1 {
+					t.Fatalf("entry %d has serial %d", i, entry.serial)
+				}
+			}
+			if err := checkAgainstLedger(accounts, base, entries); err != nil {
+				t.Errorf("checkAgainstLedger: %v", err)
+			}
+		})
+	}
+}
+
+// editLegs changes the legs of account's first record, on a copy since the
+// ledger entry shares them
+func editLegs(account *BankAccount, edit func(legs []Leg)) {
+	legs := slices.Clone(account.operations[0].legs)
+	edit(legs)
+	account.operations[0].legs = legs
+}
+
+func TestCheckAgainstLedger_CorruptedRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(account *BankAccount)
+	}{
+		{"amount", func(account *BankAccount) { editLegs(account, func(legs []Leg) { legs[0].amount.units++ }) }},
+		{"account", func(account *BankAccount) { editLegs(account, func(legs []Leg) { legs[0].accountId = 99 }) }},
+		{"serial out of order", func(account *BankAccount) { account.operations[1].id = account.operations[0].id }},
+		{"serial past the ledger", func(account *BankAccount) { account.operations[len(account.operations)-1].id += 1000 }},
+		{"missing record", func(account *BankAccount) { account.operations = account.operations[1:] }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accounts := newAccounts(5, newMoney(100000, "EUR"))
+			ledger := newLedger()
+			strategy, err := newStrategy("per-account", accounts, ledger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			runTransfers(t, strategy, accounts, 4, 100)
+			base, entries := ledger.read()
+			if err := checkAgainstLedger(accounts, base, entries); err != nil {
+				t.Fatalf("checkAgainstLedger before the corruption: %v", err)
+			}
+
+			tt.corrupt(accounts[2])
+			if err := checkAgainstLedger(accounts, base, entries); err == nil {
+				t.Error("checkAgainstLedger accepted a corrupted record")
+			}
+		})
+	}
+}
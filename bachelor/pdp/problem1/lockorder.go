@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Deadlock detection, in the style of the kernel's lockdep: while a detector
+// is enabled, every orderedMutex records which locks its goroutine already
+// holds when it is locked (an orderedRWMutex as well, read or write). Locking B while holding A adds the edge A -> B to
+// a lock-order graph, with the stack where it first happened. An edge that
+// closes a cycle (A -> B and, somewhere else, B -> A) is a potential
+// deadlock: two goroutines taking the locks of the cycle at the same time can
+// wait for each other forever. The cycle is reported as soon as its last edge
+// appears, before the lock is taken, so the run does not need to deadlock
+// for the detector to see it.
+
+// lockDetector is the enabled detector, nil (and no overhead but a load)
+// otherwise
+var lockDetector atomic.Pointer[lockOrder]
+
+// orderedMutex is a sync.Mutex watched by the enabled lock detector
+type orderedMutex struct {
+	mutex sync.Mutex
+	name  string // in the reports
+}
+
+func (m *orderedMutex) Lock() {
+	if d := lockDetector.Load(); d != nil {
+		d.acquire(m)
+	}
+	m.mutex.Lock()
+}
+
+func (m *orderedMutex) Unlock() {
+	if d := lockDetector.Load(); d != nil {
+		d.release(m)
+	}
+	m.mutex.Unlock()
+}
+
+func (m *orderedMutex) String() string {
+	return lockName(m, m.name)
+}
+
+// orderedRWMutex is a sync.RWMutex watched by the enabled lock detector. A
+// read lock counts as taking the lock: a reader waiting for a writer that
+// waits for it deadlocks too
+type orderedRWMutex struct {
+	mutex sync.RWMutex
+	name  string // in the reports
+}
+
+func (m *orderedRWMutex) Lock() {
+	if d := lockDetector.Load(); d != nil {
+		d.acquire(m)
+	}
+	m.mutex.Lock()
+}
+
+func (m *orderedRWMutex) Unlock() {
+	if d := lockDetector.Load(); d != nil {
+		d.release(m)
+	}
+	m.mutex.Unlock()
+}
+
+func (m *orderedRWMutex) RLock() {
+	if d := lockDetector.Load(); d != nil {
+		d.acquire(m)
+	}
+	m.mutex.RLock()
+}
+
+func (m *orderedRWMutex) RUnlock() {
+	if d := lockDetector.Load(); d != nil {
+		d.release(m)
+	}
+	m.mutex.RUnlock()
+}
+
+func (m *orderedRWMutex) String() string {
+	return lockName(m, m.name)
+}
+
+// watchedLock is an orderedMutex or an orderedRWMutex, by pointer
+type watchedLock interface {
+	String() string
+}
+
+func lockName(m watchedLock, name string) string {
+	if name == "" {
+		return fmt.Sprintf("lock %p", m)
+	}
+	return name
+}
+
+// lockEdge is a pair of locks taken one inside the other
+type lockEdge struct {
+	outer, inner watchedLock
+}
+
+// lockCycle is a potential deadlock: locks[i] was locked while holding
+// locks[i-1], and locks[0] while holding the last one, stacks[i] being where
+// locks[i] was first locked that way
+type lockCycle struct {
+	locks  []watchedLock
+	stacks []string
+}
+
+func (c lockCycle) String() string {
+	var b strings.Builder
+	names := make([]string, len(c.locks))
+	for i, m := range c.locks {
+		names[i] = m.String()
+	}
+	fmt.Fprintf(&b, "potential deadlock, lock order cycle: %s -> %s\n", strings.Join(names, " -> "), names[0])
+	for i, m := range c.locks {
+		outer := c.locks[(i+len(c.locks)-1)%len(c.locks)]
+		fmt.Fprintf(&b, "\n%v locked while holding %v:\n%s", m, outer, c.stacks[i])
+	}
+	return b.String()
+}
+
+// lockOrder is a lock detector: the locks each goroutine holds, in the order
+// it took them, and the lock-order graph built from them
+type lockOrder struct {
+	mutex  sync.Mutex
+	held   map[uint64][]watchedLock // by goroutine id
+	edges  map[lockEdge]string      // the stack where each edge first appeared
+	graph  map[watchedLock][]watchedLock
+	cycles []lockCycle
+	report func(lockCycle) // called with every new cycle, can be nil
+	err    error           // why the detector stopped, if it did
+}
+
+// enableLockOrder starts watching every orderedMutex and orderedRWMutex with a new detector,
+// which passes each cycle it finds to report if not nil
+func enableLockOrder(report func(lockCycle)) *lockOrder {
+	d := &lockOrder{
+		held:   map[uint64][]watchedLock{},
+		edges:  map[lockEdge]string{},
+		graph:  map[watchedLock][]watchedLock{},
+		report: report,
+	}
+	lockDetector.Store(d)
+	return d
+}
+
+// disableLockOrder stops the detector; no lock may be held at that time
+func disableLockOrder() {
+	lockDetector.Store(nil)
+}
+
+// acquire adds the edges from the locks the goroutine holds to m, checking
+// the new ones for a cycle
+func (d *lockOrder) acquire(m watchedLock) {
+	g, err := goroutineID()
+	if err != nil {
+		d.stop(err)
+		return
+	}
+	var stack string
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, outer := range d.held[g] {
+		edge := lockEdge{outer, m}
+		if _, seen := d.edges[edge]; seen {
+			continue
+		}
+		if stack == "" {
+			stack = currentStack()
+		}
+		d.edges[edge] = stack
+		d.graph[outer] = append(d.graph[outer], m)
+		// a path back from m to outer closes a cycle
+		if path := d.path(m, outer); path != nil {
+			d.addCycle(path)
+		}
+	}
+	d.held[g] = append(d.held[g], m)
+}
+
+// release forgets that the goroutine holds m
+func (d *lockOrder) release(m watchedLock) {
+	g, err := goroutineID()
+	if err != nil {
+		d.stop(err)
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	held := d.held[g]
+	if i := slices.Index(held, m); i >= 0 {
+		held = slices.Delete(held, i, i+1)
+	}
+	if len(held) == 0 {
+		delete(d.held, g)
+	} else {
+		d.held[g] = held
+	}
+}
+
+// stop disables the detector after an error: the locks keep working, only
+// unwatched, and result returns the error
+func (d *lockOrder) stop(err error) {
+	lockDetector.CompareAndSwap(d, nil)
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+// path returns the locks on a path of the graph from one lock to another,
+// both included, or nil if there is none
+func (d *lockOrder) path(from, to watchedLock) []watchedLock {
+	parent := map[watchedLock]watchedLock{from: nil}
+	queue := []watchedLock{from}
+	for len(queue) > 0 {
+		m := queue[0]
+		queue = queue[1:]
+		if m == to {
+			var path []watchedLock
+			for ; m != nil; m = parent[m] {
+				path = append(path, m)
+			}
+			slices.Reverse(path)
+			return path
+		}
+		for _, next := range d.graph[m] {
+			if _, seen := parent[next]; !seen {
+				parent[next] = m
+				queue = append(queue, next)
+			}
+		}
+	}
+	return nil
+}
+
+// addCycle records the cycle of the locks on path, the edge from the last
+// one to the first closing it
+func (d *lockOrder) addCycle(path []watchedLock) {
+	c := lockCycle{locks: path, stacks: make([]string, len(path))}
+	for i, m := range path {
+		c.stacks[i] = d.edges[lockEdge{path[(i+len(path)-1)%len(path)], m}]
+	}
+	d.cycles = append(d.cycles, c)
+	if d.report != nil {
+		d.report(c)
+	}
+}
+
+// result returns the cycles found so far, the size of the graph and, if the
+// detector stopped, why
+func (d *lockOrder) result() (cycles []lockCycle, locks, edges int, err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	nodes := map[watchedLock]bool{}
+	for edge := range d.edges {
+		nodes[edge.outer], nodes[edge.inner] = true, true
+	}
+	return slices.Clone(d.cycles), len(nodes), len(d.edges), d.err
+}
+
+// goroutineID returns the id of the current goroutine, since the runtime
+// does not expose it
+func goroutineID() (uint64, error) {
+	var buf [64]byte
+	return parseGoroutineID(buf[:runtime.Stack(buf[:], false)])
+}
+
+// parseGoroutineID parses the id from the header of a stack,
+// "goroutine 42 [running]:"
+func parseGoroutineID(stack []byte) (uint64, error) {
+	header, ok := bytes.CutPrefix(stack, []byte("goroutine "))
+	if !ok {
+		return 0, fmt.Errorf("cannot parse the goroutine id from %q", stack)
+	}
+	header, _, _ = bytes.Cut(header, []byte(" "))
+	id, err := strconv.ParseUint(string(header), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse the goroutine id: %w", err)
+	}
+	return id, nil
+}
+
+// currentStack returns the stack of the current goroutine, without the
+// frames of the detector
+func currentStack() string {
+	buf := make([]byte, 16<<10)
+	stack := string(buf[:runtime.Stack(buf, false)])
+	// skip the header and the frames up to the Lock or RLock of the
+	// watched lock, two lines each
+	lines := strings.Split(stack, "\n")
+	for i, line := range lines {
+		if strings.Contains(line, "(*orderedMutex).Lock(") || strings.Contains(line, "(*orderedRWMutex).Lock(") ||
+			strings.Contains(line, "(*orderedRWMutex).RLock(") {
+			return strings.Join(lines[i+2:], "\n")
+		}
+	}
+	return stack
+}
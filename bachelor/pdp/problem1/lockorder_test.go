@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// watchLocks enables a detector for the rest of the test
+func watchLocks(t *testing.T) *lockOrder {
+	d := enableLockOrder(nil)
+	t.Cleanup(disableLockOrder)
+	return d
+}
+
+func cycleNames(c lockCycle) string {
+	names := make([]string, len(c.locks))
+	for i, m := range c.locks {
+		names[i] = m.String()
+	}
+	return strings.Join(names, " -> ")
+}
+
+func TestLockOrder_NoCycle(t *testing.T) {
+	c := workloadConfig{
+		accounts:       6,
+		initialBalance: mustMoney(t, "50"),
+		threads:        8,
+		opsPerThread:   500,
+		minAmount:      mustMoney(t, "0.01"),
+		maxAmount:      mustMoney(t, "10"),
+		distribution:   "uniform",
+		txFraction:     0.3,
+		seed:           50,
+	}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range lockStrategies {
+		d := watchLocks(t)
+		accounts := newAccounts(c.accounts, c.initialBalance)
+		ledger := newLedger()
+		strategy, err := newStrategy(name, accounts, ledger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checker := newOnlineChecker(accounts, strategy, ledger)
+		quit := make(chan bool)
+		done := make(chan bool)
+		go func() {
+			defer close(done)
+			for {
+				select {
+				case <-quit:
+					return
+				default:
+					checker.check()
+				}
+			}
+		}()
+		runWorkload(c, accounts, strategy)
+		close(quit)
+		<-done
+
+		cycles, locks, edges, err := d.result()
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		for _, cycle := range cycles {
+			t.Errorf("%s: %v", name, cycle)
+		}
+		// every lock of the strategy, then the ledger inside it
+		if locks < 2 || edges == 0 {
+			t.Errorf("%s: %d locks and %d edges recorded", name, locks, edges)
+		}
+	}
+}
+
+func TestLockOrder_ReverseOrder(t *testing.T) {
+	d := watchLocks(t)
+	accounts := newAccounts(3, mustMoney(t, "10"))
+	strategy := perAccountLock{ledger: newLedger(), reverse: true}
+	transfer := func(from, to int) {
+		t.Helper()
+		if _, err := strategy.transfer(accounts[from-1], accounts[to-1], Transfer{from, to, mustMoney(t, "1")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// one goroutine, one transfer at a time: nothing can deadlock, but two
+	// goroutines doing the same transfers at once could
+	transfer(1, 2)
+	if cycles, _, _, _ := d.result(); len(cycles) != 0 {
+		t.Fatalf("cycle after a single transfer: %v", cycles[0])
+	}
+	transfer(2, 1)
+	cycles, _, _, _ := d.result()
+	if len(cycles) != 1 {
+		t.Fatalf("%d cycles after 1 -> 2 and 2 -> 1, want 1", len(cycles))
+	}
+	if names := cycleNames(cycles[0]); names != "account 1 -> account 2" {
+		t.Errorf("cycle %s", names)
+	}
+	for _, stack := range cycles[0].stacks {
+		if !strings.Contains(stack, ".perAccountLock.transfer(") {
+			t.Errorf("stack without the transfer:\n%s", stack)
+		}
+	}
+
+	// a longer cycle: 2 -> 3 and 3 -> 1, with 1 -> 2 from before
+	transfer(2, 3)
+	transfer(3, 1)
+	cycles, _, _, _ = d.result()
+	if len(cycles) != 2 {
+		t.Fatalf("%d cycles, want 2", len(cycles))
+	}
+	if names := cycleNames(cycles[1]); names != "account 1 -> account 2 -> account 3" {
+		t.Errorf("cycle %s", names)
+	}
+	if report := cycles[1].String(); !strings.Contains(report, "account 1 locked while holding account 3:") {
+		t.Errorf("report:\n%s", report)
+	}
+}
+
+func TestParseGoroutineID(t *testing.T) {
+	if id, err := parseGoroutineID([]byte("goroutine 42 [running]:\nmain.main()")); id != 42 || err != nil {
+		t.Errorf("parseGoroutineID = %d, %v; want 42", id, err)
+	}
+	for _, stack := range []string{"", "goroutine x [running]:", "thread 42 [running]:"} {
+		if _, err := parseGoroutineID([]byte(stack)); err == nil {
+			t.Errorf("parseGoroutineID(%q) succeeded", stack)
+		}
+	}
+}
+
+func TestLockOrder_Stop(t *testing.T) {
+	d := watchLocks(t)
+	d.stop(errors.New("no goroutine id"))
+	if lockDetector.Load() != nil {
+		t.Error("the detector still watches the locks")
+	}
+	// the locks keep working, unwatched
+	var m orderedMutex
+	m.Lock()
+	m.Unlock()
+	if _, locks, _, err := d.result(); err == nil || locks != 0 {
+		t.Errorf("result after stop: %d locks, %v", locks, err)
+	}
+}
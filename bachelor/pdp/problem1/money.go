@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// minorDigits is the number of decimals of every currency: amounts are kept
+// as whole cents, so sums are exact (0.1 + 0.2 is 0.3, unlike with float64)
+const minorDigits = 2
+
+const minorPerUnit = 100 // 10^minorDigits
+
+var (
+	errOverflow         = errors.New("amount overflow")
+	errCurrencyMismatch = errors.New("currency mismatch")
+)
+
+// Money is an amount of a currency, as an integer number of minor units
+// (cents). The units never hold math.MinInt64, so every amount can be negated.
+type Money struct {
+	units    int64
+	currency string // ISO 4217 code, like "EUR"
+}
+
+func newMoney(units int64, currency string) Money {
+	return Money{units, currency}
+}
+
+// checkCurrency accepts three upper case letters
+func checkCurrency(currency string) error {
+	if len(currency) != 3 {
+		return fmt.Errorf("invalid currency %q", currency)
+	}
+	for _, c := range currency {
+		if c < 'A' || c > 'Z' {
+			return fmt.Errorf("invalid currency %q", currency)
+		}
+	}
+	return nil
+}
+
+// parseMoney parses an amount like "12", "-0.5" or "1000.25" in currency,
+// with at most minorDigits decimals
+func parseMoney(amount, currency string) (Money, error) {
+	if err := checkCurrency(currency); err != nil {
+		return Money{}, err
+	}
+	s := amount
+	negative := strings.HasPrefix(s, "-")
+	if negative || strings.HasPrefix(s, "+") {
+		s = s[1:]
+	}
+	whole, fraction, hasPoint := strings.Cut(s, ".")
+	if whole == "" || (hasPoint && (fraction == "" || len(fraction) > minorDigits)) {
+		return Money{}, fmt.Errorf("invalid amount %q", amount)
+	}
+	// pad the decimals, "0.5" is 50 cents
+	digits := whole + fraction + strings.Repeat("0", minorDigits-len(fraction))
+	var units int64
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return Money{}, fmt.Errorf("invalid amount %q", amount)
+		}
+		if units > (math.MaxInt64-int64(c-'0'))/10 {
+			return Money{}, fmt.Errorf("amount %q: %w", amount, errOverflow)
+		}
+		units = units*10 + int64(c-'0')
+	}
+	if negative {
+		units = -units
+	}
+	return Money{units, currency}, nil
+}
+
+// String formats the amount with all its decimals and the currency, "-12.50 EUR"
+func (m Money) String() string {
+	return m.decimal() + " " + m.currency
+}
+
+// decimal formats the amount alone, "-12.50", which parseMoney reads back
+func (m Money) decimal() string {
+	sign, units := "", m.units
+	if units < 0 {
+		sign, units = "-", -units
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, units/minorPerUnit, minorDigits, units%minorPerUnit)
+}
+
+func (m Money) isNegative() bool {
+	return m.units < 0
+}
+
+func (m Money) neg() Money {
+	return Money{-m.units, m.currency}
+}
+
+// add returns m + o, failing if the currencies differ or the sum overflows
+func (m Money) add(o Money) (Money, error) {
+	if m.currency != o.currency {
+		return Money{}, fmt.Errorf("%v + %v: %w", m, o, errCurrencyMismatch)
+	}
+	sum := m.units + o.units
+	// overflow when both have the same sign and the sum has the other one
+	if (m.units > 0 && o.units > 0 && sum < 0) || (m.units < 0 && o.units < 0 && sum >= 0) || sum == math.MinInt64 {
+		return Money{}, fmt.Errorf("%v + %v: %w", m, o, errOverflow)
+	}
+	return Money{sum, m.currency}, nil
+}
+
+// sub returns m - o, failing if the currencies differ or the difference overflows
+func (m Money) sub(o Money) (Money, error) {
+	return m.add(o.neg())
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func mustMoney(t *testing.T, amount string) Money {
+	t.Helper()
+	m, err := parseMoney(amount, "EUR")
+	if err != nil {
+		t.Fatalf("parseMoney(%q): %v", amount, err)
+	}
+	return m
+}
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		in    string
+		units int64
+		out   string
+	}{
+		{"0", 0, "0.00 EUR"},
+		{"12", 1200, "12.00 EUR"},
+		{"0.5", 50, "0.50 EUR"},
+		{"0.05", 5, "0.05 EUR"},
+		{"+3.10", 310, "3.10 EUR"},
+		{"-12.34", -1234, "-12.34 EUR"},
+		{"-0.01", -1, "-0.01 EUR"},
+		{"92233720368547758.07", math.MaxInt64, "92233720368547758.07 EUR"},
+	}
+	for _, tt := range tests {
+		m := mustMoney(t, tt.in)
+		if m.units != tt.units || m.String() != tt.out {
+			t.Errorf("parseMoney(%q) = %d units, %q; want %d, %q", tt.in, m.units, m, tt.units, tt.out)
+		}
+	}
+}
+
+func TestParseMoney_Invalid(t *testing.T) {
+	for _, in := range []string{"", "-", "1.", ".5", "1.234", "1,5", "1e3", "12a", "--1", "1.-5"} {
+		if _, err := parseMoney(in, "EUR"); err == nil {
+			t.Errorf("parseMoney(%q) succeeded", in)
+		}
+	}
+	for _, in := range []string{"92233720368547758.08", "100000000000000000000"} {
+		if _, err := parseMoney(in, "EUR"); !errors.Is(err, errOverflow) {
+			t.Errorf("parseMoney(%q) error = %v, want overflow", in, err)
+		}
+	}
+	for _, currency := range []string{"", "eur", "EURO", "E1R"} {
+		if _, err := parseMoney("1", currency); err == nil {
+			t.Errorf("parseMoney with currency %q succeeded", currency)
+		}
+	}
+}
+
+func TestMoney_FractionalSumsAreExact(t *testing.T) {
+	// 0.1 + 0.2 != 0.3 in float64
+	sum, err := mustMoney(t, "0.1").add(mustMoney(t, "0.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != mustMoney(t, "0.3") {
+		t.Errorf("0.1 + 0.2 = %v", sum)
+	}
+
+	// ten times 0.1 is exactly 1
+	total := mustMoney(t, "0")
+	for i := 0; i < 10; i++ {
+		if total, err = total.add(mustMoney(t, "0.1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if total != mustMoney(t, "1") {
+		t.Errorf("10 x 0.1 = %v", total)
+	}
+}
+
+func TestMoney_Overflow(t *testing.T) {
+	max := newMoney(math.MaxInt64, "EUR")
+	if _, err := max.add(mustMoney(t, "0.01")); !errors.Is(err, errOverflow) {
+		t.Errorf("max + 0.01 error = %v, want overflow", err)
+	}
+	if _, err := max.neg().sub(mustMoney(t, "0.01")); !errors.Is(err, errOverflow) {
+		t.Errorf("-max - 0.01 error = %v, want overflow", err)
+	}
+	if m, err := max.sub(max); err != nil || m.units != 0 {
+		t.Errorf("max - max = %v, %v", m, err)
+	}
+}
+
+func TestMoney_CurrencyMismatch(t *testing.T) {
+	usd, err := parseMoney("1", "USD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mustMoney(t, "1").add(usd); !errors.Is(err, errCurrencyMismatch) {
+		t.Errorf("add error = %v, want currency mismatch", err)
+	}
+}
+
+func TestTransfer_FractionalAmounts(t *testing.T) {
+	accounts := newAccounts(2, mustMoney(t, "0.3"))
+	ledger := newLedger()
+	strategy, err := newStrategy("per-account", accounts, ledger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 0.1 three times empties the account exactly, a fourth one fails
+	for i := 0; i < 3; i++ {
+		if _, err := strategy.transfer(accounts[0], accounts[1], Transfer{1, 2, mustMoney(t, "0.1")}); err != nil {
+			t.Fatalf("transfer %d: %v", i+1, err)
+		}
+	}
+	if _, err := strategy.transfer(accounts[0], accounts[1], Transfer{1, 2, mustMoney(t, "0.1")}); !errors.Is(err, errInsufficientBalance) {
+		t.Errorf("transfer from an empty account error = %v", err)
+	}
+	if accounts[0].balance != mustMoney(t, "0") || accounts[1].balance != mustMoney(t, "0.6") {
+		t.Errorf("balances %v and %v, want 0.00 and 0.60", accounts[0].balance, accounts[1].balance)
+	}
+	if err := checkAllAccountsConsistency(accounts, ledger); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWorkload_FractionalAmounts(t *testing.T) {
+	c := workloadConfig{
+		accounts:       20,
+		initialBalance: mustMoney(t, "10.01"),
+		threads:        8,
+		opsPerThread:   2000,
+		minAmount:      mustMoney(t, "0.01"),
+		maxAmount:      mustMoney(t, "0.99"),
+		distribution:   "uniform",
+		seed:           1,
+	}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range strategyNames {
+		accounts := newAccounts(c.accounts, c.initialBalance)
+		ledger := newLedger()
+		strategy, err := newStrategy(name, accounts, ledger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := runWorkload(c, accounts, strategy)
+		if result.succeeded == 0 {
+			t.Errorf("%s: no transfer succeeded", name)
+		}
+		if err := checkTotal(strategy, accounts); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if a, ok := strategy.(*atomicBalances); ok {
+			a.settle(accounts)
+			continue
+		}
+		if err := checkAllAccountsConsistency(accounts, ledger); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
@@ -1,38 +1,44 @@
 package main
 
 import (
-	"errors"
+	"flag"
 	"fmt"
-	"sync"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
 	"time"
 )
 
-var consumedTransfers []Transfer
-
 type BankAccount struct {
 	id             int
-	balance        float64
-	initialBalance float64
-	mutex          sync.Mutex
+	balance        Money
+	initialBalance Money
+	mutex          orderedMutex
 	operations     []OperationRecord
 }
 
+func newBankAccount(id int, initialBalance Money) *BankAccount {
+	return &BankAccount{
+		id:             id,
+		balance:        initialBalance,
+		initialBalance: initialBalance,
+		mutex:          orderedMutex{name: fmt.Sprintf("account %d", id)},
+	}
+}
+
 type OperationRecord struct {
-	id       int
-	transfer Transfer
+	id   int   // serial number given by the ledger
+	legs []Leg // the whole transfer or transaction, not only this account's leg
 }
 
 type Transfer struct {
 	fromAccountId int
 	toAccountId   int
-	amount        float64
+	amount        Money
 }
 
-func invertTransfer(transfer Transfer) Transfer {
-	return Transfer{transfer.toAccountId, transfer.fromAccountId, -transfer.amount}
-}
-
-func performTransfer(from, to *BankAccount, transfer Transfer) (bool, error) {
+func performTransfer(ledger *ledger, from, to *BankAccount, transfer Transfer) (bool, error) {
 	// alawys lock the smaller id first to avoid deadlock
 	first, second := from, to
 	if from.id > to.id {
@@ -41,186 +47,277 @@ func performTransfer(from, to *BankAccount, transfer Transfer) (bool, error) {
 	// // lock the account with smaller id first
 	first.mutex.Lock()
 	second.mutex.Lock()
-
-	// check if the from account has enough balance
-	if from.balance < transfer.amount {
-		// unlock the accounts
-		second.mutex.Unlock()
-		first.mutex.Unlock()
-		return false, errors.New("insufficient balance")
-	}
-
-	// perfom the transfer
-	from.balance -= transfer.amount
-	to.balance += transfer.amount
-
-	// record the operation
-	from.recordOperation(invertTransfer(transfer))
-	to.recordOperation(transfer)
-	consumedTransfers = append(consumedTransfers, transfer)
-
 	// unlock the accounts
-	second.mutex.Unlock()
-	first.mutex.Unlock()
+	defer first.mutex.Unlock()
+	defer second.mutex.Unlock()
 
-	return true, nil
+	return applyTransfer(ledger, from, to, transfer)
 }
 
-func (b *BankAccount) recordOperation(transfer Transfer) {
-	// check if this is the first operation
-	if len(b.operations) == 0 {
-		b.operations = append(b.operations, OperationRecord{1, transfer})
-	} else {
-		// get the last operation id
-		lastOperation := b.operations[len(b.operations)-1]
-		// create the new operation record
-		newOperation := OperationRecord{lastOperation.id + 1, transfer}
-		// append the new operation to the operations list
-		b.operations = append(b.operations, newOperation)
-	}
+func (b *BankAccount) recordOperation(serial int, legs []Leg) {
+	// the serial comes from the ledger, so it is unique in the whole bank
+	b.operations = append(b.operations, OperationRecord{serial, legs})
 }
 
-func (b *BankAccount) consistencyCheck(consumedTransfers *[]Transfer) bool {
-	// check if all the operations are consistent
+func (b *BankAccount) consistencyCheck() error {
+	// check if the balance matches the operations
 	balance := b.initialBalance
 	for _, operation := range b.operations {
-		balance += operation.transfer.amount
-	}
-
-	// check if transfers made appear in the logs
-	transfersMade := getTransfersContainingAccount(b, *consumedTransfers)
-	for _, transfer := range transfersMade {
-		found := false
-		for _, operation := range b.operations {
-			if operation.transfer == transfer || operation.transfer == invertTransfer(transfer) {
-				found = true
-				break
-			}
-		}
-		if !found {
-			return false
+		var err error
+		if balance, err = balance.add(amountFor(operation.legs, b.id)); err != nil {
+			return fmt.Errorf("account %d: operation %d: %w", b.id, operation.id, err)
 		}
 	}
-	return balance == b.balance
+	// exact comparison, the amounts are whole cents
+	if balance != b.balance {
+		return fmt.Errorf("account %d: balance %v but the operations add up to %v", b.id, b.balance, balance)
+	}
+	return nil
 }
 
-func checkAllAccountsConsistency(accounts []*BankAccount, consumedTransfers *[]Transfer) bool {
-	// lock all the accounts
+func checkAllAccountsConsistency(accounts []*BankAccount, ledger *ledger) error {
+	// lock all the accounts, which also stops the ledger from growing
 	for _, account := range accounts {
 		account.mutex.Lock()
 	}
-	// check the consistency of all the accounts
-	for _, account := range accounts {
-		if !account.consistencyCheck(consumedTransfers) {
-			// unlock all the accounts
-			for _, account := range accounts {
-				account.mutex.Unlock()
-			}
-			return false
+	defer func() {
+		for _, account := range accounts {
+			account.mutex.Unlock()
 		}
-	}
-	// unlock all the accounts
+	}()
+	// check the balance of every account against its log
 	for _, account := range accounts {
-		account.mutex.Unlock()
+		if err := account.consistencyCheck(); err != nil {
+			return err
+		}
 	}
-	return true
+	// check the logs against the ledger
+	base, entries := ledger.read()
+	return checkAgainstLedger(accounts, base, entries)
 }
 
-func startConsitencyCheck(accounts []*BankAccount, quitChan chan bool, consumedTransfers *[]Transfer) {
+func startConsitencyCheck(checker *onlineChecker, quitChan chan bool) {
+	// the checker does not stop the transfers, it only takes one account's
+	// lock at a time
 	for {
 		select {
 		case <-quitChan:
 			return
 		default:
-			if !checkAllAccountsConsistency(accounts, consumedTransfers) {
+			serial, violations := checker.check()
+			if len(violations) > 0 {
 				fmt.Println("Inconsistent state detected!")
+				for _, v := range violations {
+					fmt.Println("  ", v)
+				}
 			} else {
-				fmt.Println("All accounts are consistent.")
+				fmt.Printf("All accounts are consistent up to serial %d.\n", serial)
 			}
 			time.Sleep(50 * time.Millisecond)
 		}
 	}
 }
 
-func getTransfersContainingAccount(account *BankAccount, transfers []Transfer) []Transfer {
-	var transfersMade []Transfer
-	for _, transfer := range transfers {
-		if transfer.fromAccountId == account.id || transfer.toAccountId == account.id {
-			transfersMade = append(transfersMade, transfer)
+func startCheckpoints(ledger *ledger, interval time.Duration, quitChan chan bool, doneChan chan bool) {
+	// checkpoints must not run concurrently, doneChan tells when the last one is over
+	defer close(doneChan)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quitChan:
+			return
+		case <-ticker.C:
+			if err := ledger.checkpoint(); err != nil {
+				fmt.Println("Checkpoint failed!", err)
+			}
 		}
 	}
-	return transfersMade
 }
 
 func main() {
-	// create the accounts
-	account1 := BankAccount{1, 1000, 1000, sync.Mutex{}, []OperationRecord{}}
-	account2 := BankAccount{2, 1000, 1000, sync.Mutex{}, []OperationRecord{}}
-	account3 := BankAccount{3, 1000, 1000, sync.Mutex{}, []OperationRecord{}}
-	account4 := BankAccount{4, 1000, 1000, sync.Mutex{}, []OperationRecord{}}
-	account5 := BankAccount{5, 1000, 1000, sync.Mutex{}, []OperationRecord{}}
-	// create the accounts slice
-	accounts := []*BankAccount{&account1, &account2, &account3, &account4, &account5}
-	// create some transfers
-	transfersToMake := []Transfer{
-		{1, 2, 100},
-		{2, 1, 50},
-		{2, 3, 200},
-		{3, 4, 300},
-		{4, 5, 400},
-		{5, 1, 100},
-		{1, 3, 600},
-		{3, 5, 700},
-		{5, 2, 800},
-		{2, 4, 50},
-		{4, 1, 100},
-		{1, 5, 20},
-		{5, 3, 30},
-		{3, 2, 20},
-		{2, 5, 30},
-		{5, 4, 40},
-		{4, 3, 50},
-		{1, 4, 10},
-		{4, 2, 20},
-		{2, 3, 30},
-	}
-
-	var wg sync.WaitGroup
-	// start the consistency check
-	quitChan := make(chan bool)
-	go startConsitencyCheck(accounts, quitChan, &consumedTransfers)
-	// perform the transfers
-	for len(transfersToMake) > 0 {
-		transfer := transfersToMake[0]
-		transfersToMake = transfersToMake[1:]
-		from := accounts[transfer.fromAccountId-1]
-		to := accounts[transfer.toAccountId-1]
-
-		wg.Add(1)
-		go func(from *BankAccount, to *BankAccount, transfer Transfer) {
-			defer wg.Done()
-			_, err := performTransfer(from, to, transfer)
-			if err != nil {
-				fmt.Printf("Transfer from account %d to account %d failed: %s\n", from.id, to.id, err)
-			} else {
-				fmt.Printf("Transfer from account %d to account %d of amount %.2f completed successfully.\n", from.id, to.id, transfer.amount)
+	var cfg workloadConfig
+	flag.IntVar(&cfg.accounts, "accounts", 10, "number of accounts")
+	initial := flag.String("initial", "1000", "initial balance of every account")
+	flag.IntVar(&cfg.threads, "threads", 8, "number of threads doing transfers")
+	flag.IntVar(&cfg.opsPerThread, "ops", 1000, "operations attempted by each thread")
+	minAmount := flag.String("min-amount", "1", "smallest transfer amount, up to 2 decimals")
+	maxAmount := flag.String("max-amount", "100", "largest transfer amount, up to 2 decimals")
+	currency := flag.String("currency", "EUR", "currency of all the amounts")
+	flag.StringVar(&cfg.distribution, "dist", "uniform", "distribution of the amounts: uniform or exponential")
+	flag.IntVar(&cfg.hotAccounts, "hot", 0, "number of hot accounts (the first ones)")
+	flag.Float64Var(&cfg.hotFraction, "hot-fraction", 0.8, "with -hot, chance that each side of a transfer is a hot account")
+	flag.Float64Var(&cfg.readFraction, "read-fraction", 0, "chance that an operation is a balance query instead of a transfer")
+	flag.Float64Var(&cfg.txFraction, "tx-fraction", 0, "chance that a transfer is a split payment to 2-4 accounts instead")
+	flag.Uint64Var(&cfg.seed, "seed", uint64(time.Now().UnixNano()), "seed of the random generator")
+	strategyName := flag.String("strategy", "per-account", "locking strategy: "+strings.Join(strategyNames, ", "))
+	bench := flag.Bool("bench", false, "sweep strategies x threads x accounts and print a CSV table instead")
+	benchStrategies := flag.String("bench-strategies", "all", "with -bench, comma separated strategies, or all")
+	benchThreads := flag.String("bench-threads", "1,2,4,8,16", "with -bench, comma separated thread counts")
+	benchAccounts := flag.String("bench-accounts", "10,100,1000", "with -bench, comma separated account counts")
+	dataDir := flag.String("data", "", "durable mode: keep the bank in this directory, recovering it if it exists")
+	fsync := flag.Bool("fsync", false, "with -data, sync every WAL record to the disk")
+	snapshotInterval := flag.Duration("snapshot-interval", 100*time.Millisecond, "with -data, time between snapshots")
+	serve := flag.String("serve", "", "serve the bank over HTTP on this address (like :8080) instead, starting with -accounts accounts")
+	detectLocks := flag.Bool("lock-order", false, "record the order the locks are taken in and report its cycles (potential deadlocks), slower")
+	reverseOrder := flag.Bool("reverse-lock-order", false, "per-account transfers lock the source account first, not the smaller id: a deadlock for -lock-order to catch")
+	flag.Parse()
+
+	// parse the amounts
+	var err error
+	if cfg.initialBalance, err = parseMoney(*initial, *currency); err == nil {
+		if cfg.minAmount, err = parseMoney(*minAmount, *currency); err == nil {
+			cfg.maxAmount, err = parseMoney(*maxAmount, *currency)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid amount:", err)
+		os.Exit(2)
+	}
+
+	if *detectLocks && (*bench || *serve != "" || !slices.Contains(lockStrategies, *strategyName)) {
+		fmt.Fprintln(os.Stderr, "-lock-order needs a workload with one of the strategies "+strings.Join(lockStrategies, ", "))
+		os.Exit(2)
+	}
+	if *reverseOrder && (!*detectLocks || *strategyName != "per-account") {
+		fmt.Fprintln(os.Stderr, "-reverse-lock-order needs -lock-order and the per-account strategy")
+		os.Exit(2)
+	}
+
+	if *bench {
+		b := benchConfig{workload: cfg}
+		if b.strategies, err = parseStrategies(*benchStrategies); err == nil {
+			if b.threads, err = parseIntList(*benchThreads); err == nil {
+				b.accounts, err = parseIntList(*benchAccounts)
 			}
-		}(from, to, transfer)
-		// wait before another transfer
-		time.Sleep(10 * time.Millisecond)
+		}
+		if err == nil {
+			err = runBenchmark(b, os.Stdout)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "benchmark failed:", err)
+			os.Exit(2)
+		}
+		return
+	}
+
+	if err := cfg.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid workload:", err)
+		os.Exit(2)
 	}
-	wg.Wait()
-	// stop the consistency check
+
+	// watch the locks, reporting every cycle as soon as it appears, in case
+	// the run deadlocks
+	var detector *lockOrder
+	if *detectLocks {
+		detector = enableLockOrder(func(c lockCycle) {
+			fmt.Fprintln(os.Stderr, c)
+		})
+	}
+
+	if *serve != "" {
+		if *dataDir != "" {
+			fmt.Fprintln(os.Stderr, "the HTTP service keeps the bank in memory, without -data")
+			os.Exit(2)
+		}
+		server := newBankServer(*currency, newAccounts(cfg.accounts, cfg.initialBalance))
+		fmt.Printf("Serving %d accounts on %s\n", cfg.accounts, *serve)
+		if err := http.ListenAndServe(*serve, server.handler()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// create the accounts, or open them from the data directory
+	accounts := newAccounts(cfg.accounts, cfg.initialBalance)
+	ledger := newLedger()
+	checkpointQuit, checkpointDone := make(chan bool, 1), make(chan bool)
+	if *dataDir != "" {
+		if *strategyName == "atomic" {
+			fmt.Fprintln(os.Stderr, "durable mode needs a strategy that records the transfers in the ledger")
+			os.Exit(2)
+		}
+		var r *recovery
+		if accounts, ledger, r, err = openDurable(*dataDir, cfg, *fsync); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if r != nil {
+			fmt.Printf("Recovered %d accounts from the snapshot at serial %d and %d operations from the WAL",
+				len(accounts), r.snapshotSerial, r.replayed)
+			if r.tornBytes > 0 {
+				fmt.Printf(", dropped a torn write of %d bytes", r.tornBytes)
+			}
+			fmt.Println("; all accounts are consistent.")
+			// the accounts come from the directory, not from the flags
+			cfg.accounts = len(accounts)
+			cfg.initialBalance = newMoney(0, accounts[0].balance.currency)
+			if err := cfg.validate(); err != nil {
+				fmt.Fprintln(os.Stderr, "invalid workload for the recovered bank:", err)
+				os.Exit(2)
+			}
+		}
+		go startCheckpoints(ledger, *snapshotInterval, checkpointQuit, checkpointDone)
+	} else {
+		close(checkpointDone)
+	}
+	strategy, err := newStrategy(*strategyName, accounts, ledger)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *reverseOrder {
+		strategy = perAccountLock{ledger: ledger, reverse: true}
+	}
+
+	// start the consistency check, while the transfers run
+	quitChan := make(chan bool, 1)
+	if _, ok := strategy.(*atomicBalances); !ok {
+		go startConsitencyCheck(newOnlineChecker(accounts, strategy, ledger), quitChan)
+	}
+	// perform the transfers
+	fmt.Printf("Running %d threads x %d operations on %d accounts with %s locking (seed %d)\n",
+		cfg.threads, cfg.opsPerThread, cfg.accounts, *strategyName, cfg.seed)
+	result := runWorkload(cfg, accounts, strategy)
+	// stop the consistency check and the checkpoints
 	quitChan <- true
+	checkpointQuit <- true
+	<-checkpointDone
 
 	// check the consistency of all the accounts
-	if !checkAllAccountsConsistency(accounts, &consumedTransfers) {
-		fmt.Println("Inconsistent state detected!")
+	if a, ok := strategy.(*atomicBalances); ok {
+		// no logs to check against: only the total amount of money
+		a.settle(accounts)
+		if err := checkTotal(strategy, accounts); err != nil {
+			fmt.Println("Inconsistent state detected!", err)
+		} else {
+			fmt.Println("Total balance is unchanged.")
+		}
+	} else if err := checkAllAccountsConsistency(accounts, ledger); err != nil {
+		fmt.Println("Inconsistent state detected!", err)
 	} else {
-		fmt.Println("All accounts are consistent.")
+		fmt.Printf("All accounts are consistent with the %d operations in the ledger.\n", ledger.length())
+	}
+	// write the last snapshot
+	if err := ledger.close(); err != nil {
+		fmt.Println("Closing the data directory failed!", err)
 	}
 	// print the balances of all the accounts
 	for _, account := range accounts {
-		fmt.Printf("Account ID: %d, Balance: %.2f\n", account.id, account.balance)
+		fmt.Printf("Account ID: %d, Balance: %v\n", account.id, account.balance)
+	}
+	fmt.Printf("Transfers: %d attempted (%d split payments), %d succeeded, %d failed (insufficient balance); %d balance queries\n",
+		result.attempted, result.transactions, result.succeeded, result.failed, result.queries)
+	fmt.Printf("Elapsed: %v, throughput: %.0f operations/s\n", result.elapsed, result.throughput())
+	if s, ok := strategy.(*stmBalances); ok {
+		fmt.Printf("STM: %d commits, %d aborts (conflicts)\n", s.stm.commits.Load(), s.stm.aborts.Load())
+	}
+	if detector != nil {
+		cycles, locks, edges, err := detector.result()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "lock order detection stopped:", err)
+		}
+		fmt.Printf("Lock order: %d locks, %d edges, %d potential deadlocks\n", locks, edges, len(cycles))
 	}
 }
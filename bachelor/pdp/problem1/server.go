@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// bankServer exposes a bank over HTTP, with JSON bodies and amounts as
+// decimal strings ("12.50"):
+//
+//	POST /accounts                  {"initial_balance": "100"} -> the account
+//	GET  /accounts                  all the accounts
+//	GET  /accounts/{id}             {"id": 1, "balance": "100.00", "currency": "EUR"}
+//	GET  /accounts/{id}/operations  the account's log
+//	POST /transfers                 {"from": 1, "to": 2, "amount": "5"}, with an
+//	                                optional Idempotency-Key header
+//	GET  /consistency               an online consistency check round
+//
+// The accounts use the per-account strategy, each account's mutex protecting
+// its balance and log; mutex protects the list of accounts, which only grows,
+// so a transfer works on the accounts that existed when it started.
+type bankServer struct {
+	currency string
+	ledger   *ledger
+	strategy lockStrategy
+
+	mutex    sync.RWMutex
+	accounts []*BankAccount // accounts[i] has id i+1
+
+	checkMutex sync.Mutex // a single consistency round at a time
+	checker    *onlineChecker
+
+	keysMutex sync.Mutex
+	keys      map[string]*idempotentCall
+	keyOrder  []string // the keys, oldest first
+	maxKeys   int      // completed calls beyond that are forgotten, oldest first
+}
+
+// defaultMaxKeys is the number of idempotency keys a server remembers
+const defaultMaxKeys = 10000
+
+// idempotentCall is the first transfer made with an idempotency key: a retry
+// with the same key gets its response instead of transferring again
+type idempotentCall struct {
+	request transferRequest
+	done    chan struct{} // closed once status and body are set
+	status  int
+	body    []byte
+}
+
+func (c *idempotentCall) completed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+type accountRequest struct {
+	InitialBalance string `json:"initial_balance"`
+}
+
+type accountResponse struct {
+	Id       int    `json:"id"`
+	Balance  string `json:"balance"`
+	Currency string `json:"currency"`
+}
+
+type transferRequest struct {
+	From   int    `json:"from"`
+	To     int    `json:"to"`
+	Amount string `json:"amount"`
+}
+
+type transferResponse struct {
+	Serial int    `json:"serial"`
+	From   int    `json:"from"`
+	To     int    `json:"to"`
+	Amount string `json:"amount"`
+}
+
+type legResponse struct {
+	Account int    `json:"account"`
+	Amount  string `json:"amount"`
+}
+
+type operationResponse struct {
+	Serial int           `json:"serial"`
+	Legs   []legResponse `json:"legs"`
+}
+
+type violationResponse struct {
+	Serial  int    `json:"serial,omitempty"`
+	Account int    `json:"account,omitempty"`
+	Problem string `json:"problem"`
+}
+
+type consistencyResponse struct {
+	Consistent bool                `json:"consistent"`
+	CheckedUp  int                 `json:"checked_up_to"`
+	Violations []violationResponse `json:"violations,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func newBankServer(currency string, accounts []*BankAccount) *bankServer {
+	ledger := newLedger()
+	strategy := perAccountLock{ledger: ledger}
+	return &bankServer{
+		currency: currency,
+		ledger:   ledger,
+		strategy: strategy,
+		accounts: accounts,
+		checker:  newOnlineChecker(accounts, strategy, ledger),
+		keys:     map[string]*idempotentCall{},
+		maxKeys:  defaultMaxKeys,
+	}
+}
+
+func (s *bankServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /accounts", s.createAccount)
+	mux.HandleFunc("GET /accounts", s.listAccounts)
+	mux.HandleFunc("GET /accounts/{id}", s.getAccount)
+	mux.HandleFunc("GET /accounts/{id}/operations", s.getOperations)
+	mux.HandleFunc("POST /transfers", s.postTransfer)
+	mux.HandleFunc("GET /consistency", s.checkConsistency)
+	return mux
+}
+
+// encode returns the JSON of v, with a newline like json.Encoder
+func encode(v any) []byte {
+	body, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return append(body, '\n')
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	writeBody(w, status, encode(v))
+}
+
+func writeBody(w http.ResponseWriter, status int, body []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{err.Error()})
+}
+
+// account returns the account with the id in the path, or the status to
+// answer with the error: 400 if the id is not a number, 404 if there is no
+// account with that id
+func (s *bankServer) account(r *http.Request) (*BankAccount, int, error) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid account id %q", r.PathValue("id"))
+	}
+	account, err := s.accountById(id)
+	if err != nil {
+		return nil, http.StatusNotFound, err
+	}
+	return account, http.StatusOK, nil
+}
+
+func (s *bankServer) accountById(id int) (*BankAccount, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if id < 1 || id > len(s.accounts) {
+		return nil, fmt.Errorf("unknown account %d", id)
+	}
+	return s.accounts[id-1], nil
+}
+
+func (s *bankServer) describe(account *BankAccount) accountResponse {
+	balance := s.strategy.balance(account)
+	return accountResponse{account.id, balance.decimal(), balance.currency}
+}
+
+func (s *bankServer) createAccount(w http.ResponseWriter, r *http.Request) {
+	var request accountRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	initial, err := parseMoney(request.InitialBalance, s.currency)
+	if err == nil && initial.isNegative() {
+		err = errors.New("initial balance cannot be negative")
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	s.mutex.Lock()
+	account := newBankAccount(len(s.accounts)+1, initial)
+	s.accounts = append(s.accounts, account)
+	// before any transfer can reach the account
+	s.checkMutex.Lock()
+	s.checker.addAccounts(account)
+	s.checkMutex.Unlock()
+	s.mutex.Unlock()
+	writeJSON(w, http.StatusCreated, s.describe(account))
+}
+
+func (s *bankServer) listAccounts(w http.ResponseWriter, r *http.Request) {
+	s.mutex.RLock()
+	accounts := s.accounts
+	s.mutex.RUnlock()
+	list := make([]accountResponse, len(accounts))
+	for i, account := range accounts {
+		list[i] = s.describe(account)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *bankServer) getAccount(w http.ResponseWriter, r *http.Request) {
+	account, status, err := s.account(r)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.describe(account))
+}
+
+func (s *bankServer) getOperations(w http.ResponseWriter, r *http.Request) {
+	account, status, err := s.account(r)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	_, log := s.strategy.view(account)
+	operations := make([]operationResponse, len(log))
+	for i, record := range log {
+		operations[i] = operationResponse{Serial: record.id}
+		for _, leg := range record.legs {
+			operations[i].Legs = append(operations[i].Legs, legResponse{leg.accountId, leg.amount.decimal()})
+		}
+	}
+	writeJSON(w, http.StatusOK, operations)
+}
+
+func (s *bankServer) postTransfer(w http.ResponseWriter, r *http.Request) {
+	var request transferRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		status, body := s.transfer(request)
+		writeBody(w, status, body)
+		return
+	}
+
+	// the first call with the key transfers, the others wait for its response
+	s.keysMutex.Lock()
+	call, seen := s.keys[key]
+	if !seen {
+		call = &idempotentCall{request: request, done: make(chan struct{})}
+		s.keys[key] = call
+		s.keyOrder = append(s.keyOrder, key)
+		s.forgetKeys()
+	}
+	s.keysMutex.Unlock()
+	if !seen {
+		s.complete(call)
+	} else {
+		<-call.done
+		if !s.sameTransfer(call.request, request) {
+			writeError(w, http.StatusUnprocessableEntity, fmt.Errorf("idempotency key %q was used for another transfer", key))
+			return
+		}
+	}
+	writeBody(w, call.status, call.body)
+}
+
+// complete makes the transfer of the first call with a key and publishes its
+// response. If the transfer panics, the call still completes with a 500, so
+// that neither the retries waiting for it nor forgetKeys are blocked forever
+func (s *bankServer) complete(call *idempotentCall) {
+	defer func() {
+		if call.body == nil {
+			call.status, call.body = http.StatusInternalServerError, encode(errorResponse{"internal error during the transfer"})
+		}
+		close(call.done)
+	}()
+	call.status, call.body = s.transfer(call.request)
+}
+
+// forgetKeys drops the oldest completed calls beyond maxKeys; a call still in
+// progress, and the ones after it, are kept until it completes. The caller
+// holds keysMutex
+func (s *bankServer) forgetKeys() {
+	forgotten := 0
+	for len(s.keyOrder)-forgotten > s.maxKeys {
+		key := s.keyOrder[forgotten]
+		if !s.keys[key].completed() {
+			break
+		}
+		delete(s.keys, key)
+		forgotten++
+	}
+	s.keyOrder = s.keyOrder[forgotten:]
+}
+
+// sameTransfer reports whether two requests ask for the same transfer, "5"
+// and "5.00" being the same amount
+func (s *bankServer) sameTransfer(a, b transferRequest) bool {
+	if a.From != b.From || a.To != b.To {
+		return false
+	}
+	first, err := parseMoney(a.Amount, s.currency)
+	if err != nil {
+		return a.Amount == b.Amount
+	}
+	second, err := parseMoney(b.Amount, s.currency)
+	return err == nil && first == second
+}
+
+// transfer performs request and returns the status and the body of the response
+func (s *bankServer) transfer(request transferRequest) (int, []byte) {
+	amount, err := parseMoney(request.Amount, s.currency)
+	if err == nil && amount.units <= 0 {
+		err = errors.New("the amount must be positive")
+	}
+	if err == nil && request.From == request.To {
+		err = errors.New("cannot transfer to the same account")
+	}
+	if err != nil {
+		return http.StatusBadRequest, encode(errorResponse{err.Error()})
+	}
+	s.mutex.RLock()
+	accounts := s.accounts
+	s.mutex.RUnlock()
+	for _, id := range []int{request.From, request.To} {
+		if id < 1 || id > len(accounts) {
+			return http.StatusNotFound, encode(errorResponse{fmt.Sprintf("unknown account %d", id)})
+		}
+	}
+
+	transfer := Transfer{request.From, request.To, amount}
+	serial, err := s.strategy.transact(accounts, transfer.legs())
+	switch {
+	case errors.Is(err, errInsufficientBalance), errors.Is(err, errOverflow), errors.Is(err, errCurrencyMismatch):
+		return http.StatusUnprocessableEntity, encode(errorResponse{err.Error()})
+	case err != nil:
+		return http.StatusInternalServerError, encode(errorResponse{err.Error()})
+	}
+	return http.StatusCreated, encode(transferResponse{serial, request.From, request.To, amount.decimal()})
+}
+
+func (s *bankServer) checkConsistency(w http.ResponseWriter, r *http.Request) {
+	s.checkMutex.Lock()
+	serial, violations := s.checker.check()
+	s.checkMutex.Unlock()
+	response := consistencyResponse{Consistent: len(violations) == 0, CheckedUp: serial}
+	for _, v := range violations {
+		response.Violations = append(response.Violations, violationResponse{v.serial, v.account, v.problem})
+	}
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// call sends a JSON request and decodes the JSON response into out, if not nil
+func call(t *testing.T, client *http.Client, method, url, key string, body, out any) int {
+	t.Helper()
+	var payload []byte
+	if body != nil {
+		payload = encode(body)
+	}
+	request, err := http.NewRequest(method, url, bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "" {
+		request.Header.Set("Idempotency-Key", key)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		t.Error(err)
+		return 0
+	}
+	defer response.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(response.Body).Decode(out); err != nil {
+			t.Errorf("%s %s: %v", method, url, err)
+		}
+	}
+	return response.StatusCode
+}
+
+func newTestServer(t *testing.T, accounts int, initial string) (*bankServer, *httptest.Server, *http.Client) {
+	bank := newBankServer("EUR", newAccounts(accounts, mustMoney(t, initial)))
+	server := httptest.NewServer(bank.handler())
+	t.Cleanup(server.Close)
+	client := server.Client()
+	// keep the connections of all the workers
+	client.Transport.(*http.Transport).MaxIdleConnsPerHost = 64
+	return bank, server, client
+}
+
+func TestServer_Accounts(t *testing.T) {
+	_, server, client := newTestServer(t, 2, "10")
+
+	var created accountResponse
+	if status := call(t, client, "POST", server.URL+"/accounts", "", accountRequest{"25.5"}, &created); status != http.StatusCreated {
+		t.Fatalf("create: status %d", status)
+	}
+	if created != (accountResponse{3, "25.50", "EUR"}) {
+		t.Errorf("created %+v", created)
+	}
+	var list []accountResponse
+	call(t, client, "GET", server.URL+"/accounts", "", nil, &list)
+	if len(list) != 3 {
+		t.Errorf("listed %+v", list)
+	}
+
+	var transfer transferResponse
+	if status := call(t, client, "POST", server.URL+"/transfers", "", transferRequest{3, 1, "0.5"}, &transfer); status != http.StatusCreated {
+		t.Fatalf("transfer: status %d", status)
+	}
+	var account accountResponse
+	call(t, client, "GET", server.URL+"/accounts/1", "", nil, &account)
+	if account.Balance != "10.50" {
+		t.Errorf("account 1 has %s, want 10.50", account.Balance)
+	}
+	var operations []operationResponse
+	call(t, client, "GET", server.URL+"/accounts/3/operations", "", nil, &operations)
+	want := operationResponse{transfer.Serial, []legResponse{{3, "-0.50"}, {1, "0.50"}}}
+	if len(operations) != 1 || fmt.Sprint(operations[0]) != fmt.Sprint(want) {
+		t.Errorf("operations %+v, want %+v", operations, want)
+	}
+}
+
+func TestServer_Errors(t *testing.T) {
+	_, server, client := newTestServer(t, 2, "10")
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		key    string
+		body   any
+		status int
+	}{
+		{"unknown account", "GET", "/accounts/3", "", nil, http.StatusNotFound},
+		{"invalid id", "GET", "/accounts/x/operations", "", nil, http.StatusBadRequest},
+		{"unknown account's operations", "GET", "/accounts/3/operations", "", nil, http.StatusNotFound},
+		{"negative initial balance", "POST", "/accounts", "", accountRequest{"-1"}, http.StatusBadRequest},
+		{"invalid amount", "POST", "/transfers", "", transferRequest{1, 2, "1.005"}, http.StatusBadRequest},
+		{"zero amount", "POST", "/transfers", "", transferRequest{1, 2, "0"}, http.StatusBadRequest},
+		{"same account", "POST", "/transfers", "", transferRequest{1, 1, "1"}, http.StatusBadRequest},
+		{"unknown destination", "POST", "/transfers", "", transferRequest{1, 9, "1"}, http.StatusNotFound},
+		{"insufficient balance", "POST", "/transfers", "", transferRequest{1, 2, "10.01"}, http.StatusUnprocessableEntity},
+		{"first use of a key", "POST", "/transfers", "k", transferRequest{1, 2, "1"}, http.StatusCreated},
+		{"key reused for another transfer", "POST", "/transfers", "k", transferRequest{1, 2, "2"}, http.StatusUnprocessableEntity},
+		{"key retried with the amount written differently", "POST", "/transfers", "k", transferRequest{1, 2, "1.00"}, http.StatusCreated},
+		{"largest balance", "POST", "/accounts", "", accountRequest{"92233720368547758.07"}, http.StatusCreated},
+		{"overflowing balance", "POST", "/transfers", "", transferRequest{1, 3, "1"}, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		var response errorResponse
+		status := call(t, client, tt.method, server.URL+tt.path, tt.key, tt.body, &response)
+		if status != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, status, tt.status)
+		}
+		if status >= 400 && response.Error == "" {
+			t.Errorf("%s: no error message", tt.name)
+		}
+	}
+}
+
+func TestServer_ForgetKeys(t *testing.T) {
+	bank, server, client := newTestServer(t, 2, "10")
+	bank.maxKeys = 2
+	for _, key := range []string{"a", "b", "c"} {
+		if status := call(t, client, "POST", server.URL+"/transfers", key, transferRequest{1, 2, "1"}, nil); status != http.StatusCreated {
+			t.Fatalf("key %s: status %d", key, status)
+		}
+	}
+	bank.keysMutex.Lock()
+	kept := len(bank.keys)
+	bank.keysMutex.Unlock()
+	if kept != 2 {
+		t.Errorf("%d keys kept, want 2", kept)
+	}
+
+	// a retry with the oldest key transfers again, one with a newer key does not
+	call(t, client, "POST", server.URL+"/transfers", "a", transferRequest{1, 2, "1"}, nil)
+	call(t, client, "POST", server.URL+"/transfers", "c", transferRequest{1, 2, "1"}, nil)
+	var account accountResponse
+	call(t, client, "GET", server.URL+"/accounts/1", "", nil, &account)
+	if account.Balance != "6.00" {
+		t.Errorf("account 1 has %s, want 6.00", account.Balance)
+	}
+}
+
+// TestServer_Load sends thousands of concurrent transfers, a fifth of them
+// retried with the same idempotency key, and checks the invariants at the end
+// panickingStrategy fails every transfer with a panic
+type panickingStrategy struct {
+	lockStrategy
+}
+
+func (panickingStrategy) transact(accounts []*BankAccount, legs []Leg) (int, error) {
+	panic("transact")
+}
+
+func TestServer_PanickingTransfer(t *testing.T) {
+	bank := newBankServer("EUR", newAccounts(2, mustMoney(t, "10")))
+	bank.strategy = panickingStrategy{bank.strategy}
+	post := func() *httptest.ResponseRecorder {
+		request := httptest.NewRequest("POST", "/transfers", bytes.NewReader(encode(transferRequest{1, 2, "1"})))
+		request.Header.Set("Idempotency-Key", "k")
+		recorder := httptest.NewRecorder()
+		bank.handler().ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("the first call did not panic")
+			}
+		}()
+		post()
+	}()
+	// a retry gets the 500 instead of waiting forever
+	retried := make(chan *httptest.ResponseRecorder)
+	go func() { retried <- post() }()
+	select {
+	case recorder := <-retried:
+		if recorder.Code != http.StatusInternalServerError {
+			t.Errorf("retry: status %d, want 500", recorder.Code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the retry is still waiting for the call that panicked")
+	}
+}
+
+func TestServer_Load(t *testing.T) {
+	const (
+		accounts  = 20
+		workers   = 32
+		transfers = 4000
+	)
+	bank, server, client := newTestServer(t, accounts, "100")
+
+	var mutex sync.Mutex
+	serials := map[string]int{} // successful transfer key -> serial
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := rand.New(rand.NewPCG(uint64(w), 49))
+			for i := w; i < transfers; i += workers {
+				from := 1 + r.IntN(accounts)
+				to := 1 + (from+r.IntN(accounts-1))%accounts
+				request := transferRequest{from, to, fmt.Sprintf("%d.%02d", r.IntN(30), 1+r.IntN(99))}
+				key := fmt.Sprintf("transfer-%d", i)
+				attempts := 1
+				if i%5 == 0 {
+					attempts = 2
+				}
+				for range attempts {
+					var response transferResponse
+					status := call(t, client, "POST", server.URL+"/transfers", key, request, &response)
+					switch status {
+					case http.StatusCreated:
+						mutex.Lock()
+						if serial, seen := serials[key]; seen && serial != response.Serial {
+							t.Errorf("%s: serial %d after %d", key, response.Serial, serial)
+						}
+						serials[key] = response.Serial
+						mutex.Unlock()
+					case http.StatusUnprocessableEntity:
+					default:
+						t.Errorf("%s: status %d", key, status)
+					}
+				}
+				if i%500 == 0 {
+					var check consistencyResponse
+					call(t, client, "GET", server.URL+"/consistency", "", nil, &check)
+					if !check.Consistent {
+						t.Errorf("inconsistent while the transfers run: %+v", check.Violations)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var check consistencyResponse
+	call(t, client, "GET", server.URL+"/consistency", "", nil, &check)
+	if !check.Consistent || check.CheckedUp != bank.ledger.last() {
+		t.Errorf("final check %+v, ledger at serial %d", check, bank.ledger.last())
+	}
+	// every successful key transferred exactly once
+	if len(serials) == 0 || bank.ledger.length() != len(serials) {
+		t.Errorf("%d ledger entries for %d successful transfers", bank.ledger.length(), len(serials))
+	}
+	var list []accountResponse
+	call(t, client, "GET", server.URL+"/accounts", "", nil, &list)
+	total := mustMoney(t, "0")
+	for _, account := range list {
+		balance := mustMoney(t, account.Balance)
+		if balance.isNegative() {
+			t.Errorf("account %d has %s", account.Id, account.Balance)
+		}
+		total, _ = total.add(balance)
+	}
+	if want := mustMoney(t, "2000"); total != want {
+		t.Errorf("total %v, want %v", total, want)
+	}
+	if err := checkAllAccountsConsistency(bank.accounts, bank.ledger); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"cmp"
+	"runtime"
+	"slices"
+	"sync/atomic"
+)
+
+// A small software transactional memory, in the style of TL2:
+//   - a global version clock, advanced by every commit that writes;
+//   - every TVar has a lock word, version<<1 | locked, and its committed value;
+//   - a transaction remembers the clock when it starts (its read version), the
+//     TVars it read (read set) and the values it wants to write (write set);
+//     nothing is visible to the others before the commit;
+//   - a read fails if the TVar is locked or was written after the read
+//     version: the transaction is aborted and runs again from the start;
+//   - the commit locks the write set (never waiting: a TVar already locked
+//     aborts the transaction), takes a new version from the clock, validates
+//     the read set, runs the commit hooks and publishes the values.
+
+// stm is one transactional memory: its clock, its TVar ids and its counters
+type stm struct {
+	clock   atomic.Uint64
+	nextID  atomic.Uint64
+	commits atomic.Int64
+	aborts  atomic.Int64 // transactions run again because of a conflict
+}
+
+// tvar is the part of a TVar the commit needs, whatever its type
+type tvar interface {
+	lockWord() (uint64, *atomic.Uint64)
+	publish(value any, version uint64)
+}
+
+// TVar is a transactional variable holding a T
+type TVar[T any] struct {
+	id    uint64
+	state atomic.Uint64 // version<<1 | locked
+	value atomic.Pointer[T]
+}
+
+func newTVar[T any](s *stm, value T) *TVar[T] {
+	v := &TVar[T]{id: s.nextID.Add(1)}
+	v.value.Store(&value)
+	return v
+}
+
+func (v *TVar[T]) lockWord() (uint64, *atomic.Uint64) {
+	return v.id, &v.state
+}
+
+func (v *TVar[T]) publish(value any, version uint64) {
+	t := value.(T)
+	v.value.Store(&t)
+	// unlocks too
+	v.state.Store(version << 1)
+}
+
+// load returns the last committed value, outside of any transaction
+func (v *TVar[T]) load() T {
+	return *v.value.Load()
+}
+
+// get reads v in tx: the value tx wrote, or the committed one if it is
+// not newer than the start of tx
+func (v *TVar[T]) get(tx *stmTx) T {
+	if value, ok := tx.writes[v]; ok {
+		return value.(T)
+	}
+	before := v.state.Load()
+	value := v.value.Load()
+	after := v.state.Load()
+	if before&1 == 1 || before != after || before>>1 > tx.readVersion {
+		panic(stmConflict{})
+	}
+	tx.reads[v] = true
+	return *value
+}
+
+// set writes value to v in tx, visible to the others once tx commits
+func (v *TVar[T]) set(tx *stmTx, value T) {
+	tx.writes[v] = value
+}
+
+// stmConflict aborts a transaction from inside get, to run it again
+type stmConflict struct{}
+
+// stmTx is one run of a transaction
+type stmTx struct {
+	stm         *stm
+	readVersion uint64
+	reads       map[tvar]bool
+	writes      map[tvar]any
+	hooks       []func() error
+}
+
+// onCommit adds fn to the hooks run by the commit once the transaction is
+// sure to succeed, with its write set locked and before the new values are
+// published. An error from a hook cancels the commit: nothing is written.
+func (tx *stmTx) onCommit(fn func() error) {
+	tx.hooks = append(tx.hooks, fn)
+}
+
+// atomically runs fn as a transaction until it commits. If fn returns an
+// error, the transaction is dropped without writing anything and atomically
+// returns that error, as it does with the error of a commit hook.
+func (s *stm) atomically(fn func(tx *stmTx) error) error {
+	for {
+		tx := &stmTx{
+			stm:         s,
+			readVersion: s.clock.Load(),
+			reads:       map[tvar]bool{},
+			writes:      map[tvar]any{},
+		}
+		committed, err := tx.run(fn)
+		if committed || err != nil {
+			return err
+		}
+		s.aborts.Add(1)
+		runtime.Gosched()
+	}
+}
+
+// run runs fn and commits, returning false if the transaction must run again
+func (tx *stmTx) run(fn func(tx *stmTx) error) (committed bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(stmConflict); !ok {
+				panic(r)
+			}
+			committed, err = false, nil
+		}
+	}()
+	if err := fn(tx); err != nil {
+		return false, err
+	}
+	return tx.commit()
+}
+
+func (tx *stmTx) commit() (bool, error) {
+	// lock the write set in id order
+	writes := make([]tvar, 0, len(tx.writes))
+	for v := range tx.writes {
+		writes = append(writes, v)
+	}
+	slices.SortFunc(writes, func(a, b tvar) int {
+		idA, _ := a.lockWord()
+		idB, _ := b.lockWord()
+		return cmp.Compare(idA, idB)
+	})
+	locked := make([]uint64, 0, len(writes)) // the lock words before locking
+	release := func() {
+		for i, state := range locked {
+			_, word := writes[i].lockWord()
+			word.Store(state)
+		}
+	}
+	for _, v := range writes {
+		_, word := v.lockWord()
+		state := word.Load()
+		if state&1 == 1 || state>>1 > tx.readVersion || !word.CompareAndSwap(state, state|1) {
+			release()
+			return false, nil
+		}
+		locked = append(locked, state)
+	}
+
+	// validate the read set: nothing read was written since the start
+	version := tx.stm.clock.Add(1)
+	for v := range tx.reads {
+		_, word := v.lockWord()
+		state := word.Load()
+		if _, mine := tx.writes[v]; (state&1 == 1 && !mine) || state>>1 > tx.readVersion {
+			release()
+			return false, nil
+		}
+	}
+
+	for _, hook := range tx.hooks {
+		if err := hook(); err != nil {
+			release()
+			return false, err
+		}
+	}
+	for _, v := range writes {
+		v.publish(tx.writes[v], version)
+	}
+	tx.stm.commits.Add(1)
+	return true, nil
+}
+
+// lockTVar locks v outside of any transaction, waiting for the commits that
+// hold it, and returns the function unlocking it without changing its version
+func lockTVar(v tvar) func() {
+	_, word := v.lockWord()
+	for {
+		state := word.Load()
+		if state&1 == 0 && word.CompareAndSwap(state, state|1) {
+			return func() { word.Store(state) }
+		}
+		runtime.Gosched()
+	}
+}
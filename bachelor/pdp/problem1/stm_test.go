@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSTM_Counter(t *testing.T) {
+	s := &stm{}
+	counter := newTVar(s, 0)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				s.atomically(func(tx *stmTx) error {
+					counter.set(tx, counter.get(tx)+1)
+					return nil
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	if counter.load() != 8000 {
+		t.Errorf("counter %d, want 8000", counter.load())
+	}
+	if s.commits.Load() != 8000 {
+		t.Errorf("%d commits, want 8000", s.commits.Load())
+	}
+	t.Logf("%d aborts", s.aborts.Load())
+}
+
+func TestSTM_Isolation(t *testing.T) {
+	// transfers between x and y keep x+y at 100; readers must never see
+	// another sum, not even in a transaction that is then run again
+	s := &stm{}
+	x, y := newTVar(s, 100), newTVar(s, 0)
+	var wg sync.WaitGroup
+	var bad atomic.Int64
+	for g := 0; g < 4; g++ {
+		wg.Add(2)
+		go func(g int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewPCG(uint64(g), 0))
+			for i := 0; i < 2000; i++ {
+				amount := rng.IntN(21) - 10
+				s.atomically(func(tx *stmTx) error {
+					x.set(tx, x.get(tx)-amount)
+					y.set(tx, y.get(tx)+amount)
+					return nil
+				})
+			}
+		}(g)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				s.atomically(func(tx *stmTx) error {
+					if x.get(tx)+y.get(tx) != 100 {
+						bad.Add(1)
+					}
+					return nil
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	if bad.Load() != 0 {
+		t.Errorf("%d inconsistent reads", bad.Load())
+	}
+	if x.load()+y.load() != 100 {
+		t.Errorf("x+y = %d", x.load()+y.load())
+	}
+}
+
+func TestSTM_ErrorWritesNothing(t *testing.T) {
+	s := &stm{}
+	v := newTVar(s, "old")
+	errStop := errors.New("stop")
+	err := s.atomically(func(tx *stmTx) error {
+		v.set(tx, "new")
+		return errStop
+	})
+	if err != errStop || v.load() != "old" {
+		t.Errorf("error %v, value %q", err, v.load())
+	}
+
+	// a failing hook cancels the commit and leaves the TVar unlocked
+	err = s.atomically(func(tx *stmTx) error {
+		v.set(tx, "new")
+		tx.onCommit(func() error { return errStop })
+		return nil
+	})
+	if err != errStop || v.load() != "old" {
+		t.Errorf("error %v, value %q", err, v.load())
+	}
+	s.atomically(func(tx *stmTx) error {
+		v.set(tx, v.get(tx)+"er")
+		return nil
+	})
+	if v.load() != "older" {
+		t.Errorf("value %q after the cancelled commit", v.load())
+	}
+}
+
+// BenchmarkContention compares the mutex based performTransfer with STM
+// transfers, from very high contention (2 accounts) to almost none
+func BenchmarkContention(b *testing.B) {
+	for _, n := range []int{2, 16, 1024} {
+		for _, name := range []string{"per-account", "stm"} {
+			b.Run(fmt.Sprintf("accounts=%d/%s", n, name), func(b *testing.B) {
+				initial := newMoney(1<<40, "EUR")
+				accounts := newAccounts(n, initial)
+				strategy, err := newStrategy(name, accounts, newLedger())
+				if err != nil {
+					b.Fatal(err)
+				}
+				var seed atomic.Uint64
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					rng := rand.New(rand.NewPCG(seed.Add(1), 0))
+					amount := newMoney(1, "EUR")
+					for pb.Next() {
+						from := rng.IntN(n)
+						to := (from + 1 + rng.IntN(n-1)) % n
+						transfer := Transfer{from + 1, to + 1, amount}
+						if _, err := strategy.transfer(accounts[from], accounts[to], transfer); err != nil {
+							b.Error(err)
+						}
+					}
+				})
+				if s, ok := strategy.(*stmBalances); ok {
+					b.ReportMetric(float64(s.stm.aborts.Load())/float64(b.N), "aborts/op")
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+// lockStrategy is one way of synchronizing the transfers, the transactions
+// and the balance queries on a set of accounts.
+//
+// Rules (which mutex protects what):
+// Whatever the strategy, the ledger's own mutex protects the serial counter
+// and the audit log; it is only ever taken inside the strategy's locks.
+//
+// A transaction locks all its accounts (or stripes) in the same global order as
+// a transfer, increasing ids, so transfers and transactions cannot deadlock.
+//
+//   - global:      one mutex protects the balances and logs of all accounts
+//   - per-account: account.mutex protects account.balance and account.operations;
+//     a transfer locks both accounts, the smaller id first
+//   - striped:     stripe id%stripes protects the accounts mapped to it;
+//     a transfer locks both stripes, the smaller stripe first
+//   - rwmutex:     like per-account, but balance queries only take the read lock
+//   - atomic:      no mutex, each balance is an atomic cell updated with CAS;
+//     no operation log or ledger is kept, only the total amount of money is invariant
+//   - stm:         no mutex, each balance is a TVar and a transaction an STM
+//     transaction; the commit holds the TVar locks of the accounts while it
+//     records the operation, so they protect account.balance and account.operations
+type lockStrategy interface {
+	transfer(from, to *BankAccount, transfer Transfer) (bool, error)
+	// transact applies all the legs or none of them; accounts are all the
+	// accounts of the bank, by id
+	transact(accounts []*BankAccount, legs []Leg) (int, error)
+	balance(account *BankAccount) Money
+	// view returns the balance and the log of account as seen at one moment,
+	// holding only the lock of that account; the log must not be modified
+	view(account *BankAccount) (Money, []OperationRecord)
+}
+
+var errInsufficientBalance = errors.New("insufficient balance")
+
+var strategyNames = []string{"global", "per-account", "striped", "rwmutex", "atomic", "stm"}
+
+// lockStrategies are the strategies whose locks -lock-order watches
+var lockStrategies = []string{"global", "per-account", "striped", "rwmutex"}
+
+// newStrategy creates the strategy with the given name for accounts, which
+// records the transfers in ledger
+func newStrategy(name string, accounts []*BankAccount, ledger *ledger) (lockStrategy, error) {
+	switch name {
+	case "global":
+		return &globalLock{mutex: orderedMutex{name: "global lock"}, ledger: ledger}, nil
+	case "per-account":
+		return perAccountLock{ledger: ledger}, nil
+	case "striped":
+		return newStripedLock(16, ledger), nil
+	case "rwmutex":
+		return newRWLock(accounts, ledger), nil
+	case "atomic":
+		return newAtomicBalances(accounts), nil
+	case "stm":
+		return newSTMBalances(accounts, ledger), nil
+	}
+	return nil, fmt.Errorf("unknown strategy %q", name)
+}
+
+// applyTransfer is the critical section of a transfer, a transaction of two
+// legs: the caller holds whatever protects both accounts
+func applyTransfer(ledger *ledger, from, to *BankAccount, transfer Transfer) (bool, error) {
+	_, err := applyTransaction(ledger, []*BankAccount{from, to}, transfer.legs())
+	return err == nil, err
+}
+
+// global: a single mutex, transfers never run in parallel
+type globalLock struct {
+	mutex  orderedMutex
+	ledger *ledger
+}
+
+func (g *globalLock) transfer(from, to *BankAccount, transfer Transfer) (bool, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return applyTransfer(g.ledger, from, to, transfer)
+}
+
+func (g *globalLock) transact(accounts []*BankAccount, legs []Leg) (int, error) {
+	involved, _, err := transactionAccounts(accounts, legs)
+	if err != nil {
+		return 0, err
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return applyTransaction(g.ledger, involved, legs)
+}
+
+func (g *globalLock) balance(account *BankAccount) Money {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return account.balance
+}
+
+func (g *globalLock) view(account *BankAccount) (Money, []OperationRecord) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return account.balance, account.operations
+}
+
+// per-account: the original performTransfer
+type perAccountLock struct {
+	ledger *ledger
+	// reverse locks the source account of a transfer first instead of the
+	// smaller id, a deadlock for the lock detector to catch
+	reverse bool
+}
+
+func (p perAccountLock) transfer(from, to *BankAccount, transfer Transfer) (bool, error) {
+	if !p.reverse {
+		return performTransfer(p.ledger, from, to, transfer)
+	}
+	from.mutex.Lock()
+	defer from.mutex.Unlock()
+	to.mutex.Lock()
+	defer to.mutex.Unlock()
+	return applyTransfer(p.ledger, from, to, transfer)
+}
+
+func (p perAccountLock) transact(accounts []*BankAccount, legs []Leg) (int, error) {
+	involved, ordered, err := transactionAccounts(accounts, legs)
+	if err != nil {
+		return 0, err
+	}
+	// lock the accounts in increasing id order, like performTransfer
+	for _, account := range ordered {
+		account.mutex.Lock()
+		defer account.mutex.Unlock()
+	}
+	return applyTransaction(p.ledger, involved, legs)
+}
+
+func (perAccountLock) balance(account *BankAccount) Money {
+	account.mutex.Lock()
+	defer account.mutex.Unlock()
+	return account.balance
+}
+
+func (perAccountLock) view(account *BankAccount) (Money, []OperationRecord) {
+	account.mutex.Lock()
+	defer account.mutex.Unlock()
+	return account.balance, account.operations
+}
+
+// striped: a fixed number of mutexes shared by the accounts, fewer locks
+// than accounts but still some parallelism
+type stripedLock struct {
+	stripes []orderedMutex
+	ledger  *ledger
+}
+
+func newStripedLock(n int, ledger *ledger) *stripedLock {
+	stripes := make([]orderedMutex, n)
+	for i := range stripes {
+		stripes[i].name = fmt.Sprintf("stripe %d", i)
+	}
+	return &stripedLock{stripes: stripes, ledger: ledger}
+}
+
+func (s *stripedLock) stripe(account *BankAccount) int {
+	return account.id % len(s.stripes)
+}
+
+func (s *stripedLock) transfer(from, to *BankAccount, transfer Transfer) (bool, error) {
+	first, second := s.stripe(from), s.stripe(to)
+	if first > second {
+		first, second = second, first
+	}
+	s.stripes[first].Lock()
+	defer s.stripes[first].Unlock()
+	// both accounts can be on the same stripe, which must be locked only once
+	if second != first {
+		s.stripes[second].Lock()
+		defer s.stripes[second].Unlock()
+	}
+	return applyTransfer(s.ledger, from, to, transfer)
+}
+
+func (s *stripedLock) transact(accounts []*BankAccount, legs []Leg) (int, error) {
+	involved, ordered, err := transactionAccounts(accounts, legs)
+	if err != nil {
+		return 0, err
+	}
+	// lock every stripe once, in increasing order
+	stripes := make([]int, 0, len(ordered))
+	for _, account := range ordered {
+		stripes = append(stripes, s.stripe(account))
+	}
+	sort.Ints(stripes)
+	for i, stripe := range stripes {
+		if i > 0 && stripes[i-1] == stripe {
+			continue
+		}
+		s.stripes[stripe].Lock()
+		defer s.stripes[stripe].Unlock()
+	}
+	return applyTransaction(s.ledger, involved, legs)
+}
+
+func (s *stripedLock) balance(account *BankAccount) Money {
+	i := s.stripe(account)
+	s.stripes[i].Lock()
+	defer s.stripes[i].Unlock()
+	return account.balance
+}
+
+func (s *stripedLock) view(account *BankAccount) (Money, []OperationRecord) {
+	i := s.stripe(account)
+	s.stripes[i].Lock()
+	defer s.stripes[i].Unlock()
+	return account.balance, account.operations
+}
+
+// rwmutex: one RWMutex per account, queries share the read lock
+type rwLock struct {
+	locks  []orderedRWMutex // locks[id-1] protects the account with that id
+	ledger *ledger
+}
+
+func newRWLock(accounts []*BankAccount, ledger *ledger) *rwLock {
+	locks := make([]orderedRWMutex, len(accounts))
+	for i := range locks {
+		locks[i].name = fmt.Sprintf("account %d", i+1)
+	}
+	return &rwLock{locks: locks, ledger: ledger}
+}
+
+func (r *rwLock) transfer(from, to *BankAccount, transfer Transfer) (bool, error) {
+	first, second := from, to
+	if from.id > to.id {
+		first, second = to, from
+	}
+	r.locks[first.id-1].Lock()
+	defer r.locks[first.id-1].Unlock()
+	r.locks[second.id-1].Lock()
+	defer r.locks[second.id-1].Unlock()
+	return applyTransfer(r.ledger, from, to, transfer)
+}
+
+func (r *rwLock) transact(accounts []*BankAccount, legs []Leg) (int, error) {
+	involved, ordered, err := transactionAccounts(accounts, legs)
+	if err != nil {
+		return 0, err
+	}
+	for _, account := range ordered {
+		r.locks[account.id-1].Lock()
+		defer r.locks[account.id-1].Unlock()
+	}
+	return applyTransaction(r.ledger, involved, legs)
+}
+
+func (r *rwLock) balance(account *BankAccount) Money {
+	r.locks[account.id-1].RLock()
+	defer r.locks[account.id-1].RUnlock()
+	return account.balance
+}
+
+func (r *rwLock) view(account *BankAccount) (Money, []OperationRecord) {
+	r.locks[account.id-1].RLock()
+	defer r.locks[account.id-1].RUnlock()
+	return account.balance, account.operations
+}
+
+// atomic: balances are cents in atomic cells, changed by compare-and-swap
+// loops. The debit and the credit are two separate steps, so the money is
+// briefly "in flight" and only the final total is exact.
+type atomicBalances struct {
+	cells    []atomic.Int64 // cells[id-1] holds the balance of the account with that id
+	currency string
+}
+
+func newAtomicBalances(accounts []*BankAccount) *atomicBalances {
+	a := &atomicBalances{cells: make([]atomic.Int64, len(accounts))}
+	for _, account := range accounts {
+		a.cells[account.id-1].Store(account.balance.units)
+		a.currency = account.balance.currency
+	}
+	return a
+}
+
+func (a *atomicBalances) transfer(from, to *BankAccount, transfer Transfer) (bool, error) {
+	// debit, retrying if another thread changed the balance in between
+	if err := a.update(from, transfer.amount.neg()); err != nil {
+		return false, err
+	}
+	// credit, giving the money back if the balance would overflow
+	if err := a.update(to, transfer.amount); err != nil {
+		a.update(from, transfer.amount)
+		return false, err
+	}
+	return true, nil
+}
+
+// transact debits first, then credits, giving back what was already moved if
+// a leg fails; like a transfer, it is not atomic as a whole
+func (a *atomicBalances) transact(accounts []*BankAccount, legs []Leg) (int, error) {
+	involved, _, err := transactionAccounts(accounts, legs)
+	if err != nil {
+		return 0, err
+	}
+	var applied []int
+	for _, debits := range []bool{true, false} {
+		for i, leg := range legs {
+			if leg.amount.isNegative() != debits {
+				continue
+			}
+			if err := a.update(involved[i], leg.amount); err != nil {
+				for j := len(applied) - 1; j >= 0; j-- {
+					a.update(involved[applied[j]], legs[applied[j]].amount.neg())
+				}
+				return 0, fmt.Errorf("account %d: %w", involved[i].id, err)
+			}
+			applied = append(applied, i)
+		}
+	}
+	return 0, nil
+}
+
+// update adds amount to the balance of account, unless the balance would
+// become negative or overflow
+func (a *atomicBalances) update(account *BankAccount, amount Money) error {
+	cell := &a.cells[account.id-1]
+	for {
+		old := cell.Load()
+		balance, err := newMoney(old, a.currency).add(amount)
+		if err != nil {
+			return err
+		}
+		if balance.isNegative() {
+			return errInsufficientBalance
+		}
+		if cell.CompareAndSwap(old, balance.units) {
+			return nil
+		}
+	}
+}
+
+func (a *atomicBalances) balance(account *BankAccount) Money {
+	return newMoney(a.cells[account.id-1].Load(), a.currency)
+}
+
+// view has no log to return, the atomic strategy keeps none
+func (a *atomicBalances) view(account *BankAccount) (Money, []OperationRecord) {
+	return a.balance(account), nil
+}
+
+// settle copies the balances back into the accounts, once all threads are done
+func (a *atomicBalances) settle(accounts []*BankAccount) {
+	for _, account := range accounts {
+		account.balance = a.balance(account)
+	}
+}
+
+// stm: optimistic, a transaction reads and writes the balances in TVars and
+// only locks them, briefly, to commit; a conflict makes it run again
+type stmBalances struct {
+	stm    *stm
+	cells  []*TVar[Money] // cells[id-1] holds the balance of the account with that id
+	ledger *ledger
+}
+
+func newSTMBalances(accounts []*BankAccount, ledger *ledger) *stmBalances {
+	s := &stmBalances{stm: &stm{}, cells: make([]*TVar[Money], len(accounts)), ledger: ledger}
+	for _, account := range accounts {
+		s.cells[account.id-1] = newTVar(s.stm, account.balance)
+	}
+	return s
+}
+
+func (s *stmBalances) transfer(from, to *BankAccount, transfer Transfer) (bool, error) {
+	_, err := s.apply([]*BankAccount{from, to}, transfer.legs())
+	return err == nil, err
+}
+
+func (s *stmBalances) transact(accounts []*BankAccount, legs []Leg) (int, error) {
+	involved, _, err := transactionAccounts(accounts, legs)
+	if err != nil {
+		return 0, err
+	}
+	return s.apply(involved, legs)
+}
+
+// apply is applyTransaction as an STM transaction: the legs fail or succeed
+// together, and the ledger and the logs are written by the commit
+func (s *stmBalances) apply(involved []*BankAccount, legs []Leg) (int, error) {
+	var serial int
+	err := s.stm.atomically(func(tx *stmTx) error {
+		balances := make([]Money, len(legs))
+		for i, leg := range legs {
+			cell := s.cells[involved[i].id-1]
+			balance, err := cell.get(tx).add(leg.amount)
+			if err == nil && balance.isNegative() {
+				err = errInsufficientBalance
+			}
+			if err != nil {
+				return fmt.Errorf("account %d: %w", involved[i].id, err)
+			}
+			balances[i] = balance
+			cell.set(tx, balance)
+		}
+		tx.onCommit(func() error {
+			var err error
+			if serial, err = s.ledger.record(legs); err != nil {
+				return err
+			}
+			for i, account := range involved {
+				account.balance = balances[i]
+				account.recordOperation(serial, legs)
+			}
+			return nil
+		})
+		return nil
+	})
+	return serial, err
+}
+
+func (s *stmBalances) balance(account *BankAccount) Money {
+	return s.cells[account.id-1].load()
+}
+
+func (s *stmBalances) view(account *BankAccount) (Money, []OperationRecord) {
+	unlock := lockTVar(s.cells[account.id-1])
+	defer unlock()
+	return account.balance, account.operations
+}
+
+// totalBalance sums the balances as seen through the strategy
+func totalBalance(strategy lockStrategy, accounts []*BankAccount) (Money, error) {
+	var total Money
+	for i, account := range accounts {
+		balance := strategy.balance(account)
+		if i == 0 {
+			total = balance
+			continue
+		}
+		var err error
+		if total, err = total.add(balance); err != nil {
+			return Money{}, err
+		}
+	}
+	return total, nil
+}
+
+// checkTotal verifies that the accounts together still hold their initial
+// balances: money is neither created nor lost, whatever the strategy
+func checkTotal(strategy lockStrategy, accounts []*BankAccount) error {
+	var expected Money
+	for i, account := range accounts {
+		if i == 0 {
+			expected = account.initialBalance
+			continue
+		}
+		var err error
+		if expected, err = expected.add(account.initialBalance); err != nil {
+			return err
+		}
+	}
+	total, err := totalBalance(strategy, accounts)
+	if err != nil {
+		return err
+	}
+	if total != expected {
+		return fmt.Errorf("total balance %v instead of %v", total, expected)
+	}
+	return nil
+}
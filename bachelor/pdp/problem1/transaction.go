@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var errUnbalanced = errors.New("debits and credits do not add up to zero")
+
+// Leg is one account's part in a transaction: amount is credited to the
+// account, or debited from it when negative
+type Leg struct {
+	accountId int
+	amount    Money
+}
+
+// legs returns the transfer as a transaction of two legs
+func (transfer Transfer) legs() []Leg {
+	return []Leg{
+		{transfer.fromAccountId, transfer.amount.neg()},
+		{transfer.toAccountId, transfer.amount},
+	}
+}
+
+// amountFor returns what the transaction of legs changes in the balance of
+// the account with id
+func amountFor(legs []Leg, id int) Money {
+	for _, leg := range legs {
+		if leg.accountId == id {
+			return leg.amount
+		}
+	}
+	return Money{}
+}
+
+// checkTransaction verifies that legs is a transaction on accounts 1..n: at
+// least two legs, on distinct accounts, not zero, in one currency, with the
+// debits and the credits adding up to zero (money moves, it is not created)
+func checkTransaction(legs []Leg, n int) error {
+	if len(legs) < 2 {
+		return errors.New("a transaction needs at least two legs")
+	}
+	seen := make(map[int]bool, len(legs))
+	sum := newMoney(0, legs[0].amount.currency)
+	for _, leg := range legs {
+		if leg.accountId < 1 || leg.accountId > n {
+			return fmt.Errorf("unknown account %d", leg.accountId)
+		}
+		if seen[leg.accountId] {
+			return fmt.Errorf("account %d appears in two legs", leg.accountId)
+		}
+		seen[leg.accountId] = true
+		if leg.amount.units == 0 {
+			return fmt.Errorf("account %d: zero amount", leg.accountId)
+		}
+		var err error
+		if sum, err = sum.add(leg.amount); err != nil {
+			return err
+		}
+	}
+	if sum.units != 0 {
+		return fmt.Errorf("%w: %v left over", errUnbalanced, sum)
+	}
+	return nil
+}
+
+// transactionAccounts checks legs and returns the account of every leg, in
+// the order of the legs, and the same accounts in the global lock order
+// (increasing ids)
+func transactionAccounts(accounts []*BankAccount, legs []Leg) ([]*BankAccount, []*BankAccount, error) {
+	if err := checkTransaction(legs, len(accounts)); err != nil {
+		return nil, nil, err
+	}
+	involved := make([]*BankAccount, len(legs))
+	for i, leg := range legs {
+		involved[i] = accounts[leg.accountId-1]
+	}
+	ordered := append([]*BankAccount(nil), involved...)
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].id < ordered[j].id })
+	return involved, ordered, nil
+}
+
+// applyTransaction is the critical section of a transaction: the caller holds
+// whatever protects the involved accounts, involved[i] being the account of
+// legs[i]. The legs are applied one by one and rolled back if one of them
+// fails or the ledger (the WAL) cannot record the transaction; otherwise the
+// transaction gets one serial, recorded in the log of every involved account.
+func applyTransaction(ledger *ledger, involved []*BankAccount, legs []Leg) (int, error) {
+	old := make([]Money, len(legs))
+	rollback := func(applied int) {
+		for i := applied - 1; i >= 0; i-- {
+			involved[i].balance = old[i]
+		}
+	}
+	for i, leg := range legs {
+		account := involved[i]
+		old[i] = account.balance
+		balance, err := account.balance.add(leg.amount)
+		if err == nil && balance.isNegative() {
+			err = errInsufficientBalance
+		}
+		if err != nil {
+			rollback(i)
+			return 0, fmt.Errorf("account %d: %w", account.id, err)
+		}
+		account.balance = balance
+	}
+
+	// record the transaction in the ledger (and the WAL) before it counts
+	serial, err := ledger.record(legs)
+	if err != nil {
+		rollback(len(legs))
+		return 0, err
+	}
+	for _, account := range involved {
+		account.recordOperation(serial, legs)
+	}
+	return serial, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckTransaction(t *testing.T) {
+	usd, err := parseMoney("1", "USD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	one, two := mustMoney(t, "1"), mustMoney(t, "2")
+	tests := []struct {
+		name string
+		legs []Leg
+	}{
+		{"one leg", []Leg{{1, one}}},
+		{"same account twice", []Leg{{1, one.neg()}, {1, one}}},
+		{"unknown account", []Leg{{1, one.neg()}, {4, one}}},
+		{"zero amount", []Leg{{1, one.neg()}, {2, one}, {3, newMoney(0, "EUR")}}},
+		{"unbalanced", []Leg{{1, two.neg()}, {2, one}}},
+		{"two currencies", []Leg{{1, one.neg()}, {2, usd}}},
+	}
+	for _, tt := range tests {
+		if err := checkTransaction(tt.legs, 3); err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+	if err := checkTransaction([]Leg{{3, two.neg()}, {1, one}, {2, one}}, 3); err != nil {
+		t.Errorf("split payment: %v", err)
+	}
+}
+
+func TestTransaction_SplitPayment(t *testing.T) {
+	for _, name := range strategyNames {
+		accounts := newAccounts(4, mustMoney(t, "100"))
+		ledger := newLedger()
+		strategy, err := newStrategy(name, accounts, ledger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// account 3 pays 30 to 1 and 20 to 4, plus a fee of 0.25 to 2
+		legs := []Leg{
+			{3, mustMoney(t, "-50.25")},
+			{1, mustMoney(t, "30")},
+			{4, mustMoney(t, "20")},
+			{2, mustMoney(t, "0.25")},
+		}
+		if _, err := strategy.transact(accounts, legs); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		want := []string{"130", "100.25", "49.75", "120"}
+		for i, account := range accounts {
+			if balance := strategy.balance(account); balance != mustMoney(t, want[i]) {
+				t.Errorf("%s: account %d has %v, want %s", name, account.id, balance, want[i])
+			}
+		}
+		if name == "atomic" {
+			continue
+		}
+		// one serial, in the log of every account
+		if ledger.length() != 1 {
+			t.Errorf("%s: %d ledger entries, want 1", name, ledger.length())
+		}
+		for _, account := range accounts {
+			if len(account.operations) != 1 || account.operations[0].id != 1 {
+				t.Errorf("%s: account %d log %v, want serial 1 only", name, account.id, account.operations)
+			}
+		}
+		if err := checkAllAccountsConsistency(accounts, ledger); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestTransaction_Rollback(t *testing.T) {
+	for _, name := range strategyNames {
+		accounts := newAccounts(3, mustMoney(t, "10"))
+		ledger := newLedger()
+		strategy, err := newStrategy(name, accounts, ledger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the first debit is fine, the second one is not: nothing happens
+		legs := []Leg{
+			{1, mustMoney(t, "-5")},
+			{3, mustMoney(t, "15.01")},
+			{2, mustMoney(t, "-10.01")},
+		}
+		if _, err := strategy.transact(accounts, legs); !errors.Is(err, errInsufficientBalance) {
+			t.Errorf("%s: error %v, want insufficient balance", name, err)
+		}
+		for _, account := range accounts {
+			if balance := strategy.balance(account); balance != mustMoney(t, "10") {
+				t.Errorf("%s: account %d has %v after the rollback", name, account.id, balance)
+			}
+			if len(account.operations) != 0 {
+				t.Errorf("%s: account %d logged %v", name, account.id, account.operations)
+			}
+		}
+		if ledger.length() != 0 {
+			t.Errorf("%s: %d ledger entries after the rollback", name, ledger.length())
+		}
+	}
+}
+
+func TestTransaction_ConcurrentWithTransfers(t *testing.T) {
+	c := workloadConfig{
+		accounts:       8,
+		initialBalance: mustMoney(t, "50"),
+		threads:        8,
+		opsPerThread:   2000,
+		minAmount:      mustMoney(t, "0.01"),
+		maxAmount:      mustMoney(t, "10"),
+		distribution:   "uniform",
+		hotAccounts:    3,
+		hotFraction:    0.8,
+		txFraction:     0.5,
+		seed:           3,
+	}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range strategyNames {
+		accounts := newAccounts(c.accounts, c.initialBalance)
+		ledger := newLedger()
+		strategy, err := newStrategy(name, accounts, ledger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// overlapping transactions in every order: a deadlock hangs the test
+		result := runWorkload(c, accounts, strategy)
+		if result.transactions == 0 || result.succeeded == 0 {
+			t.Errorf("%s: %+v", name, result)
+		}
+		if err := checkTotal(strategy, accounts); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if name == "atomic" {
+			continue
+		}
+		if err := checkAllAccountsConsistency(accounts, ledger); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestTransaction_Durable(t *testing.T) {
+	dir := t.TempDir()
+	c := durableConfig(t)
+	c.txFraction = 0.5
+	accounts, _ := runDurable(t, dir, c)
+
+	// recovered from the WAL alone
+	recovered, ledger, r, err := openDurable(dir, c, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.replayed == 0 {
+		t.Error("nothing replayed")
+	}
+	checkSameBalances(t, recovered, accounts)
+	ledger.store.close()
+}
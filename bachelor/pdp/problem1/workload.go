@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// workloadConfig describes a run of randomly chosen operations
+type workloadConfig struct {
+	accounts       int     // number of accounts, with ids 1..accounts
+	initialBalance Money   // balance of every account at the start
+	threads        int     // goroutines performing operations
+	opsPerThread   int     // operations attempted by each goroutine
+	minAmount      Money   // smallest amount of a transfer
+	maxAmount      Money   // largest amount of a transfer
+	distribution   string  // "uniform" or "exponential" (small amounts more likely)
+	hotAccounts    int     // the first hotAccounts accounts are "hot"
+	hotFraction    float64 // chance that each side of a transfer is a hot account
+	readFraction   float64 // chance that an operation is a balance query instead of a transfer
+	txFraction     float64 // chance that a transfer is a split payment, a transaction on 3 to 5 accounts
+	seed           uint64  // same seed, same operations per thread (the interleaving still varies)
+}
+
+// workloadResult is what happened during a run
+type workloadResult struct {
+	attempted    int64 // transfers and transactions
+	succeeded    int64
+	failed       int64 // rejected because of insufficient balance
+	transactions int64 // attempted split payments
+	queries      int64 // balance queries
+	elapsed      time.Duration
+}
+
+func (r workloadResult) throughput() float64 {
+	if r.elapsed <= 0 {
+		return 0
+	}
+	return float64(r.attempted+r.queries) / r.elapsed.Seconds()
+}
+
+func (c workloadConfig) validate() error {
+	switch {
+	case c.accounts < 2:
+		return errors.New("need at least 2 accounts")
+	case c.initialBalance.isNegative():
+		return errors.New("initial balance cannot be negative")
+	case c.threads < 1:
+		return errors.New("need at least 1 thread")
+	case c.opsPerThread < 0:
+		return errors.New("operations per thread cannot be negative")
+	case c.minAmount.currency != c.initialBalance.currency || c.maxAmount.currency != c.initialBalance.currency:
+		return errors.New("all amounts must be in the same currency")
+	case c.minAmount.units < 1 || c.maxAmount.units < c.minAmount.units:
+		return fmt.Errorf("invalid amount range [%v, %v]", c.minAmount, c.maxAmount)
+	case c.distribution != "uniform" && c.distribution != "exponential":
+		return fmt.Errorf("unknown amount distribution %q", c.distribution)
+	case c.hotAccounts < 0 || c.hotAccounts > c.accounts:
+		return fmt.Errorf("hot accounts must be between 0 and %d", c.accounts)
+	case c.hotFraction < 0 || c.hotFraction > 1:
+		return errors.New("hot fraction must be between 0 and 1")
+	case c.readFraction < 0 || c.readFraction > 1:
+		return errors.New("read fraction must be between 0 and 1")
+	case c.txFraction < 0 || c.txFraction > 1:
+		return errors.New("transaction fraction must be between 0 and 1")
+	}
+	return nil
+}
+
+// newAccounts creates n accounts with ids 1..n, all with the same balance
+func newAccounts(n int, initialBalance Money) []*BankAccount {
+	accounts := make([]*BankAccount, n)
+	for i := range accounts {
+		accounts[i] = newBankAccount(i+1, initialBalance)
+	}
+	return accounts
+}
+
+// pickAccount returns an account id, a hot one with probability hotFraction
+func (c workloadConfig) pickAccount(rng *rand.Rand) int {
+	if c.hotAccounts > 0 && rng.Float64() < c.hotFraction {
+		return rng.IntN(c.hotAccounts) + 1
+	}
+	return rng.IntN(c.accounts) + 1
+}
+
+// pickAmount returns an amount in [minAmount, maxAmount], to the cent
+func (c workloadConfig) pickAmount(rng *rand.Rand) Money {
+	span := c.maxAmount.units - c.minAmount.units
+	if c.distribution == "exponential" {
+		// mean at a quarter of the range, the tail is cut at maxAmount
+		extra := int64(rng.ExpFloat64() * float64(span) / 4)
+		return newMoney(c.minAmount.units+min(extra, span), c.minAmount.currency)
+	}
+	return newMoney(c.minAmount.units+rng.Int64N(span+1), c.minAmount.currency)
+}
+
+// randomTransfer picks two distinct accounts and an amount
+func (c workloadConfig) randomTransfer(rng *rand.Rand) Transfer {
+	from := c.pickAccount(rng)
+	to := c.pickAccount(rng)
+	for to == from {
+		to = c.pickAccount(rng)
+		if c.hotAccounts == 1 && to == from {
+			// with a single hot account, retrying could pick it forever
+			to = rng.IntN(c.accounts) + 1
+		}
+	}
+	return Transfer{from, to, c.pickAmount(rng)}
+}
+
+// randomTransaction is a split payment: one account pays a random amount to
+// each of 2 to 4 other accounts (fewer if there are not enough accounts)
+func (c workloadConfig) randomTransaction(rng *rand.Rand) []Leg {
+	payees := min(2+rng.IntN(3), c.accounts-1)
+	chosen := map[int]bool{}
+	pick := func() int {
+		id := c.pickAccount(rng)
+		for chosen[id] {
+			// the hot accounts can all be taken already
+			id = rng.IntN(c.accounts) + 1
+		}
+		chosen[id] = true
+		return id
+	}
+	payer := pick()
+	legs := []Leg{{payer, newMoney(0, c.minAmount.currency)}}
+	for i := 0; i < payees; i++ {
+		amount := c.pickAmount(rng)
+		total, err := legs[0].amount.sub(amount)
+		if err != nil {
+			break
+		}
+		legs[0].amount = total
+		legs = append(legs, Leg{pick(), amount})
+	}
+	return legs
+}
+
+// runWorkload starts the threads, each doing opsPerThread random operations
+// on accounts synchronized by strategy, and waits for all of them to finish
+func runWorkload(c workloadConfig, accounts []*BankAccount, strategy lockStrategy) workloadResult {
+	var succeeded, failed, transactions, queries atomic.Int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for thread := 0; thread < c.threads; thread++ {
+		wg.Add(1)
+		go func(thread int) {
+			defer wg.Done()
+			// every thread has its own generator: rand.Rand is not safe for concurrent use
+			rng := rand.New(rand.NewPCG(c.seed, uint64(thread)))
+			for i := 0; i < c.opsPerThread; i++ {
+				if c.readFraction > 0 && rng.Float64() < c.readFraction {
+					strategy.balance(accounts[c.pickAccount(rng)-1])
+					queries.Add(1)
+					continue
+				}
+				var err error
+				if c.txFraction > 0 && rng.Float64() < c.txFraction {
+					_, err = strategy.transact(accounts, c.randomTransaction(rng))
+					transactions.Add(1)
+				} else {
+					transfer := c.randomTransfer(rng)
+					from := accounts[transfer.fromAccountId-1]
+					to := accounts[transfer.toAccountId-1]
+					_, err = strategy.transfer(from, to, transfer)
+				}
+				if err != nil {
+					failed.Add(1)
+				} else {
+					succeeded.Add(1)
+				}
+			}
+		}(thread)
+	}
+	wg.Wait()
+	return workloadResult{
+		attempted:    succeeded.Load() + failed.Load(),
+		succeeded:    succeeded.Load(),
+		failed:       failed.Load(),
+		transactions: transactions.Load(),
+		queries:      queries.Load(),
+		elapsed:      time.Since(start),
+	}
+}
@@ -0,0 +1,589 @@
+package bcast
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/bracha"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/capture"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/config"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/fec"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/message"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/node"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/snapshot"
+)
+
+const (
+	// PayloadSize is the exact payload size in fixed-size message mode.
+	PayloadSize = message.PayloadSize
+	// MaxPayload is the largest payload Broadcast accepts by default.
+	MaxPayload = message.MaxFragmentedPayload
+	// MaxMembers is the largest group: member indices travel in a single byte.
+	MaxMembers = 256
+	// MaxTopicLen is the longest topic name.
+	MaxTopicLen = message.MaxTopicLen
+
+	defaultReassemblyTimeout = 10 * time.Second
+	defaultDeliveryBuffer    = 1024
+)
+
+// ErrClosed is returned by Broadcast once the group has stopped.
+var ErrClosed = errors.New("bcast: group closed")
+
+// Transport carries datagrams between group members, addressed by their
+// index in the peer list. The default is a UDP socket on the member's own
+// address; NewMemNetwork connects members of the same process.
+type Transport = node.Transport
+
+// MemNetwork is an in-process network; see NewMemNetwork.
+type MemNetwork = node.MemNetwork
+
+// NewMemNetwork creates an in-memory network for n members. Pass
+// WithTransport(net.Transport(i)) to member i.
+func NewMemNetwork(n int) *MemNetwork {
+	return node.NewMemNetwork(n)
+}
+
+// Ordering selects the order in which payloads are delivered.
+type Ordering int
+
+const (
+	// Unordered delivers payloads as soon as they are accepted.
+	Unordered Ordering = iota
+	// FIFO delivers the payloads of each sender in the order it broadcast
+	// them. A payload whose fragments never all arrive is skipped after the
+	// reassembly timeout; with WithBracha a broadcast that never completes
+	// stalls its sender's stream, which only a faulty sender can cause.
+	FIFO
+)
+
+// Delivery is a payload accepted by the group.
+type Delivery struct {
+	From     int    // index of the sender (authenticated with WithBracha)
+	Seq      uint32 // per-sender sequence number; always 0 for fixed-size messages without WithBracha
+	Payload  []byte
+	Verified bool   // SHA-1 of the payload matched the one announced by the sender
+	SentSHA1 string // hex SHA-1 announced by the sender
+	CalcSHA1 string // hex SHA-1 computed on receipt
+	// Recovered is set for a payload that was lost and rebuilt from parity
+	// datagrams; see WithFEC.
+	Recovered bool
+	// Topic is the topic the payload was published on, "" for Broadcast;
+	// see WithTopics.
+	Topic string
+}
+
+// TopicStats counts one topic's traffic at this member.
+type TopicStats = node.TopicStats
+
+// Snapshot is one member's part of a Chandy-Lamport snapshot of the group:
+// its datagram counters when it recorded its state and the datagrams in
+// flight on each of its incoming channels.
+type Snapshot = snapshot.Local
+
+// Recovery is a datagram (a fixed-size message or a fragment) the member
+// missed and fetched from another member through anti-entropy.
+type Recovery = node.Recovery
+
+// FECScheme selects how WithFEC computes parity datagrams.
+type FECScheme = fec.Scheme
+
+const (
+	// FECXOR sends one parity datagram per group, the XOR of its messages:
+	// one lost message per group can be rebuilt.
+	FECXOR = fec.XOR
+	// FECReedSolomon sends r parity datagrams per group, from which any r
+	// lost messages of the group can be rebuilt.
+	FECReedSolomon = fec.ReedSolomon
+
+	// MaxFECGroup is the largest number of messages an FEC group protects.
+	MaxFECGroup = node.MaxFECGroup
+)
+
+type options struct {
+	transport         Transport
+	fixedSize         bool
+	bracha            bool
+	brachaSecret      []byte
+	brachaFaulty      int
+	ordering          Ordering
+	reassemblyTimeout time.Duration
+	capture           io.Writer
+	onError           func(error)
+	unverified        bool
+	deliveryBuffer    int
+	onSnapshot        func(*Snapshot)
+	snapshotTimeout   time.Duration
+	antiEntropy       bool
+	aeInterval        time.Duration
+	onRecovered       func(Recovery)
+	fec               *node.FECOptions
+	topics            []string
+}
+
+// Option configures a Group.
+type Option func(*options)
+
+// WithTransport replaces the member's UDP socket with t. The group takes
+// ownership of t and closes it on Close.
+func WithTransport(t Transport) Option {
+	return func(o *options) { o.transport = t }
+}
+
+// WithFixedSizeMessages sends every payload as a single 1024-byte message in
+// the homework format (sender index, payload, SHA-1). Payloads must then be
+// exactly PayloadSize bytes. By default payloads of any size up to MaxPayload
+// are split into fragments of that format and reassembled by the receivers.
+func WithFixedSizeMessages() Option {
+	return func(o *options) { o.fixedSize = true }
+}
+
+// WithBracha replaces the per-message SHA-1 check with Byzantine-tolerant
+// reliable broadcast: frames are signed with keys derived from secret, and a
+// payload is delivered by every correct member or by none, as long as at most
+// f members are faulty. f < 0 selects the largest f the group tolerates.
+func WithBracha(secret []byte, f int) Option {
+	return func(o *options) { o.bracha, o.brachaSecret, o.brachaFaulty = true, secret, f }
+}
+
+// WithOrdering selects the delivery order; the default is Unordered.
+func WithOrdering(ord Ordering) Option {
+	return func(o *options) { o.ordering = ord }
+}
+
+// WithReassemblyTimeout sets how long a receiver waits for the missing
+// fragments of a payload before giving up on it (default 10s).
+func WithReassemblyTimeout(d time.Duration) Option {
+	return func(o *options) { o.reassemblyTimeout = d }
+}
+
+// WithCapture records every datagram the member sends or receives to w in the
+// capture format read by bcastreplay. The caller owns w; the records are
+// flushed by Close.
+func WithCapture(w io.Writer) Option {
+	return func(o *options) { o.capture = w }
+}
+
+// WithErrorHandler receives the errors the group cannot return to a caller:
+// malformed or corrupted datagrams, failed sends, incomplete payloads.
+// They are dropped by default. fn is called from the group's goroutines.
+func WithErrorHandler(fn func(error)) Option {
+	return func(o *options) { o.onError = fn }
+}
+
+// WithUnverified also delivers payloads whose SHA-1 does not match, with
+// Verified set to false. By default they are reported to the error handler.
+func WithUnverified() Option {
+	return func(o *options) { o.unverified = true }
+}
+
+// WithDeliveryBuffer sets the capacity of the Deliver channel (default 1024).
+// When it is full, receiving stalls until the application catches up.
+func WithDeliveryBuffer(n int) Option {
+	return func(o *options) { o.deliveryBuffer = n }
+}
+
+// WithSnapshots makes the member take part in Chandy-Lamport snapshots,
+// started by any member's InitiateSnapshot: fn receives this member's part of
+// each one, complete or given up on after timeout (10s if zero). Every member
+// of the group needs this option. fn is called from the group's goroutines.
+func WithSnapshots(fn func(*Snapshot), timeout time.Duration) Option {
+	return func(o *options) { o.onSnapshot, o.snapshotTimeout = fn, timeout }
+}
+
+// WithAntiEntropy makes the member keep what it sends and receives so that,
+// once StartAntiEntropy is called, members exchange summaries every interval
+// (100ms if zero) and fetch the datagrams UDP lost. fn, if not nil, receives
+// each one recovered this way, from the group's goroutines; duplicates are
+// dropped. Incomplete payloads then wait for their fragments to be recovered
+// rather than for the reassembly timeout. Every member needs this option. Not
+// available with WithBracha.
+func WithAntiEntropy(interval time.Duration, fn func(Recovery)) Option {
+	return func(o *options) { o.antiEntropy, o.aeInterval, o.onRecovered = true, interval, fn }
+}
+
+// WithFEC follows every k messages the member broadcasts with r parity
+// datagrams (r must be 1 with FECXOR), from which the receivers rebuild up to
+// r lost messages of the group without asking for them again. Rebuilt
+// payloads are verified like received ones and delivered with Recovered set.
+// Needs WithFixedSizeMessages; not available with WithBracha.
+func WithFEC(scheme FECScheme, k, r int) Option {
+	return func(o *options) { o.fec = &node.FECOptions{Scheme: scheme, K: k, R: r} }
+}
+
+// WithTopics also delivers the payloads published on the named topics, with
+// Delivery.Topic set. Topics share the member's socket but have their own
+// sequence numbers, ordering and counters; payloads published on topics a
+// member did not subscribe to are dropped on receipt. Names are 1 to
+// MaxTopicLen letters, digits, '-', '_' or '.'. Not available with
+// WithBracha, WithAntiEntropy, WithFEC or WithSnapshots.
+func WithTopics(names ...string) Option {
+	return func(o *options) { o.topics = append(o.topics, names...) }
+}
+
+// Group is one member of a broadcast group: every payload passed to Broadcast
+// is delivered, through Deliver, to every member, the sender included.
+type Group struct {
+	self       int
+	size       int
+	node       *node.Node
+	opts       options
+	capture    *capture.Writer
+	deliveries chan Delivery
+
+	mu      sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	started bool
+	closed  bool
+}
+
+// New creates the member self of the group whose members listen on peers
+// ("host:port", in index order). Unless WithTransport is given, it binds the
+// UDP socket of peers[self].
+func New(self int, peers []string, opts ...Option) (*Group, error) {
+	o := options{
+		reassemblyTimeout: defaultReassemblyTimeout,
+		deliveryBuffer:    defaultDeliveryBuffer,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if len(peers) == 0 || len(peers) > MaxMembers {
+		return nil, fmt.Errorf("bcast.New: group of %d members, want 1 to %d", len(peers), MaxMembers)
+	}
+	if self < 0 || self >= len(peers) {
+		return nil, fmt.Errorf("bcast.New: member index %d out of range [0, %d)", self, len(peers))
+	}
+	if o.ordering == FIFO && o.fixedSize && !o.bracha {
+		return nil, fmt.Errorf("bcast.New: FIFO ordering needs sequence numbers, which fixed-size messages only carry with WithBracha")
+	}
+	if o.antiEntropy && o.bracha {
+		return nil, fmt.Errorf("bcast.New: anti-entropy cannot be combined with WithBracha")
+	}
+	if o.fec != nil {
+		if !o.fixedSize || o.bracha {
+			return nil, fmt.Errorf("bcast.New: FEC needs WithFixedSizeMessages and no WithBracha")
+		}
+		if o.fec.K > MaxFECGroup {
+			return nil, fmt.Errorf("bcast.New: FEC groups hold at most %d messages, got %d", MaxFECGroup, o.fec.K)
+		}
+		if _, err := fec.New(o.fec.Scheme, o.fec.K, o.fec.R); err != nil {
+			return nil, fmt.Errorf("bcast.New: %w", err)
+		}
+	}
+	if len(o.topics) > 0 && (o.bracha || o.antiEntropy || o.fec != nil || o.onSnapshot != nil) {
+		return nil, fmt.Errorf("bcast.New: topics cannot be combined with WithBracha, WithAntiEntropy, WithFEC or WithSnapshots")
+	}
+	for _, name := range o.topics {
+		if err := message.CheckTopic(name); err != nil {
+			return nil, fmt.Errorf("bcast.New: %w", err)
+		}
+	}
+	if o.deliveryBuffer < 0 {
+		return nil, fmt.Errorf("bcast.New: negative delivery buffer %d", o.deliveryBuffer)
+	}
+
+	cfg := &config.Config{}
+	for _, p := range peers {
+		addr, err := parsePeer(p)
+		if err != nil {
+			return nil, fmt.Errorf("bcast.New: %w", err)
+		}
+		cfg.Nodes = append(cfg.Nodes, addr)
+	}
+
+	g := &Group{self: self, size: len(peers), opts: o, deliveries: make(chan Delivery, o.deliveryBuffer)}
+	lg := errorLogger(g.reportError)
+
+	var proc *bracha.Process
+	if o.bracha {
+		keys, err := bracha.DeriveKeyring(o.brachaSecret, self, len(peers))
+		if err != nil {
+			return nil, fmt.Errorf("bcast.New: %w", err)
+		}
+		f := o.brachaFaulty
+		if f < 0 {
+			f = bracha.MaxFaulty(len(peers))
+		}
+		if proc, err = bracha.NewProcess(keys, f); err != nil {
+			return nil, fmt.Errorf("bcast.New: %w", err)
+		}
+	}
+	if o.capture != nil {
+		cw, err := capture.NewWriter(o.capture, self)
+		if err != nil {
+			return nil, fmt.Errorf("bcast.New: %w", err)
+		}
+		g.capture = cw
+	}
+
+	if o.transport != nil {
+		g.node = node.NewNodeWithTransport(self, cfg, lg, o.transport)
+	} else {
+		n, err := node.NewNode(self, cfg, lg)
+		if err != nil {
+			return nil, fmt.Errorf("bcast.New: %w", err)
+		}
+		g.node = n
+	}
+	if proc != nil {
+		g.node.SetBracha(proc)
+	}
+	if !o.fixedSize {
+		g.node.SetFragmentation(node.FragmentOptions{Timeout: o.reassemblyTimeout})
+	}
+	if o.ordering == FIFO {
+		g.node.SetFIFO()
+	}
+	if g.capture != nil {
+		g.node.SetCapture(g.capture)
+	}
+	if o.onSnapshot != nil {
+		g.node.SetSnapshots(node.SnapshotOptions{Timeout: o.snapshotTimeout, Done: o.onSnapshot})
+	}
+	if o.antiEntropy {
+		g.node.SetAntiEntropy(node.AntiEntropyOptions{Interval: o.aeInterval, Recovered: o.onRecovered})
+	}
+	if o.fec != nil {
+		g.node.SetFEC(*o.fec)
+	}
+	g.node.SetDeliver(g.push)
+	for _, name := range o.topics {
+		g.node.Subscribe(name, g.push) // cannot fail: the name was checked
+	}
+	return g, nil
+}
+
+// Start begins receiving. The group runs until ctx is done or Close is
+// called; either way the Deliver channel is closed once it has stopped.
+func (g *Group) Start(ctx context.Context) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return ErrClosed
+	}
+	if g.started {
+		return fmt.Errorf("bcast: group already started")
+	}
+	g.ctx, g.cancel = context.WithCancel(ctx)
+	if err := g.node.Start(g.ctx); err != nil {
+		g.cancel()
+		return fmt.Errorf("bcast.Start: %w", err)
+	}
+	g.started = true
+	go func() {
+		<-g.node.Done()
+		close(g.deliveries)
+	}()
+	return nil
+}
+
+// Broadcast sends payload to every member, this one included. It returns once
+// the datagrams are handed to the transport, not when they are delivered.
+func (g *Group) Broadcast(payload []byte) error {
+	g.mu.Lock()
+	stopped := g.closed || (g.ctx != nil && g.ctx.Err() != nil)
+	g.mu.Unlock()
+	if stopped {
+		return ErrClosed
+	}
+	return g.node.Broadcast(payload)
+}
+
+// Publish is Broadcast on the named topic: the members that subscribed to it
+// with WithTopics deliver payload, whether this one did or not. "" is the
+// topic of Broadcast.
+func (g *Group) Publish(topic string, payload []byte) error {
+	g.mu.Lock()
+	stopped := g.closed || (g.ctx != nil && g.ctx.Err() != nil)
+	g.mu.Unlock()
+	if stopped {
+		return ErrClosed
+	}
+	if err := g.node.Publish(topic, payload); err != nil {
+		return fmt.Errorf("bcast.Publish: %w", err)
+	}
+	return nil
+}
+
+// TopicStats returns this member's counters for the named topic; "" is the
+// topic of Broadcast.
+func (g *Group) TopicStats(topic string) TopicStats {
+	return g.node.Stats(topic)
+}
+
+// InitiateSnapshot starts a Chandy-Lamport snapshot of the group and returns
+// its id, unique among the snapshots this member starts. Needs WithSnapshots
+// and a started group.
+func (g *Group) InitiateSnapshot() (uint32, error) {
+	g.mu.Lock()
+	started, stopped := g.started, g.closed || (g.ctx != nil && g.ctx.Err() != nil)
+	g.mu.Unlock()
+	switch {
+	case stopped:
+		return 0, ErrClosed
+	case !started:
+		return 0, fmt.Errorf("bcast.InitiateSnapshot: group not started")
+	}
+	id, err := g.node.InitiateSnapshot()
+	if err != nil {
+		return 0, fmt.Errorf("bcast.InitiateSnapshot: %w", err)
+	}
+	return id, nil
+}
+
+// StartAntiEntropy starts reconciling with the other members, normally once
+// this member is done broadcasting. It goes on until the group stops. Needs
+// WithAntiEntropy and a started group.
+func (g *Group) StartAntiEntropy() error {
+	g.mu.Lock()
+	ctx, started, stopped := g.ctx, g.started, g.closed || (g.ctx != nil && g.ctx.Err() != nil)
+	g.mu.Unlock()
+	switch {
+	case stopped:
+		return ErrClosed
+	case !started:
+		return fmt.Errorf("bcast.StartAntiEntropy: group not started")
+	}
+	if err := g.node.StartAntiEntropy(ctx); err != nil {
+		return fmt.Errorf("bcast.StartAntiEntropy: %w", err)
+	}
+	return nil
+}
+
+// Converged reports whether, as of their latest summaries, every member holds
+// exactly what this one holds, this one delivered all of it, and every member
+// found the same. A member can then stop without leaving the others waiting.
+// Always false without WithAntiEntropy.
+func (g *Group) Converged() bool {
+	return g.node.Converged()
+}
+
+// Deliver returns the channel of accepted payloads. It is closed once the
+// group has stopped.
+func (g *Group) Deliver() <-chan Delivery {
+	return g.deliveries
+}
+
+// Self returns this member's index.
+func (g *Group) Self() int {
+	return g.self
+}
+
+// Size returns the number of members.
+func (g *Group) Size() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.size
+}
+
+// AddPeers appends members listening on peers ("host:port"), which get the
+// next indices: every later Broadcast also reaches them. Needs the default UDP
+// transport; not available with WithBracha, WithAntiEntropy or WithSnapshots.
+func (g *Group) AddPeers(peers []string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.size+len(peers) > MaxMembers {
+		return fmt.Errorf("bcast.AddPeers: group of %d members, want at most %d", g.size+len(peers), MaxMembers)
+	}
+	addrs := make([]config.NodeAddr, len(peers))
+	for i, p := range peers {
+		addr, err := parsePeer(p)
+		if err != nil {
+			return fmt.Errorf("bcast.AddPeers: %w", err)
+		}
+		addrs[i] = addr
+	}
+	if err := g.node.AddPeers(addrs); err != nil {
+		return fmt.Errorf("bcast.AddPeers: %w", err)
+	}
+	g.size += len(peers)
+	return nil
+}
+
+func parsePeer(p string) (config.NodeAddr, error) {
+	host, portStr, err := net.SplitHostPort(p)
+	if err != nil {
+		return config.NodeAddr{}, fmt.Errorf("peer %q: %w", p, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return config.NodeAddr{}, fmt.Errorf("peer %q: invalid port", p)
+	}
+	return config.NodeAddr{IP: host, Port: port}, nil
+}
+
+// Close stops the group, closes its transport and flushes the capture.
+// Payloads not yet read from Deliver are discarded.
+func (g *Group) Close() error {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return nil
+	}
+	g.closed = true
+	started := g.started
+	if started {
+		g.cancel()
+	}
+	g.mu.Unlock()
+
+	err := g.node.Close()
+	if !started {
+		close(g.deliveries)
+	}
+	if g.capture != nil {
+		err = errors.Join(err, g.capture.Close())
+	}
+	return err
+}
+
+// push is the node's delivery handler.
+func (g *Group) push(d node.Delivery) {
+	if !d.OK && !g.opts.unverified {
+		topic := ""
+		if d.Topic != "" {
+			topic = " on topic " + d.Topic
+		}
+		g.reportError(fmt.Errorf("bcast: payload %d from member %d%s failed SHA-1 (%s != %s)", d.Seq, d.From, topic, d.SentHex, d.CalcHex))
+		return
+	}
+	select {
+	case g.deliveries <- Delivery{
+		From:      int(d.From),
+		Seq:       d.Seq,
+		Payload:   d.Payload,
+		Verified:  d.OK,
+		SentSHA1:  d.SentHex,
+		CalcSHA1:  d.CalcHex,
+		Recovered: d.Recovered,
+		Topic:     d.Topic,
+	}:
+	case <-g.ctx.Done():
+	}
+}
+
+func (g *Group) reportError(err error) {
+	if g.opts.onError != nil {
+		g.opts.onError(err)
+	}
+}
+
+// errorLogger routes the node's error log to the group's error handler;
+// deliveries reach the application through Deliver instead of a log.
+type errorLogger func(error)
+
+func (l errorLogger) LogMessage(ok bool, sourceIndex uint8, sentHex, calcHex string) {}
+
+func (l errorLogger) LogRecovered(ok bool, sourceIndex uint8, sentHex, calcHex string) {}
+
+func (l errorLogger) LogError(format string, args ...any) {
+	l(fmt.Errorf(format, args...))
+}
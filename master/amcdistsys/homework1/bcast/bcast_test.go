@@ -0,0 +1,589 @@
+package bcast
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/snapshot"
+)
+
+// memGroup creates n members connected by an in-memory network.
+func memGroup(t *testing.T, n int, opts ...Option) []*Group {
+	t.Helper()
+	mem := NewMemNetwork(n)
+	peers := make([]string, n)
+	for i := range peers {
+		peers[i] = fmt.Sprintf("10.0.0.%d:5000", i+1)
+	}
+	return startGroup(t, peers, func(i int) []Option {
+		return append([]Option{WithTransport(mem.Transport(i))}, opts...)
+	})
+}
+
+func startGroup(t *testing.T, peers []string, opts func(i int) []Option) []*Group {
+	t.Helper()
+	groups := make([]*Group, len(peers))
+	for i := range peers {
+		g, err := New(i, peers, opts(i)...)
+		if err != nil {
+			t.Fatalf("New(%d): %v", i, err)
+		}
+		if err := g.Start(context.Background()); err != nil {
+			t.Fatalf("Start(%d): %v", i, err)
+		}
+		t.Cleanup(func() { g.Close() })
+		groups[i] = g
+	}
+	return groups
+}
+
+// collect reads want deliveries from g, failing the test after a timeout.
+func collect(t *testing.T, g *Group, want int) []Delivery {
+	t.Helper()
+	var got []Delivery
+	timeout := time.After(10 * time.Second)
+	for len(got) < want {
+		select {
+		case d, ok := <-g.Deliver():
+			if !ok {
+				t.Fatalf("member %d: Deliver closed after %d of %d deliveries", g.Self(), len(got), want)
+			}
+			got = append(got, d)
+		case <-timeout:
+			t.Fatalf("member %d: timed out after %d of %d deliveries", g.Self(), len(got), want)
+		}
+	}
+	return got
+}
+
+func testPayload(from, seq, size int) []byte {
+	p := make([]byte, size)
+	for i := range p {
+		p[i] = byte(from*31 + seq*7 + i)
+	}
+	return p
+}
+
+// --- Every member delivers every payload, of any size, sender included ---
+
+func TestGroup_DeliversToAll(t *testing.T) {
+	const M = 3
+	sizes := []int{0, 1, 5000, 300 << 10}
+	groups := memGroup(t, M)
+
+	for i, g := range groups {
+		for seq, size := range sizes {
+			if err := g.Broadcast(testPayload(i, seq, size)); err != nil {
+				t.Fatalf("Broadcast: %v", err)
+			}
+		}
+	}
+	for _, g := range groups {
+		got := collect(t, g, M*len(sizes))
+		seen := map[[2]int]bool{}
+		for _, d := range got {
+			key := [2]int{d.From, int(d.Seq)}
+			if seen[key] {
+				t.Errorf("member %d: payload %v delivered twice", g.Self(), key)
+			}
+			seen[key] = true
+			if !d.Verified {
+				t.Errorf("member %d: payload %v not verified", g.Self(), key)
+			}
+			if want := testPayload(d.From, int(d.Seq), sizes[d.Seq]); !bytes.Equal(d.Payload, want) {
+				t.Errorf("member %d: payload %v corrupted", g.Self(), key)
+			}
+		}
+	}
+}
+
+// --- FIFO ordering restores each sender's order over a reordering link ---
+
+// swapTransport delivers every pair of datagrams to the same destination in
+// reverse order.
+type swapTransport struct {
+	Transport
+	mu   sync.Mutex
+	held map[int][]byte
+}
+
+func (s *swapTransport) Send(to int, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if first, ok := s.held[to]; ok {
+		delete(s.held, to)
+		if err := s.Transport.Send(to, data); err != nil {
+			return err
+		}
+		return s.Transport.Send(to, first)
+	}
+	s.held[to] = append([]byte(nil), data...)
+	return nil
+}
+
+func TestGroup_FIFOOrdering(t *testing.T) {
+	const M, N = 2, 10
+	for _, ord := range []Ordering{Unordered, FIFO} {
+		mem := NewMemNetwork(M)
+		groups := startGroup(t, []string{"127.0.0.1:1", "127.0.0.1:2"}, func(i int) []Option {
+			return []Option{
+				WithTransport(&swapTransport{Transport: mem.Transport(i), held: map[int][]byte{}}),
+				WithOrdering(ord),
+			}
+		})
+		for i, g := range groups {
+			for seq := 0; seq < N; seq++ {
+				g.Broadcast(testPayload(i, seq, 100))
+			}
+		}
+		inOrder := true
+		for _, g := range groups {
+			next := map[int]uint32{}
+			for _, d := range collect(t, g, M*N) {
+				if d.Seq != next[d.From] {
+					inOrder = false
+				}
+				next[d.From] = d.Seq + 1
+			}
+		}
+		if ord == FIFO && !inOrder {
+			t.Error("FIFO: payloads delivered out of sender order")
+		}
+		if ord == Unordered && inOrder {
+			t.Error("Unordered: expected the reordering link to show through")
+		}
+	}
+}
+
+// --- Bracha integrity: fixed-size messages, authenticated senders ---
+
+func TestGroup_BrachaFixedSize(t *testing.T) {
+	const M, N = 4, 3
+	groups := memGroup(t, M, WithBracha([]byte("secret"), -1), WithFixedSizeMessages(), WithOrdering(FIFO))
+	for i, g := range groups {
+		for seq := 0; seq < N; seq++ {
+			if err := g.Broadcast(testPayload(i, seq, PayloadSize)); err != nil {
+				t.Fatalf("Broadcast: %v", err)
+			}
+		}
+	}
+	for _, g := range groups {
+		next := map[int]uint32{}
+		for _, d := range collect(t, g, M*N) {
+			if d.Seq != next[d.From] {
+				t.Errorf("member %d: seq %d from %d, expected %d", g.Self(), d.Seq, d.From, next[d.From])
+			}
+			next[d.From] = d.Seq + 1
+			if !bytes.Equal(d.Payload, testPayload(d.From, int(d.Seq), PayloadSize)) {
+				t.Errorf("member %d: payload (%d, %d) corrupted", g.Self(), d.From, d.Seq)
+			}
+		}
+	}
+
+	if err := groups[0].Broadcast(make([]byte, 10)); err == nil {
+		t.Error("expected error for a payload that is not PayloadSize bytes")
+	}
+}
+
+// --- Snapshots: a cut taken during Bracha broadcasts is consistent ---
+
+func TestGroup_Snapshot(t *testing.T) {
+	const M, N = 4, 5
+	locals := make(chan *Snapshot, M)
+	groups := memGroup(t, M, WithBracha([]byte("secret"), -1), WithSnapshots(func(s *Snapshot) { locals <- s }, 0))
+	for seq := 0; seq < N; seq++ {
+		for i, g := range groups {
+			if err := g.Broadcast(testPayload(i, seq, 3000)); err != nil {
+				t.Fatalf("Broadcast: %v", err)
+			}
+		}
+		if seq == 1 {
+			if id, err := groups[2].InitiateSnapshot(); err != nil || id != 1 {
+				t.Fatalf("InitiateSnapshot: %d, %v", id, err)
+			}
+		}
+	}
+	for _, g := range groups {
+		collect(t, g, M*N)
+	}
+
+	global := &snapshot.Global{ID: 1, Initiator: 2}
+	for len(global.Nodes) < M {
+		select {
+		case s := <-locals:
+			if s.Initiator != 2 || s.ID != 1 || s.Mode != "bracha" || !s.Complete {
+				t.Errorf("member %d: unexpected snapshot %+v", s.Node, s)
+			}
+			global.Nodes = append(global.Nodes, s)
+		case <-time.After(10 * time.Second):
+			t.Fatalf("got %d of %d local snapshots", len(global.Nodes), M)
+		}
+	}
+	if problems := global.Validate(M); len(problems) > 0 {
+		t.Errorf("inconsistent snapshot: %v", problems)
+	}
+
+	plain := memGroup(t, 1)
+	if _, err := plain[0].InitiateSnapshot(); err == nil {
+		t.Error("expected error without WithSnapshots")
+	}
+}
+
+// --- Anti-entropy: a member fetches the broadcasts its link dropped ---
+
+// dropTransport drops the first n datagrams sent to member to; payloads of
+// up to a fragment are one datagram each.
+type dropTransport struct {
+	Transport
+	to int
+	mu sync.Mutex
+	n  int
+}
+
+func (d *dropTransport) Send(to int, data []byte) error {
+	d.mu.Lock()
+	drop := to == d.to && d.n > 0
+	if drop {
+		d.n--
+	}
+	d.mu.Unlock()
+	if drop {
+		return nil
+	}
+	return d.Transport.Send(to, data)
+}
+
+func TestGroup_AntiEntropy(t *testing.T) {
+	const M, N = 3, 4
+	mem := NewMemNetwork(M)
+	peers := []string{"10.0.0.1:5000", "10.0.0.2:5000", "10.0.0.3:5000"}
+	recovered := make(chan Recovery, M*N)
+	groups := startGroup(t, peers, func(i int) []Option {
+		var tr Transport = mem.Transport(i)
+		if i == 0 {
+			tr = &dropTransport{Transport: tr, to: 2, n: N}
+		}
+		return []Option{WithTransport(tr), WithAntiEntropy(10*time.Millisecond, func(r Recovery) {
+			if i == 2 {
+				recovered <- r
+			}
+		})}
+	})
+	for seq := 0; seq < N; seq++ {
+		for i, g := range groups {
+			if err := g.Broadcast(testPayload(i, seq, 100)); err != nil {
+				t.Fatalf("Broadcast: %v", err)
+			}
+		}
+	}
+	collect(t, groups[2], M*N-N)
+	for _, g := range groups {
+		if err := g.StartAntiEntropy(); err != nil {
+			t.Fatalf("StartAntiEntropy: %v", err)
+		}
+	}
+	for _, g := range groups[:2] {
+		collect(t, g, M*N)
+	}
+	for _, d := range collect(t, groups[2], N) {
+		if d.From != 0 || !d.Verified {
+			t.Errorf("unexpected recovered delivery from %d (verified %v)", d.From, d.Verified)
+		}
+	}
+	for i := 0; i < N; i++ {
+		if r := <-recovered; r.From != 0 || r.Peer == 2 {
+			t.Errorf("unexpected recovery %+v", r)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); !groups[2].Converged(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("member 2 did not converge")
+		}
+	}
+
+	plain := memGroup(t, 1)
+	if err := plain[0].StartAntiEntropy(); err == nil {
+		t.Error("expected error without WithAntiEntropy")
+	}
+}
+
+func TestGroup_FEC(t *testing.T) {
+	const M, N = 3, 8
+	mem := NewMemNetwork(M)
+	peers := []string{"10.0.0.1:5000", "10.0.0.2:5000", "10.0.0.3:5000"}
+	groups := startGroup(t, peers, func(i int) []Option {
+		var tr Transport = mem.Transport(i)
+		if i == 0 {
+			// The first two messages of member 0's first group of four.
+			tr = &dropTransport{Transport: tr, to: 2, n: 2}
+		}
+		return []Option{WithTransport(tr), WithFixedSizeMessages(), WithFEC(FECReedSolomon, 4, 2)}
+	})
+	for seq := 0; seq < N; seq++ {
+		for i, g := range groups {
+			if err := g.Broadcast(testPayload(i, seq, PayloadSize)); err != nil {
+				t.Fatalf("Broadcast: %v", err)
+			}
+		}
+	}
+	for _, g := range groups[:2] {
+		for _, d := range collect(t, g, M*N) {
+			if d.Recovered {
+				t.Errorf("member %d: unexpected rebuilt delivery from %d", g.Self(), d.From)
+			}
+		}
+	}
+	recovered := 0
+	for _, d := range collect(t, groups[2], M*N) {
+		if !d.Verified {
+			t.Errorf("unverified delivery from %d", d.From)
+		}
+		if d.Recovered {
+			recovered++
+			if d.From != 0 {
+				t.Errorf("rebuilt delivery from %d, which lost nothing", d.From)
+			}
+		}
+	}
+	if recovered != 2 {
+		t.Errorf("member 2 rebuilt %d payloads, want 2", recovered)
+	}
+}
+
+// --- Topics: each member delivers the topics it subscribed to, in order ---
+
+func TestGroup_Topics(t *testing.T) {
+	mem := NewMemNetwork(3)
+	peers := []string{"10.0.0.1:5000", "10.0.0.2:5000", "10.0.0.3:5000"}
+	subscriptions := [][]string{{"video"}, {"video", "chat"}, nil}
+	groups := startGroup(t, peers, func(i int) []Option {
+		return []Option{WithTransport(mem.Transport(i)), WithOrdering(FIFO), WithTopics(subscriptions[i]...)}
+	})
+
+	for seq := 0; seq < 3; seq++ {
+		if err := groups[2].Publish("video", testPayload(2, seq, 5000)); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+	}
+	if err := groups[0].Publish("chat", []byte("hi")); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	if err := groups[0].Broadcast([]byte("all")); err != nil {
+		t.Fatalf("Broadcast: %v", err)
+	}
+
+	for i, g := range groups {
+		want := map[string]int{"": 1}
+		for _, topic := range subscriptions[i] {
+			want[topic] = map[string]int{"video": 3, "chat": 1}[topic]
+		}
+		total := 0
+		for _, n := range want {
+			total += n
+		}
+		next := map[string]uint32{}
+		for _, d := range collect(t, g, total) {
+			if d.Seq != next[d.Topic] {
+				t.Errorf("member %d topic %q: payload %d delivered out of order", i, d.Topic, d.Seq)
+			}
+			next[d.Topic]++
+			if d.Topic == "video" && !bytes.Equal(d.Payload, testPayload(2, int(d.Seq), 5000)) {
+				t.Errorf("member %d: video payload %d corrupted", i, d.Seq)
+			}
+		}
+		for topic, n := range want {
+			if got := g.TopicStats(topic).Delivered; got != int64(n) {
+				t.Errorf("member %d topic %q: %d delivered, want %d", i, topic, got, n)
+			}
+		}
+	}
+	if s := groups[2].TopicStats("video"); s.Sent != 3 || s.Delivered != 0 {
+		t.Errorf("publisher stats %+v, want 3 sent and none delivered", s)
+	}
+	if err := groups[0].Publish("no/slash", nil); err == nil {
+		t.Error("expected error for an invalid topic")
+	}
+}
+
+// --- Default transport: UDP on the member's own address ---
+
+func TestGroup_UDP(t *testing.T) {
+	peers := make([]string, 2)
+	for i := range peers {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		peers[i] = conn.LocalAddr().String()
+		conn.Close()
+	}
+	groups := startGroup(t, peers, func(int) []Option { return nil })
+	groups[1].Broadcast([]byte("hello"))
+	for _, g := range groups {
+		d := collect(t, g, 1)[0]
+		if d.From != 1 || string(d.Payload) != "hello" {
+			t.Errorf("member %d: unexpected delivery %+v", g.Self(), d)
+		}
+	}
+}
+
+// --- Membership: a member added at runtime receives later broadcasts ---
+
+func TestGroup_AddPeers(t *testing.T) {
+	peers := make([]string, 3)
+	for i := range peers {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		peers[i] = conn.LocalAddr().String()
+		conn.Close()
+	}
+	first := startGroup(t, peers[:2], func(int) []Option { return nil })
+	late, err := New(2, peers)
+	if err != nil {
+		t.Fatalf("New(2): %v", err)
+	}
+	if err := late.Start(context.Background()); err != nil {
+		t.Fatalf("Start(2): %v", err)
+	}
+	t.Cleanup(func() { late.Close() })
+	if err := first[0].AddPeers([]string{"127.0.0.1"}); err == nil {
+		t.Error("expected error for a peer without a port")
+	}
+	if err := first[0].AddPeers(peers[2:]); err != nil {
+		t.Fatalf("AddPeers: %v", err)
+	}
+	if first[0].Size() != 3 {
+		t.Errorf("Size = %d after AddPeers, want 3", first[0].Size())
+	}
+	first[0].Broadcast([]byte("welcome"))
+	for _, d := range collect(t, late, 1) {
+		if d.From != 0 || string(d.Payload) != "welcome" {
+			t.Errorf("late member: unexpected delivery %+v", d)
+		}
+	}
+
+	mem := memGroup(t, 2)
+	if err := mem[0].AddPeers([]string{"10.0.0.9:5000"}); err == nil {
+		t.Error("expected error adding a peer over a transport without AddPeers")
+	}
+}
+
+// --- Lifecycle: cancelling the context stops the group ---
+
+func TestGroup_ContextCancel(t *testing.T) {
+	mem := NewMemNetwork(1)
+	g, err := New(0, []string{"127.0.0.1:1"}, WithTransport(mem.Transport(0)))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := g.Start(ctx); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	cancel()
+	select {
+	case _, ok := <-g.Deliver():
+		if ok {
+			t.Fatal("unexpected delivery")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Deliver not closed after the context was cancelled")
+	}
+	if err := g.Broadcast([]byte("late")); !errors.Is(err, ErrClosed) {
+		t.Errorf("Broadcast after cancel: expected ErrClosed, got %v", err)
+	}
+	if err := g.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if err := g.Start(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Errorf("Start after Close: expected ErrClosed, got %v", err)
+	}
+}
+
+func TestGroup_CloseBeforeStart(t *testing.T) {
+	g, err := New(0, []string{"127.0.0.1:1"}, WithTransport(NewMemNetwork(1).Transport(0)))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := g.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, ok := <-g.Deliver(); ok {
+		t.Error("Deliver should be closed")
+	}
+}
+
+// --- Corrupted payloads are reported, or delivered with WithUnverified ---
+
+func TestGroup_Unverified(t *testing.T) {
+	for _, unverified := range []bool{false, true} {
+		mem := NewMemNetwork(1)
+		var mu sync.Mutex
+		var errs []error
+		opts := []Option{
+			WithTransport(mem.Transport(0)),
+			WithFixedSizeMessages(),
+			WithErrorHandler(func(err error) { mu.Lock(); errs = append(errs, err); mu.Unlock() }),
+		}
+		if unverified {
+			opts = append(opts, WithUnverified())
+		}
+		g := startGroup(t, []string{"127.0.0.1:1"}, func(int) []Option { return opts })[0]
+
+		// A datagram whose SHA-1 trailer does not match its contents,
+		// injected through a second handle on the member's inbox.
+		mem.Transport(0).Send(0, make([]byte, 1024))
+		g.Broadcast(testPayload(0, 0, PayloadSize))
+
+		got := collect(t, g, map[bool]int{false: 1, true: 2}[unverified])
+		mu.Lock()
+		nerr := len(errs)
+		mu.Unlock()
+		if unverified {
+			if got[0].Verified || !got[1].Verified || nerr != 0 {
+				t.Errorf("WithUnverified: deliveries %v/%v, %d errors", got[0].Verified, got[1].Verified, nerr)
+			}
+		} else if !got[0].Verified || nerr != 1 {
+			t.Errorf("default: delivery verified=%v, %d errors", got[0].Verified, nerr)
+		}
+	}
+}
+
+// --- Option validation ---
+
+func TestNew_Invalid(t *testing.T) {
+	peers := []string{"127.0.0.1:1", "127.0.0.1:2"}
+	mem := NewMemNetwork(2)
+	cases := map[string]struct {
+		self  int
+		peers []string
+		opts  []Option
+	}{
+		"no peers":          {0, nil, nil},
+		"self out of range": {2, peers, nil},
+		"bad peer":          {0, []string{"127.0.0.1", "127.0.0.1:2"}, nil},
+		"bad port":          {0, []string{"127.0.0.1:0", "127.0.0.1:2"}, nil},
+		"fifo fixed-size":   {0, peers, []Option{WithFixedSizeMessages(), WithOrdering(FIFO)}},
+		"bracha too small":  {0, peers, []Option{WithBracha([]byte("s"), 1)}},
+		"bracha ae":         {0, peers, []Option{WithBracha([]byte("s"), 0), WithAntiEntropy(0, nil)}},
+		"fec fragments":     {0, peers, []Option{WithFEC(FECXOR, 4, 1)}},
+		"fec xor r=2":       {0, peers, []Option{WithFixedSizeMessages(), WithFEC(FECXOR, 4, 2)}},
+		"fec group too big": {0, peers, []Option{WithFixedSizeMessages(), WithFEC(FECReedSolomon, MaxFECGroup+1, 2)}},
+		"bad topic":         {0, peers, []Option{WithTopics("a b")}},
+		"topics bracha":     {0, peers, []Option{WithTopics("a"), WithBracha([]byte("s"), 0)}},
+	}
+	for name, tc := range cases {
+		opts := append([]Option{WithTransport(mem.Transport(0))}, tc.opts...)
+		if _, err := New(tc.self, tc.peers, opts...); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
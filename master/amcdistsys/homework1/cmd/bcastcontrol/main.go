@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/control"
+)
+
+// bcastcontrol sends one command to a node started with `bcastnode -control`
+// and prints its reply, e.g. `bcastcontrol 2 rate 100` to slow node 2 down
+// to 100 broadcasts per second. `bcastcontrol 0 help` lists the commands.
+func main() {
+	logsDir := flag.String("logs", "logs", "directory with the nodes' control sockets")
+	socket := flag.String("socket", "", "control socket to use instead of <logs>/node_<index>.sock")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: bcastcontrol [-logs dir | -socket path] <node_index> <command> [args...]\n")
+		fmt.Fprintf(os.Stderr, "Commands: pause, resume, rate <per_second|unlimited>, status, reload, stop, help\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	nodeIndex, err := strconv.Atoi(flag.Arg(0))
+	if err != nil || nodeIndex < 0 {
+		fmt.Fprintf(os.Stderr, "invalid node index: %s\n", flag.Arg(0))
+		os.Exit(1)
+	}
+	path := *socket
+	if path == "" {
+		path = control.SocketPath(*logsDir, nodeIndex)
+	}
+
+	out, err := control.Send(path, strings.Join(flag.Args()[1:], " "))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "node %d: %v\n", nodeIndex, err)
+		os.Exit(1)
+	}
+	fmt.Print(out)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/config"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/launcher"
+)
+
+func main() {
+	binary := flag.String("bin", defaultBinary(), "path to the bcastnode binary")
+	build := flag.Bool("build", false, "build the bcastnode binary before launching")
+	stagger := flag.Duration("stagger", 100*time.Millisecond, "delay between consecutive node starts")
+	timeout := flag.Duration("timeout", 5*time.Minute, "global timeout after which remaining nodes are killed (0 = none)")
+	grace := flag.Duration("grace", 2*time.Second, "time between interrupting and killing a straggler")
+	failFast := flag.Bool("failfast", false, "stop all nodes as soon as one fails")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: bcastctl [flags] <config_file> <first_index> <last_index> [-- node flags...]\n")
+		fmt.Fprintf(os.Stderr, "Node flags may contain %s, replaced by each node's index.\n", launcher.IndexPlaceholder)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	var nodeArgs []string
+	for i, a := range args {
+		if a == "--" {
+			args, nodeArgs = args[:i], args[i+1:]
+			break
+		}
+	}
+	if len(args) != 3 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	configPath := args[0]
+	first, err := strconv.Atoi(args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid first index %q: %v\n", args[1], err)
+		os.Exit(1)
+	}
+	last, err := strconv.Atoi(args[2])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid last index %q: %v\n", args[2], err)
+		os.Exit(1)
+	}
+
+	cfg, err := config.ParseConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config error: %v\n", err)
+		os.Exit(1)
+	}
+	if first < 0 || last >= len(cfg.Nodes) || first > last {
+		fmt.Fprintf(os.Stderr, "index range [%d, %d] invalid for %d configured nodes\n", first, last, len(cfg.Nodes))
+		os.Exit(1)
+	}
+
+	if *build {
+		fmt.Println("Building bcastnode...")
+		cmd := exec.Command("go", "build", "-o", *binary, "./cmd/bcastnode")
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "build failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	opts := launcher.Options{
+		Binary:     *binary,
+		ConfigPath: configPath,
+		First:      first,
+		Last:       last,
+		NodeArgs:   nodeArgs,
+		Stagger:    *stagger,
+		Timeout:    *timeout,
+		Grace:      *grace,
+		FailFast:   *failFast,
+		Out:        os.Stdout,
+	}
+	fmt.Printf("Launching nodes %d..%d of %s (stagger %v, timeout %v)\n", first, last, configPath, *stagger, *timeout)
+	results, err := launcher.Run(ctx, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println()
+	launcher.WriteSummary(os.Stdout, results)
+	os.Exit(launcher.ExitStatus(results))
+}
+
+// defaultBinary is the bcastnode binary built by `make build` in the working directory.
+func defaultBinary() string {
+	name := "bcastnode"
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return "." + string(filepath.Separator) + name
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/config"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/election"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/node"
+)
+
+// bcastelect runs a leader election among the nodes of a config file until
+// interrupted, printing every change of leader and logging election events to
+// logs/node_<index>_elections.log.
+func main() {
+	algo := flag.String("algo", "raft", "election algorithm: bully or raft")
+	timeout := flag.Duration("timeout", 500*time.Millisecond, "election timeout")
+	heartbeat := flag.Duration("heartbeat", 0, "leader heartbeat interval (default: timeout/5)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: bcastelect [-algo bully|raft] [-timeout d] [-heartbeat d] <config_file> <node_index>\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	algorithm, err := election.ParseAlgorithm(*algo)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	nodeIndex, err := strconv.Atoi(flag.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid node index %q: %v\n", flag.Arg(1), err)
+		os.Exit(1)
+	}
+	cfg, err := config.ParseConfig(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config error: %v\n", err)
+		os.Exit(1)
+	}
+	if nodeIndex < 0 || nodeIndex >= len(cfg.Nodes) {
+		fmt.Fprintf(os.Stderr, "node index %d out of range [0, %d)\n", nodeIndex, len(cfg.Nodes))
+		os.Exit(1)
+	}
+
+	if err := os.MkdirAll("logs", 0o755); err != nil {
+		fmt.Fprintf(os.Stderr, "logger error: %v\n", err)
+		os.Exit(1)
+	}
+	logFile, err := os.Create(filepath.Join("logs", fmt.Sprintf("node_%d_elections.log", nodeIndex)))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "logger error: %v\n", err)
+		os.Exit(1)
+	}
+	defer logFile.Close()
+
+	t, err := node.NewUDPTransport(nodeIndex, cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "node error: %v\n", err)
+		os.Exit(1)
+	}
+	e, err := election.New(nodeIndex, len(cfg.Nodes), t, election.Options{
+		Algorithm:       algorithm,
+		ElectionTimeout: *timeout,
+		Heartbeat:       *heartbeat,
+		Log:             logFile,
+	})
+	if err != nil {
+		t.Close()
+		fmt.Fprintf(os.Stderr, "election error: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := e.Start(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "election error: %v\n", err)
+		os.Exit(1)
+	}
+	defer e.Close()
+
+	fmt.Printf("Node %d: %v election among %d nodes\n", nodeIndex, algorithm, len(cfg.Nodes))
+	ticker := time.NewTicker(*timeout / 10)
+	defer ticker.Stop()
+	last := election.State{Leader: -1}
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Printf("Node %d: stopped, leader %d in term %d\n", nodeIndex, last.Leader, last.Term)
+			return
+		case <-ticker.C:
+			if s := e.State(); s.Leader != last.Leader || s.Term != last.Term {
+				if s.Leader >= 0 {
+					fmt.Printf("Node %d: term %d, leader %d (%v)\n", nodeIndex, s.Term, s.Leader, s.Role)
+				}
+				last = s
+			}
+		}
+	}
+}
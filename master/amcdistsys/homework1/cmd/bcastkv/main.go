@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/config"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/kv"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/node"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/raft"
+)
+
+const usage = `Usage:
+  bcastkv serve [-data dir] [-timeout d] [-snapshot bytes] <config_file> <node_index>
+  bcastkv [-timeout d] get    <config_file> <key>
+  bcastkv [-timeout d] put    <config_file> <key> <value>
+  bcastkv [-timeout d] append <config_file> <key> <value>
+  bcastkv [-timeout d] delete <config_file> <key>
+`
+
+// bcastkv is a key-value store replicated with Raft over the nodes of a
+// config file. "serve" runs one replica, logging to logs/node_<index>_raft.log
+// and keeping its state in <data>/node_<index>; the other commands are a
+// client that finds the leader and runs one operation.
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(1)
+	}
+	switch os.Args[1] {
+	case "serve":
+		serve(os.Args[2:])
+	case "get", "put", "append", "delete":
+		client(os.Args[1], os.Args[2:])
+	default:
+		if len(os.Args[1]) > 0 && os.Args[1][0] == '-' {
+			client("", os.Args[1:]) // flags before the command
+			return
+		}
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(1)
+	}
+}
+
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	dataDir := fs.String("data", "data", "directory for the Raft state of each node")
+	timeout := fs.Duration("timeout", 300*time.Millisecond, "election timeout")
+	threshold := fs.Int("snapshot", 1<<20, "snapshot once the Raft log exceeds this many bytes (0: never)")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage); fs.PrintDefaults() }
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	cfg, err := config.ParseConfig(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config error: %v\n", err)
+		os.Exit(1)
+	}
+	nodeIndex, err := strconv.Atoi(fs.Arg(1))
+	if err != nil || nodeIndex < 0 || nodeIndex >= len(cfg.Nodes) {
+		fmt.Fprintf(os.Stderr, "invalid node index %q: want 0 to %d\n", fs.Arg(1), len(cfg.Nodes)-1)
+		os.Exit(1)
+	}
+
+	if err := os.MkdirAll("logs", 0o755); err != nil {
+		fmt.Fprintf(os.Stderr, "logger error: %v\n", err)
+		os.Exit(1)
+	}
+	logFile, err := os.OpenFile(filepath.Join("logs", fmt.Sprintf("node_%d_raft.log", nodeIndex)),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "logger error: %v\n", err)
+		os.Exit(1)
+	}
+	defer logFile.Close()
+
+	storage, err := raft.NewFileStorage(filepath.Join(*dataDir, fmt.Sprintf("node_%d", nodeIndex)))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "storage error: %v\n", err)
+		os.Exit(1)
+	}
+	t, err := node.NewUDPTransport(nodeIndex, cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "node error: %v\n", err)
+		os.Exit(1)
+	}
+	r, err := raft.New(nodeIndex, cfg, t, storage, raft.Options{ElectionTimeout: *timeout, Log: logFile})
+	if err != nil {
+		t.Close()
+		fmt.Fprintf(os.Stderr, "raft error: %v\n", err)
+		os.Exit(1)
+	}
+	kv.NewServer(r, *threshold)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := r.Start(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "raft error: %v\n", err)
+		os.Exit(1)
+	}
+	defer r.Close()
+
+	fmt.Printf("Node %d: serving %s:%d, %d replicas\n",
+		nodeIndex, cfg.Nodes[nodeIndex].IP, cfg.Nodes[nodeIndex].Port, len(cfg.Nodes))
+	ticker := time.NewTicker(*timeout)
+	defer ticker.Stop()
+	lastLeader, lastTerm := -1, uint64(0)
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Printf("Node %d: stopped in term %d\n", nodeIndex, lastTerm)
+			return
+		case <-ticker.C:
+			if term, leader, _ := r.State(); leader >= 0 && (leader != lastLeader || term != lastTerm) {
+				fmt.Printf("Node %d: term %d, leader %d\n", nodeIndex, term, leader)
+				lastLeader, lastTerm = leader, term
+			}
+		}
+	}
+}
+
+func client(cmd string, args []string) {
+	fs := flag.NewFlagSet("client", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 10*time.Second, "give up after this long")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage); fs.PrintDefaults() }
+	fs.Parse(args)
+	args = fs.Args()
+	if cmd == "" && len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+	want := map[string]int{"get": 2, "put": 3, "append": 3, "delete": 2}[cmd]
+	if want == 0 || len(args) != want {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	cfg, err := config.ParseConfig(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config error: %v\n", err)
+		os.Exit(1)
+	}
+	c, closeClient, err := kv.DialUDP(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "client error: %v\n", err)
+		os.Exit(1)
+	}
+	defer closeClient()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	key := args[1]
+	switch cmd {
+	case "get":
+		v, ok, err := c.Get(ctx, key)
+		exitOnError(err)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "%s: not found\n", key)
+			os.Exit(2)
+		}
+		fmt.Println(v)
+	case "put":
+		exitOnError(c.Put(ctx, key, args[2]))
+	case "append":
+		v, err := c.Append(ctx, key, args[2])
+		exitOnError(err)
+		fmt.Println(v)
+	case "delete":
+		_, ok, err := c.Delete(ctx, key)
+		exitOnError(err)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "%s: not found\n", key)
+			os.Exit(2)
+		}
+	}
+}
+
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "client error: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/config"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/mutex"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/node"
+)
+
+const usage = `Usage:
+  bcastmutex [-algo ricart-agrawala|token-ring] [-k n] [-hold d] [-think d] [-shared file] [-retry d] <config_file> <node_index>
+  bcastmutex check [-logs dir] [-k n] <config_file>
+`
+
+// bcastmutex has every node of a config file enter a critical section K
+// times, appending a line to a shared file while inside. Each node logs
+// protocol events to logs/node_<index>_mutex.log and its stays in the
+// critical section to logs/node_<index>_sections.log; "check" reads the
+// latter back and verifies that no two stays overlapped.
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		check(os.Args[2:])
+		return
+	}
+	run(os.Args[1:])
+}
+
+func run(args []string) {
+	fs := flag.NewFlagSet("bcastmutex", flag.ExitOnError)
+	algo := fs.String("algo", "ricart-agrawala", "mutual exclusion algorithm: ricart-agrawala (ra) or token-ring (ring)")
+	k := fs.Int("k", 10, "number of times to enter the critical section")
+	hold := fs.Duration("hold", 10*time.Millisecond, "time spent inside the critical section")
+	think := fs.Duration("think", 20*time.Millisecond, "maximum random time between two entries")
+	shared := fs.String("shared", filepath.Join("logs", "shared.log"), "file every node appends to inside the critical section")
+	retry := fs.Duration("retry", 100*time.Millisecond, "retransmission interval for lost frames")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage); fs.PrintDefaults() }
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	algorithm, err := mutex.ParseAlgorithm(*algo)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	nodeIndex, err := strconv.Atoi(fs.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid node index %q: %v\n", fs.Arg(1), err)
+		os.Exit(1)
+	}
+	cfg, err := config.ParseConfig(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config error: %v\n", err)
+		os.Exit(1)
+	}
+	if nodeIndex < 0 || nodeIndex >= len(cfg.Nodes) {
+		fmt.Fprintf(os.Stderr, "node index %d out of range [0, %d)\n", nodeIndex, len(cfg.Nodes))
+		os.Exit(1)
+	}
+
+	if err := os.MkdirAll("logs", 0o755); err != nil {
+		fmt.Fprintf(os.Stderr, "logger error: %v\n", err)
+		os.Exit(1)
+	}
+	logFile, err := os.Create(filepath.Join("logs", fmt.Sprintf("node_%d_mutex.log", nodeIndex)))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "logger error: %v\n", err)
+		os.Exit(1)
+	}
+	defer logFile.Close()
+	sections, err := os.Create(filepath.Join("logs", fmt.Sprintf("node_%d_sections.log", nodeIndex)))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "logger error: %v\n", err)
+		os.Exit(1)
+	}
+	defer sections.Close()
+	sharedFile, err := os.OpenFile(*shared, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "shared file error: %v\n", err)
+		os.Exit(1)
+	}
+	defer sharedFile.Close()
+
+	t, err := node.NewUDPTransport(nodeIndex, cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "node error: %v\n", err)
+		os.Exit(1)
+	}
+	m, err := mutex.New(nodeIndex, len(cfg.Nodes), t, mutex.Options{Algorithm: algorithm, Retry: *retry, Log: logFile})
+	if err != nil {
+		t.Close()
+		fmt.Fprintf(os.Stderr, "mutex error: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := m.Start(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "mutex error: %v\n", err)
+		os.Exit(1)
+	}
+	defer m.Close()
+
+	fmt.Printf("Node %d: entering the critical section %d times (%v, %d nodes)\n", nodeIndex, *k, algorithm, len(cfg.Nodes))
+	var waited time.Duration
+	for entry := 0; entry < *k; entry++ {
+		if *think > 0 {
+			time.Sleep(rand.N(*think))
+		}
+		start := time.Now()
+		stamp, err := m.Lock(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "mutex error: %v\n", err)
+			os.Exit(1)
+		}
+		s := mutex.Section{Node: nodeIndex, Entry: entry, Stamp: stamp, Enter: time.Now()}
+		waited += s.Enter.Sub(start)
+		fmt.Fprintf(sharedFile, "node %d entry %d stamp %d\n", nodeIndex, entry, stamp)
+		time.Sleep(*hold)
+		s.Exit = time.Now()
+		m.Unlock()
+		fmt.Fprintln(sections, s)
+	}
+	fmt.Printf("Node %d: done, waited %v per entry on average; waiting for the other nodes\n",
+		nodeIndex, (waited / time.Duration(max(*k, 1))).Round(time.Microsecond))
+
+	// The others may still need this node's replies or its link of the ring.
+	if err := m.Leave(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "mutex error: %v\n", err)
+		os.Exit(1)
+	}
+	time.Sleep(5 * *retry) // answer the last retransmissions
+	fmt.Printf("Node %d: all nodes done\n", nodeIndex)
+}
+
+func check(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	logsDir := fs.String("logs", "logs", "directory with the section logs of the run")
+	k := fs.Int("k", 10, "number of entries every node made")
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage); fs.PrintDefaults() }
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	cfg, err := config.ParseConfig(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config error: %v\n", err)
+		os.Exit(1)
+	}
+
+	var all []mutex.Section
+	for i := range cfg.Nodes {
+		s, err := mutex.ReadSections(filepath.Join(*logsDir, fmt.Sprintf("node_%d_sections.log", i)))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "check error: %v\n", err)
+			os.Exit(1)
+		}
+		all = append(all, s...)
+	}
+	problems := mutex.Check(all, len(cfg.Nodes), *k)
+	if len(problems) == 0 {
+		fmt.Printf("%d sections of %d nodes: no overlaps, entered in stamp order\n", len(all), len(cfg.Nodes))
+		return
+	}
+	fmt.Printf("%d sections of %d nodes: %d problems\n", len(all), len(cfg.Nodes), len(problems))
+	for _, p := range problems {
+		fmt.Printf("  %s\n", p)
+	}
+	os.Exit(1)
+}
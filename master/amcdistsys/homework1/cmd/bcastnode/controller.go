@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/bcast"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/config"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/control"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/status"
+)
+
+// controller is what the control socket steers: the pace of the send loop,
+// an early stop, and the peers, which reload can extend.
+type controller struct {
+	g          *bcast.Group
+	st         *status.Counters
+	pacer      *control.Pacer
+	sending    context.Context // done once sending must stop
+	stopSend   context.CancelFunc
+	configPath string
+	server     *control.Server
+
+	mu  sync.Mutex
+	cfg *config.Config // as last loaded
+}
+
+func newController(ctx context.Context, g *bcast.Group, configPath string, cfg *config.Config, st *status.Counters) *controller {
+	c := &controller{g: g, st: st, pacer: control.NewPacer(), configPath: configPath, cfg: cfg}
+	c.sending, c.stopSend = context.WithCancel(ctx)
+	return c
+}
+
+func (c *controller) listen(path string) error {
+	s, err := control.Listen(path, map[string]control.Handler{
+		"pause":  c.pause,
+		"resume": c.resume,
+		"rate":   c.rate,
+		"status": c.status,
+		"reload": c.reload,
+		"stop":   c.stop,
+	})
+	if err != nil {
+		return err
+	}
+	c.server = s
+	go s.Serve()
+	fmt.Printf("Node %d: accepting commands on %s\n", c.g.Self(), path)
+	return nil
+}
+
+func (c *controller) close() {
+	c.server.Close()
+}
+
+func (c *controller) pause([]string) (string, error) {
+	c.pacer.Pause()
+	return fmt.Sprintf("sending paused after %d broadcasts", c.st.Report().Sent), nil
+}
+
+func (c *controller) resume([]string) (string, error) {
+	c.pacer.Resume()
+	return "sending resumed", nil
+}
+
+// rate takes broadcasts per second, or "unlimited".
+func (c *controller) rate(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("usage: rate <broadcasts per second | unlimited>")
+	}
+	perSecond := 0.0
+	if args[0] != "unlimited" {
+		var err error
+		if perSecond, err = strconv.ParseFloat(args[0], 64); err != nil || perSecond <= 0 {
+			return "", fmt.Errorf("invalid rate %q", args[0])
+		}
+	}
+	if err := c.pacer.SetRate(perSecond); err != nil {
+		return "", err
+	}
+	return "rate set to " + args[0], nil
+}
+
+func (c *controller) status([]string) (string, error) {
+	r := c.st.Report()
+	paused, perSecond := c.pacer.State()
+	sending := "running"
+	switch {
+	case c.sending.Err() != nil:
+		sending = "stopped"
+	case r.Sent == r.N:
+		sending = "done"
+	case paused:
+		sending = "paused"
+	}
+	rate := "unlimited"
+	if perSecond > 0 {
+		rate = fmt.Sprintf("%g/s", perSecond)
+	}
+	return fmt.Sprintf("node %d of %d\nsent %d/%d (%s, rate %s)\nreceived %d/%d (OK %d, FAIL %d)\nerrors %d",
+		r.Node, c.g.Size(), r.Sent, r.N, sending, rate, r.Received, r.N*c.g.Size(), r.OK, r.Fail, r.Errors), nil
+}
+
+// reload re-reads the config file, which may only have gained nodes at its
+// end, and starts broadcasting to them.
+func (c *controller) reload([]string) (string, error) {
+	cfg, err := config.ParseConfig(c.configPath)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old := c.cfg
+	if cfg.N != old.N {
+		return "", fmt.Errorf("N changed from %d to %d; only nodes can be added", old.N, cfg.N)
+	}
+	if len(cfg.Nodes) < len(old.Nodes) || !slices.Equal(cfg.Nodes[:len(old.Nodes)], old.Nodes) {
+		return "", fmt.Errorf("nodes were removed or changed; only nodes can be added at the end")
+	}
+	added := cfg.Nodes[len(old.Nodes):]
+	if len(added) == 0 {
+		return "no new nodes", nil
+	}
+	// All of them or none: on error c.cfg is still what the group holds.
+	if err := c.g.AddPeers(peers(&config.Config{Nodes: added})); err != nil {
+		return "", err
+	}
+	c.cfg = cfg
+	c.st.Grow(len(cfg.Nodes))
+	return fmt.Sprintf("added %d nodes, now %d", len(added), len(cfg.Nodes)), nil
+}
+
+// stop ends sending early and then the node, which closes its logs as on
+// a normal finish.
+func (c *controller) stop([]string) (string, error) {
+	c.stopSend()
+	return fmt.Sprintf("stopping after %d broadcasts", c.st.Report().Sent), nil
+}
@@ -1,25 +1,60 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"strconv"
+	"sync"
+	"time"
 
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/bcast"
 	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/config"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/control"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/fec"
 	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/logger"
-	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/node"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/snapshot"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/status"
 )
 
 func main() {
-	if len(os.Args) != 3 {
-		fmt.Fprintf(os.Stderr, "Usage: bcastnode <config_file> <node_index>\n")
+	capturePath := flag.String("capture", "", "record every sent/received datagram to this capture file")
+	useBracha := flag.Bool("bracha", false, "use Byzantine-tolerant reliable broadcast (Bracha)")
+	faulty := flag.Int("f", -1, "number of Byzantine nodes to tolerate in -bracha mode (default: (M-1)/3)")
+	secret := flag.String("secret", "amcdistsys", "shared secret the -bracha signing keys are derived from")
+	fragment := flag.Bool("fragment", false, "broadcast variable-size payloads split into 1024-byte fragments")
+	payloadFile := flag.String("payload", "", "in -fragment mode, broadcast the contents of this file")
+	payloadSize := flag.Int("payload-size", 64<<10, "in -fragment mode without -payload, size of the random payloads")
+	reasmTimeout := flag.Duration("reassembly-timeout", 10*time.Second, "in -fragment mode, how long to wait for missing fragments")
+	snapshotDir := flag.String("snapshot-dir", "", "take part in Chandy-Lamport snapshots, writing this node's parts to this directory")
+	snapshotInitiator := flag.Int("snapshot-initiator", 0, "with -snapshot-dir, index of the node that starts the snapshot")
+	snapshotAfter := flag.Duration("snapshot-after", 50*time.Millisecond, "with -snapshot-dir, how long after broadcasting starts the initiator snapshots")
+	antiEntropy := flag.Bool("anti-entropy", false, "after broadcasting, fetch the messages UDP lost from the other nodes")
+	aeTimeout := flag.Duration("ae-timeout", 30*time.Second, "with -anti-entropy, how long to try to converge before giving up")
+	fecScheme := flag.String("fec", "", "follow every -fec-k messages with parity datagrams (xor or rs) from which receivers rebuild lost ones")
+	fecK := flag.Int("fec-k", 8, "with -fec, messages per parity group")
+	fecR := flag.Int("fec-r", 2, "with -fec rs, parity datagrams per group (always 1 with xor)")
+	statusAddr := flag.String("status", "", "send progress reports to the bcasttop dashboard listening on this address")
+	statusInterval := flag.Duration("status-interval", 500*time.Millisecond, "with -status, time between two progress reports")
+	controlOn := flag.Bool("control", false, "accept commands (pause, resume, rate, status, reload, stop) from bcastcontrol on logs/node_<index>.sock")
+	controlPath := flag.String("control-socket", "", "with -control, the Unix socket to listen on instead")
+	topicList := flag.String("topics", "", "also broadcast on these comma-separated topics, name or name:count (default count: N), each logged to logs/node_<index>_topic_<name>_*.log")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: bcastnode [-capture file] [-bracha [-f n] [-secret s]] [-fragment [-payload file | -payload-size n]] [-snapshot-dir dir [-snapshot-initiator i] [-snapshot-after d]] [-anti-entropy [-ae-timeout d]] [-fec xor|rs [-fec-k k] [-fec-r r]] [-status addr [-status-interval d]] [-control [-control-socket path]] [-topics name[:count],...] <config_file> <node_index>\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	configPath := os.Args[1]
-	nodeIndex, err := strconv.Atoi(os.Args[2])
+	configPath := flag.Arg(0)
+	nodeIndex, err := strconv.Atoi(flag.Arg(1))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "invalid node index %q: %v\n", os.Args[2], err)
+		fmt.Fprintf(os.Stderr, "invalid node index %q: %v\n", flag.Arg(1), err)
 		os.Exit(1)
 	}
 
@@ -34,18 +69,159 @@ func main() {
 		os.Exit(1)
 	}
 
+	payload := randomPayload(bcast.PayloadSize)
+	if *fragment {
+		payload, err = fragmentPayload(*payloadFile, *payloadSize)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "payload error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	topics, err := parseTopics(*topicList, cfg.N)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "topics error: %v\n", err)
+		os.Exit(1)
+	}
+
 	lg, err := logger.NewMsgLogger(nodeIndex)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "logger error: %v\n", err)
 		os.Exit(1)
 	}
 	defer lg.Close()
+	perNode := cfg.N
+	for _, w := range topics {
+		if w.lg, err = logger.NewTopicLoggerDir("logs", nodeIndex, w.topic); err != nil {
+			fmt.Fprintf(os.Stderr, "logger error: %v\n", err)
+			os.Exit(1)
+		}
+		defer w.lg.Close()
+		perNode += w.n
+	}
+
+	// Reported to bcasttop with -status, and by the status command, over
+	// all topics.
+	st := status.NewCounters(nodeIndex, perNode, len(cfg.Nodes))
+
+	// The message log records corrupted payloads too, as FAIL lines.
+	opts := []bcast.Option{
+		bcast.WithUnverified(),
+		bcast.WithErrorHandler(func(err error) {
+			lg.LogError("%v", err)
+			st.Error()
+		}),
+	}
+	if *fragment {
+		opts = append(opts, bcast.WithReassemblyTimeout(*reasmTimeout))
+	} else {
+		opts = append(opts, bcast.WithFixedSizeMessages())
+	}
+	if *useBracha {
+		opts = append(opts, bcast.WithBracha([]byte(*secret), *faulty))
+	}
+	if *capturePath != "" {
+		f, err := os.Create(*capturePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "capture error: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		opts = append(opts, bcast.WithCapture(f))
+	}
+	snapshotAt := time.Duration(-1)
+	if *snapshotDir != "" {
+		opts = append(opts, bcast.WithSnapshots(func(s *bcast.Snapshot) {
+			if err := snapshot.WriteLocal(*snapshotDir, s); err != nil {
+				lg.LogError("%v", err)
+				st.Error()
+				return
+			}
+			fmt.Printf("Node %d: snapshot %d/%d recorded (complete=%v)\n", nodeIndex, s.Initiator, s.ID, s.Complete)
+		}, 0))
+		if nodeIndex == *snapshotInitiator {
+			snapshotAt = *snapshotAfter
+		}
+	}
+
+	var rec *recoveries
+	if *antiEntropy {
+		rec, err = newRecoveries(nodeIndex)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "logger error: %v\n", err)
+			os.Exit(1)
+		}
+		defer rec.Close()
+		opts = append(opts, bcast.WithAntiEntropy(0, rec.add))
+	}
 
-	n, err := node.NewNode(nodeIndex, cfg, lg)
+	if len(topics) > 0 {
+		names := make([]string, len(topics))
+		for i, w := range topics {
+			names[i] = w.topic
+		}
+		opts = append(opts, bcast.WithTopics(names...))
+	}
+	if *fecScheme != "" {
+		scheme, err := fec.ParseScheme(*fecScheme)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		if scheme == bcast.FECXOR {
+			*fecR = 1
+		}
+		opts = append(opts, bcast.WithFEC(scheme, *fecK, *fecR))
+	}
+
+	g, err := bcast.New(nodeIndex, peers(cfg), opts...)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "node error: %v\n", err)
 		os.Exit(1)
 	}
 
-	n.Run()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ctl := newController(ctx, g, configPath, cfg, st)
+	if *controlOn {
+		path := *controlPath
+		if path == "" {
+			path = control.SocketPath("logs", nodeIndex)
+		}
+		if err := ctl.listen(path); err != nil {
+			fmt.Fprintf(os.Stderr, "control error: %v\n", err)
+			os.Exit(1)
+		}
+		defer ctl.close()
+	}
+	var reporting sync.WaitGroup
+	rctx, stopReports := context.WithCancel(context.Background())
+	if *statusAddr != "" {
+		reporting.Add(1)
+		go func() {
+			defer reporting.Done()
+			if err := status.Send(rctx, *statusAddr, *statusInterval, st); err != nil {
+				fmt.Fprintf(os.Stderr, "status error: %v\n", err)
+			}
+		}()
+	}
+	work := append([]*workload{{n: cfg.N, lg: lg}}, topics...)
+	if err := run(ctx, g, work, payload, snapshotAt, rec, *aeTimeout, ctl); err != nil {
+		fmt.Fprintf(os.Stderr, "node error: %v\n", err)
+		st.Error()
+	}
+	st.Finish()
+	stopReports() // sends the final report
+	reporting.Wait()
+	if err := g.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "close error: %v\n", err)
+	}
+}
+
+func peers(cfg *config.Config) []string {
+	addrs := make([]string, len(cfg.Nodes))
+	for i, n := range cfg.Nodes {
+		addrs[i] = fmt.Sprintf("%s:%d", n.IP, n.Port)
+	}
+	return addrs
 }
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/bcast"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/logger"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/message"
+)
+
+const (
+	startupWait = 15 * time.Second // for all nodes to spin up
+	quietWait   = 5 * time.Second  // without deliveries after sending, before giving up
+	aeSettle    = time.Second      // after sending, before reconciling with the others
+	aeLinger    = time.Second      // after converging, so the others can still fetch from this node
+)
+
+// run is the homework experiment: wait for the other nodes, broadcast N
+// payloads, and log deliveries until all N*M arrived or, once sending is
+// done, none has arrived for quietWait. Unless snapshotAt is negative, the
+// node starts a snapshot that long after it starts broadcasting. With rec,
+// the node instead reconciles with the others once sending is done, until it
+// has all N*M and they agree or aeTimeout passes. Payloads rebuilt from FEC
+// parity are logged with a trailing "FEC". Sending is paced, and can be
+// stopped early, through ctl, which also counts progress. work[0] is the
+// default topic; the others, if any, are broadcast on concurrently and
+// count towards N*M with their own N.
+func run(ctx context.Context, g *bcast.Group, work []*workload, payload func(seq int) []byte, snapshotAt time.Duration,
+	rec *recoveries, aeTimeout time.Duration, ctl *controller) error {
+	if err := g.Start(ctx); err != nil {
+		return err
+	}
+	st := ctl.st
+	lg := work[0].lg
+	perNode := 0
+	logs := make(map[string]*workload, len(work))
+	for _, w := range work {
+		perNode += w.n
+		logs[w.topic] = w
+	}
+	N := work[0].n
+	total := perNode * g.Size()
+
+	fmt.Printf("Node %d: waiting %v before broadcasting...\n", g.Self(), startupWait)
+	select {
+	case <-time.After(startupWait):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	fmt.Printf("Node %d: starting broadcasts (N=%d, M=%d, total_expected=%d)\n", g.Self(), N, g.Size(), total)
+	sent := make(chan struct{})
+	var senders sync.WaitGroup
+	for _, w := range work {
+		senders.Add(1)
+		go func() {
+			defer senders.Done()
+			for i := 0; i < w.n; i++ {
+				if err := ctl.pacer.Wait(ctl.sending); err != nil {
+					fmt.Printf("Node %d: %sstopped sending after %d/%d broadcasts\n", g.Self(), w.label(), i, w.n)
+					break
+				}
+				if err := g.Publish(w.topic, payload(i)); err != nil {
+					w.lg.LogError("sendLoop: payload %d: %v", i, err)
+					st.Error()
+					continue
+				}
+				st.Sent()
+			}
+		}()
+	}
+	go func() {
+		senders.Wait()
+		close(sent)
+	}()
+	if snapshotAt >= 0 {
+		time.AfterFunc(snapshotAt, func() {
+			if _, err := g.InitiateSnapshot(); err != nil {
+				lg.LogError("snapshot: %v", err)
+				st.Error()
+			}
+		})
+	}
+
+	rebuilt := 0
+	defer func() {
+		if rebuilt > 0 {
+			fmt.Printf("Node %d: rebuilt %d lost messages from FEC parity\n", g.Self(), rebuilt)
+		}
+		for _, w := range work[1:] {
+			fmt.Printf("Node %d: %s%d/%d messages\n", g.Self(), w.label(), w.received, w.n*g.Size())
+		}
+	}()
+	sending := sent
+	var quiet, reconcile, giveUp <-chan time.Time
+	var converged <-chan time.Time // polls for convergence while reconciling
+	// total is recomputed every round: reload can add peers.
+	for received := 0; received < total || rec != nil; total = perNode * g.Size() {
+		select {
+		case d, ok := <-g.Deliver():
+			if !ok {
+				return ctx.Err()
+			}
+			w := logs[d.Topic]
+			if d.Recovered {
+				w.lg.LogRecovered(d.Verified, uint8(d.From), d.SentSHA1, d.CalcSHA1)
+				rebuilt++
+			} else {
+				w.lg.LogMessage(d.Verified, uint8(d.From), d.SentSHA1, d.CalcSHA1)
+			}
+			w.received++
+			received++
+			st.Delivered(d.From, d.Verified)
+			if sending == nil && rec == nil {
+				quiet = time.After(quietWait)
+			}
+		case <-sending:
+			sending = nil
+			if ctl.sending.Err() != nil && ctx.Err() == nil {
+				fmt.Printf("Node %d: stopped by command with %d/%d messages\n", g.Self(), received, total)
+				return nil
+			}
+			if rec != nil {
+				reconcile = time.After(aeSettle)
+			} else {
+				quiet = time.After(quietWait)
+			}
+		case <-quiet:
+			fmt.Printf("Node %d: no traffic for %v, giving up with %d/%d messages\n", g.Self(), quietWait, received, total)
+			return nil
+		case <-reconcile:
+			reconcile = nil
+			fmt.Printf("Node %d: reconciling with %d/%d messages\n", g.Self(), received, total)
+			if err := g.StartAntiEntropy(); err != nil {
+				return err
+			}
+			giveUp = time.After(aeTimeout)
+			tick := time.NewTicker(50 * time.Millisecond)
+			defer tick.Stop()
+			converged = tick.C
+		case <-converged:
+			if received < total || !g.Converged() {
+				continue
+			}
+			fmt.Printf("Node %d: converged with %d/%d messages; %s\n", g.Self(), received, total, rec.report())
+			time.Sleep(aeLinger)
+			return nil
+		case <-giveUp:
+			fmt.Printf("Node %d: not converged after %v, giving up with %d/%d messages; %s\n", g.Self(), aeTimeout, received, total, rec.report())
+			return nil
+		}
+	}
+	<-sent
+	fmt.Printf("Node %d: done\n", g.Self())
+	return nil
+}
+
+// workload is one topic's part of the experiment: n broadcasts per node,
+// logged to files of its own.
+type workload struct {
+	topic    string // "" for the homework's default topic
+	n        int
+	lg       *logger.MsgLogger
+	received int // owned by run's receive loop
+}
+
+// label names a named topic at the start of a progress line.
+func (w *workload) label() string {
+	if w.topic == "" {
+		return ""
+	}
+	return "topic " + w.topic + ": "
+}
+
+// parseTopics parses the -topics list: comma-separated names, each
+// optionally followed by ":count", the broadcasts per node on that topic
+// (default n).
+func parseTopics(list string, n int) ([]*workload, error) {
+	if list == "" {
+		return nil, nil
+	}
+	var work []*workload
+	seen := map[string]bool{}
+	for _, item := range strings.Split(list, ",") {
+		name, countStr, hasCount := strings.Cut(strings.TrimSpace(item), ":")
+		w := &workload{topic: name, n: n}
+		if hasCount {
+			count, err := strconv.Atoi(countStr)
+			if err != nil || count < 0 {
+				return nil, fmt.Errorf("topic %q: invalid count %q", name, countStr)
+			}
+			w.n = count
+		}
+		if err := message.CheckTopic(name); err != nil {
+			return nil, err
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("topic %q repeated", name)
+		}
+		seen[name] = true
+		work = append(work, w)
+	}
+	return work, nil
+}
+
+// fragmentPayload broadcasts the file at path if given, otherwise fresh random
+// payloads of size bytes.
+func fragmentPayload(path string, size int) (func(int) []byte, error) {
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > bcast.MaxPayload {
+			return nil, fmt.Errorf("%s is %d bytes, more than %d", path, len(data), bcast.MaxPayload)
+		}
+		return func(int) []byte { return data }, nil
+	}
+	if size < 0 || size > bcast.MaxPayload {
+		return nil, fmt.Errorf("payload size %d out of range [0, %d]", size, bcast.MaxPayload)
+	}
+	return randomPayload(size), nil
+}
+
+func randomPayload(size int) func(int) []byte {
+	return func(int) []byte {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(rand.IntN(256))
+		}
+		return data
+	}
+}
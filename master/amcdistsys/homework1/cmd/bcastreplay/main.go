@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/bracha"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/capture"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/config"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/logger"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/message"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/node"
+)
+
+// bcastreplay feeds a capture recorded by `bcastnode -capture` back through
+// message parsing, SHA-1 verification and the logger, regenerating the node's
+// message log, and the log of every topic it received, without any network
+// traffic.
+func main() {
+	logsDir := flag.String("logs", "replay", "directory to write the regenerated logs to")
+	dump := flag.Bool("dump", false, "print every captured datagram (sent and received) to stdout")
+	useBracha := flag.Bool("bracha", false, "the capture was recorded in -bracha mode (requires -config)")
+	configPath := flag.String("config", "", "config file of the run, needed by -bracha and -anti-entropy for the node count")
+	faulty := flag.Int("f", -1, "-f value the nodes were started with")
+	secret := flag.String("secret", "amcdistsys", "-secret value the nodes were started with")
+	fragment := flag.Bool("fragment", false, "the capture was recorded in -fragment mode: reassemble the payloads")
+	reasmTimeout := flag.Duration("reassembly-timeout", 10*time.Second, "with -fragment, -reassembly-timeout value the node was started with")
+	antiEntropy := flag.Bool("anti-entropy", false, "the capture was recorded with -anti-entropy: drop duplicates and replay the repaired messages (requires -config)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: bcastreplay [-logs dir] [-dump] [-bracha -config file [-f n] [-secret s]] [-fragment [-reassembly-timeout d]] [-anti-entropy -config file] <capture_file>\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *useBracha && *antiEntropy {
+		fmt.Fprintf(os.Stderr, "-anti-entropy cannot be combined with -bracha\n")
+		os.Exit(1)
+	}
+
+	r, err := capture.Open(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "capture error: %v\n", err)
+		os.Exit(1)
+	}
+	defer r.Close()
+
+	lg, err := logger.NewMsgLoggerDir(*logsDir, r.NodeIndex())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "logger error: %v\n", err)
+		os.Exit(1)
+	}
+	defer lg.Close()
+
+	// In Bracha mode the received frames are fed through a fresh protocol
+	// instance; its outgoing frames are dropped, but since the node's own
+	// ECHO/READY frames came back over loopback they are in the capture too.
+	var proc *bracha.Process
+	var nodes int
+	if *useBracha || *antiEntropy {
+		cfg, err := config.ParseConfig(*configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "config error: %v\n", err)
+			os.Exit(1)
+		}
+		nodes = len(cfg.Nodes)
+	}
+	if *useBracha {
+		keys, err := bracha.DeriveKeyring([]byte(*secret), r.NodeIndex(), nodes)
+		if err == nil {
+			f := *faulty
+			if f < 0 {
+				f = bracha.MaxFaulty(nodes)
+			}
+			proc, err = bracha.NewProcess(keys, f)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "bracha error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// In fragment mode the units are fragments, reassembled on the capture's
+	// clock: a payload is given up once its first fragment is older than the
+	// timeout, as it was by the node. With anti-entropy the node waited for
+	// the missing fragments to be repaired instead, until it stopped.
+	// Each topic has its own log and reassembly, as in the node; the default
+	// one comes first.
+	byDefault := &stream{lg: lg}
+	streams := []*stream{byDefault}
+	topics := map[string]*stream{}
+	if *fragment {
+		byDefault.reasm = message.NewReassembler(*reasmTimeout)
+	}
+
+	// With anti-entropy the node accepted each valid datagram once, whether
+	// it arrived directly or in a REPAIR message.
+	var seen receipts
+	if *antiEntropy {
+		seen = receipts{}
+	}
+
+	var sent, received, malformed, incomplete, markers, parity, recovered, duplicates int
+	var first, last time.Time
+	expire := func(now time.Time) {
+		for _, st := range streams {
+			for _, inc := range st.reasm.Expire(now) {
+				lg.LogError("receiveLoop: %spayload %d from node %d incomplete: %d/%d fragments after %v",
+					st.prefix(), inc.ID, inc.Sender, inc.Have, inc.Total, inc.Age.Round(time.Millisecond))
+				incomplete++
+			}
+		}
+	}
+	for i := 0; ; i++ {
+		rec, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// A truncated tail is expected when the node was killed; keep what we have.
+			lg.LogError("bcastreplay: record %d: %v", i, err)
+			fmt.Fprintf(os.Stderr, "stopping at record %d: %v\n", i, err)
+			break
+		}
+		if first.IsZero() {
+			first = rec.Time
+		}
+		last = rec.Time
+		if *fragment && seen == nil {
+			expire(rec.Time)
+		}
+
+		if *dump {
+			fmt.Printf("%s %s %v %d bytes\n", rec.Time.Format(time.RFC3339Nano), rec.Dir, rec.Peer, len(rec.Data))
+		}
+		if rec.Dir == capture.Sent {
+			sent++
+			continue
+		}
+		received++
+		st, data := byDefault, rec.Data
+		if message.IsTopic(data) {
+			name, unit, err := message.UnwrapTopic(data)
+			if err != nil {
+				lg.LogError("receiveLoop: %v", err)
+				malformed++
+				continue
+			}
+			if st = topics[name]; st == nil {
+				tlg, err := logger.NewTopicLoggerDir(*logsDir, r.NodeIndex(), name)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "logger error: %v\n", err)
+					os.Exit(1)
+				}
+				defer tlg.Close()
+				st = &stream{name: name, lg: tlg}
+				if *fragment {
+					st.reasm = message.NewReassembler(*reasmTimeout)
+				}
+				topics[name] = st
+				streams = append(streams, st)
+			}
+			data = unit
+		}
+		if message.IsMarker(data) {
+			// A -snapshot-dir run's Chandy-Lamport markers carry no message.
+			markers++
+			continue
+		}
+		if node.IsParity(data) {
+			// A -fec run's parity only matters for the messages UDP lost.
+			parity++
+			continue
+		}
+
+		payloads := [][]byte{data}
+		sources := []uint8{0}
+		repairedBy := -1
+		if node.IsAntiEntropy(data) {
+			if seen == nil {
+				fmt.Fprintf(os.Stderr, "unsupported capture mode: record %d is an anti-entropy datagram, replay with -anti-entropy\n", i)
+				os.Exit(1)
+			}
+			// Summaries, trees, digests and requests carry no message.
+			from, units, err := node.RepairedUnits(data, nodes)
+			if err != nil {
+				lg.LogError("receiveLoop: %v", err)
+				malformed++
+				continue
+			}
+			payloads, sources, repairedBy = units, make([]uint8, len(units)), from
+		} else if proc != nil {
+			payloads, sources = payloads[:0], sources[:0]
+			frame, err := bracha.ParseFrame(data)
+			if err == nil {
+				var delivered []bracha.Delivery
+				_, delivered, err = proc.Handle(frame)
+				for _, d := range delivered {
+					payloads = append(payloads, d.Payload)
+					sources = append(sources, d.ID.Origin)
+				}
+			}
+			if err != nil {
+				lg.LogError("brachaReceiveLoop: from %v: %v", rec.Peer, err)
+				malformed++
+				continue
+			}
+		}
+
+		for j, payload := range payloads {
+			if seen != nil {
+				fresh, valid := seen.first(payload, *fragment)
+				if repairedBy >= 0 && !valid {
+					lg.LogError("receiveLoop: node %d repaired with a corrupted datagram", repairedBy)
+					malformed++
+					continue
+				}
+				if !fresh {
+					duplicates++
+					continue
+				}
+				if repairedBy >= 0 {
+					recovered++
+				}
+			}
+			if *fragment {
+				p, err := acceptFragment(st.reasm, payload, rec.Time, proc != nil, sources[j])
+				switch {
+				case err != nil:
+					lg.LogError("receiveLoop: %v", err)
+					malformed++
+				case p != nil:
+					st.log(p.OK, p.Sender, p.SentHex, p.CalcHex)
+				}
+				continue
+			}
+			if _, err := message.ParseFragment(payload); err == nil {
+				// Random message bytes never make a consistent fragment header.
+				fmt.Fprintf(os.Stderr, "unsupported capture mode: record %d is a fragment, replay with -fragment\n", i)
+				os.Exit(1)
+			}
+			msg, err := message.ParseMessage(payload)
+			if err != nil {
+				lg.LogError("receiveLoop: parse: %v", err)
+				malformed++
+				continue
+			}
+			source := msg.SenderIndex()
+			if proc != nil {
+				source = sources[j] // authenticated origin, as logged by the node
+			}
+			sentHex, calcHex, verified := msg.Verify()
+			st.log(verified, source, sentHex, calcHex)
+		}
+	}
+
+	if *fragment {
+		// Anything still pending would never have completed.
+		expire(last.Add(*reasmTimeout + time.Nanosecond))
+	}
+
+	fmt.Printf("Node %d: replayed %d received / %d sent datagrams spanning %v\n",
+		r.NodeIndex(), received, sent, last.Sub(first))
+	ok, failed := 0, 0
+	for _, st := range streams {
+		ok, failed = ok+st.ok, failed+st.failed
+	}
+	fmt.Printf("Node %d: OK=%d FAIL=%d malformed=%d (logs in %s)\n",
+		r.NodeIndex(), ok, failed, malformed, *logsDir)
+	for _, st := range streams[1:] {
+		fmt.Printf("Node %d: topic %s: OK=%d FAIL=%d\n", r.NodeIndex(), st.name, st.ok, st.failed)
+	}
+	if *fragment {
+		fmt.Printf("Node %d: %d payloads incomplete\n", r.NodeIndex(), incomplete)
+	}
+	if seen != nil {
+		fmt.Printf("Node %d: recovered %d via anti-entropy, dropped %d duplicates\n", r.NodeIndex(), recovered, duplicates)
+	}
+	if parity > 0 {
+		fmt.Printf("Node %d: skipped %d FEC parity datagrams (the messages the node rebuilt from them are not replayed)\n", r.NodeIndex(), parity)
+	}
+	if markers > 0 {
+		fmt.Printf("Node %d: skipped %d snapshot markers\n", r.NodeIndex(), markers)
+	}
+}
+
+// stream is the replay of the default topic or of a named one.
+type stream struct {
+	name       string // "" for the default topic
+	lg         *logger.MsgLogger
+	reasm      *message.Reassembler // in -fragment mode
+	ok, failed int
+}
+
+// log records a delivered message, or payload, in the stream's message log.
+func (st *stream) log(ok bool, source uint8, sentHex, calcHex string) {
+	st.lg.LogMessage(ok, source, sentHex, calcHex)
+	if ok {
+		st.ok++
+	} else {
+		st.failed++
+	}
+}
+
+// prefix names a named topic at the start of an error line, as the node does.
+func (st *stream) prefix() string {
+	if st.name == "" {
+		return ""
+	}
+	return "topic " + st.name + ": "
+}
+
+// acceptFragment verifies one fragment and adds it to reasm, returning the
+// payload it completes, if any, like the node's receive loop. With Bracha,
+// origin is the authenticated sender of the broadcast it arrived through.
+func acceptFragment(reasm *message.Reassembler, unit []byte, now time.Time, useBracha bool, origin uint8) (*message.Payload, error) {
+	frag, err := message.ParseFragment(unit)
+	if err != nil {
+		return nil, err
+	}
+	if sentHex, calcHex, ok := frag.Verify(); !ok {
+		return nil, fmt.Errorf("fragment %d/%d of payload %d from node %d failed SHA-1 (%s != %s)",
+			frag.Index(), frag.Total(), frag.PayloadID(), frag.SenderIndex(), sentHex, calcHex)
+	}
+	if useBracha && origin != frag.SenderIndex() {
+		return nil, fmt.Errorf("node %d broadcast a fragment claiming to be from node %d", origin, frag.SenderIndex())
+	}
+	return reasm.Add(frag, now)
+}
+
+// receipts holds the SHA-1 of every valid datagram accepted with
+// anti-entropy.
+type receipts map[[sha1.Size]byte]bool
+
+// first reports whether unit is to be accepted, as the node's anti-entropy
+// did: a valid datagram once, a corrupted one every time it arrives directly
+// (and is logged as failed), so that it does not stop the genuine one from
+// being repaired.
+func (r receipts) first(unit []byte, fragment bool) (fresh, valid bool) {
+	if !validUnit(unit, fragment) {
+		return true, false
+	}
+	k := sha1.Sum(unit)
+	if r[k] {
+		return false, true
+	}
+	r[k] = true
+	return true, true
+}
+
+// validUnit reports whether unit is a message, or a fragment, whose SHA-1
+// matches.
+func validUnit(unit []byte, fragment bool) bool {
+	if fragment {
+		f, err := message.ParseFragment(unit)
+		if err != nil {
+			return false
+		}
+		_, _, ok := f.Verify()
+		return ok
+	}
+	m, err := message.ParseMessage(unit)
+	if err != nil {
+		return false
+	}
+	_, _, ok := m.Verify()
+	return ok
+}
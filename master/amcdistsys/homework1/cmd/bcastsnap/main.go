@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/snapshot"
+)
+
+// bcastsnap assembles the local Chandy-Lamport snapshots written by
+// `bcastnode -snapshot-dir` into one global snapshot file per snapshot, checks
+// that each is a consistent cut, and compares it with the final message logs.
+func main() {
+	logsDir := flag.String("logs", "logs", "directory with the message logs of the run (empty: skip the log check)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: bcastsnap [-logs dir] <snapshot_dir>\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	dir := flag.Arg(0)
+
+	globals, err := snapshot.Collect(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "snapshot error: %v\n", err)
+		os.Exit(1)
+	}
+	if len(globals) == 0 {
+		fmt.Fprintf(os.Stderr, "snapshot error: no local snapshots in %s\n", dir)
+		os.Exit(1)
+	}
+
+	bad := 0
+	for _, g := range globals {
+		path, err := snapshot.WriteGlobal(dir, g)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "snapshot error: %v\n", err)
+			os.Exit(1)
+		}
+		// Every local snapshot has one channel per node of the run.
+		m := len(g.Nodes[0].Channels)
+		problems := g.Validate(m)
+		if *logsDir != "" {
+			problems = append(problems, g.CheckLogs(*logsDir)...)
+		}
+
+		var delivered uint64
+		for _, l := range g.Nodes {
+			delivered += l.Delivered
+		}
+		fmt.Printf("Snapshot %d/%d: %d/%d nodes, %d delivered, %d in flight -> %s\n",
+			g.Initiator, g.ID, len(g.Nodes), m, delivered, g.InFlight(), path)
+		for _, p := range problems {
+			fmt.Printf("  %s\n", p)
+		}
+		if len(problems) == 0 {
+			fmt.Printf("  consistent\n")
+			continue
+		}
+		bad++
+	}
+	if bad > 0 {
+		fmt.Printf("%d of %d snapshots inconsistent\n", bad, len(globals))
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/status"
+)
+
+// A node whose latest report is older than this is shown as stale.
+const staleAfter = 3 * time.Second
+
+// ANSI escape sequences.
+const (
+	clearScreen = "\x1b[H\x1b[2J"
+	reset       = "\x1b[0m"
+	bold        = "\x1b[1m"
+	dim         = "\x1b[2m"
+	red         = "\x1b[41m\x1b[97m"
+	yellow      = "\x1b[43m\x1b[30m"
+	green       = "\x1b[42m\x1b[30m"
+)
+
+// bcasttop is a live dashboard of a running cluster: it listens for the
+// status datagrams of `bcastnode -status <addr>` and redraws, every refresh,
+// the progress of every node and a sender x receiver matrix of the share of
+// each sender's broadcasts that reached each receiver.
+func main() {
+	listen := flag.String("listen", "127.0.0.1:7070", "address to receive the nodes' status datagrams on")
+	refresh := flag.Duration("refresh", 500*time.Millisecond, "time between two redraws")
+	plain := flag.Bool("plain", false, "print each frame after the previous one, without colors or clearing the screen")
+	exitDone := flag.Bool("exit-when-done", false, "exit once every node of the cluster reported that it is done")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: bcasttop [-listen addr] [-refresh d] [-plain] [-exit-when-done]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	conn, err := net.ListenPacket("udp", *listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "listen error: %v\n", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+	board := status.NewBoard()
+	go func() {
+		if err := board.Serve(conn); err != nil {
+			fmt.Fprintf(os.Stderr, "receive error: %v\n", err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	t := time.NewTicker(*refresh)
+	defer t.Stop()
+	for {
+		var b strings.Builder
+		done := draw(&b, board, *listen, time.Now(), !*plain)
+		if *plain {
+			b.WriteString("\n")
+		} else {
+			os.Stdout.WriteString(clearScreen)
+		}
+		os.Stdout.WriteString(b.String())
+		if done && *exitDone {
+			return
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// draw renders one frame and reports whether every node of the cluster is
+// done.
+func draw(w io.Writer, board *status.Board, listen string, now time.Time, color bool) bool {
+	paint := func(style, s string) string {
+		if !color {
+			return s
+		}
+		return style + s + reset
+	}
+
+	rows := board.Rows()
+	m := board.Size()
+	fmt.Fprintf(w, "%s\n", paint(bold, fmt.Sprintf("bcasttop  %s  listening on %s  %d/%d nodes reporting",
+		now.Format("15:04:05"), listen, len(rows), m)))
+	if len(rows) == 0 {
+		fmt.Fprintf(w, "waiting for status datagrams (start the nodes with -status %s)\n", listen)
+		return false
+	}
+
+	fmt.Fprintf(w, "\n%-5s %-22s %-30s %7s %6s %6s %6s  %s\n", "NODE", "SENT", "RECEIVED", "OK", "FAIL", "LOSS", "ERRORS", "STATE")
+	done := len(rows) == m
+	for _, r := range rows {
+		total := r.N * r.M
+		state := "running"
+		switch {
+		case r.Done:
+			state = paint(green, "done")
+		case now.Sub(r.Seen) > staleAfter:
+			state = paint(yellow, fmt.Sprintf("stale %v", now.Sub(r.Seen).Round(time.Second)))
+		}
+		done = done && r.Done
+		fail := fmt.Sprintf("%6d", r.Fail)
+		if r.Fail > 0 {
+			fail = paint(red, fail)
+		}
+		fmt.Fprintf(w, "%-5d %-22s %-30s %7d %s %5.1f%% %6d  %s\n", r.Node,
+			fmt.Sprintf("%s %d/%d", bar(r.Sent, r.N, 8), r.Sent, r.N),
+			fmt.Sprintf("%s %d/%d", bar(r.Received, total, 12), r.Received, total),
+			r.OK, fail, 100*r.Loss, r.Errors, state)
+	}
+
+	fmt.Fprintf(w, "\n%s\n", paint(bold, "delivered, % of sent (rows: sender, columns: receiver)"))
+	fmt.Fprintf(w, "%6s", "")
+	for to := 0; to < m; to++ {
+		fmt.Fprintf(w, " %5d", to)
+	}
+	fmt.Fprintln(w)
+	for from := 0; from < m; from++ {
+		fmt.Fprintf(w, "%6d", from)
+		for to := 0; to < m; to++ {
+			frac, ok := board.Delivered(from, to)
+			if !ok {
+				fmt.Fprintf(w, " %5s", paint(dim, "    ."))
+				continue
+			}
+			cell := fmt.Sprintf("%5.1f", 100*frac)
+			switch {
+			case frac >= 0.99:
+				cell = paint(green, cell)
+			case frac >= 0.9:
+				cell = paint(yellow, cell)
+			default:
+				cell = paint(red, cell)
+			}
+			fmt.Fprintf(w, " %s", cell)
+		}
+		fmt.Fprintln(w)
+	}
+	if done {
+		fmt.Fprintf(w, "\nall %d nodes done\n", m)
+	}
+	return done
+}
+
+// bar draws n/total as a progress bar of width cells.
+func bar(n, total, width int) string {
+	filled := width
+	if total > 0 && n < total {
+		filled = n * width / total
+	}
+	return "[" + strings.Repeat("#", filled) + strings.Repeat(".", width-filled) + "]"
+}
@@ -0,0 +1,387 @@
+package bracha
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"testing"
+)
+
+var testSecret = []byte("test-secret")
+
+func testKeyring(t *testing.T, self, n int) *Keyring {
+	t.Helper()
+	k, err := DeriveKeyring(testSecret, self, n)
+	if err != nil {
+		t.Fatalf("DeriveKeyring: %v", err)
+	}
+	return k
+}
+
+// --- Harness: in-memory network with random delivery order ---
+
+type envelope struct {
+	to    int
+	frame *Frame
+}
+
+// cluster runs n nodes, the ones listed in byzantine being fake. Frames are
+// delivered one at a time in an order chosen by a seeded RNG, and every frame
+// is eventually delivered (reliable but asynchronous links).
+type cluster struct {
+	t         *testing.T
+	n, f      int
+	rng       *rand.Rand
+	procs     []*Process // nil for Byzantine nodes
+	keys      []*Keyring
+	queue     []envelope
+	delivered []map[ID][]byte
+}
+
+func newCluster(t *testing.T, n, f int, seed uint64, byzantine ...int) *cluster {
+	c := &cluster{
+		t:         t,
+		n:         n,
+		f:         f,
+		rng:       rand.New(rand.NewPCG(seed, seed^0x9e3779b97f4a7c15)),
+		procs:     make([]*Process, n),
+		keys:      make([]*Keyring, n),
+		delivered: make([]map[ID][]byte, n),
+	}
+	isByz := map[int]bool{}
+	for _, b := range byzantine {
+		isByz[b] = true
+	}
+	for i := 0; i < n; i++ {
+		c.keys[i] = testKeyring(t, i, n)
+		c.delivered[i] = map[ID][]byte{}
+		if isByz[i] {
+			continue
+		}
+		p, err := NewProcess(c.keys[i], f)
+		if err != nil {
+			t.Fatalf("NewProcess: %v", err)
+		}
+		c.procs[i] = p
+	}
+	return c
+}
+
+func (c *cluster) sendAll(fr *Frame) {
+	for to := 0; to < c.n; to++ {
+		c.queue = append(c.queue, envelope{to: to, frame: fr})
+	}
+}
+
+// sendTo queues a frame signed by a Byzantine node for a single recipient.
+func (c *cluster) sendTo(from, to int, t Type, id ID, payload []byte) {
+	fr := &Frame{Type: t, Origin: id.Origin, Seq: id.Seq, Payload: payload}
+	if err := c.keys[from].Sign(fr); err != nil {
+		c.t.Fatalf("sign: %v", err)
+	}
+	c.queue = append(c.queue, envelope{to: to, frame: fr})
+}
+
+// run delivers queued frames in random order until the network is quiet.
+func (c *cluster) run() {
+	for len(c.queue) > 0 {
+		i := c.rng.IntN(len(c.queue))
+		env := c.queue[i]
+		c.queue[i] = c.queue[len(c.queue)-1]
+		c.queue = c.queue[:len(c.queue)-1]
+
+		p := c.procs[env.to]
+		if p == nil {
+			continue // Byzantine nodes ignore protocol traffic
+		}
+		out, dels, err := p.Handle(env.frame)
+		if err != nil {
+			c.t.Fatalf("node %d: Handle: %v", env.to, err)
+		}
+		for _, fr := range out {
+			c.sendAll(fr)
+		}
+		for _, d := range dels {
+			if _, dup := c.delivered[env.to][d.ID]; dup {
+				c.t.Fatalf("node %d delivered %v twice", env.to, d.ID)
+			}
+			c.delivered[env.to][d.ID] = d.Payload
+		}
+	}
+}
+
+// checkAgreement asserts that every correct node delivered the same payload
+// for id, or that none of them delivered anything. Returns the payload, if any.
+func (c *cluster) checkAgreement(id ID) []byte {
+	c.t.Helper()
+	var first []byte
+	deliveredBy, correct := 0, 0
+	for i, p := range c.procs {
+		if p == nil {
+			continue
+		}
+		correct++
+		got, ok := c.delivered[i][id]
+		if !ok {
+			continue
+		}
+		deliveredBy++
+		if first == nil {
+			first = got
+		} else if !bytes.Equal(first, got) {
+			c.t.Fatalf("agreement violated for %v: node %d delivered a different payload", id, i)
+		}
+	}
+	if deliveredBy != 0 && deliveredBy != correct {
+		c.t.Fatalf("totality violated for %v: %d of %d correct nodes delivered", id, deliveredBy, correct)
+	}
+	return first
+}
+
+// --- Validity: a correct broadcaster's payload is delivered by every correct node ---
+
+func TestProcess_CorrectSenderDelivers(t *testing.T) {
+	for _, tc := range []struct{ n, f int }{{1, 0}, {4, 1}, {7, 2}, {10, 3}} {
+		t.Run(fmt.Sprintf("n=%d,f=%d", tc.n, tc.f), func(t *testing.T) {
+			// The last f nodes are Byzantine and stay silent.
+			var byz []int
+			for i := tc.n - tc.f; i < tc.n; i++ {
+				byz = append(byz, i)
+			}
+			c := newCluster(t, tc.n, tc.f, 1, byz...)
+			payload := []byte("hello bracha")
+			fr, err := c.procs[0].Broadcast(payload)
+			if err != nil {
+				t.Fatalf("Broadcast: %v", err)
+			}
+			c.sendAll(fr)
+			c.run()
+
+			got := c.checkAgreement(fr.ID())
+			if !bytes.Equal(got, payload) {
+				t.Fatalf("expected every correct node to deliver %q, got %q", payload, got)
+			}
+		})
+	}
+}
+
+// --- Agreement under an equivocating broadcaster ---
+// The Byzantine origin sends a randomly chosen payload to each node and, in
+// half of the schedules, the Byzantine nodes back each recipient's payload with
+// matching ECHO and READY frames. Over many random schedules, correct nodes
+// must never deliver different payloads.
+
+func TestProcess_EquivocatingSender(t *testing.T) {
+	for _, tc := range []struct{ n, f int }{{4, 1}, {7, 2}} {
+		t.Run(fmt.Sprintf("n=%d,f=%d", tc.n, tc.f), func(t *testing.T) {
+			delivered, none := 0, 0
+			for seed := uint64(0); seed < 100; seed++ {
+				// Nodes 0..f-1 are Byzantine; node 0 is the origin.
+				var byz []int
+				for i := 0; i < tc.f; i++ {
+					byz = append(byz, i)
+				}
+				c := newCluster(t, tc.n, tc.f, seed, byz...)
+				id := ID{Origin: 0, Seq: 7}
+				a, b := []byte("payload A"), []byte("payload B")
+
+				for to := 0; to < tc.n; to++ {
+					v := a
+					if c.rng.IntN(2) == 0 {
+						v = b
+					}
+					c.sendTo(0, to, Initial, id, v)
+					if seed%2 == 0 {
+						continue // equivocate on INITIAL only
+					}
+					for _, faulty := range byz {
+						// Byzantine helpers vote for whatever this recipient was told.
+						c.sendTo(faulty, to, Echo, id, v)
+						c.sendTo(faulty, to, Ready, id, v)
+					}
+				}
+				c.run()
+
+				if c.checkAgreement(id) != nil {
+					delivered++
+				} else {
+					none++
+				}
+			}
+			t.Logf("%d schedules delivered one payload everywhere, %d delivered nothing", delivered, none)
+		})
+	}
+}
+
+// --- A Byzantine node cannot vote twice or for two payloads ---
+
+func TestProcess_DuplicateVotesIgnored(t *testing.T) {
+	c := newCluster(t, 4, 1, 1, 3)
+	id := ID{Origin: 3, Seq: 0}
+	// Node 3 sends two conflicting READYs to node 0; only the first counts,
+	// so node 0 must not reach the f+1 amplification threshold on its own.
+	c.sendTo(3, 0, Ready, id, []byte("x"))
+	c.sendTo(3, 0, Ready, id, []byte("x"))
+	c.sendTo(3, 0, Ready, id, []byte("y"))
+	for len(c.queue) > 0 {
+		env := c.queue[0]
+		c.queue = c.queue[1:]
+		out, dels, err := c.procs[0].Handle(env.frame)
+		if err != nil {
+			t.Fatalf("Handle: %v", err)
+		}
+		if len(out) != 0 || len(dels) != 0 {
+			t.Fatalf("single faulty node triggered %d frames / %d deliveries", len(out), len(dels))
+		}
+	}
+}
+
+// --- Memory: delivered broadcasts are dropped, far-ahead ones refused ---
+
+func TestProcess_BoundedInstances(t *testing.T) {
+	c := newCluster(t, 4, 1, 1)
+	for range 10 {
+		fr, err := c.procs[0].Broadcast([]byte("v"))
+		if err != nil {
+			t.Fatalf("Broadcast: %v", err)
+		}
+		c.sendAll(fr)
+	}
+	c.run()
+	for i, p := range c.procs {
+		if w := p.origins[0]; len(p.instances) != 0 || w.floor != 10 || len(w.delivered) != 0 {
+			t.Errorf("node %d keeps %d instances and %d delivered seqs above floor %d", i, len(p.instances), len(w.delivered), w.floor)
+		}
+	}
+
+	p := c.procs[1]
+	frame := func(seq uint32) *Frame {
+		fr := &Frame{Type: Echo, Origin: 0, Seq: seq, Payload: []byte("v")}
+		if err := c.keys[3].Sign(fr); err != nil {
+			t.Fatalf("sign: %v", err)
+		}
+		return fr
+	}
+	// A late frame for a delivered broadcast is ignored.
+	if out, dels, err := p.Handle(frame(3)); len(out) != 0 || len(dels) != 0 || err != nil || len(p.instances) != 0 {
+		t.Errorf("late ECHO: %d frames, %d deliveries, %v, %d instances", len(out), len(dels), err, len(p.instances))
+	}
+	// A Byzantine node can open broadcasts up to the window, not beyond it.
+	if _, _, err := p.Handle(frame(10 + maxWindow - 1)); err != nil {
+		t.Errorf("ECHO at the end of the window: %v", err)
+	}
+	if _, _, err := p.Handle(frame(10 + maxWindow)); err == nil {
+		t.Error("expected error for an ECHO past the window")
+	}
+	if len(p.instances) != 1 {
+		t.Errorf("%d instances, want 1", len(p.instances))
+	}
+}
+
+// --- Signatures: frames cannot be forged or tampered with ---
+
+func TestProcess_RejectsForgedFrame(t *testing.T) {
+	keys := testKeyring(t, 0, 4)
+	p, _ := NewProcess(keys, 1)
+
+	// Node 3 signs a frame, then claims it came from node 1.
+	forger := testKeyring(t, 3, 4)
+	fr := &Frame{Type: Echo, Origin: 2, Seq: 0, Payload: []byte("v")}
+	forger.Sign(fr)
+	fr.From = 1
+	if _, _, err := p.Handle(fr); err == nil {
+		t.Error("expected error for frame with forged sender")
+	}
+
+	// Tampered payload.
+	fr = &Frame{Type: Echo, Origin: 2, Seq: 0, Payload: []byte("v")}
+	forger.Sign(fr)
+	fr.Payload = []byte("w")
+	if _, _, err := p.Handle(fr); err == nil {
+		t.Error("expected error for tampered payload")
+	}
+
+	// Keys derived from a different secret.
+	other, _ := DeriveKeyring([]byte("other"), 3, 4)
+	fr = &Frame{Type: Echo, Origin: 2, Seq: 0, Payload: []byte("v")}
+	other.Sign(fr)
+	if _, _, err := p.Handle(fr); err == nil {
+		t.Error("expected error for frame signed with an unknown key")
+	}
+}
+
+func TestProcess_RejectsInitialFromNonOrigin(t *testing.T) {
+	p, _ := NewProcess(testKeyring(t, 0, 4), 1)
+	fr := &Frame{Type: Initial, Origin: 2, Seq: 0, Payload: []byte("v")}
+	testKeyring(t, 3, 4).Sign(fr)
+	if _, _, err := p.Handle(fr); err == nil {
+		t.Error("expected error for INITIAL relayed by a node other than the origin")
+	}
+}
+
+func TestNewProcess_RequiresThreeFPlusOne(t *testing.T) {
+	if _, err := NewProcess(testKeyring(t, 0, 3), 1); err == nil {
+		t.Error("expected error for n=3, f=1")
+	}
+	if _, err := NewProcess(testKeyring(t, 0, 4), 1); err != nil {
+		t.Errorf("n=4, f=1 should be accepted: %v", err)
+	}
+	if MaxFaulty(4) != 1 || MaxFaulty(6) != 1 || MaxFaulty(7) != 2 {
+		t.Error("MaxFaulty mismatch")
+	}
+}
+
+// --- Wire format ---
+
+func TestFrame_MarshalParseRoundTrip(t *testing.T) {
+	keys := testKeyring(t, 2, 4)
+	fr := &Frame{Type: Ready, Origin: 1, Seq: 123456, Payload: bytes.Repeat([]byte{0xAB}, MaxPayload)}
+	if err := keys.Sign(fr); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	buf, err := fr.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if len(buf) != MaxFrameLen {
+		t.Errorf("frame length %d, expected %d", len(buf), MaxFrameLen)
+	}
+	got, err := ParseFrame(buf)
+	if err != nil {
+		t.Fatalf("ParseFrame: %v", err)
+	}
+	if got.Type != fr.Type || got.Origin != fr.Origin || got.Seq != fr.Seq || got.From != 2 || !bytes.Equal(got.Payload, fr.Payload) {
+		t.Errorf("round-trip mismatch: %+v", got)
+	}
+	if err := keys.Verify(got); err != nil {
+		t.Errorf("Verify after round-trip: %v", err)
+	}
+}
+
+func TestParseFrame_Malformed(t *testing.T) {
+	keys := testKeyring(t, 0, 1)
+	fr := &Frame{Type: Echo, Payload: []byte("abc")}
+	keys.Sign(fr)
+	good, _ := fr.Marshal()
+
+	cases := map[string][]byte{
+		"empty":     nil,
+		"short":     good[:10],
+		"truncated": good[:len(good)-1],
+		"bad magic": append([]byte{0x00}, good[1:]...),
+		"bad type":  append([]byte{good[0], 9}, good[2:]...),
+		"plain msg": make([]byte, 1024),
+	}
+	for name, buf := range cases {
+		if _, err := ParseFrame(buf); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestFrame_MarshalUnsigned(t *testing.T) {
+	fr := &Frame{Type: Echo}
+	if _, err := fr.Marshal(); err == nil {
+		t.Error("expected error marshalling an unsigned frame")
+	}
+}
@@ -0,0 +1,136 @@
+package bracha
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Type is the kind of a Bracha protocol frame.
+type Type uint8
+
+const (
+	Initial Type = iota + 1 // broadcaster -> all: the value itself
+	Echo                    // all -> all: "I saw this value from the broadcaster"
+	Ready                   // all -> all: "enough nodes saw this value"
+)
+
+func (t Type) String() string {
+	switch t {
+	case Initial:
+		return "INITIAL"
+	case Echo:
+		return "ECHO"
+	case Ready:
+		return "READY"
+	default:
+		return "Type(" + strconv.Itoa(int(t)) + ")"
+	}
+}
+
+// Wire layout (integers big-endian):
+//
+//	magic (1) | type (1) | origin (1) | seq (4) | from (1) | payload len (2) | payload | ed25519 signature (64)
+//
+// The signature is made by node `from` over every preceding byte.
+const (
+	frameMagic  = 0xBB
+	headerSize  = 1 + 1 + 1 + 4 + 1 + 2
+	MaxPayload  = 1024
+	MaxFrameLen = headerSize + MaxPayload + ed25519.SignatureSize
+)
+
+// Frame is a single signed Bracha protocol message.
+type Frame struct {
+	Type    Type
+	Origin  uint8  // index of the node that started the broadcast
+	Seq     uint32 // per-origin broadcast sequence number
+	From    uint8  // index of the node that sent (and signed) this frame
+	Payload []byte
+	Sig     []byte
+}
+
+// ID identifies one broadcast instance.
+type ID struct {
+	Origin uint8
+	Seq    uint32
+}
+
+func (f *Frame) ID() ID {
+	return ID{Origin: f.Origin, Seq: f.Seq}
+}
+
+// Digest is the SHA-256 of a payload; frames for the same instance are only
+// counted together when their digests match.
+type Digest [sha256.Size]byte
+
+func digestOf(payload []byte) Digest {
+	return sha256.Sum256(payload)
+}
+
+// signedPart serialises everything covered by the signature.
+func (f *Frame) signedPart() ([]byte, error) {
+	if len(f.Payload) > MaxPayload {
+		return nil, fmt.Errorf("bracha: payload of %d bytes exceeds %d", len(f.Payload), MaxPayload)
+	}
+	buf := make([]byte, headerSize+len(f.Payload), headerSize+len(f.Payload)+ed25519.SignatureSize)
+	buf[0] = frameMagic
+	buf[1] = byte(f.Type)
+	buf[2] = f.Origin
+	binary.BigEndian.PutUint32(buf[3:7], f.Seq)
+	buf[7] = f.From
+	binary.BigEndian.PutUint16(buf[8:10], uint16(len(f.Payload)))
+	copy(buf[headerSize:], f.Payload)
+	return buf, nil
+}
+
+// Sign sets f.Sig using the private key of node f.From.
+func (f *Frame) Sign(key ed25519.PrivateKey) error {
+	body, err := f.signedPart()
+	if err != nil {
+		return err
+	}
+	f.Sig = ed25519.Sign(key, body)
+	return nil
+}
+
+// Marshal returns the wire encoding of a signed frame.
+func (f *Frame) Marshal() ([]byte, error) {
+	if len(f.Sig) != ed25519.SignatureSize {
+		return nil, errors.New("bracha: frame is not signed")
+	}
+	body, err := f.signedPart()
+	if err != nil {
+		return nil, err
+	}
+	return append(body, f.Sig...), nil
+}
+
+// ParseFrame decodes a wire frame. It does not check the signature; see Keyring.Verify.
+func ParseFrame(buf []byte) (*Frame, error) {
+	if len(buf) < headerSize+ed25519.SignatureSize {
+		return nil, fmt.Errorf("ParseFrame: short frame of %d bytes", len(buf))
+	}
+	if buf[0] != frameMagic {
+		return nil, fmt.Errorf("ParseFrame: bad magic %#x", buf[0])
+	}
+	f := &Frame{
+		Type:   Type(buf[1]),
+		Origin: buf[2],
+		Seq:    binary.BigEndian.Uint32(buf[3:7]),
+		From:   buf[7],
+	}
+	if f.Type < Initial || f.Type > Ready {
+		return nil, fmt.Errorf("ParseFrame: unknown type %d", buf[1])
+	}
+	plen := int(binary.BigEndian.Uint16(buf[8:10]))
+	if plen > MaxPayload || len(buf) != headerSize+plen+ed25519.SignatureSize {
+		return nil, fmt.Errorf("ParseFrame: payload length %d does not match frame of %d bytes", plen, len(buf))
+	}
+	f.Payload = append([]byte(nil), buf[headerSize:headerSize+plen]...)
+	f.Sig = append([]byte(nil), buf[headerSize+plen:]...)
+	return f, nil
+}
@@ -0,0 +1,83 @@
+package bracha
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// Keyring holds the public keys of every node and the private key of this node.
+type Keyring struct {
+	self int
+	priv ed25519.PrivateKey
+	pubs []ed25519.PublicKey
+}
+
+// NewKeyring builds a keyring for node self from its private key and the
+// public keys of all nodes (index = node index).
+func NewKeyring(self int, priv ed25519.PrivateKey, pubs []ed25519.PublicKey) (*Keyring, error) {
+	if self < 0 || self >= len(pubs) {
+		return nil, fmt.Errorf("NewKeyring: node index %d out of range [0, %d)", self, len(pubs))
+	}
+	if len(priv) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("NewKeyring: bad private key size %d", len(priv))
+	}
+	return &Keyring{self: self, priv: priv, pubs: pubs}, nil
+}
+
+// DeriveKeyring deterministically derives the key pairs of all n nodes from a
+// shared secret and returns the keyring of node self.
+//
+// This is meant for lab setups where every node is started from the same
+// config: anyone holding the secret can derive every private key, so it only
+// protects against nodes that do not know it (e.g. spoofed UDP datagrams).
+// Use NewKeyring with separately distributed keys for anything stronger.
+func DeriveKeyring(secret []byte, self, n int) (*Keyring, error) {
+	pubs := make([]ed25519.PublicKey, n)
+	var priv ed25519.PrivateKey
+	for i := 0; i < n; i++ {
+		key := ed25519.NewKeyFromSeed(deriveSeed(secret, i))
+		pubs[i] = key.Public().(ed25519.PublicKey)
+		if i == self {
+			priv = key
+		}
+	}
+	return NewKeyring(self, priv, pubs)
+}
+
+func deriveSeed(secret []byte, index int) []byte {
+	h := sha256.New()
+	h.Write([]byte("bracha-node-key"))
+	var idx [4]byte
+	binary.BigEndian.PutUint32(idx[:], uint32(index))
+	h.Write(idx[:])
+	h.Write(secret)
+	return h.Sum(nil)
+}
+
+// Size returns the number of nodes in the keyring.
+func (k *Keyring) Size() int {
+	return len(k.pubs)
+}
+
+// Sign signs f as this node, overwriting f.From.
+func (k *Keyring) Sign(f *Frame) error {
+	f.From = uint8(k.self)
+	return f.Sign(k.priv)
+}
+
+// Verify checks that f was signed by node f.From.
+func (k *Keyring) Verify(f *Frame) error {
+	if int(f.From) >= len(k.pubs) {
+		return fmt.Errorf("bracha: frame from unknown node %d", f.From)
+	}
+	body, err := f.signedPart()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(k.pubs[f.From], body, f.Sig) {
+		return fmt.Errorf("bracha: bad signature on %v frame from node %d", f.Type, f.From)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package bracha
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Delivery is a payload accepted by reliable broadcast.
+type Delivery struct {
+	ID      ID
+	Payload []byte
+}
+
+// Process is the Bracha reliable-broadcast state machine of a single node.
+// It is transport-agnostic: Broadcast and Handle return the frames that must
+// be sent to every node (including this one), and the caller moves bytes.
+//
+// With n >= 3f+1 nodes of which at most f are Byzantine, it guarantees that
+// all correct nodes deliver the same payload for a given (origin, seq), or
+// none of them does, even if the origin equivocates.
+type Process struct {
+	mu        sync.Mutex
+	keys      *Keyring
+	n, f      int
+	nextSeq   uint32
+	instances map[ID]*instance // only the undelivered ones
+	origins   []originWindow   // origins[i] is what is left of origin i's delivered broadcasts
+}
+
+// maxWindow bounds the broadcasts of one origin a Process tracks, from its
+// oldest undelivered seq on. Frames further ahead are rejected, so that a
+// Byzantine node cannot make the instances grow without bound.
+const maxWindow = 4096
+
+// originWindow is what a Process remembers of the delivered broadcasts of one
+// origin, so that late frames for them are ignored: every seq below floor, and
+// the seqs in delivered above it. The floor moves up as the seqs below it are
+// delivered, so the memory needed stays bounded.
+type originWindow struct {
+	floor     uint32
+	delivered map[uint32]bool
+}
+
+func (w *originWindow) isDelivered(seq uint32) bool {
+	return seq < w.floor || w.delivered[seq]
+}
+
+func (w *originWindow) deliver(seq uint32) {
+	w.delivered[seq] = true
+	for w.delivered[w.floor] {
+		delete(w.delivered, w.floor)
+		w.floor++
+	}
+}
+
+// instance tracks one broadcast (origin, seq) until it is delivered.
+type instance struct {
+	echoed    bool
+	readied   bool
+	echoFrom  map[uint8]bool // first ECHO per sender is the only one counted
+	readyFrom map[uint8]bool // first READY per sender is the only one counted
+	echoes    map[Digest]int
+	readies   map[Digest]int
+}
+
+// NewProcess creates the state machine for the keyring's node, tolerating f faulty nodes.
+func NewProcess(keys *Keyring, f int) (*Process, error) {
+	n := keys.Size()
+	if f < 0 || n < 3*f+1 {
+		return nil, fmt.Errorf("NewProcess: need n >= 3f+1, got n=%d f=%d", n, f)
+	}
+	p := &Process{keys: keys, n: n, f: f, instances: make(map[ID]*instance), origins: make([]originWindow, n)}
+	for i := range p.origins {
+		p.origins[i].delivered = make(map[uint32]bool)
+	}
+	return p, nil
+}
+
+// MaxFaulty returns the largest f tolerated by n nodes.
+func MaxFaulty(n int) int {
+	return (n - 1) / 3
+}
+
+// echoThreshold is ceil((n+f+1)/2): two such quorums intersect in a correct node,
+// so no two different payloads can both gather enough echoes.
+func (p *Process) echoThreshold() int {
+	return (p.n + p.f + 2) / 2
+}
+
+// Broadcast starts a new broadcast of payload and returns the signed INITIAL
+// frame to send to all nodes.
+func (p *Process) Broadcast(payload []byte) (*Frame, error) {
+	p.mu.Lock()
+	seq := p.nextSeq
+	p.nextSeq++
+	p.mu.Unlock()
+
+	f := &Frame{Type: Initial, Origin: uint8(p.keys.self), Seq: seq, Payload: payload}
+	if err := p.keys.Sign(f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Handle processes a received frame. It returns the frames to send to all
+// nodes and the payloads that became deliverable. Frames with a bad signature
+// or that violate the protocol are rejected with an error, and so are frames
+// for a broadcast more than maxWindow ahead of its origin's oldest undelivered
+// one. Frames for a broadcast already delivered are ignored.
+func (p *Process) Handle(f *Frame) (out []*Frame, delivered []Delivery, err error) {
+	if int(f.Origin) >= p.n {
+		return nil, nil, fmt.Errorf("bracha: frame for unknown origin %d", f.Origin)
+	}
+	if err := p.keys.Verify(f); err != nil {
+		return nil, nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	w := &p.origins[f.Origin]
+	if w.isDelivered(f.Seq) {
+		return nil, nil, nil
+	}
+	if f.Seq-w.floor >= maxWindow {
+		return nil, nil, fmt.Errorf("bracha: seq %d of origin %d is %d or more ahead of its oldest undelivered one", f.Seq, f.Origin, maxWindow)
+	}
+	inst := p.instances[f.ID()]
+	if inst == nil {
+		inst = &instance{
+			echoFrom:  make(map[uint8]bool),
+			readyFrom: make(map[uint8]bool),
+			echoes:    make(map[Digest]int),
+			readies:   make(map[Digest]int),
+		}
+		p.instances[f.ID()] = inst
+	}
+	d := digestOf(f.Payload)
+
+	switch f.Type {
+	case Initial:
+		if f.From != f.Origin {
+			return nil, nil, fmt.Errorf("bracha: INITIAL for origin %d sent by node %d", f.Origin, f.From)
+		}
+		if !inst.echoed {
+			inst.echoed = true
+			out = append(out, p.reply(Echo, f))
+		}
+
+	case Echo:
+		if inst.echoFrom[f.From] {
+			return nil, nil, nil
+		}
+		inst.echoFrom[f.From] = true
+		inst.echoes[d]++
+		if inst.echoes[d] >= p.echoThreshold() && !inst.readied {
+			inst.readied = true
+			out = append(out, p.reply(Ready, f))
+		}
+
+	case Ready:
+		if inst.readyFrom[f.From] {
+			return nil, nil, nil
+		}
+		inst.readyFrom[f.From] = true
+		inst.readies[d]++
+		// Amplification: f+1 READYs mean at least one correct node is ready.
+		if inst.readies[d] >= p.f+1 && !inst.readied {
+			inst.readied = true
+			out = append(out, p.reply(Ready, f))
+		}
+		if inst.readies[d] >= 2*p.f+1 {
+			// The READY above was sent already, which is all the
+			// other nodes still need from this one.
+			w.deliver(f.Seq)
+			delete(p.instances, f.ID())
+			delivered = append(delivered, Delivery{ID: f.ID(), Payload: f.Payload})
+		}
+
+	default:
+		return nil, nil, fmt.Errorf("bracha: unknown frame type %v", f.Type)
+	}
+
+	return out, delivered, nil
+}
+
+// reply builds and signs a frame of type t for the same instance and payload as f.
+func (p *Process) reply(t Type, f *Frame) *Frame {
+	r := &Frame{Type: t, Origin: f.Origin, Seq: f.Seq, Payload: f.Payload}
+	// Cannot fail: f's payload size was already checked by Verify.
+	_ = p.keys.Sign(r)
+	return r
+}
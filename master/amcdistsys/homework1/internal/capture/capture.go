@@ -0,0 +1,234 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Direction tells whether a captured datagram was sent or received by the node.
+type Direction uint8
+
+const (
+	Received Direction = 'R'
+	Sent     Direction = 'S'
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Received:
+		return "RECV"
+	case Sent:
+		return "SEND"
+	default:
+		return fmt.Sprintf("Direction(%d)", uint8(d))
+	}
+}
+
+// File layout (all integers big-endian):
+//
+//	header: magic "BCAP" | version (1) | node index (2)
+//	record: direction (1) | unix nanos (8) | IPv4 (4) | port (2) | length (2) | data
+const (
+	magic         = "BCAP"
+	version       = 1
+	headerSize    = len(magic) + 1 + 2
+	recordHdrSize = 1 + 8 + 4 + 2 + 2
+	maxDataSize   = 1<<16 - 1
+)
+
+// Record is a single captured datagram.
+type Record struct {
+	Dir  Direction
+	Time time.Time
+	Peer *net.UDPAddr // destination for Sent, source for Received (nil if unknown)
+	Data []byte
+}
+
+// Writer appends records to a capture stream. It is safe for concurrent use,
+// so the send and receive loops of a node can share one Writer.
+type Writer struct {
+	mu  sync.Mutex
+	w   *bufio.Writer
+	f   *os.File // nil when wrapping an arbitrary io.Writer
+	hdr [recordHdrSize]byte
+	now func() time.Time
+}
+
+// Create creates (or truncates) the capture file at path and writes its header.
+// Caller must call Close() when done.
+func Create(path string, nodeIndex int) (*Writer, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("capture.Create: %w", err)
+	}
+	w, err := NewWriter(f, nodeIndex)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	w.f = f
+	return w, nil
+}
+
+// NewWriter writes the capture header for nodeIndex to dst and returns a Writer.
+func NewWriter(dst io.Writer, nodeIndex int) (*Writer, error) {
+	if nodeIndex < 0 || nodeIndex > 0xFFFF {
+		return nil, fmt.Errorf("capture.NewWriter: node index %d out of range", nodeIndex)
+	}
+	w := &Writer{w: bufio.NewWriter(dst), now: time.Now}
+	var hdr [headerSize]byte
+	copy(hdr[:], magic)
+	hdr[len(magic)] = version
+	binary.BigEndian.PutUint16(hdr[len(magic)+1:], uint16(nodeIndex))
+	if _, err := w.w.Write(hdr[:]); err != nil {
+		return nil, fmt.Errorf("capture.NewWriter: write header: %w", err)
+	}
+	return w, nil
+}
+
+// Record captures data with the current time.
+func (w *Writer) Record(dir Direction, peer *net.UDPAddr, data []byte) error {
+	return w.Write(Record{Dir: dir, Time: w.now(), Peer: peer, Data: data})
+}
+
+// Write appends rec to the capture stream.
+func (w *Writer) Write(rec Record) error {
+	if len(rec.Data) > maxDataSize {
+		return fmt.Errorf("capture.Write: datagram of %d bytes exceeds %d", len(rec.Data), maxDataSize)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	h := w.hdr[:]
+	clear(h)
+	h[0] = byte(rec.Dir)
+	binary.BigEndian.PutUint64(h[1:9], uint64(rec.Time.UnixNano()))
+	if rec.Peer != nil {
+		if ip4 := rec.Peer.IP.To4(); ip4 != nil {
+			copy(h[9:13], ip4)
+		}
+		binary.BigEndian.PutUint16(h[13:15], uint16(rec.Peer.Port))
+	}
+	binary.BigEndian.PutUint16(h[15:17], uint16(len(rec.Data)))
+
+	if _, err := w.w.Write(h); err != nil {
+		return fmt.Errorf("capture.Write: %w", err)
+	}
+	if _, err := w.w.Write(rec.Data); err != nil {
+		return fmt.Errorf("capture.Write: %w", err)
+	}
+	return nil
+}
+
+// Close flushes buffered records and closes the underlying file, if any.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.w.Flush()
+	if w.f != nil {
+		if cerr := w.f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("capture.Close: %w", err)
+	}
+	return nil
+}
+
+// Reader iterates over the records of a capture stream.
+type Reader struct {
+	r         *bufio.Reader
+	f         *os.File
+	nodeIndex int
+}
+
+// Open opens the capture file at path and validates its header.
+// Caller must call Close() when done.
+func Open(path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("capture.Open: %w", err)
+	}
+	r, err := NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r.f = f
+	return r, nil
+}
+
+// NewReader reads and validates the capture header from src.
+func NewReader(src io.Reader) (*Reader, error) {
+	r := &Reader{r: bufio.NewReader(src)}
+	var hdr [headerSize]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("capture.NewReader: read header: %w", err)
+	}
+	if string(hdr[:len(magic)]) != magic {
+		return nil, fmt.Errorf("capture.NewReader: bad magic %q", hdr[:len(magic)])
+	}
+	if hdr[len(magic)] != version {
+		return nil, fmt.Errorf("capture.NewReader: unsupported version %d", hdr[len(magic)])
+	}
+	r.nodeIndex = int(binary.BigEndian.Uint16(hdr[len(magic)+1:]))
+	return r, nil
+}
+
+// NodeIndex returns the index of the node that produced the capture.
+func (r *Reader) NodeIndex() int {
+	return r.nodeIndex
+}
+
+// Next returns the next record, or io.EOF once the stream is exhausted.
+// A record cut short (e.g. the node was killed mid-write) yields io.ErrUnexpectedEOF.
+func (r *Reader) Next() (Record, error) {
+	var h [recordHdrSize]byte
+	if _, err := io.ReadFull(r.r, h[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return Record{}, io.EOF
+		}
+		return Record{}, fmt.Errorf("capture.Next: read record header: %w", err)
+	}
+
+	dir := Direction(h[0])
+	if dir != Received && dir != Sent {
+		return Record{}, fmt.Errorf("capture.Next: unknown direction %#x", h[0])
+	}
+	rec := Record{
+		Dir:  dir,
+		Time: time.Unix(0, int64(binary.BigEndian.Uint64(h[1:9]))),
+		Data: make([]byte, binary.BigEndian.Uint16(h[15:17])),
+	}
+	ip := net.IP(h[9:13])
+	port := int(binary.BigEndian.Uint16(h[13:15]))
+	if !ip.Equal(net.IPv4zero) || port != 0 {
+		rec.Peer = &net.UDPAddr{IP: net.IPv4(ip[0], ip[1], ip[2], ip[3]), Port: port}
+	}
+
+	if _, err := io.ReadFull(r.r, rec.Data); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return Record{}, fmt.Errorf("capture.Next: read %d data bytes: %w", len(rec.Data), err)
+	}
+	return rec, nil
+}
+
+// Close closes the underlying file, if any.
+func (r *Reader) Close() error {
+	if r.f == nil {
+		return nil
+	}
+	return r.f.Close()
+}
@@ -0,0 +1,140 @@
+package capture
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// --- Round-trip: records written are read back identically ---
+
+func TestWriterReader_RoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, 7)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+
+	peer := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5001}
+	ts := time.Unix(1700000000, 123456789)
+	want := []Record{
+		{Dir: Sent, Time: ts, Peer: peer, Data: []byte("hello")},
+		{Dir: Received, Time: ts.Add(time.Millisecond), Peer: peer, Data: bytes.Repeat([]byte{0xAB}, 1024)},
+		{Dir: Received, Time: ts.Add(2 * time.Millisecond), Peer: nil, Data: []byte{}},
+	}
+	for _, rec := range want {
+		if err := w.Write(rec); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	if r.NodeIndex() != 7 {
+		t.Errorf("node index: expected 7, got %d", r.NodeIndex())
+	}
+	for i, exp := range want {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if got.Dir != exp.Dir {
+			t.Errorf("record %d: dir %v, expected %v", i, got.Dir, exp.Dir)
+		}
+		if !got.Time.Equal(exp.Time) {
+			t.Errorf("record %d: time %v, expected %v", i, got.Time, exp.Time)
+		}
+		if !bytes.Equal(got.Data, exp.Data) {
+			t.Errorf("record %d: data mismatch", i)
+		}
+		if exp.Peer == nil {
+			if got.Peer != nil {
+				t.Errorf("record %d: expected nil peer, got %v", i, got.Peer)
+			}
+		} else if got.Peer == nil || got.Peer.String() != exp.Peer.String() {
+			t.Errorf("record %d: peer %v, expected %v", i, got.Peer, exp.Peer)
+		}
+	}
+	if _, err := r.Next(); !errors.Is(err, io.EOF) {
+		t.Errorf("expected io.EOF after last record, got %v", err)
+	}
+}
+
+// --- A record cut short (node killed mid-write) is reported, not silently dropped ---
+
+func TestReader_TruncatedRecord(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := NewWriter(&buf, 0)
+	w.Write(Record{Dir: Received, Time: time.Now(), Data: make([]byte, 1024)})
+	w.Close()
+
+	truncated := buf.Bytes()[:buf.Len()-10]
+	r, err := NewReader(bytes.NewReader(truncated))
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+	_, err = r.Next()
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestNewReader_BadMagic(t *testing.T) {
+	_, err := NewReader(bytes.NewReader([]byte("PCAP\x01\x00\x00")))
+	if err == nil {
+		t.Fatal("expected error for bad magic")
+	}
+}
+
+func TestNewReader_Empty(t *testing.T) {
+	_, err := NewReader(bytes.NewReader(nil))
+	if err == nil {
+		t.Fatal("expected error for empty stream")
+	}
+}
+
+func TestWriter_RejectsOversizedDatagram(t *testing.T) {
+	w, _ := NewWriter(io.Discard, 0)
+	err := w.Record(Sent, nil, make([]byte, maxDataSize+1))
+	if err == nil {
+		t.Fatal("expected error for oversized datagram")
+	}
+}
+
+// --- Create/Open work with files on disk ---
+
+func TestCreateOpen_File(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "node_2.bcap")
+	w, err := Create(p, 2)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := w.Record(Sent, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6000}, []byte{1, 2, 3}); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	r, err := Open(p)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer r.Close()
+	rec, err := r.Next()
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if rec.Dir != Sent || rec.Peer.String() != "10.0.0.1:6000" || !bytes.Equal(rec.Data, []byte{1, 2, 3}) {
+		t.Errorf("unexpected record: %+v", rec)
+	}
+}
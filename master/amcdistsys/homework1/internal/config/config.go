@@ -3,6 +3,7 @@ package config
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"strconv"
 	"strings"
@@ -19,7 +20,8 @@ type Config struct {
 }
 
 // ParseConfig reads the config file and returns a Config.
-// First line: N (number of broadcasts). Remaining lines: IP PORT.
+// First line: N (number of broadcasts, not negative). Remaining lines: IP PORT,
+// with PORT in 1-65535 and no address listed twice.
 // Lines starting with '#' or empty lines are ignored after the first line.
 func ParseConfig(path string) (*Config, error) {
 	f, err := os.Open(path)
@@ -27,18 +29,29 @@ func ParseConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("ParseConfig: open %q: %w", path, err)
 	}
 	defer f.Close()
+	return parse(f)
+}
 
-	scanner := bufio.NewScanner(f)
+// parse reads a config in the file format from r.
+func parse(r io.Reader) (*Config, error) {
+	scanner := bufio.NewScanner(r)
 
 	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("ParseConfig: scan: %w", err)
+		}
 		return nil, fmt.Errorf("ParseConfig: empty config file")
 	}
 	n, err := strconv.Atoi(strings.TrimSpace(scanner.Text()))
 	if err != nil {
 		return nil, fmt.Errorf("ParseConfig: invalid N %q: %w", scanner.Text(), err)
 	}
+	if n < 0 {
+		return nil, fmt.Errorf("ParseConfig: negative N %d", n)
+	}
 
 	cfg := &Config{N: n}
+	seen := map[NodeAddr]int{}
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
 		// strip inline comments
@@ -56,7 +69,15 @@ func ParseConfig(path string) (*Config, error) {
 		if err != nil {
 			return nil, fmt.Errorf("ParseConfig: invalid port %q: %w", parts[1], err)
 		}
-		cfg.Nodes = append(cfg.Nodes, NodeAddr{IP: parts[0], Port: port})
+		if port < 1 || port > 65535 {
+			return nil, fmt.Errorf("ParseConfig: port %d out of range 1-65535", port)
+		}
+		addr := NodeAddr{IP: parts[0], Port: port}
+		if i, ok := seen[addr]; ok {
+			return nil, fmt.Errorf("ParseConfig: %s %d listed for nodes %d and %d", addr.IP, addr.Port, i, len(cfg.Nodes))
+		}
+		seen[addr] = len(cfg.Nodes)
+		cfg.Nodes = append(cfg.Nodes, addr)
 	}
 	if err := scanner.Err(); err != nil {
 		return nil, fmt.Errorf("ParseConfig: scan: %w", err)
@@ -66,3 +87,13 @@ func ParseConfig(path string) (*Config, error) {
 	}
 	return cfg, nil
 }
+
+// String returns the config in the file format, which ParseConfig reads back.
+func (c *Config) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d\n", c.N)
+	for _, n := range c.Nodes {
+		fmt.Fprintf(&b, "%s %d\n", n.IP, n.Port)
+	}
+	return b.String()
+}
@@ -3,6 +3,8 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -130,6 +132,45 @@ func TestParseConfig_MalformedLine(t *testing.T) {
 	}
 }
 
+func TestParseConfig_NegativeN(t *testing.T) {
+	p := writeTempConfig(t, "-1\n127.0.0.1 5000\n")
+	if _, err := ParseConfig(p); err == nil {
+		t.Fatal("expected error for negative N")
+	}
+}
+
+func TestParseConfig_PortOutOfRange(t *testing.T) {
+	for _, port := range []string{"0", "-5000", "65536", "99999999"} {
+		p := writeTempConfig(t, "10\n127.0.0.1 "+port+"\n")
+		if _, err := ParseConfig(p); err == nil {
+			t.Errorf("expected error for port %s", port)
+		}
+	}
+	p := writeTempConfig(t, "10\n127.0.0.1 1\n127.0.0.1 65535\n")
+	if _, err := ParseConfig(p); err != nil {
+		t.Errorf("ports 1 and 65535: %v", err)
+	}
+}
+
+func TestParseConfig_DuplicateAddress(t *testing.T) {
+	p := writeTempConfig(t, "10\n127.0.0.1 5000\n127.0.0.1 5001\n127.0.0.1 5000\n")
+	if _, err := ParseConfig(p); err == nil {
+		t.Fatal("expected error for an address listed twice")
+	}
+}
+
+func TestParseConfig_ExtraFields(t *testing.T) {
+	// Fields after the port are ignored, as they always were.
+	p := writeTempConfig(t, "10\n127.0.0.1 5000 extra\n")
+	cfg, err := ParseConfig(p)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.Nodes) != 1 || cfg.Nodes[0] != (NodeAddr{IP: "127.0.0.1", Port: 5000}) {
+		t.Errorf("nodes = %+v", cfg.Nodes)
+	}
+}
+
 func TestParseConfig_FileNotFound(t *testing.T) {
 	_, err := ParseConfig("/nonexistent/path/config.txt")
 	if err == nil {
@@ -160,3 +201,54 @@ func TestParseConfig_NodeIndexMatchesLineOrder(t *testing.T) {
 		}
 	}
 }
+
+// --- String writes the file format back ---
+
+func TestConfig_StringRoundTrip(t *testing.T) {
+	cfg := &Config{N: 7, Nodes: []NodeAddr{{"10.0.0.1", 6000}, {"localhost", 6001}}}
+	got, err := ParseConfig(writeTempConfig(t, cfg.String()))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got, cfg) {
+		t.Errorf("round-trip: got %+v, want %+v", got, cfg)
+	}
+}
+
+// --- Fuzzing: arbitrary config text (seed corpus in testdata/fuzz) ---
+
+func FuzzParseConfig(f *testing.F) {
+	f.Add("5\n127.0.0.1 5000\n127.0.0.1 5001\n127.0.0.1 5002\n")
+	f.Fuzz(func(t *testing.T, text string) {
+		cfg, err := parse(strings.NewReader(text))
+		if err != nil {
+			return
+		}
+		if cfg.N < 0 {
+			t.Errorf("accepted negative N %d", cfg.N)
+		}
+		if len(cfg.Nodes) == 0 {
+			t.Error("accepted a config without nodes")
+		}
+		seen := map[NodeAddr]bool{}
+		for i, n := range cfg.Nodes {
+			if n.Port < 1 || n.Port > 65535 {
+				t.Errorf("node %d: accepted port %d", i, n.Port)
+			}
+			if n.IP == "" || strings.ContainsAny(n.IP, " \t\n#") {
+				t.Errorf("node %d: accepted IP %q", i, n.IP)
+			}
+			if seen[n] {
+				t.Errorf("node %d: accepted duplicate address %+v", i, n)
+			}
+			seen[n] = true
+		}
+		again, err := parse(strings.NewReader(cfg.String()))
+		if err != nil {
+			t.Fatalf("String() of an accepted config does not parse: %v\n%s", err, cfg)
+		}
+		if !reflect.DeepEqual(again, cfg) {
+			t.Errorf("round-trip: got %+v, want %+v", again, cfg)
+		}
+	})
+}
@@ -0,0 +1,245 @@
+// Package control steers a running node through a local Unix domain socket:
+// a client connects, writes one command line ("rate 200") and reads the
+// reply, which starts with "ok" or "error: ".
+package control
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ioTimeout bounds how long a client may take to send its command or read
+// the reply.
+const ioTimeout = 5 * time.Second
+
+// Handler runs one command with its arguments and returns its output.
+type Handler func(args []string) (string, error)
+
+// Server accepts commands on a Unix domain socket.
+type Server struct {
+	ln       net.Listener
+	handlers map[string]Handler
+	wg       sync.WaitGroup
+}
+
+// Listen creates the socket at path, replacing a stale one left by a node
+// that did not shut down cleanly, and serves the given commands on it once
+// Serve is called. "help" lists them.
+func Listen(path string, handlers map[string]Handler) (*Server, error) {
+	if _, err := os.Stat(path); err == nil {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("Listen: %s is in use by a running node", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("Listen: remove stale socket: %w", err)
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("Listen: %w", err)
+	}
+	s := &Server{ln: ln, handlers: map[string]Handler{}}
+	for name, h := range handlers {
+		s.handlers[name] = h
+	}
+	s.handlers["help"] = s.help
+	return s, nil
+}
+
+// Serve answers clients until Close, one command per connection.
+func (s *Server) Serve() error {
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("Serve: %w", err)
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.answer(c)
+		}()
+	}
+}
+
+// Close removes the socket and waits for the commands being run.
+func (s *Server) Close() error {
+	err := s.ln.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) answer(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(ioTimeout))
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		fmt.Fprintf(c, "error: empty command\n")
+		return
+	}
+	h := s.handlers[fields[0]]
+	if h == nil {
+		fmt.Fprintf(c, "error: unknown command %q (try help)\n", fields[0])
+		return
+	}
+	out, err := h(fields[1:])
+	if err != nil {
+		fmt.Fprintf(c, "error: %v\n", err)
+		return
+	}
+	fmt.Fprintf(c, "ok\n%s", out)
+	if out != "" && !strings.HasSuffix(out, "\n") {
+		fmt.Fprintln(c)
+	}
+}
+
+func (s *Server) help([]string) (string, error) {
+	names := make([]string, 0, len(s.handlers))
+	for name := range s.handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, "\n"), nil
+}
+
+// Send runs command on the node serving the socket at path and returns its
+// output. A command the node rejected is returned as an error.
+func Send(path, command string) (string, error) {
+	c, err := net.DialTimeout("unix", path, ioTimeout)
+	if err != nil {
+		return "", fmt.Errorf("Send: %w", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(ioTimeout))
+	if _, err := fmt.Fprintf(c, "%s\n", command); err != nil {
+		return "", fmt.Errorf("Send: %w", err)
+	}
+	reply, err := io.ReadAll(c)
+	if err != nil {
+		return "", fmt.Errorf("Send: %w", err)
+	}
+	status, out, _ := strings.Cut(string(reply), "\n")
+	switch {
+	case status == "ok":
+		return out, nil
+	case strings.HasPrefix(status, "error: "):
+		return "", errors.New(strings.TrimPrefix(status, "error: "))
+	}
+	return "", fmt.Errorf("Send: malformed reply %q", status)
+}
+
+// Pacer paces a send loop: Wait blocks while paused and, under a rate limit,
+// until the next send is due. It is safe for concurrent use.
+type Pacer struct {
+	mu       sync.Mutex
+	paused   bool
+	interval time.Duration // between two sends; 0 for no limit
+	next     time.Time     // earliest time of the next send
+	changed  chan struct{} // closed, and replaced, on every change
+}
+
+// NewPacer returns a running pacer without a rate limit.
+func NewPacer() *Pacer {
+	return &Pacer{changed: make(chan struct{})}
+}
+
+// Wait returns once the next send may go, or ctx's error once it is done.
+func (p *Pacer) Wait(ctx context.Context) error {
+	for {
+		p.mu.Lock()
+		changed := p.changed
+		var timer *time.Timer
+		var wait <-chan time.Time
+		switch now := time.Now(); {
+		case p.paused:
+		case p.interval == 0:
+			p.mu.Unlock()
+			return nil
+		case !p.next.After(now):
+			p.next = now.Add(p.interval)
+			p.mu.Unlock()
+			return nil
+		default:
+			timer = time.NewTimer(p.next.Sub(now))
+			wait = timer.C
+		}
+		p.mu.Unlock()
+		select {
+		case <-changed:
+		case <-wait:
+		case <-ctx.Done():
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// Pause holds Wait until Resume.
+func (p *Pacer) Pause() {
+	p.update(func() { p.paused = true })
+}
+
+// Resume lets Wait return again.
+func (p *Pacer) Resume() {
+	p.update(func() { p.paused = false })
+}
+
+// SetRate limits sends to perSecond per second; 0 removes the limit.
+func (p *Pacer) SetRate(perSecond float64) error {
+	if perSecond < 0 {
+		return fmt.Errorf("SetRate: negative rate %v", perSecond)
+	}
+	p.update(func() {
+		p.interval = 0
+		if perSecond > 0 {
+			p.interval = time.Duration(float64(time.Second) / perSecond)
+		}
+		p.next = time.Time{}
+	})
+	return nil
+}
+
+// State returns whether the pacer is paused and its rate per second (0 when
+// unlimited).
+func (p *Pacer) State() (paused bool, perSecond float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.interval > 0 {
+		perSecond = float64(time.Second) / float64(p.interval)
+	}
+	return p.paused, perSecond
+}
+
+func (p *Pacer) update(fn func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fn()
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// SocketPath returns the default control socket of node index, in dir.
+func SocketPath(dir string, index int) string {
+	return filepath.Join(dir, fmt.Sprintf("node_%d.sock", index))
+}
@@ -0,0 +1,133 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func serve(t *testing.T, path string, handlers map[string]Handler) *Server {
+	t.Helper()
+	s, err := Listen(path, handlers)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go s.Serve()
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// --- Commands over the Unix socket ---
+
+func TestServer_Commands(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.sock")
+	serve(t, path, map[string]Handler{
+		"echo": func(args []string) (string, error) { return strings.Join(args, " "), nil },
+		"fail": func([]string) (string, error) { return "", errors.New("not now") },
+	})
+
+	if out, err := Send(path, "echo a  b"); err != nil || out != "a b\n" {
+		t.Errorf("echo: %q, %v", out, err)
+	}
+	if _, err := Send(path, "fail"); err == nil || err.Error() != "not now" {
+		t.Errorf("fail: expected the handler's error, got %v", err)
+	}
+	if _, err := Send(path, "reboot"); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Errorf("reboot: expected unknown command, got %v", err)
+	}
+	if _, err := Send(path, ""); err == nil {
+		t.Error("expected error for an empty command")
+	}
+	if out, err := Send(path, "help"); err != nil || out != "echo\nfail\nhelp\n" {
+		t.Errorf("help: %q, %v", out, err)
+	}
+}
+
+func TestListen_ReplacesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.sock")
+	// A socket file nobody listens on, as left by a killed node.
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("stale socket not left behind: %v", err)
+	}
+
+	s := serve(t, path, nil)
+	if _, err := Listen(path, nil); err == nil {
+		t.Error("expected error for a socket in use")
+	}
+	s.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket not removed on Close: %v", err)
+	}
+}
+
+// --- Pacing the send loop ---
+
+func TestPacer_PauseResume(t *testing.T) {
+	p := NewPacer()
+	if err := p.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait: %v", err)
+	}
+	p.Pause()
+	returned := make(chan error, 1)
+	go func() { returned <- p.Wait(context.Background()) }()
+	select {
+	case <-returned:
+		t.Fatal("Wait returned while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	p.Resume()
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Fatalf("Wait: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wait still blocked after Resume")
+	}
+
+	p.Pause()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := p.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Wait on a done context: %v", err)
+	}
+}
+
+func TestPacer_Rate(t *testing.T) {
+	p := NewPacer()
+	if err := p.SetRate(-1); err == nil {
+		t.Error("expected error for a negative rate")
+	}
+	if err := p.SetRate(100); err != nil {
+		t.Fatalf("SetRate: %v", err)
+	}
+	if paused, rate := p.State(); paused || rate != 100 {
+		t.Errorf("State = %v, %v; want false, 100", paused, rate)
+	}
+	start := time.Now()
+	for i := 0; i < 11; i++ {
+		p.Wait(context.Background())
+	}
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Errorf("11 sends at 100/s took %v, want at least 100ms", d)
+	}
+	p.SetRate(0)
+	start = time.Now()
+	for i := 0; i < 1000; i++ {
+		p.Wait(context.Background())
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("1000 unlimited sends took %v", d)
+	}
+}
@@ -0,0 +1,556 @@
+package election
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/node"
+)
+
+// Algorithm selects how a leader is chosen.
+type Algorithm int
+
+const (
+	// Bully elects the highest-indexed live node: a node that notices the
+	// leader is gone challenges every higher node and takes over if none answers.
+	Bully Algorithm = iota
+	// Raft elects whichever candidate first collects the votes of a majority,
+	// after randomized timeouts; terms fence off stale leaders.
+	Raft
+)
+
+func (a Algorithm) String() string {
+	switch a {
+	case Bully:
+		return "bully"
+	case Raft:
+		return "raft"
+	}
+	return fmt.Sprintf("Algorithm(%d)", int(a))
+}
+
+// ParseAlgorithm parses "bully" or "raft".
+func ParseAlgorithm(s string) (Algorithm, error) {
+	switch strings.ToLower(s) {
+	case "bully":
+		return Bully, nil
+	case "raft":
+		return Raft, nil
+	}
+	return 0, fmt.Errorf("ParseAlgorithm: unknown algorithm %q (want bully or raft)", s)
+}
+
+// Role is a node's part in the current term.
+type Role int
+
+const (
+	Follower Role = iota
+	Candidate
+	Leader
+)
+
+func (r Role) String() string {
+	switch r {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// State is a node's view of the election. Leader is -1 while unknown.
+type State struct {
+	Leader int
+	Term   uint64
+	Role   Role
+}
+
+// Options configures an Elector.
+type Options struct {
+	Algorithm Algorithm
+	// ElectionTimeout is how long a follower waits for the leader's heartbeat
+	// before starting an election (Raft draws each timeout from
+	// [ElectionTimeout, 2*ElectionTimeout)), and how long a Bully candidate
+	// waits for answers. Defaults to 500ms.
+	ElectionTimeout time.Duration
+	// Heartbeat is the interval at which the leader announces itself.
+	// Defaults to ElectionTimeout/5.
+	Heartbeat time.Duration
+	// Log receives one line per election event; nil discards them.
+	Log io.Writer
+}
+
+const defaultElectionTimeout = 500 * time.Millisecond
+
+// Elector runs leader elections among the nodes of a config, addressed by
+// their index in config.Config.Nodes, over a node transport.
+type Elector struct {
+	self      int
+	n         int
+	transport node.Transport
+	opts      Options
+	log       *log.Logger
+
+	mu    sync.Mutex
+	state State
+
+	// Owned by the event loop.
+	votedFor int          // Raft: candidate voted for in the current term, -1 if none
+	votes    map[int]bool // Raft: votes received as candidate
+	electing bool         // Bully: election in progress
+	answered bool         // Bully: a higher node answered our challenge
+	timer    *time.Timer
+
+	cancel    context.CancelFunc
+	stopped   chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// New creates the Elector of node self in a cluster of n nodes. The elector
+// takes ownership of t.
+func New(self, n int, t node.Transport, opts Options) (*Elector, error) {
+	if n < 1 || n > 256 {
+		return nil, fmt.Errorf("election.New: cluster of %d nodes, want 1 to 256", n)
+	}
+	if self < 0 || self >= n {
+		return nil, fmt.Errorf("election.New: node index %d out of range [0, %d)", self, n)
+	}
+	if opts.Algorithm != Bully && opts.Algorithm != Raft {
+		return nil, fmt.Errorf("election.New: unknown algorithm %v", opts.Algorithm)
+	}
+	if opts.ElectionTimeout <= 0 {
+		opts.ElectionTimeout = defaultElectionTimeout
+	}
+	if opts.Heartbeat <= 0 {
+		opts.Heartbeat = opts.ElectionTimeout / 5
+	}
+	if opts.Heartbeat >= opts.ElectionTimeout {
+		return nil, fmt.Errorf("election.New: heartbeat %v must be shorter than the election timeout %v",
+			opts.Heartbeat, opts.ElectionTimeout)
+	}
+	w := opts.Log
+	if w == nil {
+		w = io.Discard
+	}
+	return &Elector{
+		self:      self,
+		n:         n,
+		transport: t,
+		opts:      opts,
+		log:       log.New(w, fmt.Sprintf("node %d: ", self), log.LstdFlags|log.Lmicroseconds),
+		state:     State{Leader: -1},
+		votedFor:  -1,
+	}, nil
+}
+
+// State returns the node's current view of the election.
+func (e *Elector) State() State {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.state
+}
+
+// Leader returns the current leader (-1 if unknown) and term.
+func (e *Elector) Leader() (int, uint64) {
+	s := e.State()
+	return s.Leader, s.Term
+}
+
+// Start runs elections until ctx is done or Close is called.
+func (e *Elector) Start(ctx context.Context) error {
+	if e.stopped != nil {
+		return fmt.Errorf("Start: elector already started")
+	}
+	ctx, e.cancel = context.WithCancel(ctx)
+	e.stopped = make(chan struct{})
+	inbox := make(chan frame, 64)
+	go func() {
+		<-ctx.Done()
+		e.closeTransport()
+	}()
+	go e.receiveLoop(ctx, inbox)
+	go func() {
+		defer close(e.stopped)
+		e.eventLoop(ctx, inbox)
+	}()
+	return nil
+}
+
+// Close stops the elector and closes its transport. To the other nodes it
+// looks exactly like a crash.
+func (e *Elector) Close() error {
+	if e.cancel == nil {
+		return e.closeTransport()
+	}
+	e.cancel()
+	err := e.closeTransport()
+	<-e.stopped
+	return err
+}
+
+func (e *Elector) closeTransport() error {
+	e.closeOnce.Do(func() { e.closeErr = e.transport.Close() })
+	return e.closeErr
+}
+
+func (e *Elector) receiveLoop(ctx context.Context, inbox chan<- frame) {
+	buf := make([]byte, frameSize+1)
+	for {
+		recvd, from, err := e.transport.Recv(buf)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue // timeouts are expected; the event loop keeps its own time
+		}
+		f, err := parseFrame(buf[:recvd], e.n)
+		if err != nil {
+			e.log.Printf("dropping datagram from %v: %v", from, err)
+			continue
+		}
+		select {
+		case inbox <- f:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (e *Elector) eventLoop(ctx context.Context, inbox <-chan frame) {
+	e.timer = time.NewTimer(e.followerTimeout())
+	defer e.timer.Stop()
+	heartbeat := time.NewTicker(e.opts.Heartbeat)
+	defer heartbeat.Stop()
+
+	e.log.Printf("started (%v, %d nodes)", e.opts.Algorithm, e.n)
+	if e.opts.Algorithm == Bully {
+		e.startBully() // a (re)started node challenges the nodes above it
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			e.log.Printf("stopped in term %d", e.State().Term)
+			return
+		case f := <-inbox:
+			if e.opts.Algorithm == Raft {
+				e.handleRaft(f)
+			} else {
+				e.handleBully(f)
+			}
+		case <-e.timer.C:
+			if e.opts.Algorithm == Raft {
+				e.raftTimeout()
+			} else {
+				e.bullyTimeout()
+			}
+		case <-heartbeat.C:
+			if s := e.State(); s.Role == Leader {
+				typ := raftHeartbeat
+				if e.opts.Algorithm == Bully {
+					typ = bullyCoordinator
+				}
+				e.sendOthers(frame{typ: typ, term: s.Term})
+			}
+		}
+	}
+}
+
+// followerTimeout is how long to wait for the leader before suspecting it.
+func (e *Elector) followerTimeout() time.Duration {
+	t := e.opts.ElectionTimeout
+	if e.opts.Algorithm == Raft {
+		t += rand.N(e.opts.ElectionTimeout)
+	}
+	return t
+}
+
+func (e *Elector) setState(s State) {
+	e.mu.Lock()
+	e.state = s
+	e.mu.Unlock()
+}
+
+// --- Raft ---
+
+func (e *Elector) raftTimeout() {
+	s := e.State()
+	if s.Role == Leader {
+		e.timer.Reset(e.followerTimeout())
+		return
+	}
+	if s.Leader >= 0 {
+		e.log.Printf("term %d: leader %d timed out", s.Term, s.Leader)
+	}
+	term := s.Term + 1
+	e.setState(State{Leader: -1, Term: term, Role: Candidate})
+	e.votedFor = e.self
+	e.votes = map[int]bool{e.self: true}
+	e.log.Printf("term %d: starting election", term)
+	e.timer.Reset(e.followerTimeout())
+	if e.hasMajority() {
+		e.becomeLeader(term)
+		return
+	}
+	e.sendOthers(frame{typ: raftRequestVote, term: term})
+}
+
+func (e *Elector) hasMajority() bool {
+	return 2*len(e.votes) > e.n
+}
+
+func (e *Elector) handleRaft(f frame) {
+	s := e.State()
+	if f.term > s.Term {
+		// A newer term: whatever we were, we are now a follower without a vote cast.
+		if s.Role == Leader {
+			e.log.Printf("term %d: stepping down, node %d is in term %d", s.Term, f.from, f.term)
+		}
+		s = State{Leader: -1, Term: f.term, Role: Follower}
+		e.setState(s)
+		e.votedFor = -1
+	}
+
+	switch f.typ {
+	case raftRequestVote:
+		granted := f.term == s.Term && s.Role == Follower && (e.votedFor == -1 || e.votedFor == f.from)
+		if granted {
+			e.votedFor = f.from
+			e.timer.Reset(e.followerTimeout())
+			e.log.Printf("term %d: voted for node %d", s.Term, f.from)
+		}
+		e.send(f.from, frame{typ: raftVote, term: s.Term, granted: granted})
+	case raftVote:
+		if s.Role != Candidate || f.term != s.Term || !f.granted {
+			return
+		}
+		e.votes[f.from] = true
+		if e.hasMajority() {
+			e.becomeLeader(s.Term)
+		}
+	case raftHeartbeat:
+		if f.term < s.Term {
+			e.send(f.from, frame{typ: raftHeartbeatReply, term: s.Term}) // tell the stale leader
+			return
+		}
+		if s.Leader != f.from {
+			e.setState(State{Leader: f.from, Term: s.Term, Role: Follower})
+			e.log.Printf("term %d: following node %d", s.Term, f.from)
+		}
+		e.timer.Reset(e.followerTimeout())
+	case raftHeartbeatReply:
+		// Only its term matters, handled above.
+	default:
+		e.log.Printf("unexpected %v from node %d in raft mode", f.typ, f.from)
+	}
+}
+
+func (e *Elector) becomeLeader(term uint64) {
+	e.setState(State{Leader: e.self, Term: term, Role: Leader})
+	e.electing = false
+	e.log.Printf("term %d: elected leader (%v)", term, e.opts.Algorithm)
+	typ := raftHeartbeat
+	if e.opts.Algorithm == Bully {
+		typ = bullyCoordinator
+	}
+	e.sendOthers(frame{typ: typ, term: term})
+}
+
+// --- Bully ---
+
+func (e *Elector) startBully() {
+	s := e.State()
+	e.electing, e.answered = true, false
+	e.setState(State{Leader: -1, Term: s.Term, Role: Candidate})
+	if e.self == e.n-1 {
+		e.becomeLeader(e.bullyTerm(s.Term))
+		return
+	}
+	e.log.Printf("term %d: challenging nodes %d-%d", s.Term, e.self+1, e.n-1)
+	for i := e.self + 1; i < e.n; i++ {
+		e.send(i, frame{typ: bullyElection, term: s.Term})
+	}
+	e.timer.Reset(e.opts.ElectionTimeout)
+}
+
+// bullyTerm returns the first term after known that this node may lead.
+// Bully nodes do not vote on terms, so terms are numbered with term % n being
+// the leader's index: two nodes can then never lead the same term, even if
+// one of them was elected without knowing the latest term.
+func (e *Elector) bullyTerm(known uint64) uint64 {
+	t := known + 1
+	for t%uint64(e.n) != uint64(e.self) {
+		t++
+	}
+	return t
+}
+
+func (e *Elector) bullyTimeout() {
+	s := e.State()
+	switch {
+	case e.electing && !e.answered:
+		e.becomeLeader(e.bullyTerm(s.Term)) // nobody above us is alive
+	case e.electing:
+		e.log.Printf("term %d: a higher node answered but never took over", s.Term)
+		e.startBully()
+	case s.Role == Leader:
+		e.timer.Reset(e.opts.ElectionTimeout)
+	default:
+		e.log.Printf("term %d: leader %d timed out", s.Term, s.Leader)
+		e.startBully()
+	}
+}
+
+func (e *Elector) handleBully(f frame) {
+	s := e.State()
+	if f.term > s.Term {
+		if s.Role == Leader && f.from < e.self {
+			// We were elected without knowing the latest term (e.g. after a
+			// restart): move past it.
+			e.becomeLeader(e.bullyTerm(f.term))
+			s = e.State()
+		} else {
+			s.Term = f.term
+			e.setState(s)
+		}
+	}
+
+	switch f.typ {
+	case bullyElection:
+		if f.from > e.self {
+			return // only lower nodes challenge us
+		}
+		e.send(f.from, frame{typ: bullyAnswer, term: s.Term})
+		if s.Role == Leader {
+			e.send(f.from, frame{typ: bullyCoordinator, term: s.Term})
+		} else if !e.electing {
+			e.startBully()
+		}
+	case bullyAnswer:
+		if e.electing && f.from > e.self {
+			e.answered = true
+			// Now wait for its coordinator message; it first has to run its
+			// own challenge, which takes up to an election timeout.
+			e.timer.Reset(2 * e.opts.ElectionTimeout)
+		}
+	case bullyCoordinator:
+		if f.from < e.self {
+			// A lower node claims leadership while we are alive: bully it.
+			if !e.electing {
+				e.startBully()
+			}
+			return
+		}
+		if s.Leader != f.from {
+			e.log.Printf("term %d: following node %d", s.Term, f.from)
+		}
+		e.electing = false
+		e.setState(State{Leader: f.from, Term: s.Term, Role: Follower})
+		e.timer.Reset(e.opts.ElectionTimeout)
+	default:
+		e.log.Printf("unexpected %v from node %d in bully mode", f.typ, f.from)
+	}
+}
+
+// --- Transport ---
+
+func (e *Elector) send(to int, f frame) {
+	f.from = e.self
+	if err := e.transport.Send(to, f.marshal()); err != nil && !errors.Is(err, net.ErrClosed) {
+		e.log.Printf("send %v to node %d: %v", f.typ, to, err)
+	}
+}
+
+func (e *Elector) sendOthers(f frame) {
+	for i := 0; i < e.n; i++ {
+		if i != e.self {
+			e.send(i, f)
+		}
+	}
+}
+
+// Wire format, 12 bytes: magic, type, sender index, vote granted, term.
+const (
+	frameMagic = 0xEC
+	frameSize  = 12
+)
+
+type frameType uint8
+
+const (
+	raftRequestVote frameType = iota + 1
+	raftVote
+	raftHeartbeat
+	raftHeartbeatReply
+	bullyElection
+	bullyAnswer
+	bullyCoordinator
+)
+
+func (t frameType) String() string {
+	switch t {
+	case raftRequestVote:
+		return "REQUEST-VOTE"
+	case raftVote:
+		return "VOTE"
+	case raftHeartbeat:
+		return "HEARTBEAT"
+	case raftHeartbeatReply:
+		return "HEARTBEAT-REPLY"
+	case bullyElection:
+		return "ELECTION"
+	case bullyAnswer:
+		return "ANSWER"
+	case bullyCoordinator:
+		return "COORDINATOR"
+	}
+	return fmt.Sprintf("frameType(%d)", uint8(t))
+}
+
+type frame struct {
+	typ     frameType
+	from    int
+	granted bool
+	term    uint64
+}
+
+func (f frame) marshal() []byte {
+	buf := make([]byte, frameSize)
+	buf[0] = frameMagic
+	buf[1] = byte(f.typ)
+	buf[2] = byte(f.from)
+	if f.granted {
+		buf[3] = 1
+	}
+	binary.BigEndian.PutUint64(buf[4:], f.term)
+	return buf
+}
+
+func parseFrame(buf []byte, n int) (frame, error) {
+	if len(buf) != frameSize || buf[0] != frameMagic {
+		return frame{}, fmt.Errorf("parseFrame: not an election frame (%d bytes)", len(buf))
+	}
+	f := frame{typ: frameType(buf[1]), from: int(buf[2]), granted: buf[3] == 1, term: binary.BigEndian.Uint64(buf[4:])}
+	if f.typ < raftRequestVote || f.typ > bullyCoordinator {
+		return frame{}, fmt.Errorf("parseFrame: unknown type %d", buf[1])
+	}
+	if f.from >= n {
+		return frame{}, fmt.Errorf("parseFrame: sender %d out of range", f.from)
+	}
+	return f, nil
+}
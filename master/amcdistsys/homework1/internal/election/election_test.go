@@ -0,0 +1,202 @@
+package election
+
+import (
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/node"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/testutil"
+)
+
+// --- Harness: in-process cluster over a MemNetwork ---
+
+type cluster struct {
+	*testutil.Cluster[*Elector] // Nodes[i] is nil while killed
+}
+
+func newCluster(t *testing.T, algo Algorithm, n int) *cluster {
+	c := &cluster{}
+	c.Cluster = testutil.NewCluster(t, n, func(i int, tr node.Transport) (*Elector, error) {
+		return New(i, n, tr, Options{
+			Algorithm:       algo,
+			ElectionTimeout: 100 * time.Millisecond,
+			Heartbeat:       20 * time.Millisecond,
+			Log:             c.Log,
+		})
+	})
+	c.StartAll()
+	return c
+}
+
+// waitForLeader waits until every live node follows the same leader in the
+// same term, and that leader considers itself the leader.
+func (c *cluster) waitForLeader() (int, uint64) {
+	c.T.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if leader, term, ok := c.agreed(); ok {
+			return leader, term
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i, e := range c.Nodes {
+		if e != nil {
+			c.T.Logf("node %d: %+v", i, e.State())
+		}
+	}
+	c.T.Fatalf("no agreed leader after 5s\n%s", c.Log.String())
+	return -1, 0
+}
+
+func (c *cluster) agreed() (int, uint64, bool) {
+	leader, term := -1, uint64(0)
+	for _, e := range c.Nodes {
+		if e == nil {
+			continue
+		}
+		s := e.State()
+		if s.Leader < 0 || (leader >= 0 && (s.Leader != leader || s.Term != term)) {
+			return -1, 0, false
+		}
+		leader, term = s.Leader, s.Term
+	}
+	if leader < 0 || c.Nodes[leader] == nil || c.Nodes[leader].State().Role != Leader {
+		return -1, 0, false
+	}
+	return leader, term, true
+}
+
+var electedRe = regexp.MustCompile(`node (\d+): .*term (\d+): elected leader`)
+
+// checkOneLeaderPerTerm asserts from the election log that no term had two leaders.
+func (c *cluster) checkOneLeaderPerTerm() {
+	c.T.Helper()
+	leaders := map[uint64]int{}
+	for _, m := range electedRe.FindAllStringSubmatch(c.Log.String(), -1) {
+		id, _ := strconv.Atoi(m[1])
+		term, _ := strconv.ParseUint(m[2], 10, 64)
+		if prev, ok := leaders[term]; ok && prev != id {
+			c.T.Errorf("term %d has two leaders: %d and %d\n%s", term, prev, id, c.Log.String())
+		}
+		leaders[term] = id
+	}
+	if len(leaders) == 0 {
+		c.T.Error("election log records no elected leader")
+	}
+}
+
+// --- Killed leaders are replaced; restarted nodes rejoin ---
+
+func TestElection_KillAndReelect(t *testing.T) {
+	for _, algo := range []Algorithm{Bully, Raft} {
+		t.Run(algo.String(), func(t *testing.T) {
+			c := newCluster(t, algo, 5)
+
+			first, term := c.waitForLeader()
+			if algo == Bully && first != 4 {
+				t.Errorf("bully should elect the highest node, got %d", first)
+			}
+
+			c.Kill(first)
+			second, term2 := c.waitForLeader()
+			if second == first || term2 <= term {
+				t.Errorf("after killing %d (term %d): leader %d in term %d", first, term, second, term2)
+			}
+			if algo == Bully && second != 3 {
+				t.Errorf("bully should elect node 3 once 4 is dead, got %d", second)
+			}
+
+			c.Kill(second)
+			third, term3 := c.waitForLeader()
+			if third == first || third == second || term3 <= term2 {
+				t.Errorf("after killing %d (term %d): leader %d in term %d", second, term2, third, term3)
+			}
+
+			// The first leader comes back.
+			c.Start(first)
+			leader, term4 := c.waitForLeader()
+			if term4 < term3 {
+				t.Errorf("term went back from %d to %d", term3, term4)
+			}
+			if algo == Bully && leader != first {
+				t.Errorf("restarted node %d should bully its way back, leader is %d", first, leader)
+			}
+			c.checkOneLeaderPerTerm()
+		})
+	}
+}
+
+// --- Raft needs a majority: a minority never elects a leader ---
+
+func TestElection_RaftMinority(t *testing.T) {
+	c := newCluster(t, Raft, 3)
+	leader, _ := c.waitForLeader()
+	c.Kill(leader)
+	c.Kill((leader + 1) % 3)
+
+	survivor := c.Nodes[(leader+2)%3]
+	time.Sleep(600 * time.Millisecond)
+	if s := survivor.State(); s.Role == Leader {
+		t.Errorf("lone survivor elected itself: %+v", s)
+	}
+}
+
+// --- A single node elects itself ---
+
+func TestElection_SingleNode(t *testing.T) {
+	for _, algo := range []Algorithm{Bully, Raft} {
+		c := newCluster(t, algo, 1)
+		if leader, _ := c.waitForLeader(); leader != 0 {
+			t.Errorf("%v: expected node 0 to lead, got %d", algo, leader)
+		}
+	}
+}
+
+// --- Wire format ---
+
+func TestFrame_RoundTrip(t *testing.T) {
+	f := frame{typ: raftVote, from: 3, granted: true, term: 1 << 40}
+	got, err := parseFrame(f.marshal(), 4)
+	if err != nil || got != f {
+		t.Fatalf("round-trip: %+v, %v", got, err)
+	}
+	bad := map[string][]byte{
+		"short":       f.marshal()[:5],
+		"bad magic":   append([]byte{0}, f.marshal()[1:]...),
+		"bad type":    append([]byte{frameMagic, 0}, f.marshal()[2:]...),
+		"bad sender":  append([]byte{frameMagic, byte(raftVote), 9}, f.marshal()[3:]...),
+		"broadcast":   make([]byte, 1024),
+		"unknown typ": append([]byte{frameMagic, 99}, f.marshal()[2:]...),
+	}
+	for name, buf := range bad {
+		if _, err := parseFrame(buf, 4); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	mem := node.NewMemNetwork(2)
+	cases := []struct {
+		self, n int
+		opts    Options
+	}{
+		{2, 2, Options{}},
+		{0, 0, Options{}},
+		{0, 2, Options{Algorithm: Algorithm(7)}},
+		{0, 2, Options{ElectionTimeout: time.Second, Heartbeat: 2 * time.Second}},
+	}
+	for _, tc := range cases {
+		if _, err := New(tc.self, tc.n, mem.Transport(0), tc.opts); err == nil {
+			t.Errorf("New(%d, %d, %+v): expected error", tc.self, tc.n, tc.opts)
+		}
+	}
+	if a, err := ParseAlgorithm("Raft"); err != nil || a != Raft {
+		t.Errorf("ParseAlgorithm: %v, %v", a, err)
+	}
+	if _, err := ParseAlgorithm("paxos"); err == nil {
+		t.Error("expected error for unknown algorithm")
+	}
+}
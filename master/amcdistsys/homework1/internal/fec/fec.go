@@ -0,0 +1,267 @@
+// Package fec implements systematic erasure codes for forward error
+// correction: K equal-length data shards are sent as they are, followed by R
+// parity shards, and any K of the K+R shards rebuild the data. XOR parity
+// tolerates one loss per group; Reed-Solomon, over GF(2^8) with a Cauchy
+// matrix, tolerates R.
+package fec
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Scheme selects how parity shards are computed.
+type Scheme uint8
+
+const (
+	XOR         Scheme = iota + 1 // one parity shard, the XOR of the data
+	ReedSolomon                   // R parity shards, any R losses recoverable
+)
+
+// ParseScheme accepts "xor" and "rs" (or "reed-solomon").
+func ParseScheme(s string) (Scheme, error) {
+	switch s {
+	case "xor":
+		return XOR, nil
+	case "rs", "reed-solomon":
+		return ReedSolomon, nil
+	}
+	return 0, fmt.Errorf("ParseScheme: unknown scheme %q (want xor or rs)", s)
+}
+
+func (s Scheme) String() string {
+	switch s {
+	case XOR:
+		return "xor"
+	case ReedSolomon:
+		return "reed-solomon"
+	}
+	return fmt.Sprintf("Scheme(%d)", uint8(s))
+}
+
+// ErrTooManyLost is returned by Reconstruct when fewer than K shards of a
+// group are present.
+var ErrTooManyLost = errors.New("fec: too many shards lost")
+
+// Code is an erasure code for groups of K data and R parity shards.
+type Code struct {
+	scheme Scheme
+	k, r   int
+	matrix [][]byte // r rows of k coefficients: parity i = sum of matrix[i][j]*data[j]
+}
+
+// New returns the code of the given scheme for k data and r parity shards.
+// XOR needs r == 1; Reed-Solomon needs k+r <= 256.
+func New(scheme Scheme, k, r int) (*Code, error) {
+	if k < 1 || r < 1 {
+		return nil, fmt.Errorf("fec.New: need at least one data and one parity shard, got k=%d r=%d", k, r)
+	}
+	c := &Code{scheme: scheme, k: k, r: r, matrix: make([][]byte, r)}
+	switch scheme {
+	case XOR:
+		if r != 1 {
+			return nil, fmt.Errorf("fec.New: XOR has exactly one parity shard, got r=%d", r)
+		}
+		c.matrix[0] = make([]byte, k)
+		for j := range c.matrix[0] {
+			c.matrix[0][j] = 1
+		}
+	case ReedSolomon:
+		if k+r > 256 {
+			return nil, fmt.Errorf("fec.New: k+r = %d exceeds the 256 elements of GF(2^8)", k+r)
+		}
+		// Cauchy matrix 1/(x_i + y_j) with x_i = k+i, y_j = j: every square
+		// submatrix is invertible, so any k shards determine the data.
+		for i := range c.matrix {
+			c.matrix[i] = make([]byte, k)
+			for j := range c.matrix[i] {
+				c.matrix[i][j] = gfInv(byte(k+i) ^ byte(j))
+			}
+		}
+	default:
+		return nil, fmt.Errorf("fec.New: unknown scheme %d", scheme)
+	}
+	return c, nil
+}
+
+// K returns the number of data shards per group.
+func (c *Code) K() int { return c.k }
+
+// R returns the number of parity shards per group.
+func (c *Code) R() int { return c.r }
+
+// Scheme returns the code's scheme.
+func (c *Code) Scheme() Scheme { return c.scheme }
+
+// Encode computes the R parity shards of k data shards of equal length.
+func (c *Code) Encode(data [][]byte) ([][]byte, error) {
+	if len(data) != c.k {
+		return nil, fmt.Errorf("Encode: got %d data shards, want %d", len(data), c.k)
+	}
+	size := len(data[0])
+	for j, d := range data {
+		if len(d) != size {
+			return nil, fmt.Errorf("Encode: shard %d is %d bytes, shard 0 is %d", j, len(d), size)
+		}
+	}
+	parity := make([][]byte, c.r)
+	for i := range parity {
+		parity[i] = make([]byte, size)
+		for j, d := range data {
+			mulAdd(parity[i], d, c.matrix[i][j])
+		}
+	}
+	return parity, nil
+}
+
+// Reconstruct fills in the missing (nil) entries of data from the present
+// ones and the present (non-nil) entries of parity, which has R entries. It
+// returns ErrTooManyLost if fewer than K shards are present in total.
+func (c *Code) Reconstruct(data, parity [][]byte) error {
+	if len(data) != c.k || len(parity) != c.r {
+		return fmt.Errorf("Reconstruct: got %d+%d shards, want %d+%d", len(data), len(parity), c.k, c.r)
+	}
+	var missing, rows []int
+	size := -1
+	for j, d := range data {
+		if d == nil {
+			missing = append(missing, j)
+		} else if size < 0 {
+			size = len(d)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	for i, p := range parity {
+		if p != nil && len(rows) < len(missing) {
+			rows = append(rows, i)
+			if size < 0 {
+				size = len(p)
+			}
+		}
+	}
+	if len(rows) < len(missing) {
+		return fmt.Errorf("Reconstruct: %d of %d data shards missing, %d parity shards present: %w",
+			len(missing), c.k, len(rows), ErrTooManyLost)
+	}
+	for j, d := range data {
+		if d != nil && len(d) != size {
+			return fmt.Errorf("Reconstruct: data shard %d is %d bytes, want %d", j, len(d), size)
+		}
+	}
+	for _, i := range rows {
+		if len(parity[i]) != size {
+			return fmt.Errorf("Reconstruct: parity shard %d is %d bytes, want %d", i, len(parity[i]), size)
+		}
+	}
+
+	// Each chosen parity row, minus the contribution of the present data,
+	// is a linear combination of the missing shards: solve for them.
+	e := len(missing)
+	rhs := make([][]byte, e)
+	a := make([][]byte, e)
+	for r, i := range rows {
+		rhs[r] = append([]byte(nil), parity[i]...)
+		for j, d := range data {
+			if d != nil {
+				mulAdd(rhs[r], d, c.matrix[i][j])
+			}
+		}
+		a[r] = make([]byte, e)
+		for m, j := range missing {
+			a[r][m] = c.matrix[i][j]
+		}
+	}
+	inv, err := invert(a)
+	if err != nil {
+		return fmt.Errorf("Reconstruct: %w", err)
+	}
+	for m, j := range missing {
+		shard := make([]byte, size)
+		for r := range rhs {
+			mulAdd(shard, rhs[r], inv[m][r])
+		}
+		data[j] = shard
+	}
+	return nil
+}
+
+// invert returns the inverse of the square matrix a over GF(2^8), by
+// Gauss-Jordan elimination.
+func invert(a [][]byte) ([][]byte, error) {
+	n := len(a)
+	m := make([][]byte, n)
+	for i := range a {
+		m[i] = make([]byte, 2*n)
+		copy(m[i], a[i])
+		m[i][n+i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for row := col; row < n; row++ {
+			if m[row][col] != 0 {
+				pivot = row
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, errors.New("singular matrix")
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		scale := gfInv(m[col][col])
+		for k := range m[col] {
+			m[col][k] = gfMul(m[col][k], scale)
+		}
+		for row := 0; row < n; row++ {
+			if row != col && m[row][col] != 0 {
+				mulAdd(m[row], m[col], m[row][col])
+			}
+		}
+	}
+	inv := make([][]byte, n)
+	for i := range m {
+		inv[i] = m[i][n:]
+	}
+	return inv, nil
+}
+
+// GF(2^8) arithmetic with the primitive polynomial x^8+x^4+x^3+x^2+1.
+var gfExp, gfLog = func() (exp [510]byte, log [256]byte) {
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i], exp[i+255] = byte(x), byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	return exp, log
+}()
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// mulAdd adds c*src to dst, element-wise; addition in GF(2^8) is XOR.
+func mulAdd(dst, src []byte, c byte) {
+	switch c {
+	case 0:
+	case 1:
+		for i, s := range src {
+			dst[i] ^= s
+		}
+	default:
+		for i, s := range src {
+			dst[i] ^= gfMul(s, c)
+		}
+	}
+}
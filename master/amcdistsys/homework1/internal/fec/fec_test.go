@@ -0,0 +1,136 @@
+package fec
+
+import (
+	"bytes"
+	"errors"
+	"math/rand/v2"
+	"testing"
+)
+
+func shards(k, size int) [][]byte {
+	data := make([][]byte, k)
+	for j := range data {
+		data[j] = make([]byte, size)
+		for i := range data[j] {
+			data[j][i] = byte(rand.IntN(256))
+		}
+	}
+	return data
+}
+
+// --- Any K of the K+R shards rebuild the data ---
+
+func TestCode_ReconstructsAnyLosses(t *testing.T) {
+	for _, tc := range []struct {
+		scheme Scheme
+		k, r   int
+	}{{XOR, 1, 1}, {XOR, 8, 1}, {ReedSolomon, 1, 3}, {ReedSolomon, 4, 2}, {ReedSolomon, 10, 4}} {
+		c, err := New(tc.scheme, tc.k, tc.r)
+		if err != nil {
+			t.Fatalf("New(%v, %d, %d): %v", tc.scheme, tc.k, tc.r, err)
+		}
+		data := shards(tc.k, 64)
+		parity, err := c.Encode(data)
+		if err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+		// Every way of losing up to r of the k+r shards.
+		n := tc.k + tc.r
+		for mask := 0; mask < 1<<n; mask++ {
+			lost := 0
+			for b := mask; b != 0; b &= b - 1 {
+				lost++
+			}
+			if lost > tc.r {
+				continue
+			}
+			d := make([][]byte, tc.k)
+			p := make([][]byte, tc.r)
+			for i := 0; i < n; i++ {
+				if mask&(1<<i) != 0 {
+					continue
+				}
+				if i < tc.k {
+					d[i] = data[i]
+				} else {
+					p[i-tc.k] = parity[i-tc.k]
+				}
+			}
+			if err := c.Reconstruct(d, p); err != nil {
+				t.Fatalf("%v k=%d r=%d lost %b: %v", tc.scheme, tc.k, tc.r, mask, err)
+			}
+			for j := range data {
+				if !bytes.Equal(d[j], data[j]) {
+					t.Fatalf("%v k=%d r=%d lost %b: shard %d reconstructed wrong", tc.scheme, tc.k, tc.r, mask, j)
+				}
+			}
+		}
+	}
+}
+
+func TestCode_XORIsPlainParity(t *testing.T) {
+	c, _ := New(XOR, 3, 1)
+	parity, _ := c.Encode([][]byte{{1, 2}, {4, 8}, {16, 32}})
+	if !bytes.Equal(parity[0], []byte{1 ^ 4 ^ 16, 2 ^ 8 ^ 32}) {
+		t.Errorf("XOR parity = %v", parity[0])
+	}
+}
+
+func TestCode_TooManyLost(t *testing.T) {
+	c, _ := New(ReedSolomon, 4, 2)
+	data := shards(4, 16)
+	parity, _ := c.Encode(data)
+	d := [][]byte{nil, data[1], nil, nil}
+	err := c.Reconstruct(d, parity)
+	if !errors.Is(err, ErrTooManyLost) {
+		t.Fatalf("expected ErrTooManyLost with 3 of 4 lost and 2 parity, got %v", err)
+	}
+	if d[0] != nil {
+		t.Error("Reconstruct filled shards despite failing")
+	}
+}
+
+// --- Parameter and shard validation ---
+
+func TestNew_Invalid(t *testing.T) {
+	cases := map[string]struct {
+		scheme Scheme
+		k, r   int
+	}{
+		"no data":        {ReedSolomon, 0, 1},
+		"no parity":      {ReedSolomon, 4, 0},
+		"xor r=2":        {XOR, 4, 2},
+		"field too big":  {ReedSolomon, 200, 57},
+		"unknown scheme": {9, 4, 1},
+	}
+	for name, tc := range cases {
+		if _, err := New(tc.scheme, tc.k, tc.r); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	if _, err := New(ReedSolomon, 200, 56); err != nil {
+		t.Errorf("k+r=256: %v", err)
+	}
+
+	c, _ := New(ReedSolomon, 2, 1)
+	if _, err := c.Encode([][]byte{{1}}); err == nil {
+		t.Error("expected error for a wrong shard count")
+	}
+	if _, err := c.Encode([][]byte{{1}, {1, 2}}); err == nil {
+		t.Error("expected error for shards of different lengths")
+	}
+	if err := c.Reconstruct([][]byte{nil, {1, 2}}, [][]byte{{1}}); err == nil {
+		t.Error("expected error for a parity shard of the wrong length")
+	}
+}
+
+func TestParseScheme(t *testing.T) {
+	for in, want := range map[string]Scheme{"xor": XOR, "rs": ReedSolomon, "reed-solomon": ReedSolomon} {
+		if got, err := ParseScheme(in); err != nil || got != want {
+			t.Errorf("ParseScheme(%q) = %v, %v; want %v", in, got, err, want)
+		}
+	}
+	if _, err := ParseScheme("ldpc"); err == nil {
+		t.Error("expected error for an unknown scheme")
+	}
+}
@@ -0,0 +1,207 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"time"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/config"
+)
+
+// Client requests and replies share the servers' Raft sockets, told apart by
+// their first byte.
+const (
+	requestMagic = 0xC1
+	replyMagic   = 0xC2
+)
+
+type reply struct {
+	ClientID  uint64
+	Seq       uint64
+	Result    Result
+	NotLeader bool
+	Leader    int
+	Err       string
+}
+
+func marshalRequest(op Op) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(requestMagic)
+	if err := gob.NewEncoder(&buf).Encode(op); err != nil {
+		return nil, fmt.Errorf("marshalRequest: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func parseRequest(data []byte) (Op, error) {
+	var op Op
+	if len(data) == 0 || data[0] != requestMagic {
+		return op, fmt.Errorf("parseRequest: not a request")
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data[1:])).Decode(&op); err != nil {
+		return op, fmt.Errorf("parseRequest: %w", err)
+	}
+	return op, nil
+}
+
+func (r *reply) marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(replyMagic)
+	if err := gob.NewEncoder(&buf).Encode(r); err != nil {
+		return nil, fmt.Errorf("reply.marshal: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func parseReply(data []byte) (reply, error) {
+	var r reply
+	if len(data) == 0 || data[0] != replyMagic {
+		return r, fmt.Errorf("parseReply: not a reply")
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data[1:])).Decode(&r); err != nil {
+		return r, fmt.Errorf("parseReply: %w", err)
+	}
+	return r, nil
+}
+
+// Caller sends op to server number i and returns its answer.
+type Caller func(ctx context.Context, i int, op Op) (Result, error)
+
+// Client runs operations against a cluster, finding the leader and retrying
+// until each operation succeeds exactly once. A Client runs one operation at
+// a time; use one per goroutine.
+type Client struct {
+	id     uint64
+	seq    uint64
+	n      int
+	leader int
+	call   Caller
+
+	// Attempt bounds each try against one server. Defaults to 500ms.
+	Attempt time.Duration
+}
+
+// NewClient returns a client of n servers reached through call.
+func NewClient(n int, call Caller) *Client {
+	return &Client{id: rand.Uint64(), n: n, leader: rand.N(n), call: call, Attempt: 500 * time.Millisecond}
+}
+
+// NewLocalClient returns a client that calls servers of the same process.
+// A nil server is unreachable.
+func NewLocalClient(servers []*Server) *Client {
+	return NewClient(len(servers), func(ctx context.Context, i int, op Op) (Result, error) {
+		if servers[i] == nil {
+			<-ctx.Done()
+			return Result{}, ctx.Err()
+		}
+		return servers[i].Do(ctx, op)
+	})
+}
+
+// DialUDP returns a client of the servers of cfg that sends requests from a
+// local UDP socket. The returned function releases the socket.
+func DialUDP(cfg *config.Config) (*Client, func() error, error) {
+	addrs := make([]*net.UDPAddr, len(cfg.Nodes))
+	for i, nd := range cfg.Nodes {
+		a, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", nd.IP, nd.Port))
+		if err != nil {
+			return nil, nil, fmt.Errorf("DialUDP: resolve %s:%d: %w", nd.IP, nd.Port, err)
+		}
+		addrs[i] = a
+	}
+	if len(addrs) == 0 {
+		return nil, nil, fmt.Errorf("DialUDP: config has no nodes")
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("DialUDP: %w", err)
+	}
+	buf := make([]byte, 64<<10)
+	call := func(ctx context.Context, i int, op Op) (Result, error) {
+		data, err := marshalRequest(op)
+		if err != nil {
+			return Result{}, err
+		}
+		if _, err := conn.WriteToUDP(data, addrs[i]); err != nil {
+			return Result{}, fmt.Errorf("send to node %d: %w", i, err)
+		}
+		deadline, _ := ctx.Deadline()
+		conn.SetReadDeadline(deadline)
+		for {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return Result{}, fmt.Errorf("node %d: %w", i, err)
+			}
+			rep, err := parseReply(buf[:n])
+			if err != nil || rep.ClientID != op.ClientID || rep.Seq != op.Seq {
+				continue // a late reply to an earlier attempt
+			}
+			switch {
+			case rep.NotLeader:
+				return Result{}, &NotLeaderError{Leader: rep.Leader}
+			case rep.Err != "":
+				return Result{}, errors.New(rep.Err)
+			}
+			return rep.Result, nil
+		}
+	}
+	return NewClient(len(addrs), call), conn.Close, nil
+}
+
+// Get returns the value of key and whether it exists.
+func (c *Client) Get(ctx context.Context, key string) (string, bool, error) {
+	r, err := c.Do(ctx, Op{Kind: Get, Key: key})
+	return r.Value, r.Found, err
+}
+
+// Put sets key to value.
+func (c *Client) Put(ctx context.Context, key, value string) error {
+	_, err := c.Do(ctx, Op{Kind: Put, Key: key, Value: value})
+	return err
+}
+
+// Append appends value to the value of key and returns the result.
+func (c *Client) Append(ctx context.Context, key, value string) (string, error) {
+	r, err := c.Do(ctx, Op{Kind: Append, Key: key, Value: value})
+	return r.Value, err
+}
+
+// Delete removes key and returns the value it had, if any.
+func (c *Client) Delete(ctx context.Context, key string) (string, bool, error) {
+	r, err := c.Do(ctx, Op{Kind: Delete, Key: key})
+	return r.Value, r.Found, err
+}
+
+// Do runs op, retrying against the servers until it succeeds or ctx is done.
+// ClientID and Seq are filled in by the client.
+func (c *Client) Do(ctx context.Context, op Op) (Result, error) {
+	c.seq++
+	op.ClientID, op.Seq = c.id, c.seq
+	for {
+		attempt, cancel := context.WithTimeout(ctx, c.Attempt)
+		res, err := c.call(attempt, c.leader, op)
+		cancel()
+		if err == nil {
+			return res, nil
+		}
+		if ctx.Err() != nil {
+			return Result{}, fmt.Errorf("Do %v %q: %w (last error: %v)", op.Kind, op.Key, ctx.Err(), err)
+		}
+		var nl *NotLeaderError
+		if !errors.As(err, &nl) {
+			c.leader = (c.leader + 1) % c.n // down, partitioned or deposed
+			continue
+		}
+		if nl.Leader >= 0 && nl.Leader != c.leader {
+			c.leader = nl.Leader
+		} else {
+			c.leader = (c.leader + 1) % c.n
+		}
+		time.Sleep(10 * time.Millisecond) // an election may be under way
+	}
+}
@@ -0,0 +1,307 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/raft"
+)
+
+// Kind is the operation an Op performs.
+type Kind uint8
+
+const (
+	Get Kind = iota
+	Put
+	Append
+	Delete
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Get:
+		return "get"
+	case Put:
+		return "put"
+	case Append:
+		return "append"
+	case Delete:
+		return "delete"
+	}
+	return fmt.Sprintf("Kind(%d)", uint8(k))
+}
+
+// Op is one client operation. ClientID and Seq identify it so that a retried
+// operation is applied once: each client numbers its operations 1, 2, ... and
+// has at most one outstanding.
+type Op struct {
+	Kind     Kind
+	Key      string
+	Value    string
+	ClientID uint64
+	Seq      uint64
+}
+
+// Result is what an Op observed: the value of the key after the operation
+// (before it, for Delete), and whether the key existed.
+type Result struct {
+	Value string
+	Found bool
+}
+
+// NotLeaderError is returned by a server that cannot serve an operation
+// because it is not the leader. Leader is the node it believes leads, -1 if
+// it does not know.
+type NotLeaderError struct {
+	Leader int
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader < 0 {
+		return "kv: not the leader, leader unknown"
+	}
+	return fmt.Sprintf("kv: not the leader, try node %d", e.Leader)
+}
+
+// ErrLost is returned when a server lost leadership before the operation
+// committed. The operation may or may not take effect; retrying it with the
+// same ClientID and Seq is safe.
+var ErrLost = errors.New("kv: leadership lost before the operation committed")
+
+// ErrStopped is returned by a server whose Raft node has stopped.
+var ErrStopped = errors.New("kv: server stopped")
+
+// Server is the key-value state machine replicated by a Raft node. Every
+// operation, reads included, goes through the log, so the store is
+// linearizable.
+type Server struct {
+	raft      *raft.Raft
+	threshold int
+
+	mu          sync.Mutex
+	data        map[string]string
+	last        map[uint64]applied // per client: its latest applied operation
+	lastApplied uint64
+	waiting     map[uint64]chan applied // log index -> the Do waiting for it
+	stopped     chan struct{}
+}
+
+// applied is an operation with the result it had.
+type applied struct {
+	ClientID uint64
+	Seq      uint64
+	Result   Result
+}
+
+// NewServer creates the state machine of r and starts applying its log. It
+// must be called before r is started. Once the persisted Raft state grows past
+// snapshotThreshold bytes the server snapshots; 0 disables snapshots.
+func NewServer(r *raft.Raft, snapshotThreshold int) *Server {
+	s := &Server{
+		raft:      r,
+		threshold: snapshotThreshold,
+		data:      map[string]string{},
+		last:      map[uint64]applied{},
+		waiting:   map[uint64]chan applied{},
+		stopped:   make(chan struct{}),
+	}
+	r.SetUnhandled(s.serveDatagram)
+	go s.applyLoop()
+	return s
+}
+
+// Do runs op and returns its result once it has committed, a
+// *NotLeaderError if this server cannot run it, or ErrLost.
+func (s *Server) Do(ctx context.Context, op Op) (Result, error) {
+	s.mu.Lock()
+	if last, ok := s.last[op.ClientID]; ok && last.Seq == op.Seq {
+		s.mu.Unlock()
+		return last.Result, nil // a retry of an operation that already committed
+	}
+	s.mu.Unlock()
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(op); err != nil {
+		return Result{}, fmt.Errorf("Do: %w", err)
+	}
+	if buf.Len() > raft.MaxCommand {
+		return Result{}, fmt.Errorf("Do: operation of %d bytes exceeds %d", buf.Len(), raft.MaxCommand)
+	}
+	// Holding mu until the waiter is registered keeps the entry from being
+	// applied unnoticed in between.
+	s.mu.Lock()
+	index, _, ok := s.raft.Propose(buf.Bytes())
+	if !ok {
+		s.mu.Unlock()
+		_, leader, _ := s.raft.State()
+		return Result{}, &NotLeaderError{Leader: leader}
+	}
+	ch := make(chan applied, 1)
+	if old, ok := s.waiting[index]; ok {
+		close(old) // an earlier proposal at this index was lost
+	}
+	s.waiting[index] = ch
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		if s.waiting[index] == ch {
+			delete(s.waiting, index)
+		}
+		s.mu.Unlock()
+	}()
+
+	select {
+	case a, ok := <-ch:
+		if !ok || a.ClientID != op.ClientID || a.Seq != op.Seq {
+			return Result{}, ErrLost
+		}
+		return a.Result, nil
+	case <-s.stopped:
+		return Result{}, ErrStopped
+	case <-ctx.Done():
+		return Result{}, ctx.Err()
+	}
+}
+
+// Snapshot returns a copy of the store's contents.
+func (s *Server) Snapshot() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]string, len(s.data))
+	for k, v := range s.data {
+		out[k] = v
+	}
+	return out
+}
+
+func (s *Server) applyLoop() {
+	defer close(s.stopped)
+	for msg := range s.raft.Apply() {
+		s.mu.Lock()
+		if msg.Snapshot != nil {
+			if err := s.restore(msg.Snapshot); err != nil {
+				panic(fmt.Sprintf("kv: %v", err)) // the log can no longer be applied
+			}
+			s.lastApplied = msg.Index
+			for index, ch := range s.waiting {
+				if index <= msg.Index {
+					close(ch) // whether these committed is now unknown
+					delete(s.waiting, index)
+				}
+			}
+			s.mu.Unlock()
+			continue
+		}
+		s.lastApplied = msg.Index
+		var a applied // a no-op answers nobody
+		if len(msg.Command) > 0 {
+			var op Op
+			if err := gob.NewDecoder(bytes.NewReader(msg.Command)).Decode(&op); err != nil {
+				panic(fmt.Sprintf("kv: undecodable command at index %d: %v", msg.Index, err))
+			}
+			a = s.apply(op)
+		}
+		if ch, ok := s.waiting[msg.Index]; ok {
+			ch <- a
+			delete(s.waiting, msg.Index)
+		}
+		var snap []byte
+		if s.threshold > 0 && s.raft.StateSize() > s.threshold {
+			snap = s.encode()
+		}
+		s.mu.Unlock()
+		if snap != nil {
+			s.raft.Snapshot(msg.Index, snap)
+		}
+	}
+}
+
+// apply runs op against the store, once per ClientID and Seq; the caller holds mu.
+func (s *Server) apply(op Op) applied {
+	if last, ok := s.last[op.ClientID]; ok && last.Seq >= op.Seq {
+		if last.Seq == op.Seq {
+			return last
+		}
+		return applied{ClientID: op.ClientID, Seq: op.Seq} // superseded; nobody waits for it
+	}
+	a := applied{ClientID: op.ClientID, Seq: op.Seq}
+	v, found := s.data[op.Key]
+	switch op.Kind {
+	case Put:
+		s.data[op.Key] = op.Value
+		a.Result = Result{Value: op.Value, Found: true}
+	case Append:
+		s.data[op.Key] = v + op.Value
+		a.Result = Result{Value: v + op.Value, Found: true}
+	case Delete:
+		delete(s.data, op.Key)
+		a.Result = Result{Value: v, Found: found}
+	default:
+		a.Result = Result{Value: v, Found: found}
+	}
+	s.last[op.ClientID] = a
+	return a
+}
+
+// snapshotState is what a snapshot holds: the store and the deduplication table.
+type snapshotState struct {
+	Data map[string]string
+	Last map[uint64]applied
+}
+
+func (s *Server) encode() []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(snapshotState{s.data, s.last}); err != nil {
+		panic(fmt.Sprintf("kv: encode snapshot: %v", err))
+	}
+	return buf.Bytes()
+}
+
+func (s *Server) restore(snapshot []byte) error {
+	var st snapshotState
+	if err := gob.NewDecoder(bytes.NewReader(snapshot)).Decode(&st); err != nil {
+		return fmt.Errorf("restore snapshot: %w", err)
+	}
+	s.data, s.last = st.Data, st.Last
+	if s.data == nil {
+		s.data = map[string]string{}
+	}
+	if s.last == nil {
+		s.last = map[uint64]applied{}
+	}
+	return nil
+}
+
+// --- Client requests over the node's socket ---
+
+// requestTimeout bounds how long a server works on a client datagram.
+const requestTimeout = 2 * time.Second
+
+func (s *Server) serveDatagram(data []byte, from *net.UDPAddr) {
+	req, err := parseRequest(data)
+	if err != nil || from == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		defer cancel()
+		res, err := s.Do(ctx, req)
+		rep := reply{ClientID: req.ClientID, Seq: req.Seq, Result: res, Leader: -1}
+		var nl *NotLeaderError
+		switch {
+		case errors.As(err, &nl):
+			rep.NotLeader, rep.Leader = true, nl.Leader
+		case err != nil:
+			rep.Err = err.Error()
+		}
+		if data, err := rep.marshal(); err == nil {
+			s.raft.SendTo(from, data)
+		}
+	}()
+}
@@ -0,0 +1,360 @@
+package kv
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/config"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/node"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/raft"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/testutil"
+)
+
+// --- Harness: in-process cluster over a MemNetwork ---
+
+type cluster struct {
+	*testutil.Cluster[*raft.Raft] // Nodes[i] is nil while killed
+	servers                       []*Server
+}
+
+func newCluster(t *testing.T, n, snapshotThreshold int) *cluster {
+	c := &cluster{servers: make([]*Server, n)}
+	cfg := testutil.Config(n)
+	storage := make([]*raft.MemStorage, n)
+	for i := range n {
+		storage[i] = raft.NewMemStorage()
+	}
+	c.Cluster = testutil.NewCluster(t, n, func(i int, tr node.Transport) (*raft.Raft, error) {
+		r, err := raft.New(i, cfg, tr, storage[i], raft.Options{
+			ElectionTimeout: 100 * time.Millisecond,
+			Heartbeat:       20 * time.Millisecond,
+		})
+		if err != nil {
+			return nil, err
+		}
+		c.servers[i] = NewServer(r, snapshotThreshold)
+		return r, nil
+	})
+	c.Killed = func(i int) {
+		<-c.servers[i].stopped
+		c.servers[i] = nil
+	}
+	c.StartAll()
+	return c
+}
+
+// --- Linearizability checking ---
+
+// event is one completed operation as a client saw it.
+type event struct {
+	op         Op
+	res        Result
+	call, done time.Time
+}
+
+// state is the model of one key.
+type state struct {
+	value  string
+	exists bool
+}
+
+// step applies op to s and reports whether res is what the model returns.
+func step(s state, op Op, res Result) (state, bool) {
+	switch op.Kind {
+	case Put:
+		return state{op.Value, true}, res == Result{op.Value, true}
+	case Append:
+		next := state{s.value + op.Value, true}
+		return next, res == Result{next.value, true}
+	case Delete:
+		return state{}, res == Result{s.value, s.exists}
+	default:
+		return s, res == Result{s.value, s.exists}
+	}
+}
+
+// linearizable reports whether the operations on one key can be ordered so
+// that each takes effect at an instant between its call and its return, and
+// every result matches the model. It searches depth-first for such an order,
+// remembering dead ends (Wing & Gong, with Lowe's memoization).
+func linearizable(events []event) bool {
+	sort.Slice(events, func(a, b int) bool { return events[a].call.Before(events[b].call) })
+	done := make([]bool, len(events))
+	seen := map[string]bool{}
+	var search func(s state, left int) bool
+	search = func(s state, left int) bool {
+		if left == 0 {
+			return true
+		}
+		key := fmt.Sprint(done, s)
+		if seen[key] {
+			return false
+		}
+		seen[key] = true
+		// Only an operation called before every pending one returned can go next.
+		horizon := time.Time{}
+		for i, e := range events {
+			if !done[i] && (horizon.IsZero() || e.done.Before(horizon)) {
+				horizon = e.done
+			}
+		}
+		for i, e := range events {
+			if done[i] || e.call.After(horizon) {
+				continue
+			}
+			next, ok := step(s, e.op, e.res)
+			if !ok {
+				continue
+			}
+			done[i] = true
+			if search(next, left-1) {
+				return true
+			}
+			done[i] = false
+		}
+		return false
+	}
+	return search(state{}, len(events))
+}
+
+func checkHistory(t *testing.T, history []event) {
+	t.Helper()
+	byKey := map[string][]event{}
+	for _, e := range history {
+		byKey[e.op.Key] = append(byKey[e.op.Key], e)
+	}
+	for key, events := range byKey {
+		if !linearizable(events) {
+			var b strings.Builder
+			for _, e := range events {
+				fmt.Fprintf(&b, "  %v %q -> %+v [%v, %v]\n", e.op.Kind, e.op.Value, e.res,
+					e.call.Format("15:04:05.000000"), e.done.Format("15:04:05.000000"))
+			}
+			t.Errorf("history of key %q is not linearizable:\n%s", key, b.String())
+		}
+	}
+}
+
+func TestLinearizable_Checker(t *testing.T) {
+	at := func(ms int) time.Time { return time.Unix(0, 0).Add(time.Duration(ms) * time.Millisecond) }
+	ok := []event{
+		{Op{Kind: Put, Value: "a"}, Result{"a", true}, at(0), at(10)},
+		{Op{Kind: Append, Value: "b"}, Result{"ab", true}, at(5), at(30)},
+		{Op{Kind: Get}, Result{"a", true}, at(12), at(20)}, // overlaps the append: may precede it
+	}
+	if !linearizable(ok) {
+		t.Error("valid history rejected")
+	}
+	stale := []event{
+		{Op{Kind: Put, Value: "a"}, Result{"a", true}, at(0), at(10)},
+		{Op{Kind: Put, Value: "b"}, Result{"b", true}, at(11), at(20)},
+		{Op{Kind: Get}, Result{"a", true}, at(21), at(30)}, // stale read
+	}
+	if linearizable(stale) {
+		t.Error("stale read accepted")
+	}
+}
+
+// --- The store stays linearizable while the network partitions and heals ---
+
+func TestKV_LinearizableUnderPartitions(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping partition test in short mode")
+	}
+	const n, clients, duration = 5, 5, 3 * time.Second
+	c := newCluster(t, n, 4<<10)
+	keys := []string{"x", "y", "z"}
+
+	var mu sync.Mutex
+	var history []event
+	stop := make(chan struct{})
+	var partitioner sync.WaitGroup
+	partitioner.Add(1)
+	go func() {
+		defer partitioner.Done()
+		for {
+			select {
+			case <-stop:
+				c.Mem.Heal()
+				return
+			case <-time.After(time.Duration(100+rand.IntN(300)) * time.Millisecond):
+			}
+			if rand.IntN(3) == 0 {
+				c.Mem.Heal()
+				continue
+			}
+			perm := rand.Perm(n)
+			split := 1 + rand.IntN(n-1)
+			c.Mem.Partition(perm[:split], perm[split:])
+		}
+	}()
+
+	var wg sync.WaitGroup
+	end := time.Now().Add(duration)
+	for k := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cl := NewLocalClient(c.servers)
+			cl.Attempt = 200 * time.Millisecond
+			for j := 0; time.Now().Before(end); j++ {
+				op := Op{Key: keys[rand.IntN(len(keys))]}
+				switch rand.IntN(4) {
+				case 0:
+					op.Kind = Get
+				case 1:
+					op.Kind, op.Value = Put, fmt.Sprintf("p%d.%d ", k, j)
+				case 2:
+					op.Kind, op.Value = Append, fmt.Sprintf("a%d.%d ", k, j)
+				default:
+					op.Kind = Delete
+				}
+				// Start at a random server, so that stale ones are asked too.
+				cl.leader = rand.IntN(n)
+				ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+				call := time.Now()
+				res, err := cl.Do(ctx, op)
+				done := time.Now()
+				cancel()
+				if err != nil {
+					t.Errorf("client %d: %v", k, err)
+					return
+				}
+				mu.Lock()
+				history = append(history, event{op, res, call, done})
+				mu.Unlock()
+				time.Sleep(time.Duration(rand.IntN(20)) * time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	partitioner.Wait()
+
+	t.Logf("%d operations", len(history))
+	checkHistory(t, history)
+}
+
+// --- A restarted server catches up, through a snapshot, to the same state ---
+
+func TestKV_RestartCatchesUp(t *testing.T) {
+	c := newCluster(t, 3, 2<<10)
+	servers := func() []*Server { return append([]*Server(nil), c.servers...) }
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	cl := NewLocalClient(servers())
+	if err := cl.Put(ctx, "k", "v0"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	c.Kill(2)
+	cl = NewLocalClient(servers())
+	for j := range 100 {
+		if _, err := cl.Append(ctx, "log", fmt.Sprintf("%d,", j)); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	if _, _, err := cl.Delete(ctx, "k"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if size := c.Nodes[0].StateSize(); size > 8<<10 {
+		t.Errorf("log not compacted: %d bytes of Raft state", size)
+	}
+
+	c.Start(2)
+	cl = NewLocalClient(servers())
+	want, _ := cl.Append(ctx, "log", "end")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := c.servers[2].Snapshot()
+		if got["log"] == want && len(got) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("restarted server has %v, want log=%q only", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// --- Retried operations take effect once ---
+
+func TestKV_RetryAppliesOnce(t *testing.T) {
+	c := newCluster(t, 1, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	op := Op{Kind: Append, Key: "k", Value: "x", ClientID: 42, Seq: 1}
+	for range 3 {
+		res, err := retryLocal(ctx, c.servers[0], op)
+		if err != nil || res.Value != "x" {
+			t.Fatalf("Do: %+v, %v", res, err)
+		}
+	}
+	if got := c.servers[0].Snapshot()["k"]; got != "x" {
+		t.Errorf("retried append applied more than once: %q", got)
+	}
+}
+
+func retryLocal(ctx context.Context, s *Server, op Op) (Result, error) {
+	for {
+		res, err := s.Do(ctx, op)
+		if _, ok := err.(*NotLeaderError); ok {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		return res, err
+	}
+}
+
+// --- The CLI path: clients over UDP to servers on UDP sockets ---
+
+func TestKV_UDP(t *testing.T) {
+	cfg := &config.Config{}
+	for range 3 {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		cfg.Nodes = append(cfg.Nodes, config.NodeAddr{IP: "127.0.0.1", Port: conn.LocalAddr().(*net.UDPAddr).Port})
+		conn.Close()
+	}
+	for i := range cfg.Nodes {
+		tr, err := node.NewUDPTransport(i, cfg)
+		if err != nil {
+			t.Fatalf("NewUDPTransport: %v", err)
+		}
+		r, err := raft.New(i, cfg, tr, raft.NewMemStorage(), raft.Options{ElectionTimeout: 100 * time.Millisecond})
+		if err != nil {
+			t.Fatalf("raft.New: %v", err)
+		}
+		NewServer(r, 0)
+		if err := r.Start(context.Background()); err != nil {
+			t.Fatalf("Start: %v", err)
+		}
+		t.Cleanup(func() { r.Close() })
+	}
+
+	cl, closeClient, err := DialUDP(cfg)
+	if err != nil {
+		t.Fatalf("DialUDP: %v", err)
+	}
+	defer closeClient()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := cl.Put(ctx, "greeting", "hello"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if v, ok, err := cl.Get(ctx, "greeting"); err != nil || !ok || v != "hello" {
+		t.Errorf("Get: %q, %v, %v", v, ok, err)
+	}
+	if _, ok, err := cl.Get(ctx, "missing"); err != nil || ok {
+		t.Errorf("Get missing: %v, %v", ok, err)
+	}
+}
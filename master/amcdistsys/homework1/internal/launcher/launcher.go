@@ -0,0 +1,271 @@
+package launcher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// StartWindow is the assignment's limit: all nodes must start within 10 seconds.
+const StartWindow = 10 * time.Second
+
+// IndexPlaceholder in Options.NodeArgs is replaced by the node index,
+// e.g. "-capture" "logs/node_{index}.bcap".
+const IndexPlaceholder = "{index}"
+
+const defaultGrace = 2 * time.Second
+
+// Options describes which nodes to launch and how.
+type Options struct {
+	Binary     string        // path to the bcastnode executable
+	ConfigPath string        // config file passed to every node
+	First      int           // first node index (inclusive)
+	Last       int           // last node index (inclusive)
+	NodeArgs   []string      // extra flags passed to every node, before the positional args
+	Env        []string      // extra environment variables for every node
+	Stagger    time.Duration // delay between consecutive starts
+	Timeout    time.Duration // global deadline for all nodes; 0 = none
+	Grace      time.Duration // time between interrupt and kill for stragglers; 0 = 2s
+	FailFast   bool          // stop the remaining nodes as soon as one fails
+	Out        io.Writer     // multiplexed, prefixed stdout/stderr of all nodes
+}
+
+// Result is the outcome of a single node process.
+type Result struct {
+	Index    int
+	PID      int
+	ExitCode int // -1 if the process did not exit normally
+	Elapsed  time.Duration
+	TimedOut bool  // stopped because the global timeout expired
+	Stopped  bool  // stopped because of cancellation (interrupt or fail-fast)
+	Err      error // start or wait error, nil on a clean exit
+}
+
+// OK reports whether the node ran to completion with exit status 0.
+func (r Result) OK() bool {
+	return r.Err == nil && r.ExitCode == 0
+}
+
+// Status returns a short human-readable description of the result.
+func (r Result) Status() string {
+	switch {
+	case r.OK():
+		return "ok"
+	case r.TimedOut:
+		return "killed (timeout)"
+	case r.Stopped:
+		return "killed (stopped)"
+	case r.PID == 0:
+		return fmt.Sprintf("start failed: %v", r.Err)
+	default:
+		return fmt.Sprintf("exit %d", r.ExitCode)
+	}
+}
+
+// Validate checks the options before anything is launched.
+func (o *Options) Validate() error {
+	if o.Binary == "" {
+		return errors.New("launcher: no binary given")
+	}
+	if o.First < 0 || o.Last < o.First {
+		return fmt.Errorf("launcher: invalid index range [%d, %d]", o.First, o.Last)
+	}
+	if o.Stagger < 0 {
+		return fmt.Errorf("launcher: negative stagger %v", o.Stagger)
+	}
+	if spread := time.Duration(o.Last-o.First) * o.Stagger; spread > StartWindow {
+		return fmt.Errorf("launcher: staggering %d nodes by %v takes %v, more than the %v start window",
+			o.Last-o.First+1, o.Stagger, spread, StartWindow)
+	}
+	return nil
+}
+
+// Run launches nodes First..Last as child processes, staggering their starts,
+// and waits for all of them. When the global timeout expires (or ctx is
+// cancelled) the remaining nodes are interrupted and, after Grace, killed.
+// Results are returned in index order.
+func Run(ctx context.Context, opts Options) ([]Result, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.Out == nil {
+		opts.Out = io.Discard
+	}
+	if opts.Grace <= 0 {
+		opts.Grace = defaultGrace
+	}
+
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	var outMu sync.Mutex
+	count := opts.Last - opts.First + 1
+	results := make([]Result, count)
+
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		if i > 0 && opts.Stagger > 0 {
+			select {
+			case <-time.After(opts.Stagger):
+			case <-ctx.Done():
+			}
+		}
+		idx := opts.First + i
+		if ctx.Err() != nil {
+			results[i] = Result{Index: idx, ExitCode: -1, Err: ctx.Err()}
+			markCancelled(ctx, &results[i])
+			continue
+		}
+
+		wg.Add(1)
+		go func(res *Result) {
+			defer wg.Done()
+			*res = runNode(ctx, &opts, idx, &outMu)
+			if opts.FailFast && !res.OK() && ctx.Err() == nil {
+				stop()
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+
+	return results, nil
+}
+
+// runNode starts one node process and waits for it to exit.
+func runNode(ctx context.Context, opts *Options, idx int, outMu *sync.Mutex) Result {
+	res := Result{Index: idx, ExitCode: -1}
+
+	args := make([]string, 0, len(opts.NodeArgs)+2)
+	for _, a := range opts.NodeArgs {
+		args = append(args, strings.ReplaceAll(a, IndexPlaceholder, strconv.Itoa(idx)))
+	}
+	args = append(args, opts.ConfigPath, strconv.Itoa(idx))
+
+	cmd := exec.CommandContext(ctx, opts.Binary, args...)
+	cmd.Env = append(os.Environ(), opts.Env...)
+	cmd.Cancel = func() error {
+		// Interrupt first so the node can flush its logs; Windows has no
+		// interrupt for child processes, so fall back to killing it.
+		if err := cmd.Process.Signal(os.Interrupt); err != nil {
+			return cmd.Process.Kill()
+		}
+		return nil
+	}
+	cmd.WaitDelay = opts.Grace
+
+	prefix := fmt.Sprintf("[node %d] ", idx)
+	stdout := &lineWriter{mu: outMu, out: opts.Out, prefix: prefix}
+	stderr := &lineWriter{mu: outMu, out: opts.Out, prefix: prefix}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		res.Err = fmt.Errorf("start: %w", err)
+		return res
+	}
+	res.PID = cmd.Process.Pid
+	stdout.printf("started (pid %d)", res.PID)
+
+	err := cmd.Wait()
+	res.Elapsed = time.Since(start)
+	stdout.flush()
+	stderr.flush()
+
+	if cmd.ProcessState != nil {
+		res.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	if err != nil {
+		res.Err = err
+		markCancelled(ctx, &res)
+	}
+	return res
+}
+
+func markCancelled(ctx context.Context, res *Result) {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		res.TimedOut = true
+	case ctx.Err() != nil:
+		res.Stopped = true
+	}
+}
+
+// WriteSummary prints a table with one row per node.
+func WriteSummary(w io.Writer, results []Result) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NODE\tPID\tEXIT\tELAPSED\tSTATUS")
+	for _, r := range results {
+		pid := "-"
+		if r.PID != 0 {
+			pid = strconv.Itoa(r.PID)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%v\t%s\n", r.Index, pid, r.ExitCode, r.Elapsed.Round(time.Millisecond), r.Status())
+	}
+	tw.Flush()
+}
+
+// ExitStatus combines the results into a single process exit status:
+// 0 if every node succeeded, 1 otherwise.
+func ExitStatus(results []Result) int {
+	for _, r := range results {
+		if !r.OK() {
+			return 1
+		}
+	}
+	return 0
+}
+
+// lineWriter prefixes every complete line written to it and forwards it to out.
+// Writers of different nodes share mu so lines are never interleaved.
+type lineWriter struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	lw.buf = append(lw.buf, p...)
+	for {
+		i := bytes.IndexByte(lw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		lw.emit(lw.buf[:i])
+		lw.buf = lw.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (lw *lineWriter) printf(format string, args ...any) {
+	lw.emit([]byte(fmt.Sprintf(format, args...)))
+}
+
+// flush emits a trailing line that was not terminated by a newline.
+func (lw *lineWriter) flush() {
+	if len(lw.buf) > 0 {
+		lw.emit(lw.buf)
+		lw.buf = nil
+	}
+}
+
+func (lw *lineWriter) emit(line []byte) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	fmt.Fprintf(lw.out, "%s%s\n", lw.prefix, bytes.TrimRight(line, "\r"))
+}
@@ -0,0 +1,211 @@
+package launcher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/testutil"
+)
+
+// The test binary doubles as a fake bcastnode: when LAUNCHER_HELPER is set,
+// TestMain behaves according to its value instead of running the tests.
+// Positional args are the last two: <config_file> <node_index>.
+func TestMain(m *testing.M) {
+	switch os.Getenv("LAUNCHER_HELPER") {
+	case "":
+		os.Exit(m.Run())
+	case "ok":
+		idx := os.Args[len(os.Args)-1]
+		fmt.Printf("Node %s: hello\n", idx)
+		fmt.Printf("Node %s: args %s\n", idx, strings.Join(os.Args[1:], " "))
+		fmt.Fprintf(os.Stderr, "Node %s: no newline", idx)
+		os.Exit(0)
+	case "fail-odd":
+		idx := os.Args[len(os.Args)-1]
+		if idx == "1" || idx == "3" {
+			os.Exit(3)
+		}
+		time.Sleep(200 * time.Millisecond)
+		os.Exit(0)
+	case "hang":
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	}
+}
+
+func helperOptions(mode string, first, last int) (Options, *testutil.SyncBuffer) {
+	out := &testutil.SyncBuffer{}
+	return Options{
+		Binary:     os.Args[0],
+		ConfigPath: "config.txt",
+		First:      first,
+		Last:       last,
+		Env:        []string{"LAUNCHER_HELPER=" + mode},
+		Grace:      200 * time.Millisecond,
+		Out:        out,
+	}, out
+}
+
+// --- All nodes succeed: output is prefixed per node, exit status 0 ---
+
+func TestRun_AllOK(t *testing.T) {
+	opts, out := helperOptions("ok", 2, 4)
+	opts.NodeArgs = []string{"-capture", "node_{index}.bcap"}
+
+	results, err := Run(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	for i, r := range results {
+		if r.Index != 2+i {
+			t.Errorf("result %d: index %d", i, r.Index)
+		}
+		if !r.OK() {
+			t.Errorf("node %d: expected ok, got %s (%v)", r.Index, r.Status(), r.Err)
+		}
+		if r.PID == 0 {
+			t.Errorf("node %d: pid not recorded", r.Index)
+		}
+	}
+	if ExitStatus(results) != 0 {
+		t.Error("expected exit status 0")
+	}
+
+	text := out.String()
+	for idx := 2; idx <= 4; idx++ {
+		want := fmt.Sprintf("[node %d] Node %d: hello", idx, idx)
+		if !strings.Contains(text, want) {
+			t.Errorf("output missing %q:\n%s", want, text)
+		}
+		args := fmt.Sprintf("[node %d] Node %d: args -capture node_%d.bcap config.txt %d", idx, idx, idx, idx)
+		if !strings.Contains(text, args) {
+			t.Errorf("output missing %q:\n%s", args, text)
+		}
+		tail := fmt.Sprintf("[node %d] Node %d: no newline\n", idx, idx)
+		if !strings.Contains(text, tail) {
+			t.Errorf("unterminated line not flushed, missing %q", tail)
+		}
+	}
+}
+
+// --- A failing node makes the combined exit status non-zero ---
+
+func TestRun_FailureReported(t *testing.T) {
+	opts, _ := helperOptions("fail-odd", 0, 2)
+
+	results, err := Run(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if !results[0].OK() || !results[2].OK() {
+		t.Errorf("nodes 0 and 2 should succeed: %s, %s", results[0].Status(), results[2].Status())
+	}
+	if results[1].OK() || results[1].ExitCode != 3 {
+		t.Errorf("node 1: expected exit 3, got %s", results[1].Status())
+	}
+	if ExitStatus(results) != 1 {
+		t.Error("expected exit status 1")
+	}
+}
+
+// --- Global timeout kills stragglers ---
+
+func TestRun_TimeoutKillsStragglers(t *testing.T) {
+	opts, _ := helperOptions("hang", 0, 1)
+	opts.Timeout = 300 * time.Millisecond
+
+	start := time.Now()
+	results, err := Run(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("stragglers not killed in time: took %v", elapsed)
+	}
+	for _, r := range results {
+		if !r.TimedOut {
+			t.Errorf("node %d: expected timeout, got %s", r.Index, r.Status())
+		}
+	}
+	if ExitStatus(results) != 1 {
+		t.Error("expected exit status 1")
+	}
+}
+
+// --- Fail-fast stops the remaining nodes after the first failure ---
+
+func TestRun_FailFast(t *testing.T) {
+	opts, _ := helperOptions("fail-odd", 0, 1)
+	opts.FailFast = true
+	opts.Env = []string{"LAUNCHER_HELPER=fail-odd"}
+
+	results, err := Run(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if results[1].ExitCode != 3 {
+		t.Errorf("node 1: expected exit 3, got %s", results[1].Status())
+	}
+	if ExitStatus(results) != 1 {
+		t.Error("expected exit status 1")
+	}
+}
+
+// --- Staggering must fit within the assignment's 10-second start window ---
+
+func TestValidate_StaggerWindow(t *testing.T) {
+	opts := Options{Binary: "x", First: 0, Last: 20, Stagger: time.Second}
+	if err := opts.Validate(); err == nil {
+		t.Error("expected error when 21 nodes staggered by 1s exceed the start window")
+	}
+	opts.Stagger = 500 * time.Millisecond
+	if err := opts.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestValidate_BadRange(t *testing.T) {
+	opts := Options{Binary: "x", First: 3, Last: 1}
+	if err := opts.Validate(); err == nil {
+		t.Error("expected error for last < first")
+	}
+}
+
+func TestRun_StartFailure(t *testing.T) {
+	opts := Options{Binary: "/nonexistent/bcastnode", ConfigPath: "c", First: 0, Last: 0}
+	results, err := Run(context.Background(), opts)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if results[0].OK() || results[0].PID != 0 {
+		t.Errorf("expected start failure, got %s", results[0].Status())
+	}
+}
+
+// --- Summary table has a header and one row per node ---
+
+func TestWriteSummary(t *testing.T) {
+	var buf bytes.Buffer
+	WriteSummary(&buf, []Result{
+		{Index: 0, PID: 100, ExitCode: 0, Elapsed: time.Second},
+		{Index: 1, PID: 101, ExitCode: -1, TimedOut: true, Err: context.DeadlineExceeded},
+	})
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got %d:\n%s", len(lines), buf.String())
+	}
+	if !strings.HasPrefix(lines[0], "NODE") {
+		t.Errorf("missing header: %q", lines[0])
+	}
+	if !strings.Contains(lines[1], "ok") || !strings.Contains(lines[2], "killed (timeout)") {
+		t.Errorf("unexpected rows:\n%s", buf.String())
+	}
+}
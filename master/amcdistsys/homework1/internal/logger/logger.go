@@ -1,10 +1,13 @@
 package logger
 
 import (
+	"bufio"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 // MsgLogger writes received-message logs and error logs to separate files.
@@ -21,12 +24,31 @@ const logsDir = "logs"
 // logs/node_<index>_messages.log and logs/node_<index>_errors.log inside it.
 // Caller must call Close() when done.
 func NewMsgLogger(nodeIndex int) (*MsgLogger, error) {
-	if err := os.MkdirAll(logsDir, 0o755); err != nil {
+	return NewMsgLoggerDir(logsDir, nodeIndex)
+}
+
+// NewMsgLoggerDir is like NewMsgLogger but places the log files in dir
+// instead of "logs" (used e.g. by bcastreplay to avoid clobbering live logs).
+func NewMsgLoggerDir(dir string, nodeIndex int) (*MsgLogger, error) {
+	return open(dir, fmt.Sprintf("node_%d", nodeIndex))
+}
+
+// NewTopicLoggerDir opens the logs of one topic in dir:
+// node_<index>_topic_<topic>_messages.log and node_<index>_topic_<topic>_errors.log.
+// The topic name must be safe in a file name, as bcast topic names are.
+func NewTopicLoggerDir(dir string, nodeIndex int, topic string) (*MsgLogger, error) {
+	return open(dir, fmt.Sprintf("node_%d_topic_%s", nodeIndex, topic))
+}
+
+// open creates dir if needed and the <prefix>_messages.log and
+// <prefix>_errors.log files inside it.
+func open(dir, prefix string) (*MsgLogger, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
 		return nil, fmt.Errorf("NewMsgLogger: create logs dir: %w", err)
 	}
 
-	msgPath := filepath.Join(logsDir, fmt.Sprintf("node_%d_messages.log", nodeIndex))
-	errPath := filepath.Join(logsDir, fmt.Sprintf("node_%d_errors.log", nodeIndex))
+	msgPath := filepath.Join(dir, prefix+"_messages.log")
+	errPath := filepath.Join(dir, prefix+"_errors.log")
 
 	msgFile, err := os.Create(msgPath)
 	if err != nil {
@@ -55,6 +77,53 @@ func (l *MsgLogger) LogMessage(ok bool, sourceIndex uint8, sentHex, calcHex stri
 	l.msgLog.Printf("%s %d %s %s", status, sourceIndex, sentHex, calcHex)
 }
 
+// LogRecovered writes the line of a message that was lost and reconstructed
+// from parity datagrams: as LogMessage, followed by " FEC".
+func (l *MsgLogger) LogRecovered(ok bool, sourceIndex uint8, sentHex, calcHex string) {
+	status := "OK"
+	if !ok {
+		status = "FAIL"
+	}
+	l.msgLog.Printf("%s %d %s %s FEC", status, sourceIndex, sentHex, calcHex)
+}
+
+// Entry is one line of a message log.
+type Entry struct {
+	OK          bool
+	SourceIndex uint8
+	SentHex     string
+	CalcHex     string
+	Recovered   bool // written by LogRecovered
+}
+
+// ReadMessageLog parses a message log written by LogMessage and LogRecovered.
+func ReadMessageLog(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("ReadMessageLog: %w", err)
+	}
+	defer f.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		recovered := len(fields) == 5 && fields[4] == "FEC"
+		if (len(fields) != 4 && !recovered) || (fields[0] != "OK" && fields[0] != "FAIL") {
+			return nil, fmt.Errorf("ReadMessageLog: %s:%d: malformed line %q", path, line, scanner.Text())
+		}
+		src, err := strconv.ParseUint(fields[1], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("ReadMessageLog: %s:%d: invalid source %q", path, line, fields[1])
+		}
+		entries = append(entries, Entry{OK: fields[0] == "OK", SourceIndex: uint8(src), SentHex: fields[2], CalcHex: fields[3], Recovered: recovered})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("ReadMessageLog: %w", err)
+	}
+	return entries, nil
+}
+
 // LogError writes a formatted error line to the error log file.
 func (l *MsgLogger) LogError(format string, args ...any) {
 	l.errLog.Printf(format, args...)
@@ -265,3 +265,96 @@ func TestNewMsgLogger_DifferentIndices(t *testing.T) {
 		t.Error("node 1 log should contain 'OK 1'")
 	}
 }
+
+// --- NewMsgLoggerDir writes to a custom directory ---
+
+func TestNewMsgLoggerDir_CustomDir(t *testing.T) {
+	_, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	lg, err := NewMsgLoggerDir("replay", 4)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sha := "0123456789abcdef0123456789abcdef01234567"
+	lg.LogMessage(true, 2, sha, sha)
+	lg.Close()
+
+	data, err := os.ReadFile(filepath.Join("replay", "node_4_messages.log"))
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !strings.HasPrefix(string(data), "OK 2 ") {
+		t.Errorf("unexpected log content: %q", data)
+	}
+	if _, err := os.Stat(logsDir); err == nil {
+		t.Error("default logs dir should not be created")
+	}
+}
+
+// --- NewTopicLoggerDir keeps each topic's logs apart from the node's ---
+
+func TestNewTopicLoggerDir_SeparateFiles(t *testing.T) {
+	_, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewMsgLogger(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	topic, err := NewTopicLoggerDir(logsDir, 1, "chat")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sha := "0123456789abcdef0123456789abcdef01234567"
+	node.LogMessage(true, 0, sha, sha)
+	topic.LogMessage(false, 2, sha, sha)
+	topic.LogError("late")
+	node.Close()
+	topic.Close()
+
+	entries, err := ReadMessageLog(filepath.Join(logsDir, "node_1_topic_chat_messages.log"))
+	if err != nil || len(entries) != 1 || entries[0].OK || entries[0].SourceIndex != 2 {
+		t.Errorf("topic log: %+v, %v", entries, err)
+	}
+	if entries, _ := ReadMessageLog(filepath.Join(logsDir, "node_1_messages.log")); len(entries) != 1 || !entries[0].OK {
+		t.Errorf("node log: %+v", entries)
+	}
+	data, _ := os.ReadFile(filepath.Join(logsDir, "node_1_topic_chat_errors.log"))
+	if !strings.Contains(string(data), "late") {
+		t.Errorf("topic error log: %q", data)
+	}
+}
+
+// --- ReadMessageLog parses what LogMessage wrote ---
+
+func TestReadMessageLog_RoundTrip(t *testing.T) {
+	_, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	lg, err := NewMsgLogger(0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sha := "0123456789abcdef0123456789abcdef01234567"
+	lg.LogMessage(true, 2, sha, sha)
+	lg.LogMessage(false, 7, sha, "ffff")
+	lg.LogRecovered(true, 3, sha, sha)
+	lg.Close()
+
+	entries, err := ReadMessageLog(filepath.Join(logsDir, "node_0_messages.log"))
+	if err != nil {
+		t.Fatalf("ReadMessageLog: %v", err)
+	}
+	want := []Entry{{true, 2, sha, sha, false}, {false, 7, sha, "ffff", false}, {true, 3, sha, sha, true}}
+	if len(entries) != len(want) || entries[0] != want[0] || entries[1] != want[1] || entries[2] != want[2] {
+		t.Errorf("entries: %+v", entries)
+	}
+
+	for _, bad := range []string{"OK two x y\n", "OK 2 x y ARQ\n"} {
+		os.WriteFile("bad.log", []byte(bad), 0o644)
+		if _, err := ReadMessageLog("bad.log"); err == nil {
+			t.Errorf("expected error for malformed line %q", bad)
+		}
+	}
+}
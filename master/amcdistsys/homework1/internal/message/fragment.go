@@ -0,0 +1,342 @@
+package message
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Fragment layout. A fragment is an ordinary 1024-byte message: byte 0 is the
+// sender index and bytes 1004-1023 are the SHA-1 of bytes 0-1003, so the
+// per-datagram integrity check is unchanged. The "random" bytes 1-1003 carry
+// a fragment header followed by a chunk of the application payload:
+//
+//	1-4     payload id (per sender)
+//	5-8     fragment index
+//	9-12    fragment count
+//	13-16   whole payload length
+//	17-36   SHA-1 of the whole payload
+//	37-38   chunk length
+//	39-1003 chunk data
+const (
+	fragIDOff     = 1
+	fragIndexOff  = 5
+	fragTotalOff  = 9
+	fragLenOff    = 13
+	fragDigestOff = 17
+	fragChunkOff  = 37
+	fragDataOff   = 39
+
+	// FragmentDataSize is the number of payload bytes carried per fragment.
+	FragmentDataSize = payloadEnd - fragDataOff
+
+	// MaxFragmentedPayload bounds the payloads that can be split/reassembled,
+	// so a bogus header cannot make a receiver allocate arbitrary memory.
+	MaxFragmentedPayload = 64 << 20
+)
+
+// Fragment is one 1024-byte piece of a larger payload.
+type Fragment struct {
+	raw [MessageSize]byte
+}
+
+// SplitPayload cuts payload into fragments for the given sender and payload id.
+// An empty payload still produces a single (empty) fragment.
+func SplitPayload(senderIndex uint8, payloadID uint32, payload []byte) ([]*Fragment, error) {
+	if len(payload) > MaxFragmentedPayload {
+		return nil, fmt.Errorf("SplitPayload: payload of %d bytes exceeds %d", len(payload), MaxFragmentedPayload)
+	}
+	total := fragmentCount(len(payload))
+	digest := sha1.Sum(payload)
+
+	frags := make([]*Fragment, total)
+	for i := 0; i < total; i++ {
+		chunk := payload[i*FragmentDataSize : min((i+1)*FragmentDataSize, len(payload))]
+		f := &Fragment{}
+		f.raw[0] = senderIndex
+		binary.BigEndian.PutUint32(f.raw[fragIDOff:], payloadID)
+		binary.BigEndian.PutUint32(f.raw[fragIndexOff:], uint32(i))
+		binary.BigEndian.PutUint32(f.raw[fragTotalOff:], uint32(total))
+		binary.BigEndian.PutUint32(f.raw[fragLenOff:], uint32(len(payload)))
+		copy(f.raw[fragDigestOff:fragChunkOff], digest[:])
+		binary.BigEndian.PutUint16(f.raw[fragChunkOff:], uint16(len(chunk)))
+		copy(f.raw[fragDataOff:payloadEnd], chunk)
+		sum := sha1.Sum(f.raw[:payloadEnd])
+		copy(f.raw[payloadEnd:], sum[:])
+		frags[i] = f
+	}
+	return frags, nil
+}
+
+func fragmentCount(payloadLen int) int {
+	if payloadLen == 0 {
+		return 1
+	}
+	return (payloadLen + FragmentDataSize - 1) / FragmentDataSize
+}
+
+// ParseFragment wraps a raw 1024-byte buffer into a Fragment and checks that
+// its header is self-consistent. The SHA-1 trailer is checked by Verify.
+func ParseFragment(buf []byte) (*Fragment, error) {
+	if len(buf) != MessageSize {
+		return nil, fmt.Errorf("ParseFragment: expected %d bytes, got %d", MessageSize, len(buf))
+	}
+	f := &Fragment{}
+	copy(f.raw[:], buf)
+
+	total, index, length := f.Total(), f.Index(), int(f.PayloadLen())
+	chunk := int(binary.BigEndian.Uint16(f.raw[fragChunkOff:]))
+	switch {
+	case total == 0 || index >= total:
+		return nil, fmt.Errorf("ParseFragment: fragment %d of %d", index, total)
+	case length > MaxFragmentedPayload:
+		return nil, fmt.Errorf("ParseFragment: payload length %d exceeds %d", length, MaxFragmentedPayload)
+	case uint32(fragmentCount(length)) != total:
+		return nil, fmt.Errorf("ParseFragment: payload length %d does not split into %d fragments", length, total)
+	case chunk > FragmentDataSize:
+		return nil, fmt.Errorf("ParseFragment: chunk length %d exceeds %d", chunk, FragmentDataSize)
+	case chunk != expectedChunk(length, int(index)):
+		return nil, fmt.Errorf("ParseFragment: fragment %d of a %d-byte payload has %d bytes", index, length, chunk)
+	}
+	return f, nil
+}
+
+func expectedChunk(payloadLen, index int) int {
+	return min(FragmentDataSize, payloadLen-index*FragmentDataSize)
+}
+
+// Bytes returns the raw byte slice for sending over UDP.
+func (f *Fragment) Bytes() []byte {
+	return f.raw[:]
+}
+
+// SenderIndex returns the sender node index from byte 0.
+func (f *Fragment) SenderIndex() uint8 {
+	return f.raw[0]
+}
+
+// PayloadID returns the sender-local id of the payload this fragment belongs to.
+func (f *Fragment) PayloadID() uint32 {
+	return binary.BigEndian.Uint32(f.raw[fragIDOff:])
+}
+
+// Index returns the position of this fragment within its payload.
+func (f *Fragment) Index() uint32 {
+	return binary.BigEndian.Uint32(f.raw[fragIndexOff:])
+}
+
+// Total returns the number of fragments the payload was split into.
+func (f *Fragment) Total() uint32 {
+	return binary.BigEndian.Uint32(f.raw[fragTotalOff:])
+}
+
+// PayloadLen returns the length of the whole payload.
+func (f *Fragment) PayloadLen() uint32 {
+	return binary.BigEndian.Uint32(f.raw[fragLenOff:])
+}
+
+// PayloadDigest returns the SHA-1 of the whole payload as announced by the sender.
+func (f *Fragment) PayloadDigest() [sha1Size]byte {
+	var d [sha1Size]byte
+	copy(d[:], f.raw[fragDigestOff:fragChunkOff])
+	return d
+}
+
+// Data returns the chunk of payload carried by this fragment.
+func (f *Fragment) Data() []byte {
+	n := int(binary.BigEndian.Uint16(f.raw[fragChunkOff:]))
+	return f.raw[fragDataOff:min(fragDataOff+n, payloadEnd)]
+}
+
+// Verify computes SHA-1 of bytes 0-1003 and compares with stored bytes 1004-1023,
+// exactly like Message.Verify. Returns (sentHex, calculatedHex, ok).
+func (f *Fragment) Verify() (sentHex, calcHex string, ok bool) {
+	calc := sha1.Sum(f.raw[:payloadEnd])
+	sentHex = hex.EncodeToString(f.raw[payloadEnd:])
+	calcHex = hex.EncodeToString(calc[:])
+	ok = sentHex == calcHex
+	return
+}
+
+// Payload is a reassembled payload. SentHex is the whole-payload SHA-1
+// announced in the fragment headers, CalcHex the one computed after
+// reassembly; OK reports whether they match.
+type Payload struct {
+	Sender  uint8
+	ID      uint32
+	Data    []byte
+	SentHex string
+	CalcHex string
+	OK      bool
+}
+
+// Incomplete describes a payload whose fragments did not all arrive in time.
+type Incomplete struct {
+	Sender uint8
+	ID     uint32
+	Have   int
+	Total  int
+	Age    time.Duration
+}
+
+type payloadKey struct {
+	sender uint8
+	id     uint32
+}
+
+type partialPayload struct {
+	first  time.Time
+	length uint32
+	digest [sha1Size]byte
+	chunks [][]byte
+	have   int
+}
+
+// maxDoneWindow bounds the completed or expired payload ids a Reassembler
+// remembers per sender above its high-water mark.
+const maxDoneWindow = 4096
+
+// senderWindow is what a Reassembler remembers of the payloads of one sender
+// that are completed or expired, so that late duplicates are ignored: every
+// id below floor, and the ids in done above it. The floor moves up as the
+// ids below it complete, so the memory needed stays bounded.
+type senderWindow struct {
+	floor uint32
+	done  map[uint32]bool
+	last  time.Time // the sender's last fragment, or the expiry of one of its payloads
+}
+
+func (w *senderWindow) isDone(id uint32) bool {
+	return id < w.floor || w.done[id]
+}
+
+func (w *senderWindow) finish(id uint32) {
+	if id < w.floor {
+		return
+	}
+	w.done[id] = true
+	if len(w.done) > maxDoneWindow {
+		// Give up on the oldest gap: its payloads never sent a single fragment.
+		w.floor = id
+		for d := range w.done {
+			w.floor = min(w.floor, d)
+		}
+	}
+	for w.done[w.floor] {
+		delete(w.done, w.floor)
+		w.floor++
+	}
+}
+
+// Reassembler collects fragments into whole payloads. It is not safe for
+// concurrent use; the node's receive loop owns it.
+type Reassembler struct {
+	timeout time.Duration
+	partial map[payloadKey]*partialPayload
+	senders map[uint8]*senderWindow
+}
+
+// NewReassembler creates a Reassembler that gives up on a payload once its
+// first fragment is older than timeout.
+func NewReassembler(timeout time.Duration) *Reassembler {
+	return &Reassembler{
+		timeout: timeout,
+		partial: make(map[payloadKey]*partialPayload),
+		senders: make(map[uint8]*senderWindow),
+	}
+}
+
+// sender returns the window of sender, starting a new one when the sender
+// restarted: its payload ids start again from 0, so an id already done that
+// comes after a silence longer than the timeout is taken for a new payload.
+func (r *Reassembler) sender(sender uint8, id uint32, now time.Time) *senderWindow {
+	w := r.senders[sender]
+	if w == nil || (w.isDone(id) && now.Sub(w.last) > r.timeout) {
+		w = &senderWindow{done: make(map[uint32]bool)}
+		r.senders[sender] = w
+		for key := range r.partial {
+			if key.sender == sender {
+				delete(r.partial, key)
+			}
+		}
+	}
+	w.last = now
+	return w
+}
+
+// Add stores a fragment received at now. It returns the reassembled payload
+// once the last missing fragment arrives, nil while the set is incomplete, and
+// an error if the fragment contradicts the ones already received for its payload.
+func (r *Reassembler) Add(f *Fragment, now time.Time) (*Payload, error) {
+	key := payloadKey{sender: f.SenderIndex(), id: f.PayloadID()}
+	w := r.sender(key.sender, key.id, now)
+	if w.isDone(key.id) {
+		return nil, nil
+	}
+
+	p := r.partial[key]
+	if p == nil {
+		p = &partialPayload{
+			first:  now,
+			length: f.PayloadLen(),
+			digest: f.PayloadDigest(),
+			chunks: make([][]byte, f.Total()),
+		}
+		r.partial[key] = p
+	}
+	if f.PayloadLen() != p.length || f.PayloadDigest() != p.digest || int(f.Total()) != len(p.chunks) {
+		return nil, fmt.Errorf("Reassembler: fragment %d of payload %d from node %d does not match earlier fragments",
+			f.Index(), key.id, key.sender)
+	}
+	if p.chunks[f.Index()] != nil {
+		return nil, nil // duplicate
+	}
+	p.chunks[f.Index()] = append([]byte(nil), f.Data()...)
+	p.have++
+	if p.have < len(p.chunks) {
+		return nil, nil
+	}
+
+	delete(r.partial, key)
+	w.finish(key.id)
+
+	data := make([]byte, 0, p.length)
+	for _, c := range p.chunks {
+		data = append(data, c...)
+	}
+	calc := sha1.Sum(data)
+	res := &Payload{
+		Sender:  key.sender,
+		ID:      key.id,
+		Data:    data,
+		SentHex: hex.EncodeToString(p.digest[:]),
+		CalcHex: hex.EncodeToString(calc[:]),
+	}
+	res.OK = res.SentHex == res.CalcHex
+	return res, nil
+}
+
+// Expire drops and returns the payloads whose first fragment arrived more
+// than the timeout before now, oldest first.
+func (r *Reassembler) Expire(now time.Time) []Incomplete {
+	var expired []Incomplete
+	for key, p := range r.partial {
+		if age := now.Sub(p.first); age > r.timeout {
+			expired = append(expired, Incomplete{Sender: key.sender, ID: key.id, Have: p.have, Total: len(p.chunks), Age: age})
+			delete(r.partial, key)
+			w := r.senders[key.sender]
+			w.finish(key.id)
+			w.last = now
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].Age > expired[j].Age })
+	return expired
+}
+
+// Pending returns the number of payloads still waiting for fragments.
+func (r *Reassembler) Pending() int {
+	return len(r.partial)
+}
@@ -0,0 +1,292 @@
+package message
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"math/rand/v2"
+	"testing"
+	"time"
+)
+
+func randomPayload(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(rand.IntN(256))
+	}
+	return b
+}
+
+// --- Fragments keep the 1024-byte frame: sender at byte 0, SHA-1 trailer ---
+
+func TestSplitPayload_FrameFormat(t *testing.T) {
+	frags, err := SplitPayload(3, 9, randomPayload(3000))
+	if err != nil {
+		t.Fatalf("SplitPayload: %v", err)
+	}
+	if len(frags) != 4 {
+		t.Fatalf("3000 bytes should need 4 fragments of %d, got %d", FragmentDataSize, len(frags))
+	}
+	for i, f := range frags {
+		if len(f.Bytes()) != MessageSize {
+			t.Errorf("fragment %d: %d bytes", i, len(f.Bytes()))
+		}
+		if f.SenderIndex() != 3 || f.Bytes()[0] != 3 {
+			t.Errorf("fragment %d: sender index %d", i, f.SenderIndex())
+		}
+		if f.PayloadID() != 9 || f.Index() != uint32(i) || f.Total() != 4 || f.PayloadLen() != 3000 {
+			t.Errorf("fragment %d: header id=%d index=%d total=%d len=%d", i, f.PayloadID(), f.Index(), f.Total(), f.PayloadLen())
+		}
+		if _, _, ok := f.Verify(); !ok {
+			t.Errorf("fragment %d: SHA-1 trailer does not verify", i)
+		}
+		// The trailer is also a valid plain-message checksum.
+		m, _ := ParseMessage(f.Bytes())
+		if _, _, ok := m.Verify(); !ok {
+			t.Errorf("fragment %d: not a valid message", i)
+		}
+	}
+	if got := len(frags[3].Data()); got != 3000-3*FragmentDataSize {
+		t.Errorf("last chunk: %d bytes", got)
+	}
+}
+
+func TestSplitPayload_Empty(t *testing.T) {
+	frags, err := SplitPayload(0, 0, nil)
+	if err != nil {
+		t.Fatalf("SplitPayload: %v", err)
+	}
+	if len(frags) != 1 || len(frags[0].Data()) != 0 {
+		t.Fatalf("empty payload should give one empty fragment, got %d", len(frags))
+	}
+	r := NewReassembler(time.Second)
+	p, err := r.Add(frags[0], time.Now())
+	if err != nil || p == nil || len(p.Data) != 0 || !p.OK {
+		t.Fatalf("empty payload should reassemble immediately: %+v, %v", p, err)
+	}
+}
+
+func TestSplitPayload_TooLarge(t *testing.T) {
+	if _, err := SplitPayload(0, 0, make([]byte, MaxFragmentedPayload+1)); err == nil {
+		t.Error("expected error for oversized payload")
+	}
+}
+
+// --- Reassembly in any order, with duplicates, yields the original payload ---
+
+func TestReassembler_OutOfOrderWithDuplicates(t *testing.T) {
+	payload := randomPayload(5 << 20) // several MB, like a file
+	frags, err := SplitPayload(1, 42, payload)
+	if err != nil {
+		t.Fatalf("SplitPayload: %v", err)
+	}
+	order := rand.Perm(len(frags))
+
+	r := NewReassembler(time.Minute)
+	now := time.Now()
+	var got *Payload
+	for k, i := range order {
+		buf := frags[i].Bytes()
+		f, err := ParseFragment(buf)
+		if err != nil {
+			t.Fatalf("ParseFragment: %v", err)
+		}
+		p, err := r.Add(f, now)
+		if err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+		if k%100 == 0 {
+			// Re-add a fragment already seen: must be ignored.
+			if dup, err := r.Add(f, now); dup != nil || err != nil {
+				t.Fatalf("duplicate fragment: %+v, %v", dup, err)
+			}
+		}
+		if p != nil {
+			if k != len(order)-1 {
+				t.Fatalf("payload completed after %d of %d fragments", k+1, len(order))
+			}
+			got = p
+		}
+	}
+	if got == nil {
+		t.Fatal("payload never completed")
+	}
+	if !bytes.Equal(got.Data, payload) {
+		t.Fatal("reassembled payload differs from original")
+	}
+	want := sha1.Sum(payload)
+	if !got.OK || got.SentHex != hex.EncodeToString(want[:]) || got.CalcHex != got.SentHex {
+		t.Errorf("digest check: %+v", got)
+	}
+	if got.Sender != 1 || got.ID != 42 {
+		t.Errorf("sender/id: %d/%d", got.Sender, got.ID)
+	}
+	if r.Pending() != 0 {
+		t.Errorf("pending after completion: %d", r.Pending())
+	}
+	// A late duplicate after completion must not start a new set.
+	if p, err := r.Add(frags[0], now); p != nil || err != nil || r.Pending() != 0 {
+		t.Errorf("late duplicate: %+v, %v, pending %d", p, err, r.Pending())
+	}
+}
+
+// --- Payloads from different senders/ids are kept apart ---
+
+func TestReassembler_Interleaved(t *testing.T) {
+	a, b := randomPayload(2500), randomPayload(2500)
+	fa, _ := SplitPayload(0, 1, a)
+	fb, _ := SplitPayload(1, 1, b)
+	r := NewReassembler(time.Minute)
+	now := time.Now()
+	var done []*Payload
+	for i := range fa {
+		for _, f := range []*Fragment{fa[i], fb[i]} {
+			p, err := r.Add(f, now)
+			if err != nil {
+				t.Fatalf("Add: %v", err)
+			}
+			if p != nil {
+				done = append(done, p)
+			}
+		}
+	}
+	if len(done) != 2 || !bytes.Equal(done[0].Data, a) || !bytes.Equal(done[1].Data, b) {
+		t.Fatal("interleaved payloads were mixed up")
+	}
+}
+
+// --- Whole-payload digest catches a fragment swapped in from another payload ---
+
+func TestReassembler_DigestMismatch(t *testing.T) {
+	payload := randomPayload(2000)
+	frags, _ := SplitPayload(0, 5, payload)
+
+	// Forge fragment 1 with different data but the original header fields,
+	// re-sealed so that its own SHA-1 trailer still verifies.
+	forged := *frags[1]
+	forged.raw[fragDataOff] ^= 0xFF
+	sum := sha1.Sum(forged.raw[:payloadEnd])
+	copy(forged.raw[payloadEnd:], sum[:])
+
+	r := NewReassembler(time.Minute)
+	now := time.Now()
+	r.Add(frags[0], now)
+	p, err := r.Add(&forged, now)
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if p, _ = r.Add(frags[2], now); p == nil {
+		t.Fatal("payload should complete")
+	}
+	if p.OK || p.SentHex == p.CalcHex {
+		t.Error("expected whole-payload digest mismatch")
+	}
+}
+
+func TestReassembler_InconsistentHeader(t *testing.T) {
+	f1, _ := SplitPayload(0, 5, randomPayload(2000))
+	f2, _ := SplitPayload(0, 5, randomPayload(2000)) // same id, different payload
+	r := NewReassembler(time.Minute)
+	r.Add(f1[0], time.Now())
+	if _, err := r.Add(f2[1], time.Now()); err == nil {
+		t.Error("expected error for fragment contradicting earlier ones")
+	}
+}
+
+// --- Incomplete sets are given up after the timeout ---
+
+func TestReassembler_Expire(t *testing.T) {
+	frags, _ := SplitPayload(2, 7, randomPayload(3000))
+	r := NewReassembler(time.Second)
+	start := time.Now()
+	r.Add(frags[0], start)
+	r.Add(frags[2], start.Add(500*time.Millisecond))
+
+	if exp := r.Expire(start.Add(900 * time.Millisecond)); len(exp) != 0 {
+		t.Fatalf("expired too early: %+v", exp)
+	}
+	exp := r.Expire(start.Add(1500 * time.Millisecond))
+	if len(exp) != 1 {
+		t.Fatalf("expected 1 expired payload, got %d", len(exp))
+	}
+	if exp[0].Sender != 2 || exp[0].ID != 7 || exp[0].Have != 2 || exp[0].Total != 4 {
+		t.Errorf("unexpected expiry: %+v", exp[0])
+	}
+	if r.Pending() != 0 {
+		t.Errorf("pending after expiry: %d", r.Pending())
+	}
+	// Stragglers of an expired payload are ignored.
+	if p, err := r.Add(frags[1], start.Add(2*time.Second)); p != nil || err != nil || r.Pending() != 0 {
+		t.Errorf("straggler after expiry: %+v, %v", p, err)
+	}
+}
+
+// --- Completed ids are remembered in bounded memory, until a sender restarts ---
+
+func TestReassembler_DoneWindow(t *testing.T) {
+	r := NewReassembler(time.Second)
+	now := time.Now()
+	// Payload 0 never arrives; the others do, in order.
+	for id := uint32(1); id <= 3*maxDoneWindow; id++ {
+		frags, _ := SplitPayload(4, id, randomPayload(10))
+		if p, err := r.Add(frags[0], now); p == nil || err != nil {
+			t.Fatalf("payload %d: %+v, %v", id, p, err)
+		}
+	}
+	w := r.senders[4]
+	if len(w.done) > maxDoneWindow || w.floor == 0 {
+		t.Errorf("window not bounded: floor %d, %d ids above it", w.floor, len(w.done))
+	}
+	// A late duplicate is still ignored.
+	frags, _ := SplitPayload(4, 3*maxDoneWindow, randomPayload(10))
+	if p, _ := r.Add(frags[0], now); p != nil {
+		t.Error("late duplicate delivered again")
+	}
+}
+
+func TestReassembler_SenderRestart(t *testing.T) {
+	r := NewReassembler(time.Second)
+	start := time.Now()
+	first, _ := SplitPayload(1, 0, randomPayload(10))
+	if p, _ := r.Add(first[0], start); p == nil {
+		t.Fatal("first payload not delivered")
+	}
+	// The sender restarts and numbers its payloads from 0 again.
+	again, _ := SplitPayload(1, 0, randomPayload(10))
+	if p, _ := r.Add(again[0], start.Add(500*time.Millisecond)); p != nil {
+		t.Fatal("taken for a restart within the timeout")
+	}
+	if p, _ := r.Add(again[0], start.Add(2*time.Second)); p == nil {
+		t.Error("payload 0 of the restarted sender dropped as a duplicate")
+	}
+}
+
+// --- ParseFragment rejects inconsistent headers ---
+
+func TestParseFragment_Malformed(t *testing.T) {
+	frags, _ := SplitPayload(0, 0, randomPayload(2000))
+	good := frags[0].Bytes()
+
+	mutate := func(fn func(b []byte)) []byte {
+		b := append([]byte(nil), good...)
+		fn(b)
+		return b
+	}
+	cases := map[string][]byte{
+		"short":           good[:100],
+		"zero total":      mutate(func(b []byte) { b[fragTotalOff+3] = 0 }),
+		"index >= total":  mutate(func(b []byte) { b[fragIndexOff+3] = 5 }),
+		"length mismatch": mutate(func(b []byte) { b[fragLenOff+2] = 0xFF }),
+		"chunk too long":  mutate(func(b []byte) { b[fragChunkOff] = 0xFF }),
+		"chunk too short": mutate(func(b []byte) { b[fragChunkOff+1]-- }),
+		"huge length":     mutate(func(b []byte) { b[fragLenOff] = 0xFF }),
+	}
+	for name, buf := range cases {
+		if _, err := ParseFragment(buf); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	if _, err := ParseFragment(good); err != nil {
+		t.Errorf("valid fragment rejected: %v", err)
+	}
+}
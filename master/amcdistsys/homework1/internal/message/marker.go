@@ -0,0 +1,67 @@
+package message
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+)
+
+// Marker layout. A Chandy-Lamport marker is a short datagram, so it can never
+// be mistaken for a 1024-byte message or fragment:
+//
+//	0-1     magic "CL"
+//	2       sender index
+//	3       initiator index
+//	4-7     snapshot id (per initiator)
+//	8-27    SHA-1 of bytes 0-7
+const (
+	MarkerSize = markerSumOff + sha1Size
+
+	markerSenderOff    = 2
+	markerInitiatorOff = 3
+	markerIDOff        = 4
+	markerSumOff       = 8
+)
+
+var markerMagic = []byte("CL")
+
+// Marker separates, on one channel, the datagrams sent before the sender
+// recorded its state for a snapshot from those sent after.
+type Marker struct {
+	Sender    uint8
+	Initiator uint8
+	ID        uint32
+}
+
+// Bytes returns the wire encoding of the marker.
+func (m Marker) Bytes() []byte {
+	buf := make([]byte, MarkerSize)
+	copy(buf, markerMagic)
+	buf[markerSenderOff] = m.Sender
+	buf[markerInitiatorOff] = m.Initiator
+	binary.BigEndian.PutUint32(buf[markerIDOff:], m.ID)
+	sum := sha1.Sum(buf[:markerSumOff])
+	copy(buf[markerSumOff:], sum[:])
+	return buf
+}
+
+// IsMarker reports whether buf looks like a marker, without checking it.
+func IsMarker(buf []byte) bool {
+	return len(buf) == MarkerSize && bytes.HasPrefix(buf, markerMagic)
+}
+
+// ParseMarker decodes a marker and checks its SHA-1.
+func ParseMarker(buf []byte) (Marker, error) {
+	if !IsMarker(buf) {
+		return Marker{}, fmt.Errorf("ParseMarker: not a %d-byte marker", MarkerSize)
+	}
+	if sum := sha1.Sum(buf[:markerSumOff]); !bytes.Equal(sum[:], buf[markerSumOff:]) {
+		return Marker{}, fmt.Errorf("ParseMarker: SHA-1 mismatch")
+	}
+	return Marker{
+		Sender:    buf[markerSenderOff],
+		Initiator: buf[markerInitiatorOff],
+		ID:        binary.BigEndian.Uint32(buf[markerIDOff:]),
+	}, nil
+}
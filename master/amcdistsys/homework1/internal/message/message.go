@@ -9,8 +9,9 @@ import (
 
 const (
 	MessageSize = 1024
-	payloadEnd  = 1004 // bytes 0-1003: node index + random (1004 bytes)
-	sha1Size    = 20   // bytes 1004-1023: SHA-1 checksum
+	PayloadSize = payloadEnd - 1 // bytes 1-1003: application payload (random in the assignment)
+	payloadEnd  = 1004           // bytes 0-1003: node index + random (1004 bytes)
+	sha1Size    = 20             // bytes 1004-1023: SHA-1 checksum
 )
 
 // Message is a fixed-size 1024-byte UDP payload.
@@ -21,14 +22,26 @@ type Message struct {
 // BuildMessage constructs a new Message for the given sender index.
 // Byte 0 = senderIndex, bytes 1-1003 = random, bytes 1004-1023 = SHA-1(bytes 0-1003).
 func BuildMessage(senderIndex uint8) *Message {
+	payload := make([]byte, PayloadSize)
+	for i := range payload {
+		payload[i] = byte(rand.IntN(256))
+	}
+	m, _ := NewMessage(senderIndex, payload) // cannot fail: payload has the right size
+	return m
+}
+
+// NewMessage constructs a Message carrying the given PayloadSize-byte payload
+// in bytes 1-1003 instead of random values.
+func NewMessage(senderIndex uint8, payload []byte) (*Message, error) {
+	if len(payload) != PayloadSize {
+		return nil, fmt.Errorf("NewMessage: expected %d payload bytes, got %d", PayloadSize, len(payload))
+	}
 	m := &Message{}
 	m.raw[0] = senderIndex
-	for i := 1; i < payloadEnd; i++ {
-		m.raw[i] = byte(rand.IntN(256))
-	}
+	copy(m.raw[1:payloadEnd], payload)
 	sum := sha1.Sum(m.raw[:payloadEnd])
 	copy(m.raw[payloadEnd:], sum[:])
-	return m
+	return m, nil
 }
 
 // ParseMessage wraps a raw 1024-byte buffer into a Message.
@@ -51,6 +64,11 @@ func (m *Message) SenderIndex() uint8 {
 	return m.raw[0]
 }
 
+// Payload returns bytes 1-1003.
+func (m *Message) Payload() []byte {
+	return m.raw[1:payloadEnd]
+}
+
 // Verify computes SHA-1 of bytes 0-1003 and compares with stored bytes 1004-1023.
 // Returns (sentHex, calculatedHex, ok).
 func (m *Message) Verify() (sentHex, calcHex string, ok bool) {
@@ -1,6 +1,7 @@
 package message
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"encoding/hex"
 	"testing"
@@ -188,3 +189,170 @@ func TestBuildMessage_RoundTrip(t *testing.T) {
 		}
 	}
 }
+
+// --- NewMessage: caller-supplied payload in bytes 1-1003 ---
+
+func TestNewMessage_Payload(t *testing.T) {
+	payload := make([]byte, PayloadSize)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	msg, err := NewMessage(4, payload)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if msg.SenderIndex() != 4 {
+		t.Errorf("sender index: expected 4, got %d", msg.SenderIndex())
+	}
+	if string(msg.Payload()) != string(payload) {
+		t.Error("payload mismatch")
+	}
+	if _, _, ok := msg.Verify(); !ok {
+		t.Error("expected Verify to return ok=true")
+	}
+}
+
+func TestNewMessage_WrongPayloadSize(t *testing.T) {
+	for _, size := range []int{0, PayloadSize - 1, PayloadSize + 1} {
+		if _, err := NewMessage(0, make([]byte, size)); err == nil {
+			t.Errorf("expected error for payload size %d", size)
+		}
+	}
+}
+
+// --- Chandy-Lamport markers: distinct from messages, checksummed ---
+
+func TestMarker_RoundTrip(t *testing.T) {
+	m := Marker{Sender: 3, Initiator: 1, ID: 7}
+	buf := m.Bytes()
+	if len(buf) != MarkerSize || !IsMarker(buf) {
+		t.Fatalf("marker of %d bytes not recognised", len(buf))
+	}
+	got, err := ParseMarker(buf)
+	if err != nil || got != m {
+		t.Fatalf("round-trip: %+v, %v", got, err)
+	}
+	if IsMarker(BuildMessage(0).Bytes()) {
+		t.Error("a message was taken for a marker")
+	}
+	buf[markerIDOff] ^= 1
+	if _, err := ParseMarker(buf); err == nil {
+		t.Error("expected error for a corrupted marker")
+	}
+}
+
+// --- Topic envelopes: the unit travels unchanged behind a checked header ---
+
+func TestTopic_RoundTrip(t *testing.T) {
+	msg := BuildMessage(2)
+	buf, err := WrapTopic("orders.v2", msg.Bytes())
+	if err != nil {
+		t.Fatalf("WrapTopic: %v", err)
+	}
+	if !IsTopic(buf) || len(buf) > MaxTopicDatagram {
+		t.Fatalf("envelope of %d bytes not recognised", len(buf))
+	}
+	if IsTopic(msg.Bytes()) || IsTopic(Marker{}.Bytes()) {
+		t.Error("a bare message or marker was taken for a topic envelope")
+	}
+	name, unit, err := UnwrapTopic(buf)
+	if err != nil || name != "orders.v2" || !bytes.Equal(unit, msg.Bytes()) {
+		t.Fatalf("round-trip: %q, %v", name, err)
+	}
+
+	corrupt := bytes.Clone(buf)
+	corrupt[topicNameOff] ^= 1
+	if _, _, err := UnwrapTopic(corrupt); err == nil {
+		t.Error("expected error for a corrupted topic name")
+	}
+	if _, _, err := UnwrapTopic(buf[:len(buf)-1]); err == nil {
+		t.Error("expected error for a truncated envelope")
+	}
+	if _, err := WrapTopic("orders", msg.Bytes()[:10]); err == nil {
+		t.Error("expected error for a short unit")
+	}
+}
+
+func TestCheckTopic(t *testing.T) {
+	for _, name := range []string{"a", "load-test_1.b", string(bytes.Repeat([]byte("x"), MaxTopicLen))} {
+		if err := CheckTopic(name); err != nil {
+			t.Errorf("CheckTopic(%q): %v", name, err)
+		}
+	}
+	for _, name := range []string{"", ".hidden", "a/b", "a b", "ü", string(bytes.Repeat([]byte("x"), MaxTopicLen+1))} {
+		if err := CheckTopic(name); err == nil {
+			t.Errorf("CheckTopic(%q): expected error", name)
+		}
+	}
+}
+
+// --- Fuzzing: arbitrary buffers and payloads (seed corpus in testdata/fuzz) ---
+
+func FuzzParseMessage(f *testing.F) {
+	f.Add(BuildMessage(3).Bytes())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := ParseMessage(data)
+		if len(data) != MessageSize {
+			if err == nil {
+				t.Fatalf("accepted a %d-byte buffer", len(data))
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("rejected a %d-byte buffer: %v", len(data), err)
+		}
+		if !bytes.Equal(msg.Bytes(), data) || msg.SenderIndex() != data[0] || !bytes.Equal(msg.Payload(), data[1:payloadEnd]) {
+			t.Fatal("parsed message differs from the buffer")
+		}
+		sentHex, calcHex, ok := msg.Verify()
+		sum := sha1.Sum(data[:payloadEnd])
+		if sentHex != hex.EncodeToString(data[payloadEnd:]) || calcHex != hex.EncodeToString(sum[:]) {
+			t.Fatalf("Verify reported %s/%s", sentHex, calcHex)
+		}
+		// A buffer verifies exactly when it is what NewMessage builds from
+		// its sender and payload.
+		rebuilt, err := NewMessage(msg.SenderIndex(), msg.Payload())
+		if err != nil {
+			t.Fatalf("NewMessage: %v", err)
+		}
+		if ok != bytes.Equal(rebuilt.Bytes(), data) {
+			t.Errorf("Verify = %v, but rebuilding the message gives equal bytes = %v", ok, !ok)
+		}
+	})
+}
+
+func FuzzMessage_RoundTrip(f *testing.F) {
+	f.Add(uint8(0), make([]byte, PayloadSize), 0)
+	f.Fuzz(func(t *testing.T, sender uint8, payload []byte, flip int) {
+		msg, err := NewMessage(sender, payload)
+		if len(payload) != PayloadSize {
+			if err == nil {
+				t.Fatalf("accepted a %d-byte payload", len(payload))
+			}
+			payload = append(payload, make([]byte, PayloadSize)...)[:PayloadSize]
+			msg, err = NewMessage(sender, payload)
+		}
+		if err != nil {
+			t.Fatalf("NewMessage: %v", err)
+		}
+		parsed, err := ParseMessage(msg.Bytes())
+		if err != nil {
+			t.Fatalf("ParseMessage: %v", err)
+		}
+		if parsed.SenderIndex() != sender || !bytes.Equal(parsed.Payload(), payload) {
+			t.Fatal("sender or payload changed on the round-trip")
+		}
+		if _, _, ok := parsed.Verify(); !ok {
+			t.Fatal("Verify failed after the round-trip")
+		}
+
+		// Any single flipped bit is detected.
+		buf := append([]byte(nil), msg.Bytes()...)
+		bit := uint(flip) % (MessageSize * 8)
+		buf[bit/8] ^= 1 << (bit % 8)
+		corrupted, _ := ParseMessage(buf)
+		if _, _, ok := corrupted.Verify(); ok {
+			t.Errorf("Verify accepted a message with bit %d flipped", bit)
+		}
+	})
+}
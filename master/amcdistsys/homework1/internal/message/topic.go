@@ -0,0 +1,93 @@
+package message
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+)
+
+// Topic envelope layout. A broadcast on a named topic travels as its usual
+// 1024-byte unit (message or fragment) behind a header naming the topic, so
+// that several topics share one socket while the unit, and its SHA-1 check,
+// stay unchanged. Broadcasts on the default topic "" are sent bare.
+//
+//	0-1       magic "TP"
+//	2         topic name length L (1-MaxTopicLen)
+//	3-2+L     topic name
+//	3+L-22+L  SHA-1 of bytes 0-2+L
+//	23+L-     the 1024-byte unit
+const (
+	// MaxTopicLen bounds topic names, which also name log files.
+	MaxTopicLen = 64
+	// MaxTopicDatagram is the size of an envelope with the longest name.
+	MaxTopicDatagram = topicNameOff + MaxTopicLen + sha1Size + MessageSize
+
+	topicLenOff  = 2
+	topicNameOff = 3
+)
+
+var topicMagic = []byte("TP")
+
+// CheckTopic reports whether name can name a topic: 1 to MaxTopicLen
+// letters, digits, '-', '_' or '.', not starting with '.'.
+func CheckTopic(name string) error {
+	if name == "" || len(name) > MaxTopicLen {
+		return fmt.Errorf("CheckTopic: topic name %q must be 1 to %d bytes", name, MaxTopicLen)
+	}
+	if name[0] == '.' {
+		return fmt.Errorf("CheckTopic: topic name %q starts with '.'", name)
+	}
+	for _, c := range []byte(name) {
+		ok := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.'
+		if !ok {
+			return fmt.Errorf("CheckTopic: topic name %q has invalid character %q", name, c)
+		}
+	}
+	return nil
+}
+
+// WrapTopic puts unit, a 1024-byte message or fragment, in the envelope of
+// topic name.
+func WrapTopic(name string, unit []byte) ([]byte, error) {
+	if err := CheckTopic(name); err != nil {
+		return nil, fmt.Errorf("WrapTopic: %w", err)
+	}
+	if len(unit) != MessageSize {
+		return nil, fmt.Errorf("WrapTopic: expected a %d-byte unit, got %d bytes", MessageSize, len(unit))
+	}
+	sumOff := topicNameOff + len(name)
+	buf := make([]byte, sumOff+sha1Size+MessageSize)
+	copy(buf, topicMagic)
+	buf[topicLenOff] = byte(len(name))
+	copy(buf[topicNameOff:], name)
+	sum := sha1.Sum(buf[:sumOff])
+	copy(buf[sumOff:], sum[:])
+	copy(buf[sumOff+sha1Size:], unit)
+	return buf, nil
+}
+
+// IsTopic reports whether buf looks like a topic envelope, without checking
+// it. Envelopes are always longer than a bare unit.
+func IsTopic(buf []byte) bool {
+	return len(buf) > MessageSize && bytes.HasPrefix(buf, topicMagic)
+}
+
+// UnwrapTopic checks a topic envelope and returns the topic name and the
+// unit it carries, which still has to be verified on its own.
+func UnwrapTopic(buf []byte) (name string, unit []byte, err error) {
+	if !IsTopic(buf) {
+		return "", nil, fmt.Errorf("UnwrapTopic: not a topic envelope")
+	}
+	sumOff := topicNameOff + int(buf[topicLenOff])
+	if len(buf) != sumOff+sha1Size+MessageSize {
+		return "", nil, fmt.Errorf("UnwrapTopic: %d bytes for a %d-byte topic name", len(buf), buf[topicLenOff])
+	}
+	if sum := sha1.Sum(buf[:sumOff]); !bytes.Equal(sum[:], buf[sumOff:sumOff+sha1Size]) {
+		return "", nil, fmt.Errorf("UnwrapTopic: header SHA-1 mismatch")
+	}
+	name = string(buf[topicNameOff:sumOff])
+	if err := CheckTopic(name); err != nil {
+		return "", nil, fmt.Errorf("UnwrapTopic: %w", err)
+	}
+	return name, buf[sumOff+sha1Size:], nil
+}
@@ -0,0 +1,106 @@
+package mutex
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// Section is one stay of a node in the critical section, as recorded by the
+// node itself: the logical stamp Lock returned and the wall-clock times of
+// entering and leaving. Nodes on one host share the clock, so the sections of
+// all of them can be compared.
+type Section struct {
+	Node  int
+	Entry int // 0 for the node's first section
+	Stamp uint64
+	Enter time.Time
+	Exit  time.Time
+}
+
+// String formats s as one line of a section log:
+// "<node> <entry> <stamp> <enter_unix_ns> <exit_unix_ns>".
+func (s Section) String() string {
+	return fmt.Sprintf("%d %d %d %d %d", s.Node, s.Entry, s.Stamp, s.Enter.UnixNano(), s.Exit.UnixNano())
+}
+
+// ReadSections parses a section log written with Section.String, one line
+// per section.
+func ReadSections(path string) ([]Section, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("ReadSections: %w", err)
+	}
+	defer f.Close()
+
+	var sections []Section
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		var s Section
+		var enter, exit int64
+		if _, err := fmt.Sscanf(sc.Text(), "%d %d %d %d %d", &s.Node, &s.Entry, &s.Stamp, &enter, &exit); err != nil {
+			return nil, fmt.Errorf("ReadSections: %s:%d: %w", path, line, err)
+		}
+		s.Enter, s.Exit = time.Unix(0, enter), time.Unix(0, exit)
+		sections = append(sections, s)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("ReadSections: %w", err)
+	}
+	return sections, nil
+}
+
+// Check verifies the sections recorded by n nodes that each entered the
+// critical section k times: no two sections overlap in time, and they
+// happened in increasing (stamp, node) order, as both algorithms guarantee.
+// It returns one line per problem.
+func Check(sections []Section, n, k int) []string {
+	var problems []string
+	entries := make([]map[int]bool, n)
+	for i := range entries {
+		entries[i] = map[int]bool{}
+	}
+	for _, s := range sections {
+		switch {
+		case s.Node < 0 || s.Node >= n:
+			problems = append(problems, fmt.Sprintf("node %d: index out of range [0, %d)", s.Node, n))
+			continue
+		case entries[s.Node][s.Entry]:
+			problems = append(problems, fmt.Sprintf("node %d: entry %d recorded twice", s.Node, s.Entry))
+		case s.Exit.Before(s.Enter):
+			problems = append(problems, fmt.Sprintf("node %d: entry %d left before entering", s.Node, s.Entry))
+		}
+		entries[s.Node][s.Entry] = true
+	}
+	for i, e := range entries {
+		if len(e) != k {
+			problems = append(problems, fmt.Sprintf("node %d: %d of %d entries recorded", i, len(e), k))
+		}
+	}
+
+	sorted := append([]Section(nil), sections...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Enter.Before(sorted[j].Enter) })
+	for i := 1; i < len(sorted); i++ {
+		prev, cur := sorted[i-1], sorted[i]
+		if !before(prev.Stamp, prev.Node, cur.Stamp, cur.Node) {
+			problems = append(problems, fmt.Sprintf("node %d entry %d (stamp %d) entered after node %d entry %d (stamp %d)",
+				cur.Node, cur.Entry, cur.Stamp, prev.Node, prev.Entry, prev.Stamp))
+		}
+	}
+	// Compare each section with the one that, of those entered before it,
+	// was left last.
+	var last *Section
+	for i := range sorted {
+		cur := &sorted[i]
+		if last != nil && cur.Enter.Before(last.Exit) {
+			problems = append(problems, fmt.Sprintf("node %d entry %d overlaps node %d entry %d by %v",
+				cur.Node, cur.Entry, last.Node, last.Entry, last.Exit.Sub(cur.Enter)))
+		}
+		if last == nil || cur.Exit.After(last.Exit) {
+			last = cur
+		}
+	}
+	return problems
+}
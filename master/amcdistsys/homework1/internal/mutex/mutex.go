@@ -0,0 +1,610 @@
+package mutex
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/node"
+)
+
+// Algorithm selects how nodes agree on who enters the critical section.
+type Algorithm int
+
+const (
+	// RicartAgrawala asks every other node for permission with a request
+	// stamped by a Lamport clock; a node defers its reply while it is in the
+	// critical section or wants it with an earlier (stamp, index).
+	RicartAgrawala Algorithm = iota
+	// TokenRing passes a single token around the nodes in index order; only
+	// its holder may enter.
+	TokenRing
+)
+
+func (a Algorithm) String() string {
+	switch a {
+	case RicartAgrawala:
+		return "ricart-agrawala"
+	case TokenRing:
+		return "token-ring"
+	}
+	return fmt.Sprintf("Algorithm(%d)", int(a))
+}
+
+// ParseAlgorithm parses "ricart-agrawala" (or "ra") and "token-ring" (or "ring").
+func ParseAlgorithm(s string) (Algorithm, error) {
+	switch strings.ToLower(s) {
+	case "ricart-agrawala", "ra":
+		return RicartAgrawala, nil
+	case "token-ring", "ring":
+		return TokenRing, nil
+	}
+	return 0, fmt.Errorf("ParseAlgorithm: unknown algorithm %q (want ricart-agrawala or token-ring)", s)
+}
+
+// Options configures a Mutex.
+type Options struct {
+	Algorithm Algorithm
+	// Retry is how often unanswered requests, tokens and leave notices are
+	// sent again: every frame may be lost on UDP. Defaults to 100ms.
+	Retry time.Duration
+	// IdleHold is how long a token-ring node that does not want the critical
+	// section keeps the token before passing it on, so that an idle ring does
+	// not spin. Defaults to 1ms.
+	IdleHold time.Duration
+	// Log receives one line per protocol event; nil discards them.
+	Log io.Writer
+}
+
+const (
+	defaultRetry    = 100 * time.Millisecond
+	defaultIdleHold = time.Millisecond
+)
+
+// ErrClosed is returned by Lock and Leave once the mutex has stopped.
+var ErrClosed = errors.New("mutex: closed")
+
+// Mutex is one node's end of a distributed mutual exclusion protocol among
+// the nodes of a config, addressed by their index in config.Config.Nodes.
+// Every node must keep running, Leave included, until all of them have left:
+// the others need its replies or its link of the ring.
+type Mutex struct {
+	self      int
+	n         int
+	transport node.Transport
+	opts      Options
+	log       *log.Logger
+
+	calls   chan func() // run by the event loop
+	stopped chan struct{}
+
+	// Owned by the event loop.
+	clock    uint64      // Lamport clock
+	waiting  chan uint64 // Lock waiting for the grant, nil if none
+	inCS     bool
+	reqStamp uint64   // RA: stamp of the outstanding request
+	replied  []bool   // RA: replies to it
+	deferred []uint64 // RA: stamps of the deferred requests, 0 if none
+	lastReq  []uint64 // RA: latest request stamp seen from each node
+	token    bool     // ring: this node holds the token
+	tokenSeq uint64   // ring: passes of the token so far
+	passing  bool     // ring: token sent on, not yet acknowledged
+	passAt   time.Time
+	leaving  chan struct{} // Leave waiting for the others, nil if none
+	left     []bool        // LEAVE received from each node
+	leaveAck []bool        // our LEAVE acknowledged by each node
+
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// New creates the Mutex of node self in a cluster of n nodes. The mutex
+// takes ownership of t.
+func New(self, n int, t node.Transport, opts Options) (*Mutex, error) {
+	if n < 1 || n > 256 {
+		return nil, fmt.Errorf("mutex.New: cluster of %d nodes, want 1 to 256", n)
+	}
+	if self < 0 || self >= n {
+		return nil, fmt.Errorf("mutex.New: node index %d out of range [0, %d)", self, n)
+	}
+	if opts.Algorithm != RicartAgrawala && opts.Algorithm != TokenRing {
+		return nil, fmt.Errorf("mutex.New: unknown algorithm %v", opts.Algorithm)
+	}
+	if opts.Retry <= 0 {
+		opts.Retry = defaultRetry
+	}
+	if opts.IdleHold <= 0 {
+		opts.IdleHold = defaultIdleHold
+	}
+	w := opts.Log
+	if w == nil {
+		w = io.Discard
+	}
+	return &Mutex{
+		self:      self,
+		n:         n,
+		transport: t,
+		opts:      opts,
+		log:       log.New(w, fmt.Sprintf("node %d: ", self), log.LstdFlags|log.Lmicroseconds),
+		calls:     make(chan func()),
+		replied:   make([]bool, n),
+		deferred:  make([]uint64, n),
+		lastReq:   make([]uint64, n),
+		token:     self == 0, // node 0 creates the token
+		left:      make([]bool, n),
+		leaveAck:  make([]bool, n),
+	}, nil
+}
+
+// Start runs the protocol until ctx is done or Close is called.
+func (m *Mutex) Start(ctx context.Context) error {
+	if m.stopped != nil {
+		return fmt.Errorf("Start: mutex already started")
+	}
+	ctx, m.cancel = context.WithCancel(ctx)
+	m.stopped = make(chan struct{})
+	inbox := make(chan frame, 64)
+	go func() {
+		<-ctx.Done()
+		m.closeTransport()
+	}()
+	go m.receiveLoop(ctx, inbox)
+	go func() {
+		defer close(m.stopped)
+		m.eventLoop(ctx, inbox)
+	}()
+	return nil
+}
+
+// Close stops the protocol and closes the transport.
+func (m *Mutex) Close() error {
+	if m.cancel == nil {
+		return m.closeTransport()
+	}
+	m.cancel()
+	err := m.closeTransport()
+	<-m.stopped
+	return err
+}
+
+func (m *Mutex) closeTransport() error {
+	m.closeOnce.Do(func() { m.closeErr = m.transport.Close() })
+	return m.closeErr
+}
+
+// call runs fn on the event loop and waits for it to return.
+func (m *Mutex) call(fn func()) error {
+	if m.stopped == nil {
+		return fmt.Errorf("mutex: not started")
+	}
+	done := make(chan struct{})
+	select {
+	case m.calls <- func() { fn(); close(done) }:
+		<-done
+		return nil
+	case <-m.stopped:
+		return ErrClosed
+	}
+}
+
+// Lock blocks until the node is in the critical section and returns the
+// logical stamp of the entry: the Lamport stamp of the request with
+// Ricart-Agrawala, the token's pass count with the token ring. Entries happen
+// in increasing (stamp, node index) order. If ctx is done first, the request
+// is withdrawn and ctx's error returned.
+func (m *Mutex) Lock(ctx context.Context) (uint64, error) {
+	granted := make(chan uint64, 1)
+	var err error
+	if cerr := m.call(func() {
+		if m.waiting != nil || m.inCS {
+			err = fmt.Errorf("Lock: already locked or locking")
+			return
+		}
+		if m.left[m.self] {
+			err = fmt.Errorf("Lock: node has left")
+			return
+		}
+		m.waiting = granted
+		m.request()
+	}); cerr != nil {
+		return 0, fmt.Errorf("Lock: %w", cerr)
+	}
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case stamp := <-granted:
+		return stamp, nil
+	case <-m.stopped:
+		return 0, fmt.Errorf("Lock: %w", ErrClosed)
+	case <-ctx.Done():
+		m.call(func() {
+			if m.waiting == granted {
+				m.withdraw()
+			}
+		})
+		select {
+		case <-granted: // granted meanwhile: give it back
+			m.Unlock()
+		default:
+		}
+		return 0, ctx.Err()
+	}
+}
+
+// Unlock leaves the critical section.
+func (m *Mutex) Unlock() {
+	m.call(func() {
+		if !m.inCS {
+			m.log.Printf("Unlock outside the critical section")
+			return
+		}
+		m.inCS = false
+		m.log.Printf("left the critical section")
+		m.release()
+	})
+}
+
+// Leave announces that this node will not enter the critical section again
+// and waits until every node has left. Until Close, the node keeps answering
+// requests and passing the token on; it should linger a few Retry intervals
+// after Leave returns, so that the others' last retransmissions are answered.
+func (m *Mutex) Leave(ctx context.Context) error {
+	done := make(chan struct{})
+	var err error
+	if cerr := m.call(func() {
+		if m.waiting != nil || m.inCS {
+			err = fmt.Errorf("Leave: critical section held or requested")
+			return
+		}
+		if m.left[m.self] {
+			err = fmt.Errorf("Leave: node has already left")
+			return
+		}
+		m.leaving = done
+		m.left[m.self], m.leaveAck[m.self] = true, true
+		m.log.Printf("leaving")
+		m.sendLeave()
+		m.checkLeft()
+	}); cerr != nil {
+		return fmt.Errorf("Leave: %w", cerr)
+	}
+	if err != nil {
+		return err
+	}
+	select {
+	case <-done:
+		return nil
+	case <-m.stopped:
+		return fmt.Errorf("Leave: %w", ErrClosed)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *Mutex) receiveLoop(ctx context.Context, inbox chan<- frame) {
+	buf := make([]byte, frameSize+1)
+	for {
+		recvd, from, err := m.transport.Recv(buf)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue // timeouts are expected; the event loop keeps its own time
+		}
+		f, err := parseFrame(buf[:recvd], m.n)
+		if err != nil {
+			m.log.Printf("dropping datagram from %v: %v", from, err)
+			continue
+		}
+		select {
+		case inbox <- f:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *Mutex) eventLoop(ctx context.Context, inbox <-chan frame) {
+	retry := time.NewTicker(m.opts.Retry)
+	defer retry.Stop()
+	var hold <-chan time.Time
+	if m.opts.Algorithm == TokenRing {
+		t := time.NewTicker(m.opts.IdleHold)
+		defer t.Stop()
+		hold = t.C
+	}
+
+	m.log.Printf("started (%v, %d nodes)", m.opts.Algorithm, m.n)
+	for {
+		select {
+		case <-ctx.Done():
+			m.log.Printf("stopped at clock %d", m.clock)
+			return
+		case fn := <-m.calls:
+			fn()
+		case f := <-inbox:
+			m.handle(f)
+		case <-retry.C:
+			m.retransmit()
+		case <-hold:
+			if m.token && m.waiting == nil && !m.inCS {
+				m.pass()
+			}
+		}
+	}
+}
+
+// request starts acquiring the critical section for the waiting Lock.
+func (m *Mutex) request() {
+	if m.opts.Algorithm == TokenRing {
+		if m.token {
+			m.enter(m.tokenSeq)
+		}
+		return
+	}
+	m.clock++
+	m.reqStamp = m.clock
+	for i := range m.replied {
+		m.replied[i] = i == m.self
+	}
+	m.log.Printf("requesting at stamp %d", m.reqStamp)
+	m.sendOthers(frame{typ: request, stamp: m.reqStamp}, nil)
+	m.checkReplies()
+}
+
+// withdraw gives up the waiting Lock's request.
+func (m *Mutex) withdraw() {
+	m.waiting = nil
+	m.log.Printf("request withdrawn")
+	if m.opts.Algorithm == RicartAgrawala {
+		m.reqStamp = 0
+		m.replyDeferred()
+	}
+}
+
+func (m *Mutex) enter(stamp uint64) {
+	m.inCS = true
+	m.log.Printf("entered the critical section at stamp %d", stamp)
+	m.waiting <- stamp
+	m.waiting = nil
+}
+
+// release hands the critical section on after Unlock.
+func (m *Mutex) release() {
+	if m.opts.Algorithm == TokenRing {
+		m.pass()
+		return
+	}
+	m.reqStamp = 0
+	m.replyDeferred()
+}
+
+func (m *Mutex) handle(f frame) {
+	switch f.typ {
+	case request, reply:
+		if f.stamp > m.clock {
+			m.clock = f.stamp
+		}
+		m.clock++
+		if f.typ == request {
+			m.handleRequest(f)
+		} else if m.reqStamp != 0 && f.ref == m.reqStamp {
+			m.replied[f.from] = true
+			m.checkReplies()
+		}
+	case token:
+		m.send(f.from, frame{typ: tokenAck, ref: f.stamp})
+		if f.stamp <= m.tokenSeq {
+			return // a retransmission of a token we already had
+		}
+		m.token, m.tokenSeq = true, f.stamp
+		m.passing = false // it went all the way round
+		if m.waiting != nil {
+			m.enter(m.tokenSeq)
+		}
+	case tokenAck:
+		if m.passing && f.ref == m.tokenSeq {
+			m.passing = false
+		}
+	case leave:
+		m.send(f.from, frame{typ: leaveAck})
+		if !m.left[f.from] {
+			m.left[f.from] = true
+			m.log.Printf("node %d left", f.from)
+			m.checkLeft()
+		}
+	case leaveAck:
+		m.leaveAck[f.from] = true
+		m.checkLeft()
+	}
+}
+
+// handleRequest answers a Ricart-Agrawala request at once, or defers the
+// reply while this node is in the critical section or asked for it first.
+func (m *Mutex) handleRequest(f frame) {
+	if f.stamp < m.lastReq[f.from] {
+		return // delayed copy of an older request
+	}
+	m.lastReq[f.from] = f.stamp
+	mine := m.inCS || m.reqStamp != 0 && before(m.reqStamp, m.self, f.stamp, f.from)
+	if mine {
+		if m.deferred[f.from] != f.stamp {
+			m.log.Printf("deferring node %d (stamp %d)", f.from, f.stamp)
+		}
+		m.deferred[f.from] = f.stamp
+		return
+	}
+	m.send(f.from, frame{typ: reply, stamp: m.clock, ref: f.stamp})
+}
+
+// before reports whether request (s1, n1) has priority over (s2, n2).
+func before(s1 uint64, n1 int, s2 uint64, n2 int) bool {
+	return s1 < s2 || s1 == s2 && n1 < n2
+}
+
+func (m *Mutex) checkReplies() {
+	if m.waiting == nil || m.reqStamp == 0 {
+		return
+	}
+	for _, ok := range m.replied {
+		if !ok {
+			return
+		}
+	}
+	m.enter(m.reqStamp)
+}
+
+func (m *Mutex) replyDeferred() {
+	for i, stamp := range m.deferred {
+		if stamp != 0 {
+			m.clock++
+			m.send(i, frame{typ: reply, stamp: m.clock, ref: stamp})
+			m.deferred[i] = 0
+		}
+	}
+}
+
+// pass sends the token to the next node of the ring.
+func (m *Mutex) pass() {
+	if m.n == 1 {
+		m.tokenSeq++ // the token just comes back
+		return
+	}
+	m.token = false
+	m.tokenSeq++
+	m.passing, m.passAt = true, time.Now()
+	m.send((m.self+1)%m.n, frame{typ: token, stamp: m.tokenSeq})
+}
+
+// retransmit sends again whatever may have been lost.
+func (m *Mutex) retransmit() {
+	if m.opts.Algorithm == RicartAgrawala && m.waiting != nil && m.reqStamp != 0 {
+		m.sendOthers(frame{typ: request, stamp: m.reqStamp}, m.replied)
+	}
+	if m.passing && time.Since(m.passAt) >= m.opts.Retry {
+		m.send((m.self+1)%m.n, frame{typ: token, stamp: m.tokenSeq})
+	}
+	if m.leaving != nil {
+		m.sendLeave()
+	}
+}
+
+func (m *Mutex) sendLeave() {
+	m.sendOthers(frame{typ: leave}, m.leaveAck)
+}
+
+func (m *Mutex) checkLeft() {
+	if m.leaving == nil {
+		return
+	}
+	for i := 0; i < m.n; i++ {
+		if !m.left[i] || !m.leaveAck[i] {
+			return
+		}
+	}
+	m.log.Printf("all nodes left")
+	close(m.leaving)
+	m.leaving = nil
+}
+
+// --- Transport ---
+
+func (m *Mutex) send(to int, f frame) {
+	f.from = m.self
+	if err := m.transport.Send(to, f.marshal()); err != nil && !errors.Is(err, net.ErrClosed) {
+		m.log.Printf("send %v to node %d: %v", f.typ, to, err)
+	}
+}
+
+// sendOthers sends f to every other node, except those marked in skip.
+func (m *Mutex) sendOthers(f frame, skip []bool) {
+	for i := 0; i < m.n; i++ {
+		if i != m.self && (skip == nil || !skip[i]) {
+			m.send(i, f)
+		}
+	}
+}
+
+// Wire format, 20 bytes: magic, type, sender index, unused, Lamport stamp
+// (or token pass count), and the stamp of the request or token acknowledged.
+const (
+	frameMagic = 0xE5
+	frameSize  = 20
+)
+
+type frameType uint8
+
+const (
+	request frameType = iota + 1
+	reply
+	token
+	tokenAck
+	leave
+	leaveAck
+)
+
+func (t frameType) String() string {
+	switch t {
+	case request:
+		return "REQUEST"
+	case reply:
+		return "REPLY"
+	case token:
+		return "TOKEN"
+	case tokenAck:
+		return "TOKEN-ACK"
+	case leave:
+		return "LEAVE"
+	case leaveAck:
+		return "LEAVE-ACK"
+	}
+	return fmt.Sprintf("frameType(%d)", uint8(t))
+}
+
+type frame struct {
+	typ   frameType
+	from  int
+	stamp uint64
+	ref   uint64
+}
+
+func (f frame) marshal() []byte {
+	buf := make([]byte, frameSize)
+	buf[0] = frameMagic
+	buf[1] = byte(f.typ)
+	buf[2] = byte(f.from)
+	binary.BigEndian.PutUint64(buf[4:], f.stamp)
+	binary.BigEndian.PutUint64(buf[12:], f.ref)
+	return buf
+}
+
+func parseFrame(buf []byte, n int) (frame, error) {
+	if len(buf) != frameSize || buf[0] != frameMagic {
+		return frame{}, fmt.Errorf("parseFrame: not a mutex frame (%d bytes)", len(buf))
+	}
+	f := frame{
+		typ:   frameType(buf[1]),
+		from:  int(buf[2]),
+		stamp: binary.BigEndian.Uint64(buf[4:]),
+		ref:   binary.BigEndian.Uint64(buf[12:]),
+	}
+	if f.typ < request || f.typ > leaveAck {
+		return frame{}, fmt.Errorf("parseFrame: unknown type %d", buf[1])
+	}
+	if f.from >= n {
+		return frame{}, fmt.Errorf("parseFrame: sender %d out of range", f.from)
+	}
+	return f, nil
+}
@@ -0,0 +1,246 @@
+package mutex
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/node"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/testutil"
+)
+
+// lossyTransport drops a fraction of the datagrams it sends.
+type lossyTransport struct {
+	node.Transport
+	loss float64
+}
+
+func (t *lossyTransport) Send(to int, data []byte) error {
+	if rand.Float64() < t.loss {
+		return nil
+	}
+	return t.Transport.Send(to, data)
+}
+
+// --- Harness: in-process cluster over a MemNetwork ---
+
+func newCluster(t *testing.T, algo Algorithm, n int, loss float64) []*Mutex {
+	t.Helper()
+	c := testutil.NewCluster(t, n, func(i int, tr node.Transport) (*Mutex, error) {
+		return New(i, n, &lossyTransport{tr, loss}, Options{Algorithm: algo, Retry: 10 * time.Millisecond})
+	})
+	c.StartAll()
+	return c.Nodes
+}
+
+// run has every node enter the critical section k times, failing the test if
+// two nodes are ever inside at once, and returns the recorded sections.
+func run(t *testing.T, nodes []*Mutex, k int) []Section {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var inside atomic.Int32
+	var mu sync.Mutex
+	var sections []Section
+	var wg sync.WaitGroup
+	for i, m := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := 0; entry < k; entry++ {
+				stamp, err := m.Lock(ctx)
+				if err != nil {
+					t.Errorf("node %d: Lock: %v", i, err)
+					return
+				}
+				s := Section{Node: i, Entry: entry, Stamp: stamp, Enter: time.Now()}
+				if inside.Add(1) != 1 {
+					t.Errorf("node %d: entered while another node was inside", i)
+				}
+				time.Sleep(time.Duration(rand.IntN(500)) * time.Microsecond)
+				inside.Add(-1)
+				s.Exit = time.Now()
+				m.Unlock()
+
+				mu.Lock()
+				sections = append(sections, s)
+				mu.Unlock()
+			}
+			if err := m.Leave(ctx); err != nil {
+				t.Errorf("node %d: Leave: %v", i, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return sections
+}
+
+// --- Mutual exclusion: no overlapping sections, entries in stamp order ---
+
+func TestMutex_MutualExclusion(t *testing.T) {
+	for _, algo := range []Algorithm{RicartAgrawala, TokenRing} {
+		for _, loss := range []float64{0, 0.2} {
+			t.Run(algo.String(), func(t *testing.T) {
+				const n, k = 4, 10
+				sections := run(t, newCluster(t, algo, n, loss), k)
+				if problems := Check(sections, n, k); len(problems) > 0 {
+					t.Errorf("loss %v:\n%s", loss, strings.Join(problems, "\n"))
+				}
+			})
+		}
+	}
+}
+
+func TestMutex_SingleNode(t *testing.T) {
+	for _, algo := range []Algorithm{RicartAgrawala, TokenRing} {
+		sections := run(t, newCluster(t, algo, 1, 0), 3)
+		if problems := Check(sections, 1, 3); len(problems) > 0 {
+			t.Errorf("%v: %v", algo, problems)
+		}
+	}
+}
+
+// --- Lock gives up when its context is done, without blocking the others ---
+
+func TestMutex_LockCancel(t *testing.T) {
+	for _, algo := range []Algorithm{RicartAgrawala, TokenRing} {
+		nodes := newCluster(t, algo, 2, 0)
+		if _, err := nodes[0].Lock(context.Background()); err != nil {
+			t.Fatalf("%v: Lock: %v", algo, err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, err := nodes[1].Lock(ctx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("%v: expected DeadlineExceeded while node 0 holds the lock, got %v", algo, err)
+		}
+		if _, err := nodes[0].Lock(context.Background()); err == nil {
+			t.Errorf("%v: expected error locking twice", algo)
+		}
+		nodes[0].Unlock()
+
+		ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+		if _, err := nodes[1].Lock(ctx); err != nil {
+			t.Errorf("%v: Lock after a withdrawn request: %v", algo, err)
+		}
+		cancel()
+	}
+}
+
+// --- Checker: overlaps, order violations and missing entries are reported ---
+
+func TestCheck(t *testing.T) {
+	at := func(ms int) time.Time { return time.Unix(0, 0).Add(time.Duration(ms) * time.Millisecond) }
+	good := []Section{
+		{Node: 0, Entry: 0, Stamp: 1, Enter: at(0), Exit: at(10)},
+		{Node: 1, Entry: 0, Stamp: 1, Enter: at(10), Exit: at(20)},
+		{Node: 0, Entry: 1, Stamp: 5, Enter: at(25), Exit: at(30)},
+		{Node: 1, Entry: 1, Stamp: 7, Enter: at(31), Exit: at(32)},
+	}
+	if problems := Check(good, 2, 2); len(problems) > 0 {
+		t.Fatalf("valid sections reported: %v", problems)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(s []Section) []Section
+		want   string
+	}{
+		{"overlap", func(s []Section) []Section { s[0].Exit = at(12); return s }, "node 1 entry 0 overlaps node 0 entry 0 by 2ms"},
+		{"nested", func(s []Section) []Section { s[0].Exit = at(31); return s }, "node 0 entry 1 overlaps node 0 entry 0 by 6ms"},
+		{"order", func(s []Section) []Section { s[2].Stamp = 0; return s }, "node 0 entry 1 (stamp 0) entered after node 1 entry 0 (stamp 1)"},
+		{"tie", func(s []Section) []Section { s[0].Node, s[1].Node = 1, 0; return s }, "entered after node 1 entry 0"},
+		{"missing", func(s []Section) []Section { return s[:3] }, "node 1: 1 of 2 entries recorded"},
+		{"duplicate", func(s []Section) []Section { s[2].Entry = 0; return s }, "node 0: entry 0 recorded twice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sections := tt.modify(append([]Section(nil), good...))
+			problems := strings.Join(Check(sections, 2, 2), "\n")
+			if !strings.Contains(problems, tt.want) {
+				t.Errorf("want %q among the problems, got:\n%s", tt.want, problems)
+			}
+		})
+	}
+}
+
+func TestReadSections_RoundTrip(t *testing.T) {
+	want := []Section{
+		{Node: 2, Entry: 0, Stamp: 9, Enter: time.Unix(0, 1_700_000_000_000_000_001), Exit: time.Unix(0, 1_700_000_000_000_000_002)},
+		{Node: 2, Entry: 1, Stamp: 12, Enter: time.Unix(0, 1_700_000_000_000_000_003), Exit: time.Unix(0, 1_700_000_000_000_000_004)},
+	}
+	path := filepath.Join(t.TempDir(), "sections.log")
+	var lines []string
+	for _, s := range want {
+		lines = append(lines, s.String())
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadSections(path)
+	if err != nil {
+		t.Fatalf("ReadSections: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d sections, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i].Node != want[i].Node || got[i].Entry != want[i].Entry || got[i].Stamp != want[i].Stamp ||
+			!got[i].Enter.Equal(want[i].Enter) || !got[i].Exit.Equal(want[i].Exit) {
+			t.Errorf("section %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	os.WriteFile(path, []byte("2 0 x 1 2\n"), 0o644)
+	if _, err := ReadSections(path); err == nil {
+		t.Error("expected error for a malformed line")
+	}
+}
+
+// --- Wire format and option validation ---
+
+func TestFrame_RoundTrip(t *testing.T) {
+	f := frame{typ: reply, from: 3, stamp: 1 << 40, ref: 77}
+	got, err := parseFrame(f.marshal(), 4)
+	if err != nil || got != f {
+		t.Fatalf("round trip: got %+v, %v; want %+v", got, err, f)
+	}
+	if _, err := parseFrame(f.marshal(), 3); err == nil {
+		t.Error("expected error for a sender out of range")
+	}
+	bad := f.marshal()
+	bad[1] = 0
+	if _, err := parseFrame(bad, 4); err == nil {
+		t.Error("expected error for an unknown type")
+	}
+	if _, err := parseFrame(f.marshal()[:frameSize-1], 4); err == nil {
+		t.Error("expected error for a short frame")
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	mem := node.NewMemNetwork(1)
+	if _, err := New(0, 0, mem.Transport(0), Options{}); err == nil {
+		t.Error("expected error for an empty cluster")
+	}
+	if _, err := New(2, 2, mem.Transport(0), Options{}); err == nil {
+		t.Error("expected error for an index out of range")
+	}
+	if _, err := New(0, 1, mem.Transport(0), Options{Algorithm: 7}); err == nil {
+		t.Error("expected error for an unknown algorithm")
+	}
+	if _, err := ParseAlgorithm("ring"); err != nil {
+		t.Errorf("ParseAlgorithm(ring): %v", err)
+	}
+	if _, err := ParseAlgorithm("paxos"); err == nil {
+		t.Error("expected error for an unknown algorithm name")
+	}
+}
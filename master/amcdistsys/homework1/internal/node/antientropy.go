@@ -0,0 +1,579 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/message"
+)
+
+// AntiEntropyOptions configures the reconciliation of missed broadcasts.
+type AntiEntropyOptions struct {
+	// Interval is the time between two rounds, in each of which the node
+	// sends its summary to every other node (100ms if zero).
+	Interval time.Duration
+	// Recovered receives every message or fragment the node only got
+	// through reconciliation. It is called from the receive loop.
+	Recovered func(Recovery)
+}
+
+// Recovery is a message (or fragment) that UDP lost on its way to this node
+// and that reconciliation fetched from a peer.
+type Recovery struct {
+	From   uint8  // original sender
+	Peer   int    // node that supplied it; this node itself for its own lost self-sends
+	Digest string // hex SHA-1 trailer of the datagram, as in the message log for plain messages
+}
+
+// Reconciliation walks a two-level hash tree per sender: the summary holds 16
+// buckets, by the first 4 bits of each datagram's key, and every bucket 256
+// children, by the next 8 bits. Digests are only exchanged for the children
+// that differ.
+const (
+	aeBuckets  = 16
+	aeChildren = 256
+)
+
+const (
+	aeMagic       = "AE" // never 1024 bytes long, so never taken for a message
+	aeMaxDatagram = 64 << 10
+	aeDigestChunk = 1500            // digests per DIGESTS or GET datagram, ~30KB
+	aeUnitChunk   = 28              // datagrams per REPAIR datagram, ~29KB
+	aeTreeChunk   = 4               // buckets expanded per TREE datagram, ~12KB
+	aeRoundBudget = 8 * aeUnitChunk // datagrams fetched, or re-sent to itself, per round
+	aeReadBuffer  = 4 << 20         // socket receive buffer requested with anti-entropy
+)
+
+// unitKey identifies a datagram by the SHA-1 of all its bytes: unlike the
+// trailer, it also covers the fragment header.
+type unitKey [sha1.Size]byte
+
+func (k unitKey) bucket() int { return int(k[0] >> 4) }
+
+func (k unitKey) child() int { return int(k[0]&0x0f)<<4 | int(k[1]>>4) }
+
+// bucketSum summarizes a set of datagrams of one sender. Two nodes with
+// equal sums hold, with overwhelming probability, the same datagrams.
+type bucketSum struct {
+	Count uint32
+	XOR   uint64 // of the first 8 bytes of each key
+}
+
+func (s *bucketSum) add(k unitKey) {
+	s.Count++
+	s.XOR ^= binary.BigEndian.Uint64(k[:8])
+}
+
+// senderSum is the summary of the datagrams of one sender.
+type senderSum struct {
+	Sender  uint8
+	Buckets [aeBuckets]bucketSum
+}
+
+// aeBucket names the datagrams of one sender in one bucket, or in one child
+// of it.
+type aeBucket struct {
+	Sender uint8
+	Bucket uint8
+	Child  uint8 // in LIST messages only
+}
+
+// aeTree holds the child sums of one bucket.
+type aeTree struct {
+	Of       aeBucket
+	Children [aeChildren]bucketSum
+}
+
+type aeType uint8
+
+const (
+	aeSummary aeType = iota + 1 // Summary, Agreed: what the sender holds
+	aeTreeOf                    // Trees: the children of buckets that differ
+	aeList                      // Buckets: the children whose digests the sender wants
+	aeDigests                   // Keys: what the sender holds in those children
+	aeGet                       // Keys: what the sender wants
+	aeRepair                    // Units: the datagrams wanted
+)
+
+// aeMessage is the union of the reconciliation messages.
+type aeMessage struct {
+	Type    aeType
+	From    int
+	Summary []senderSum
+	Agreed  bool // the sender holds what every node's latest summary says
+	Trees   []aeTree
+	Buckets []aeBucket
+	Keys    []unitKey
+	Units   [][]byte
+}
+
+// antiEntropy is the node's store of every datagram it sent or received.
+type antiEntropy struct {
+	opts AntiEntropyOptions
+
+	mu          sync.Mutex
+	units       map[unitKey][]byte
+	undelivered map[unitKey]bool       // sent by this node, not accepted by it yet
+	index       map[aeBucket][]unitKey // keys by sender and bucket
+	sums        map[uint8]*senderSum
+	peers       [][]senderSum         // latest summary from each node
+	heard       []bool                // a summary arrived from each node
+	agreed      []bool                // Agreed of each node's latest summary
+	requested   map[unitKey]time.Time // GET sent, not answered yet
+	budget      int                   // datagrams this round may still fetch
+	started     bool
+}
+
+// SetAntiEntropy makes the node keep every plain message or fragment it
+// sends or receives, answer the reconciliation requests of other nodes, and
+// drop duplicates. StartAntiEntropy then starts fetching what the node missed.
+// In fragment mode, incomplete payloads are kept until their fragments are
+// recovered instead of given up after FragmentOptions.Timeout. Not available
+// in Bracha mode. Must be called before Start.
+func (n *Node) SetAntiEntropy(opts AntiEntropyOptions) {
+	if opts.Interval <= 0 {
+		opts.Interval = 100 * time.Millisecond
+	}
+	n.ae = &antiEntropy{
+		opts:        opts,
+		units:       map[unitKey][]byte{},
+		undelivered: map[unitKey]bool{},
+		index:       map[aeBucket][]unitKey{},
+		sums:        map[uint8]*senderSum{},
+		peers:       make([][]senderSum, len(n.config.Nodes)),
+		heard:       make([]bool, len(n.config.Nodes)),
+		agreed:      make([]bool, len(n.config.Nodes)),
+		requested:   map[unitKey]time.Time{},
+	}
+}
+
+// StartAntiEntropy starts the reconciliation rounds, normally once
+// broadcasting is over: every interval, the node sends its summary to every
+// other node and fetches what they hold and it does not, and delivers its own
+// broadcasts whose self-send was lost. Rounds go on until the node stops.
+func (n *Node) StartAntiEntropy(ctx context.Context) error {
+	if n.ae == nil {
+		return fmt.Errorf("StartAntiEntropy: anti-entropy is not enabled")
+	}
+	if n.stopped == nil {
+		return fmt.Errorf("StartAntiEntropy: node not started")
+	}
+	n.ae.mu.Lock()
+	if n.ae.started {
+		n.ae.mu.Unlock()
+		return fmt.Errorf("StartAntiEntropy: already started")
+	}
+	n.ae.started = true
+	n.ae.mu.Unlock()
+
+	go func() {
+		t := time.NewTicker(n.ae.opts.Interval)
+		defer t.Stop()
+		for {
+			n.round()
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			case <-n.stopped:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Converged reports whether all nodes hold the same messages and know it:
+// this node delivered everything it holds, the latest summary of every other
+// node matches its own and says that node found the same. A node that
+// converged can stop without leaving the others waiting for its summary.
+func (n *Node) Converged() bool {
+	if n.ae == nil {
+		return false
+	}
+	n.ae.mu.Lock()
+	defer n.ae.mu.Unlock()
+	if !n.ae.agrees(n.index) {
+		return false
+	}
+	for i, ok := range n.ae.agreed {
+		if i != n.index && !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// agrees reports whether node self delivered everything it holds and the
+// latest summary of every other node matches its own; the caller holds
+// ae.mu.
+func (ae *antiEntropy) agrees(self int) bool {
+	if len(ae.undelivered) > 0 {
+		return false
+	}
+	mine := ae.summary()
+	for i, p := range ae.peers {
+		if i != self && (!ae.heard[i] || !equalSummaries(mine, p)) {
+			return false
+		}
+	}
+	return true
+}
+
+// keep stores a datagram this node sent.
+func (n *Node) keep(unit []byte) {
+	n.ae.mu.Lock()
+	defer n.ae.mu.Unlock()
+	n.ae.add(keyOf(unit), unit, false)
+}
+
+// firstReceipt records a received data datagram and reports whether it is
+// new; duplicates, such as a late original of a recovered message, are to be
+// dropped. Only datagrams with a valid SHA-1 are kept: a corrupted copy does
+// not stop the genuine one from being recovered.
+func (n *Node) firstReceipt(unit []byte) bool {
+	if !verifiedUnit(unit, n.fragments != nil) {
+		return true // reported by accept as usual
+	}
+	k := keyOf(unit)
+	n.ae.mu.Lock()
+	defer n.ae.mu.Unlock()
+	if n.ae.units[k] != nil {
+		return n.ae.delivered(k)
+	}
+	n.ae.add(k, unit, true)
+	return true
+}
+
+func verifiedUnit(unit []byte, fragment bool) bool {
+	if len(unit) != message.MessageSize {
+		return false
+	}
+	if fragment {
+		f, err := message.ParseFragment(unit)
+		if err != nil {
+			return false
+		}
+		_, _, ok := f.Verify()
+		return ok
+	}
+	m, err := message.ParseMessage(unit)
+	if err != nil {
+		return false
+	}
+	_, _, ok := m.Verify()
+	return ok
+}
+
+func keyOf(unit []byte) unitKey {
+	return sha1.Sum(unit)
+}
+
+// add stores a new datagram; the caller holds ae.mu.
+func (ae *antiEntropy) add(k unitKey, unit []byte, delivered bool) {
+	if ae.units[k] != nil {
+		return
+	}
+	ae.units[k] = append([]byte(nil), unit...)
+	if !delivered {
+		ae.undelivered[k] = true
+	}
+	b := aeBucket{Sender: unit[0], Bucket: uint8(k.bucket())}
+	ae.index[b] = append(ae.index[b], k)
+	s := ae.sums[unit[0]]
+	if s == nil {
+		s = &senderSum{Sender: unit[0]}
+		ae.sums[unit[0]] = s
+	}
+	s.Buckets[k.bucket()].add(k)
+	delete(ae.requested, k)
+}
+
+// delivered marks a held datagram as accepted and reports whether it was not
+// before; the caller holds ae.mu.
+func (ae *antiEntropy) delivered(k unitKey) bool {
+	if !ae.undelivered[k] {
+		return false
+	}
+	delete(ae.undelivered, k)
+	return true
+}
+
+// summary returns the node's summary, by sender; the caller holds ae.mu.
+func (ae *antiEntropy) summary() []senderSum {
+	out := make([]senderSum, 0, len(ae.sums))
+	for i := 0; i < 256; i++ {
+		if s := ae.sums[uint8(i)]; s != nil {
+			out = append(out, *s)
+		}
+	}
+	return out
+}
+
+// children returns the child sums of bucket b; the caller holds ae.mu.
+func (ae *antiEntropy) children(b aeBucket) [aeChildren]bucketSum {
+	var c [aeChildren]bucketSum
+	for _, k := range ae.index[aeBucket{Sender: b.Sender, Bucket: b.Bucket}] {
+		c[k.child()].add(k)
+	}
+	return c
+}
+
+func equalSummaries(a, b []senderSum) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// round sends the node's summary to every other node and, through its own
+// transport, its own broadcasts whose self-send was lost. Each round fetches
+// at most aeRoundBudget datagrams, so that reconciling after heavy losses
+// does not overflow the socket buffers and lose the repairs too.
+func (n *Node) round() {
+	var own [][]byte
+	n.ae.mu.Lock()
+	m := &aeMessage{Type: aeSummary, Summary: n.ae.summary(), Agreed: n.ae.agrees(n.index)}
+	for k := range n.ae.undelivered {
+		if len(own) == aeRoundBudget {
+			break
+		}
+		own = append(own, n.ae.units[k])
+	}
+	n.ae.budget = aeRoundBudget
+	n.ae.mu.Unlock()
+	for i := range n.config.Nodes {
+		if i != n.index {
+			n.sendAE(i, m)
+		}
+	}
+	for len(own) > 0 {
+		c := min(len(own), aeUnitChunk)
+		n.sendAE(n.index, &aeMessage{Type: aeRepair, Units: own[:c]})
+		own = own[c:]
+	}
+}
+
+// handleAE processes a reconciliation message; it runs on the receive loop.
+// A summary is answered with the children of some of the buckets that
+// differ, picked at random so that all get their turn; the peer lists the
+// children it lacks something in, gets their digests, and fetches what it
+// does not hold. Every reply fits in one datagram.
+func (n *Node) handleAE(data []byte) {
+	m, err := parseAE(data, len(n.config.Nodes))
+	if err != nil {
+		n.logger.LogError("receiveLoop: %v", err)
+		return
+	}
+	ae := n.ae
+	switch m.Type {
+	case aeSummary:
+		ae.mu.Lock()
+		ae.peers[m.From], ae.heard[m.From], ae.agreed[m.From] = m.Summary, true, m.Agreed
+		theirs := map[uint8]*senderSum{}
+		for i := range m.Summary {
+			theirs[m.Summary[i].Sender] = &m.Summary[i]
+		}
+		var differ []aeBucket
+		for sender, s := range ae.sums {
+			for b := range s.Buckets {
+				var t bucketSum
+				if theirs[sender] != nil {
+					t = theirs[sender].Buckets[b]
+				}
+				if s.Buckets[b].Count > 0 && s.Buckets[b] != t {
+					differ = append(differ, aeBucket{Sender: sender, Bucket: uint8(b)})
+				}
+			}
+		}
+		rand.Shuffle(len(differ), func(i, j int) { differ[i], differ[j] = differ[j], differ[i] })
+		reply := &aeMessage{Type: aeTreeOf}
+		for _, b := range differ[:min(len(differ), aeTreeChunk)] {
+			reply.Trees = append(reply.Trees, aeTree{Of: b, Children: ae.children(b)})
+		}
+		ae.mu.Unlock()
+		if len(reply.Trees) > 0 {
+			n.sendAE(m.From, reply)
+		}
+	case aeTreeOf:
+		// Ask for the digests of differing children, no more than fit in
+		// one DIGESTS datagram.
+		var list []aeBucket
+		keys := 0
+		ae.mu.Lock()
+		for _, t := range m.Trees {
+			mine := ae.children(t.Of)
+			for c, s := range t.Children {
+				if s.Count == 0 || s == mine[c] || keys+int(s.Count) > aeDigestChunk {
+					continue
+				}
+				keys += int(s.Count)
+				list = append(list, aeBucket{Sender: t.Of.Sender, Bucket: t.Of.Bucket, Child: uint8(c)})
+			}
+		}
+		ae.mu.Unlock()
+		if len(list) > 0 {
+			n.sendAE(m.From, &aeMessage{Type: aeList, Buckets: list})
+		}
+	case aeList:
+		want := map[aeBucket]bool{}
+		for _, b := range m.Buckets {
+			want[b] = true
+		}
+		var keys []unitKey
+		ae.mu.Lock()
+		for b := range want {
+			for _, k := range ae.index[aeBucket{Sender: b.Sender, Bucket: b.Bucket}] {
+				if k.child() == int(b.Child) && len(keys) < aeDigestChunk {
+					keys = append(keys, k)
+				}
+			}
+		}
+		ae.mu.Unlock()
+		if len(keys) > 0 {
+			n.sendAE(m.From, &aeMessage{Type: aeDigests, Keys: keys})
+		}
+	case aeDigests:
+		now := time.Now()
+		var want []unitKey
+		ae.mu.Lock()
+		for _, k := range m.Keys {
+			if ae.budget == 0 {
+				break
+			}
+			if ae.units[k] == nil && now.Sub(ae.requested[k]) > 2*ae.opts.Interval {
+				ae.requested[k] = now
+				ae.budget--
+				want = append(want, k)
+			}
+		}
+		ae.mu.Unlock()
+		if len(want) > 0 {
+			n.sendAE(m.From, &aeMessage{Type: aeGet, Keys: want})
+		}
+	case aeGet:
+		var units [][]byte
+		ae.mu.Lock()
+		for _, k := range m.Keys {
+			if unit := ae.units[k]; unit != nil {
+				units = append(units, unit)
+			}
+		}
+		ae.mu.Unlock()
+		for len(units) > 0 {
+			c := min(len(units), aeUnitChunk)
+			n.sendAE(m.From, &aeMessage{Type: aeRepair, Units: units[:c]})
+			units = units[c:]
+		}
+	case aeRepair:
+		for _, unit := range m.Units {
+			if !verifiedUnit(unit, n.fragments != nil) {
+				n.logger.LogError("receiveLoop: node %d repaired with a corrupted datagram", m.From)
+				continue
+			}
+			// New, or one of our own broadcasts we never got back.
+			k := keyOf(unit)
+			ae.mu.Lock()
+			fresh := ae.units[k] == nil
+			if fresh {
+				ae.add(k, unit, true)
+			} else {
+				fresh = ae.delivered(k)
+			}
+			ae.mu.Unlock()
+			if fresh {
+				n.recovered(unit, m.From)
+			}
+		}
+	}
+}
+
+// recovered reports and accepts a datagram obtained through reconciliation.
+func (n *Node) recovered(unit []byte, peer int) {
+	if n.ae.opts.Recovered != nil {
+		n.ae.opts.Recovered(Recovery{
+			From:   unit[0],
+			Peer:   peer,
+			Digest: hex.EncodeToString(unit[message.MessageSize-sha1.Size:]),
+		})
+	}
+	n.accept(n.main, unit, nil)
+}
+
+func (n *Node) sendAE(to int, m *aeMessage) {
+	m.From = n.index
+	data, err := encodeAE(m)
+	if err != nil {
+		n.logger.LogError("anti-entropy: encode: %v", err)
+		return
+	}
+	if err := n.transport.Send(to, data); err != nil && !errors.Is(err, net.ErrClosed) {
+		n.logger.LogError("anti-entropy: send to node %d: %v", to, err)
+	}
+}
+
+func encodeAE(m *aeMessage) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(aeMagic)
+	if err := gob.NewEncoder(&buf).Encode(m); err != nil {
+		return nil, err
+	}
+	if buf.Len() == message.MessageSize {
+		buf.WriteByte(0) // gob ignores it; the length tells us apart from messages
+	}
+	return buf.Bytes(), nil
+}
+
+// isAE reports whether a datagram is a reconciliation message.
+func isAE(data []byte) bool {
+	return len(data) != message.MessageSize && bytes.HasPrefix(data, []byte(aeMagic))
+}
+
+// IsAntiEntropy reports whether a captured datagram is a reconciliation
+// message.
+func IsAntiEntropy(data []byte) bool {
+	return isAE(data)
+}
+
+// RepairedUnits decodes a captured reconciliation message of a group of n
+// nodes and returns its sender and, for a REPAIR, the datagrams it carries;
+// the other messages carry none.
+func RepairedUnits(data []byte, n int) (from int, units [][]byte, err error) {
+	m, err := parseAE(data, n)
+	if err != nil {
+		return 0, nil, err
+	}
+	if m.Type == aeRepair {
+		units = m.Units
+	}
+	return m.From, units, nil
+}
+
+func parseAE(data []byte, n int) (*aeMessage, error) {
+	var m aeMessage
+	if err := gob.NewDecoder(bytes.NewReader(data[len(aeMagic):])).Decode(&m); err != nil {
+		return nil, fmt.Errorf("parseAE: %w", err)
+	}
+	if m.Type < aeSummary || m.Type > aeRepair {
+		return nil, fmt.Errorf("parseAE: unknown type %d", m.Type)
+	}
+	if m.From < 0 || m.From >= n {
+		return nil, fmt.Errorf("parseAE: sender %d out of range", m.From)
+	}
+	return &m, nil
+}
@@ -0,0 +1,52 @@
+package node
+
+import (
+	"net"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/bracha"
+)
+
+// brachaReadBuffer is the socket receive buffer requested in Bracha mode: every
+// broadcast fans out into O(M^2) ECHO/READY frames arriving in bursts, which
+// overflow the OS default and turn into UDP drops the protocol cannot recover.
+const brachaReadBuffer = 4 << 20
+
+// SetBracha switches the node to Byzantine-tolerant reliable broadcast: every
+// message is disseminated with Bracha's echo/ready protocol driven by p, and
+// a message is only delivered once p delivers it. Must be called before Start.
+func (n *Node) SetBracha(p *bracha.Process) {
+	n.bracha = p
+}
+
+// handleFrame runs one received protocol frame through the echo/ready state
+// machine, relays the frames it triggers and accepts the payloads it delivers.
+func (n *Node) handleFrame(data []byte, from *net.UDPAddr) {
+	frame, err := bracha.ParseFrame(data)
+	if err != nil {
+		n.logger.LogError("receiveLoop: from %v: %v", from, err)
+		return
+	}
+	out, delivered, err := n.bracha.Handle(frame)
+	if err != nil {
+		n.logger.LogError("receiveLoop: from %v: %v", from, err)
+		return
+	}
+	for _, f := range out {
+		n.sendFrame(f)
+	}
+	for _, d := range delivered {
+		// The source is the authenticated origin of the broadcast, not byte 0
+		// of the payload, which a Byzantine origin controls.
+		n.accept(n.main, d.Payload, &d.ID)
+	}
+}
+
+// sendFrame sends a protocol frame to every node, including this one.
+func (n *Node) sendFrame(f *bracha.Frame) {
+	data, err := f.Marshal()
+	if err != nil {
+		n.logger.LogError("sendFrame: %v", err)
+		return
+	}
+	n.sendAll(data)
+}
@@ -0,0 +1,397 @@
+package node
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/capture"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/fec"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/message"
+)
+
+// A parity datagram is "FC", the sender, the scheme, the group number (4
+// bytes), the group's message count k, its parity count r and the index of
+// this parity datagram, followed by the k SHA-1 trailers of the group's
+// messages, in order, and the 1024 parity bytes. It is never 1024 bytes
+// long, so it is never taken for a message.
+const (
+	fecMagic       = "FC"
+	fecHeaderLen   = len(fecMagic) + 9
+	fecMaxDatagram = fecHeaderLen + MaxFECGroup*sha1.Size + message.MessageSize
+	fecFlushDelay  = 50 * time.Millisecond // a partial group is protected once broadcasting pauses this long
+	fecCacheSize   = 4096                  // recent messages kept per sender for the groups still to come
+	fecReadBuffer  = 4 << 20               // socket receive buffer requested with FEC
+)
+
+// MaxFECGroup is the largest number of messages an FEC group protects.
+const MaxFECGroup = 64
+
+// FECOptions configures forward error correction of plain broadcasts.
+type FECOptions struct {
+	Scheme fec.Scheme
+	// K is the number of messages per group (at most MaxFECGroup), R the
+	// number of parity datagrams sent after each group: up to R lost
+	// messages of a group are rebuilt. XOR needs R = 1.
+	K, R int
+	// Timeout is how long a receiver keeps a group it cannot rebuild yet
+	// (counted from its first parity datagram) before giving up on it
+	// (10s if zero).
+	Timeout time.Duration
+}
+
+type fecDigest [sha1.Size]byte
+
+// digestOf returns the SHA-1 trailer of a message.
+func digestOf(unit []byte) fecDigest {
+	return fecDigest(unit[message.MessageSize-sha1.Size:])
+}
+
+type fecGroupKey struct {
+	sender uint8
+	group  uint32
+}
+
+// fecGroup is a group of messages that lost some of them and waits for
+// enough parity to rebuild them.
+type fecGroup struct {
+	code    *fec.Code
+	digests []fecDigest
+	data    [][]byte // nil where the message is missing
+	parity  [][]byte // nil where the parity datagram is missing
+	first   time.Time
+}
+
+// fecCache holds the latest fecCacheSize verified messages of one sender.
+type fecCache struct {
+	units map[fecDigest][]byte
+	ring  []fecDigest
+	next  int
+}
+
+func (c *fecCache) add(d fecDigest, unit []byte) {
+	if c.units[d] != nil {
+		return
+	}
+	if len(c.ring) < fecCacheSize {
+		c.ring = append(c.ring, d)
+	} else {
+		delete(c.units, c.ring[c.next])
+		c.ring[c.next] = d
+		c.next = (c.next + 1) % fecCacheSize
+	}
+	c.units[d] = append([]byte(nil), unit...)
+}
+
+type fecState struct {
+	opts FECOptions
+
+	// The group being sent, filled by Broadcast.
+	mu    sync.Mutex
+	group uint32
+	units [][]byte
+	timer *time.Timer
+
+	// Owned by the receive loop.
+	cache     map[uint8]*fecCache
+	pending   map[fecGroupKey]*fecGroup
+	done      map[fecGroupKey]bool
+	recovered map[fecDigest]bool // rebuilt, original not received (yet)
+}
+
+// SetFEC makes the node follow every opts.K plain messages it broadcasts with
+// opts.R parity datagrams, from which receivers rebuild lost messages without
+// asking for them again. Rebuilt messages are verified like received ones and
+// logged with a trailing "FEC". Needs plain mode. Must be called before Start.
+func (n *Node) SetFEC(opts FECOptions) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	n.fec = &fecState{
+		opts:      opts,
+		cache:     map[uint8]*fecCache{},
+		pending:   map[fecGroupKey]*fecGroup{},
+		done:      map[fecGroupKey]bool{},
+		recovered: map[fecDigest]bool{},
+	}
+}
+
+// checkFEC validates the FEC options at Start.
+func (n *Node) checkFEC() error {
+	if n.fragments != nil || n.bracha != nil {
+		return fmt.Errorf("FEC needs plain mode")
+	}
+	if n.fec.opts.K > MaxFECGroup {
+		return fmt.Errorf("FEC groups hold at most %d messages, got %d", MaxFECGroup, n.fec.opts.K)
+	}
+	_, err := fec.New(n.fec.opts.Scheme, n.fec.opts.K, n.fec.opts.R)
+	return err
+}
+
+// protect adds a message this node broadcast to the current group, sending
+// the group's parity once it is full.
+func (n *Node) protect(unit []byte) {
+	f := n.fec
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.units = append(f.units, unit)
+	if len(f.units) == f.opts.K {
+		n.sendParity()
+		return
+	}
+	if len(f.units) == 1 {
+		f.timer = time.AfterFunc(fecFlushDelay, n.flushFEC)
+	}
+}
+
+// flushFEC sends the parity of the current group, however few messages it
+// holds.
+func (n *Node) flushFEC() {
+	n.fec.mu.Lock()
+	defer n.fec.mu.Unlock()
+	if len(n.fec.units) > 0 {
+		n.sendParity()
+	}
+}
+
+// sendParity encodes the current group and sends its parity datagrams to
+// every node, including this one; the caller holds fec.mu.
+func (n *Node) sendParity() {
+	f := n.fec
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+	units, group := f.units, f.group
+	f.units, f.group = nil, f.group+1
+
+	code, err := fec.New(f.opts.Scheme, len(units), f.opts.R)
+	if err != nil {
+		n.logger.LogError("sendParity: %v", err)
+		return
+	}
+	parity, err := code.Encode(units)
+	if err != nil {
+		n.logger.LogError("sendParity: %v", err)
+		return
+	}
+	for i, p := range parity {
+		buf := make([]byte, 0, fecHeaderLen+len(units)*sha1.Size+len(p))
+		buf = append(buf, fecMagic...)
+		buf = append(buf, uint8(n.index), uint8(f.opts.Scheme))
+		buf = binary.BigEndian.AppendUint32(buf, group)
+		buf = append(buf, uint8(len(units)), uint8(f.opts.R), uint8(i))
+		for _, u := range units {
+			buf = append(buf, u[message.MessageSize-sha1.Size:]...)
+		}
+		buf = append(buf, p...)
+		for to := range n.size() {
+			if err := n.transport.Send(to, buf); err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					n.logger.LogError("sendParity: send to node %d: %v", to, err)
+				}
+				continue
+			}
+			n.record(capture.Sent, n.transport.Addr(to), buf)
+		}
+	}
+}
+
+// isParity reports whether a datagram is an FEC parity datagram.
+func isParity(data []byte) bool {
+	return len(data) != message.MessageSize && bytes.HasPrefix(data, []byte(fecMagic))
+}
+
+// IsParity reports whether a captured datagram is an FEC parity datagram.
+func IsParity(data []byte) bool {
+	return isParity(data)
+}
+
+type fecParity struct {
+	key     fecGroupKey
+	scheme  fec.Scheme
+	k, r, i int
+	digests []fecDigest
+	data    []byte
+}
+
+// parseParity decodes a parity datagram, copying out of data.
+func parseParity(data []byte) (*fecParity, error) {
+	if len(data) < fecHeaderLen {
+		return nil, fmt.Errorf("parseParity: %d bytes, shorter than the header", len(data))
+	}
+	h := data[len(fecMagic):]
+	p := &fecParity{
+		key:    fecGroupKey{sender: h[0], group: binary.BigEndian.Uint32(h[2:6])},
+		scheme: fec.Scheme(h[1]),
+		k:      int(h[6]),
+		r:      int(h[7]),
+		i:      int(h[8]),
+	}
+	if p.k < 1 || p.k > MaxFECGroup || p.i >= p.r {
+		return nil, fmt.Errorf("parseParity: parity %d of a %d+%d group", p.i, p.k, p.r)
+	}
+	if want := fecHeaderLen + p.k*sha1.Size + message.MessageSize; len(data) != want {
+		return nil, fmt.Errorf("parseParity: got %d bytes, expected %d", len(data), want)
+	}
+	body := data[fecHeaderLen:]
+	for j := 0; j < p.k; j++ {
+		p.digests = append(p.digests, fecDigest(body[j*sha1.Size:]))
+	}
+	p.data = append([]byte(nil), body[p.k*sha1.Size:]...)
+	return p, nil
+}
+
+// handleParity adds a parity datagram to its group, rebuilding the group's
+// lost messages once enough of it arrived.
+func (n *Node) handleParity(data []byte) {
+	p, err := parseParity(data)
+	if err != nil {
+		n.logger.LogError("receiveLoop: %v", err)
+		return
+	}
+	f := n.fec
+	if f.done[p.key] {
+		return
+	}
+	g := f.pending[p.key]
+	if g == nil {
+		code, err := fec.New(p.scheme, p.k, p.r)
+		if err != nil {
+			n.logger.LogError("receiveLoop: FEC group %d from node %d: %v", p.key.group, p.key.sender, err)
+			return
+		}
+		g = &fecGroup{code: code, digests: p.digests, data: make([][]byte, p.k), parity: make([][]byte, p.r), first: time.Now()}
+		if c := f.cache[p.key.sender]; c != nil {
+			for j, d := range g.digests {
+				g.data[j] = c.units[d]
+			}
+		}
+		f.pending[p.key] = g
+	} else if p.k != len(g.data) || p.r != len(g.parity) {
+		n.logger.LogError("receiveLoop: FEC group %d from node %d: parity for %d+%d, group is %d+%d",
+			p.key.group, p.key.sender, p.k, p.r, len(g.data), len(g.parity))
+		return
+	}
+	g.parity[p.i] = p.data
+	n.tryGroup(p.key, g)
+}
+
+// noteData records a received message for the groups that protect it and
+// reports whether it is to be accepted: the late original of a message that
+// was already rebuilt is dropped.
+func (n *Node) noteData(unit []byte) bool {
+	if !verifiedUnit(unit, false) {
+		return true // reported by accept as usual; a group treats it as lost
+	}
+	f := n.fec
+	d := digestOf(unit)
+	if f.recovered[d] {
+		delete(f.recovered, d)
+		return false
+	}
+	c := f.cache[unit[0]]
+	if c == nil {
+		c = &fecCache{units: map[fecDigest][]byte{}}
+		f.cache[unit[0]] = c
+	}
+	c.add(d, unit)
+	for key, g := range f.pending {
+		if key.sender != unit[0] {
+			continue
+		}
+		for j := range g.digests {
+			if g.data[j] == nil && g.digests[j] == d {
+				g.data[j] = c.units[d]
+				n.tryGroup(key, g)
+				break
+			}
+		}
+	}
+	return true
+}
+
+// tryGroup rebuilds the missing messages of g, if enough of it arrived, and
+// delivers them.
+func (n *Node) tryGroup(key fecGroupKey, g *fecGroup) {
+	var lost []int
+	have := 0
+	for j, d := range g.data {
+		if d == nil {
+			lost = append(lost, j)
+		}
+	}
+	for _, p := range g.parity {
+		if p != nil {
+			have++
+		}
+	}
+	if len(lost) > 0 && have < len(lost) {
+		return
+	}
+	delete(n.fec.pending, key)
+	n.fec.done[key] = true
+	if len(lost) == 0 {
+		return
+	}
+	if err := g.code.Reconstruct(g.data, g.parity); err != nil {
+		n.logger.LogError("receiveLoop: FEC group %d from node %d: %v", key.group, key.sender, err)
+		return
+	}
+	for _, j := range lost {
+		n.acceptRecovered(key, g.data[j], g.digests[j])
+	}
+}
+
+// acceptRecovered verifies a rebuilt message and delivers it, marked as
+// recovered.
+func (n *Node) acceptRecovered(key fecGroupKey, unit []byte, want fecDigest) {
+	msg, err := message.ParseMessage(unit)
+	if err != nil {
+		n.logger.LogError("receiveLoop: FEC group %d from node %d: %v", key.group, key.sender, err)
+		return
+	}
+	sentHex, calcHex, ok := msg.Verify()
+	if !ok || digestOf(unit) != want || msg.SenderIndex() != key.sender {
+		n.logger.LogError("receiveLoop: FEC group %d from node %d: message rebuilt wrong (%s != %s)",
+			key.group, key.sender, sentHex, calcHex)
+		return
+	}
+	if n.snaps != nil {
+		n.countReceived(unit)
+	}
+	if n.ae != nil && !n.firstReceipt(unit) {
+		return
+	}
+	n.fec.recovered[want] = true
+	n.deliver(n.main, Delivery{From: msg.SenderIndex(), Payload: msg.Payload(), SentHex: sentHex, CalcHex: calcHex, OK: ok, Recovered: true})
+}
+
+// expireFEC gives up on the groups still missing messages at now.
+func (n *Node) expireFEC(now time.Time) {
+	for key, g := range n.fec.pending {
+		if now.Sub(g.first) < n.fec.opts.Timeout {
+			continue
+		}
+		have, parity := 0, 0
+		for _, d := range g.data {
+			if d != nil {
+				have++
+			}
+		}
+		for _, p := range g.parity {
+			if p != nil {
+				parity++
+			}
+		}
+		n.logger.LogError("receiveLoop: FEC group %d from node %d unrecoverable: %d/%d messages and %d/%d parity after %v",
+			key.group, key.sender, have, len(g.data), parity, len(g.parity), time.Since(g.first).Round(time.Millisecond))
+		delete(n.fec.pending, key)
+		n.fec.done[key] = true
+	}
+}
@@ -0,0 +1,53 @@
+package node
+
+// fifoQueue restores per-sender order: a delivery is released only after
+// every earlier sequence number from the same sender was released or skipped.
+// It is not safe for concurrent use; the node's receive loop owns it.
+type fifoQueue struct {
+	next    map[uint8]uint32
+	pending map[uint8]map[uint32]*Delivery // nil entry: skipped
+}
+
+func newFIFOQueue() *fifoQueue {
+	return &fifoQueue{next: make(map[uint8]uint32), pending: make(map[uint8]map[uint32]*Delivery)}
+}
+
+// push adds d and returns the deliveries that are now in order, d included
+// if it was the next one expected from its sender.
+func (q *fifoQueue) push(d Delivery) []Delivery {
+	return q.put(d.From, d.Seq, &d)
+}
+
+// skip gives up on seq from sender and returns the deliveries it unblocks.
+func (q *fifoQueue) skip(sender uint8, seq uint32) []Delivery {
+	return q.put(sender, seq, nil)
+}
+
+func (q *fifoQueue) put(sender uint8, seq uint32, d *Delivery) []Delivery {
+	if seq < q.next[sender] {
+		return nil // already released or skipped
+	}
+	held := q.pending[sender]
+	if held == nil {
+		held = make(map[uint32]*Delivery)
+		q.pending[sender] = held
+	}
+	if _, dup := held[seq]; dup {
+		return nil
+	}
+	held[seq] = d
+
+	var ready []Delivery
+	for {
+		next := q.next[sender]
+		d, ok := held[next]
+		if !ok {
+			return ready
+		}
+		delete(held, next)
+		q.next[sender] = next + 1
+		if d != nil {
+			ready = append(ready, *d)
+		}
+	}
+}
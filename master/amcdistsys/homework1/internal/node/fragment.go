@@ -0,0 +1,80 @@
+package node
+
+import (
+	"time"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/bracha"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/message"
+)
+
+// fragmentReadBuffer is the socket receive buffer requested in fragment mode,
+// where a single broadcast is a burst of many datagrams.
+const fragmentReadBuffer = 4 << 20
+
+// FragmentOptions configures broadcasting of payloads larger than one message.
+type FragmentOptions struct {
+	// Timeout is how long a receiver waits for the missing fragments of a
+	// payload (counted from its first fragment) before giving up on it.
+	Timeout time.Duration
+}
+
+// SetFragmentation switches the node to variable-size payloads: each
+// broadcast is split into 1024-byte fragments, and a payload is delivered once
+// all its fragments have arrived and its whole-payload SHA-1 has been checked.
+// Must be called before Start.
+func (n *Node) SetFragmentation(opts FragmentOptions) {
+	n.fragments = &opts
+}
+
+// acceptFragment verifies one fragment and adds it to the reassembler of
+// topic t, delivering the payload it completes, if any. In Bracha mode id is
+// the reliable broadcast the fragment arrived through.
+func (n *Node) acceptFragment(t *topic, unit []byte, id *bracha.ID) {
+	frag, err := message.ParseFragment(unit)
+	if err != nil {
+		n.logger.LogError("receiveLoop: %v", err)
+		return
+	}
+	if sentHex, calcHex, ok := frag.Verify(); !ok {
+		n.logger.LogError("receiveLoop: fragment %d/%d of payload %d from node %d failed SHA-1 (%s != %s)",
+			frag.Index(), frag.Total(), frag.PayloadID(), frag.SenderIndex(), sentHex, calcHex)
+		return
+	}
+	if id != nil && id.Origin != frag.SenderIndex() {
+		n.logger.LogError("receiveLoop: node %d broadcast a fragment claiming to be from node %d",
+			id.Origin, frag.SenderIndex())
+		return
+	}
+	p, err := t.reasm.Add(frag, time.Now())
+	if err != nil {
+		n.logger.LogError("receiveLoop: %v", err)
+		return
+	}
+	if p != nil {
+		n.deliver(t, Delivery{From: p.Sender, Seq: p.ID, Payload: p.Data, SentHex: p.SentHex, CalcHex: p.CalcHex, OK: p.OK})
+	}
+}
+
+// expire gives up on the payloads still incomplete at now, on every topic,
+// logging them and letting FIFO delivery move past them.
+func (n *Node) expire(now time.Time) {
+	for _, t := range n.receiving {
+		for _, inc := range t.reasm.Expire(now) {
+			n.logger.LogError("receiveLoop: %spayload %d from node %d incomplete: %d/%d fragments after %v",
+				topicPrefix(t.name), inc.ID, inc.Sender, inc.Have, inc.Total, inc.Age.Round(time.Millisecond))
+			if t.fifo != nil {
+				for _, ready := range t.fifo.skip(inc.Sender, inc.ID) {
+					t.handle(ready)
+				}
+			}
+		}
+	}
+}
+
+// topicPrefix names a named topic at the start of a log line.
+func topicPrefix(name string) string {
+	if name == "" {
+		return ""
+	}
+	return "topic " + name + ": "
+}
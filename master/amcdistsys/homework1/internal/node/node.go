@@ -2,65 +2,321 @@ package node
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/bracha"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/capture"
 	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/config"
-	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/logger"
 	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/message"
 )
 
-const (
-	startupWait = 15 * time.Second
-	ioTimeout   = 5 * time.Second
-)
+const ioTimeout = 5 * time.Second
+
+// startupWait is a variable only so tests can shorten it.
+var startupWait = 15 * time.Second
+
+// Logger receives the messages delivered by Run and every error the node
+// runs into; *logger.MsgLogger implements it.
+type Logger interface {
+	LogMessage(ok bool, sourceIndex uint8, sentHex, calcHex string)
+	LogRecovered(ok bool, sourceIndex uint8, sentHex, calcHex string)
+	LogError(format string, args ...any)
+}
+
+// Delivery is a message (or, in fragment mode, a reassembled payload)
+// accepted by the node.
+type Delivery struct {
+	From    uint8  // sender index; the authenticated origin in Bracha mode
+	Seq     uint32 // per-sender sequence number; 0 for plain messages outside Bracha mode
+	Payload []byte
+	SentHex string // SHA-1 announced by the sender
+	CalcHex string // SHA-1 computed on receipt
+	OK      bool
+	// Recovered is set for a message that was lost and rebuilt from FEC
+	// parity datagrams.
+	Recovered bool
+	Topic     string // "" for the default topic; see Subscribe
+}
 
 // Node represents a single broadcast node.
 type Node struct {
 	index     int
-	config    *config.Config
-	conn      *net.UDPConn
-	logger    *logger.MsgLogger
+	config    *config.Config // replaced, never modified, by AddPeers under peersMu
+	peersMu   sync.RWMutex
+	transport Transport
+	logger    Logger
+	capture   *capture.Writer      // optional, records every datagram sent/received
+	bracha    *bracha.Process      // optional, switches to Byzantine-tolerant broadcast
+	fragments *FragmentOptions     // optional, switches to fragmented variable-size payloads
+	snaps     *snapshots           // optional, takes part in Chandy-Lamport snapshots
+	ae        *antiEntropy         // optional, keeps datagrams to reconcile missed broadcasts
+	fec       *fecState            // optional, sends and uses parity to rebuild lost messages
+	payloads  func(seq int) []byte // Run's payload source, random by default
 	recvCount atomic.Int64
+
+	// The default topic, "", delivers to logDelivery unless SetDeliver
+	// replaced it; named topics are added by Subscribe and Publish.
+	main         *topic
+	topics       map[string]*topic // under topicsMu
+	receiving    []*topic          // the subscribed topics, fixed by Start
+	topicsMu     sync.RWMutex
+	unsubscribed atomic.Int64
+
+	// Run's termination: reached is closed once expected deliveries were
+	// logged, idle receives the start of every read window that timed out.
+	expected int64
+	reached  chan struct{}
+	idle     chan time.Time
+
+	cancel    context.CancelFunc
+	stopped   chan struct{}
+	closeOnce sync.Once
+	closeErr  error
 }
 
 // NewNode creates a Node and binds its UDP socket on the node's own address.
-func NewNode(index int, cfg *config.Config, lg *logger.MsgLogger) (*Node, error) {
-	addr := cfg.Nodes[index]
-	udpAddr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", addr.IP, addr.Port))
+func NewNode(index int, cfg *config.Config, lg Logger) (*Node, error) {
+	t, err := NewUDPTransport(index, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("NewNode: %w", err)
+	}
+	return NewNodeWithTransport(index, cfg, lg, t), nil
+}
+
+// NewNodeWithTransport creates a Node that exchanges datagrams through t
+// instead of its own UDP socket. The node takes ownership of t.
+func NewNodeWithTransport(index int, cfg *config.Config, lg Logger, t Transport) *Node {
+	n := &Node{index: index, config: cfg, transport: t, logger: lg, idle: make(chan time.Time, 1)}
+	n.main = &topic{deliverFn: n.logDelivery}
+	n.topics = map[string]*topic{"": n.main}
+	return n
+}
+
+// SetCapture makes the node record every datagram it sends or receives to w.
+// Must be called before Start; the caller owns w and closes it after Close.
+func (n *Node) SetCapture(w *capture.Writer) {
+	n.capture = w
+}
+
+// SetDeliver replaces the default handling of deliveries (logging them and
+// counting them towards Run's N*M) with fn. fn is called from the receive
+// loop, one delivery at a time. Must be called before Start.
+func (n *Node) SetDeliver(fn func(Delivery)) {
+	n.main.deliverFn = fn
+}
+
+// SetFIFO holds deliveries back until all earlier ones from the same sender
+// were delivered or given up on, on every topic. Needs sequence numbers, so
+// it only works in fragment or Bracha mode. Must be called before Start.
+func (n *Node) SetFIFO() {
+	n.main.fifo = newFIFOQueue()
+}
+
+// SetPayloads sets the source of the payloads Run broadcasts; by default Run
+// sends random message.PayloadSize-byte payloads.
+func (n *Node) SetPayloads(fn func(seq int) []byte) {
+	n.payloads = fn
+}
+
+// AddPeers appends nodes to the group: from now on every broadcast also goes
+// to them. The transport must support it (UDPTransport does) and the node
+// must not be in Bracha mode or keep per-node state for anti-entropy or
+// snapshots, which is sized when it starts. Either every node is added or,
+// on error, none. Safe to call while running.
+func (n *Node) AddPeers(nodes []config.NodeAddr) error {
+	if n.bracha != nil || n.ae != nil || n.snaps != nil {
+		return fmt.Errorf("AddPeers: the group is fixed in Bracha mode and with anti-entropy or snapshots")
+	}
+	t, ok := n.transport.(interface{ AddPeers([]config.NodeAddr) error })
+	if !ok {
+		return fmt.Errorf("AddPeers: the transport cannot add peers")
+	}
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+	if err := t.AddPeers(nodes); err != nil {
+		return err
+	}
+	n.config = &config.Config{N: n.config.N, Nodes: append(append([]config.NodeAddr(nil), n.config.Nodes...), nodes...)}
+	return nil
+}
+
+// size returns the number of nodes in the group.
+func (n *Node) size() int {
+	n.peersMu.RLock()
+	defer n.peersMu.RUnlock()
+	return len(n.config.Nodes)
+}
+
+// Start launches the receive loop, which runs until ctx is done or Close is called.
+func (n *Node) Start(ctx context.Context) error {
+	if n.main.fifo != nil && n.fragments == nil && n.bracha == nil {
+		return fmt.Errorf("Start: FIFO ordering needs fragment or Bracha mode")
+	}
+	if n.ae != nil && n.bracha != nil {
+		return fmt.Errorf("Start: anti-entropy needs plain or fragment mode")
+	}
+	if n.fec != nil {
+		if err := n.checkFEC(); err != nil {
+			return fmt.Errorf("Start: %w", err)
+		}
+	}
+	n.receiving = n.subscribed()
+	if len(n.receiving) > 1 {
+		if err := n.checkTopics(); err != nil {
+			return fmt.Errorf("Start: %w", err)
+		}
+	}
+	for _, t := range n.receiving {
+		if n.fragments != nil {
+			t.reasm = message.NewReassembler(n.fragments.Timeout)
+		}
+		if n.main.fifo != nil && t != n.main {
+			t.fifo = newFIFOQueue()
+		}
+	}
+	if n.snaps != nil {
+		deliver := n.main.deliverFn
+		n.main.deliverFn = func(d Delivery) {
+			deliver(d)
+			n.countDelivered()
+		}
+	}
+	if size := n.readBuffer(); size > 0 {
+		if t, ok := n.transport.(interface{ SetReadBuffer(int) error }); ok {
+			if err := t.SetReadBuffer(size); err != nil {
+				n.logger.LogError("Start: set read buffer: %v", err)
+			}
+		}
+	}
+
+	ctx, n.cancel = context.WithCancel(ctx)
+	n.stopped = make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		n.closeTransport() // unblocks the pending read
+	}()
+	go func() {
+		defer close(n.stopped)
+		n.receiveLoop(ctx)
+	}()
+	return nil
+}
+
+// Done returns a channel that is closed once the receive loop has stopped.
+func (n *Node) Done() <-chan struct{} {
+	return n.stopped
+}
+
+// Close stops the receive loop and closes the transport.
+func (n *Node) Close() error {
+	if n.cancel == nil {
+		return n.closeTransport()
+	}
+	n.cancel()
+	err := n.closeTransport()
+	<-n.stopped
+	return err
+}
+
+func (n *Node) closeTransport() error {
+	n.closeOnce.Do(func() { n.closeErr = n.transport.Close() })
+	return n.closeErr
+}
+
+// Broadcast sends payload to every node, including this one. In plain mode
+// payload must be exactly message.PayloadSize bytes; in fragment mode it can
+// be up to message.MaxFragmentedPayload bytes. Failures to reach individual
+// nodes are logged rather than returned, as with any lost datagram.
+func (n *Node) Broadcast(payload []byte) error {
+	units, err := n.frame(n.main, payload)
 	if err != nil {
-		return nil, fmt.Errorf("NewNode: resolve addr: %w", err)
+		return fmt.Errorf("Broadcast: %w", err)
+	}
+	for _, unit := range units {
+		if n.ae != nil {
+			n.keep(unit)
+		}
+		if n.bracha == nil {
+			n.sendAll(unit)
+			if n.fec != nil {
+				n.protect(unit)
+			}
+			continue
+		}
+		frame, err := n.bracha.Broadcast(unit)
+		if err != nil {
+			return fmt.Errorf("Broadcast: %w", err)
+		}
+		n.sendFrame(frame)
 	}
-	conn, err := net.ListenUDP("udp4", udpAddr)
+	n.main.sent.Add(1)
+	return nil
+}
+
+// frame turns a payload into the 1024-byte units sent on the wire: a single
+// message in plain mode, its fragments (in order) in fragment mode, numbered
+// within topic t.
+func (n *Node) frame(t *topic, payload []byte) ([][]byte, error) {
+	if n.fragments == nil {
+		msg, err := message.NewMessage(uint8(n.index), payload)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{msg.Bytes()}, nil
+	}
+	frags, err := message.SplitPayload(uint8(n.index), t.nextID.Add(1)-1, payload)
 	if err != nil {
-		return nil, fmt.Errorf("NewNode: listen UDP on %s:%d: %w", addr.IP, addr.Port, err)
+		return nil, err
+	}
+	units := make([][]byte, len(frags))
+	for i, f := range frags {
+		units[i] = f.Bytes()
+	}
+	return units, nil
+}
+
+// sendAll sends one datagram to every node, including this one.
+func (n *Node) sendAll(data []byte) {
+	if n.snaps != nil {
+		n.snaps.sendMu.Lock()
+		defer n.snaps.sendMu.Unlock()
+	}
+	for i := range n.size() {
+		if err := n.transport.Send(i, data); err != nil {
+			n.logger.LogError("sendAll: send to node %d: %v", i, err)
+			continue
+		}
+		n.record(capture.Sent, n.transport.Addr(i), data)
+		if n.snaps != nil {
+			n.countSent(i)
+		}
 	}
-	return &Node{index: index, config: cfg, conn: conn, logger: lg}, nil
 }
 
 // Run starts the node lifecycle:
 //  1. Receiver goroutine starts immediately (captures early messages from other nodes)
 //  2. Sleeps 15 seconds (startup wait for all nodes to spin up)
 //  3. Sender goroutine starts broadcasting
-//  4. Blocks until both goroutines complete
+//  4. Blocks until N*M messages were received, or the sender is done and
+//     the network has been quiet for 5 seconds
 func (n *Node) Run() {
-	defer n.conn.Close()
-
 	M := len(n.config.Nodes)
 	N := n.config.N
 	total := int64(N * M)
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	var wg sync.WaitGroup
-	wg.Add(2)
-
 	// 1. Start receiver immediately so we don't miss messages from early-waking nodes
-	go n.receiveLoop(ctx, &wg, total)
+	n.expected, n.reached = total, make(chan struct{})
+	if err := n.Start(context.Background()); err != nil {
+		n.logger.LogError("Run: %v", err)
+		n.Close()
+		return
+	}
+	defer n.Close()
 
 	// 2. Wait for all nodes to spin up
 	fmt.Printf("Node %d: waiting %v before broadcasting...\n", n.index, startupWait)
@@ -68,84 +324,234 @@ func (n *Node) Run() {
 
 	// 3. Start sender
 	fmt.Printf("Node %d: starting broadcasts (N=%d, M=%d, total_expected=%d)\n", n.index, N, M, total)
-	go n.sendLoop(&wg, N, cancel)
+	sent := make(chan time.Time, 1)
+	go n.sendLoop(N, sent)
 
-	wg.Wait()
-	fmt.Printf("Node %d: done\n", n.index)
+	var senderDone time.Time
+	for {
+		select {
+		case <-n.reached:
+			if senderDone.IsZero() {
+				<-sent
+			}
+			fmt.Printf("Node %d: done\n", n.index)
+			return
+		case senderDone = <-sent:
+		case windowStart := <-n.idle:
+			// A quiet read window only means "no more traffic" if the
+			// sender was already done for the whole window.
+			if !senderDone.IsZero() && !windowStart.Before(senderDone) {
+				fmt.Printf("Node %d: done\n", n.index)
+				return
+			}
+		}
+	}
 }
 
-// sendLoop sends N broadcasts to all M nodes (including self), then signals completion via cancel.
-func (n *Node) sendLoop(wg *sync.WaitGroup, N int, cancel context.CancelFunc) {
-	defer wg.Done()
-	defer cancel() // signal receiver that all sends are done
-
+// sendLoop broadcasts N payloads to all M nodes (including self), then reports when it finished.
+func (n *Node) sendLoop(N int, done chan<- time.Time) {
 	for i := 0; i < N; i++ {
-		msg := message.BuildMessage(uint8(n.index))
-		for _, dest := range n.config.Nodes {
-			destAddr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", dest.IP, dest.Port))
-			if err != nil {
-				n.logger.LogError("sendLoop: resolve %s:%d: %v", dest.IP, dest.Port, err)
-				continue
-			}
-			if err := insistWrite(n.conn, msg.Bytes(), destAddr); err != nil {
-				n.logger.LogError("sendLoop: send to %s:%d: %v", dest.IP, dest.Port, err)
-			}
+		if err := n.Broadcast(n.payload(i)); err != nil {
+			n.logger.LogError("sendLoop: payload %d: %v", i, err)
 		}
 	}
+	if n.fec != nil {
+		n.flushFEC()
+	}
+	done <- time.Now()
 }
 
-// receiveLoop reads messages until total messages have been received or ctx is done.
-func (n *Node) receiveLoop(ctx context.Context, wg *sync.WaitGroup, total int64) {
-	defer wg.Done()
+func (n *Node) payload(seq int) []byte {
+	if n.payloads != nil {
+		return n.payloads(seq)
+	}
+	return message.BuildMessage(uint8(n.index)).Payload()
+}
 
-	buf := make([]byte, message.MessageSize)
+// receiveLoop reads datagrams until ctx is done.
+func (n *Node) receiveLoop(ctx context.Context) {
+	if n.fragments != nil {
+		// Anything still pending will never complete: report it.
+		defer func() { n.expire(time.Now().Add(n.fragments.Timeout + time.Nanosecond)) }()
+	}
+	if n.snaps != nil {
+		// Snapshots still waiting for markers will never get them.
+		defer func() { n.expireSnapshots(time.Now().Add(n.snaps.opts.Timeout + time.Nanosecond)) }()
+	}
+	if n.fec != nil {
+		// Groups still missing parity will never get it.
+		defer func() { n.expireFEC(time.Now().Add(n.fec.opts.Timeout)) }()
+	}
+
+	buf := make([]byte, n.readSize())
 	for {
-		if n.recvCount.Load() >= total {
-			return // clean exit: received all expected messages
+		windowStart := time.Now()
+		recvd, from, err := n.transport.Recv(buf)
+		if ctx.Err() != nil {
+			return
+		}
+		if recvd > 0 {
+			n.record(capture.Received, from, buf[:recvd])
+		}
+		if n.fragments != nil && n.ae == nil {
+			// With anti-entropy, missing fragments are recovered instead.
+			n.expire(time.Now())
+		}
+		if n.snaps != nil {
+			n.expireSnapshots(time.Now())
+		}
+		if n.fec != nil {
+			n.expireFEC(time.Now())
 		}
-
-		recvd, err := insistRead(n.conn, buf)
 		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				// Timeout: only exit if the sender is done (ctx cancelled)
+			if isTimeout(err) {
 				select {
-				case <-ctx.Done():
-					return
+				case n.idle <- windowStart:
 				default:
-					continue // sender still running, keep waiting
 				}
+				continue
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
 			}
 			// Non-timeout error (transient buffer glitch, etc.): log and retry
 			n.logger.LogError("receiveLoop: %v", err)
 			continue
 		}
 
-		msg, err := message.ParseMessage(buf[:recvd])
-		if err != nil {
-			n.logger.LogError("receiveLoop: parse: %v", err)
+		if message.IsTopic(buf[:recvd]) {
+			n.handleTopic(buf[:recvd])
+			continue
+		}
+		if n.ae != nil && isAE(buf[:recvd]) {
+			n.handleAE(buf[:recvd])
 			continue
 		}
+		if n.fec != nil && isParity(buf[:recvd]) {
+			n.handleParity(buf[:recvd])
+			continue
+		}
+		if n.snaps != nil {
+			if message.IsMarker(buf[:recvd]) {
+				n.handleMarker(buf[:recvd])
+				continue
+			}
+			n.countReceived(buf[:recvd])
+		}
+		if n.bracha != nil {
+			n.handleFrame(buf[:recvd], from)
+			continue
+		}
+		if n.fec != nil && !n.noteData(buf[:recvd]) {
+			continue
+		}
+		if n.ae != nil && !n.firstReceipt(buf[:recvd]) {
+			continue
+		}
+		n.accept(n.main, buf[:recvd], nil)
+	}
+}
 
-		sentHex, calcHex, ok := msg.Verify()
-		n.logger.LogMessage(ok, msg.SenderIndex(), sentHex, calcHex)
-		n.recvCount.Add(1)
+// readSize is one byte more than the largest valid datagram, so that
+// oversized datagrams are detected instead of silently truncated. Topic
+// envelopes always fit, so that unsubscribed ones are counted rather than
+// reported as truncated.
+func (n *Node) readSize() int {
+	size := message.MaxTopicDatagram + 1
+	switch {
+	case n.ae != nil:
+		size = max(size, aeMaxDatagram)
+	case n.fec != nil:
+		size = max(size, fecMaxDatagram+1)
+	case n.bracha != nil:
+		size = max(size, bracha.MaxFrameLen+1)
 	}
+	return size
 }
 
-// insistRead performs a single UDP read with a 5-second deadline.
-// Returns the number of bytes read, or an error (caller distinguishes timeout vs other errors).
-func insistRead(conn *net.UDPConn, buf []byte) (int, error) {
-	if err := conn.SetReadDeadline(time.Now().Add(ioTimeout)); err != nil {
-		return 0, fmt.Errorf("insistRead: set deadline: %w", err)
+func (n *Node) readBuffer() int {
+	switch {
+	case n.bracha != nil:
+		return brachaReadBuffer
+	case n.fragments != nil:
+		return fragmentReadBuffer
+	case n.ae != nil:
+		return aeReadBuffer
+	case n.fec != nil:
+		return fecReadBuffer
 	}
-	n, _, err := conn.ReadFromUDP(buf)
+	return 0
+}
+
+// accept processes one 1024-byte unit of topic t, a plain message or a
+// fragment, received directly or delivered by reliable broadcast instance id.
+func (n *Node) accept(t *topic, unit []byte, id *bracha.ID) {
+	if n.fragments != nil {
+		n.acceptFragment(t, unit, id)
+		return
+	}
+	if len(unit) != message.MessageSize {
+		n.logger.LogError("receiveLoop: partial read: got %d bytes, expected %d", len(unit), message.MessageSize)
+		return
+	}
+	msg, err := message.ParseMessage(unit)
 	if err != nil {
-		return 0, err
+		n.logger.LogError("receiveLoop: parse: %v", err)
+		return
+	}
+	sentHex, calcHex, ok := msg.Verify()
+	d := Delivery{From: msg.SenderIndex(), Payload: msg.Payload(), SentHex: sentHex, CalcHex: calcHex, OK: ok}
+	if id != nil {
+		d.From, d.Seq = id.Origin, id.Seq
 	}
-	if n != message.MessageSize {
-		return n, fmt.Errorf("insistRead: partial read: got %d bytes, expected %d", n, message.MessageSize)
+	n.deliver(t, d)
+}
+
+// deliver hands d to the delivery handler of topic t, in sender order if
+// FIFO is on.
+func (n *Node) deliver(t *topic, d Delivery) {
+	d.Topic = t.name
+	if t.fifo == nil {
+		t.handle(d)
+		return
+	}
+	for _, ready := range t.fifo.push(d) {
+		t.handle(ready)
+	}
+}
+
+// logDelivery is the default delivery handler: one line in the message log.
+func (n *Node) logDelivery(d Delivery) {
+	if d.Recovered {
+		n.logger.LogRecovered(d.OK, d.From, d.SentHex, d.CalcHex)
+	} else {
+		n.logger.LogMessage(d.OK, d.From, d.SentHex, d.CalcHex)
+	}
+	if n.recvCount.Add(1) == n.expected && n.reached != nil {
+		close(n.reached)
+	}
+}
+
+// record appends a datagram to the capture file, if capturing is enabled.
+func (n *Node) record(dir capture.Direction, peer *net.UDPAddr, data []byte) {
+	if n.capture == nil {
+		return
+	}
+	if err := n.capture.Record(dir, peer, data); err != nil {
+		n.logger.LogError("capture: %v", err)
+	}
+}
+
+// readDatagram performs a single UDP read of any size with a 5-second deadline.
+func readDatagram(conn *net.UDPConn, buf []byte) (int, *net.UDPAddr, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(ioTimeout)); err != nil {
+		return 0, nil, fmt.Errorf("readDatagram: set deadline: %w", err)
+	}
+	n, from, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		return 0, nil, err
 	}
-	return n, nil
+	return n, from, nil
 }
 
 // insistWrite attempts to write data to dest with a 5-second deadline.
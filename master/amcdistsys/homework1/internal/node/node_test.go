@@ -1,17 +1,26 @@
 package node
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"math/rand/v2"
 	"net"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/bracha"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/capture"
 	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/config"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/fec"
 	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/logger"
 	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/message"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/snapshot"
 )
 
 // getFreePort returns an available UDP port on localhost.
@@ -54,8 +63,8 @@ func TestNewNode_BindsUDP(t *testing.T) {
 	if err != nil {
 		t.Fatalf("NewNode: %v", err)
 	}
-	// Node should have a bound connection — close it via the conn field
-	n.conn.Close()
+	// Node should have a bound connection — close it via its transport
+	n.Close()
 }
 
 // --- Requirement: NewNode should fail if port is already in use ---
@@ -130,9 +139,9 @@ func TestInsistWrite_SendsFullMessage(t *testing.T) {
 	}
 }
 
-// --- Requirement: insistRead reads exactly MessageSize bytes ---
+// --- Requirement: readDatagram reads a whole message ---
 
-func TestInsistRead_ReadsFullMessage(t *testing.T) {
+func TestReadDatagram_ReadsFullMessage(t *testing.T) {
 	// Receiver
 	recvAddr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:0")
 	recvConn, err := net.ListenUDP("udp4", recvAddr)
@@ -154,18 +163,18 @@ func TestInsistRead_ReadsFullMessage(t *testing.T) {
 	sendConn.WriteToUDP(msg.Bytes(), destAddr)
 
 	buf := make([]byte, message.MessageSize)
-	n, err := insistRead(recvConn, buf)
+	n, _, err := readDatagram(recvConn, buf)
 	if err != nil {
-		t.Fatalf("insistRead: %v", err)
+		t.Fatalf("readDatagram: %v", err)
 	}
 	if n != message.MessageSize {
-		t.Errorf("insistRead returned %d, expected %d", n, message.MessageSize)
+		t.Errorf("readDatagram returned %d, expected %d", n, message.MessageSize)
 	}
 }
 
-// --- Requirement: insistRead times out after 5s (verify deadline is set) ---
+// --- Requirement: readDatagram times out after 5s (verify deadline is set) ---
 
-func TestInsistRead_Timeout(t *testing.T) {
+func TestReadDatagram_Timeout(t *testing.T) {
 	addr, _ := net.ResolveUDPAddr("udp4", "127.0.0.1:0")
 	conn, err := net.ListenUDP("udp4", addr)
 	if err != nil {
@@ -175,7 +184,7 @@ func TestInsistRead_Timeout(t *testing.T) {
 
 	buf := make([]byte, message.MessageSize)
 	start := time.Now()
-	_, err = insistRead(conn, buf)
+	_, _, err = readDatagram(conn, buf)
 	elapsed := time.Since(start)
 
 	if err == nil {
@@ -218,8 +227,8 @@ func TestFullBroadcast_TwoNodes(t *testing.T) {
 
 	// Override the startup wait so tests don't take 15 seconds
 	origStartupWait := startupWait
-	// We can't override const, so we'll directly test with a small N
-	_ = origStartupWait
+	startupWait = 500 * time.Millisecond
+	defer func() { startupWait = origStartupWait }()
 
 	// Create loggers
 	lg0, err := logger.NewMsgLogger(0)
@@ -241,7 +250,7 @@ func TestFullBroadcast_TwoNodes(t *testing.T) {
 		t.Fatalf("node 1: %v", err)
 	}
 
-	// Run nodes concurrently (this will block for 15s startup + broadcast time)
+	// Run nodes concurrently (this will block for the startup wait + broadcast time)
 	done := make(chan int, 2)
 	go func() { n0.Run(); lg0.Close(); done <- 0 }()
 	go func() { n1.Run(); lg1.Close(); done <- 1 }()
@@ -347,3 +356,911 @@ func TestBroadcast_IncludesSelf(t *testing.T) {
 		}
 	}
 }
+
+// --- Capture: every sent and received datagram is recorded ---
+
+func TestRun_CapturesTraffic(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	dir := t.TempDir()
+	origDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(origDir)
+
+	port := getFreePort(t)
+	N := 2
+	cfg := &config.Config{
+		N:     N,
+		Nodes: []config.NodeAddr{{IP: "127.0.0.1", Port: port}},
+	}
+
+	lg, err := logger.NewMsgLogger(0)
+	if err != nil {
+		t.Fatalf("logger: %v", err)
+	}
+	defer lg.Close()
+
+	n, err := NewNode(0, cfg, lg)
+	if err != nil {
+		t.Fatalf("node: %v", err)
+	}
+	cw, err := capture.Create("node_0.bcap", 0)
+	if err != nil {
+		t.Fatalf("capture: %v", err)
+	}
+	n.SetCapture(cw)
+
+	origWait := startupWait
+	startupWait = 500 * time.Millisecond
+	defer func() { startupWait = origWait }()
+
+	done := make(chan struct{})
+	go func() { n.Run(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("timed out waiting for node")
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatalf("close capture: %v", err)
+	}
+
+	r, err := capture.Open("node_0.bcap")
+	if err != nil {
+		t.Fatalf("open capture: %v", err)
+	}
+	defer r.Close()
+
+	counts := map[capture.Direction]int{}
+	for {
+		rec, err := r.Next()
+		if err != nil {
+			break
+		}
+		counts[rec.Dir]++
+		if len(rec.Data) != message.MessageSize {
+			t.Errorf("captured %d bytes, expected %d", len(rec.Data), message.MessageSize)
+		}
+		if rec.Peer == nil || rec.Peer.Port != port {
+			t.Errorf("captured peer %v, expected port %d", rec.Peer, port)
+		}
+	}
+	if counts[capture.Sent] != N || counts[capture.Received] != N {
+		t.Errorf("expected %d sent and %d received records, got %v", N, N, counts)
+	}
+}
+
+// --- Bracha mode: correct nodes agree despite an equivocating fake node ---
+// Nodes 0-2 run the real protocol over UDP; node 3 is a fake that sends a
+// different payload to node 2 than to nodes 0 and 1 for every broadcast and
+// backs node 0's copy with its own ECHO and READY.
+
+func TestBracha_EquivocatingFakeNode(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	dir := t.TempDir()
+	origDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(origDir)
+
+	origWait := startupWait
+	startupWait = 500 * time.Millisecond
+	defer func() { startupWait = origWait }()
+
+	const M, f, N = 4, 1, 5
+	cfg := &config.Config{N: N}
+	for i := 0; i < M; i++ {
+		cfg.Nodes = append(cfg.Nodes, config.NodeAddr{IP: "127.0.0.1", Port: getFreePort(t)})
+	}
+	secret := []byte("test")
+
+	done := make(chan int, M)
+	for i := 0; i < M-1; i++ {
+		lg, err := logger.NewMsgLogger(i)
+		if err != nil {
+			t.Fatalf("logger %d: %v", i, err)
+		}
+		n, err := NewNode(i, cfg, lg)
+		if err != nil {
+			t.Fatalf("node %d: %v", i, err)
+		}
+		keys, _ := bracha.DeriveKeyring(secret, i, M)
+		proc, err := bracha.NewProcess(keys, f)
+		if err != nil {
+			t.Fatalf("process %d: %v", i, err)
+		}
+		n.SetBracha(proc)
+		go func(i int) { n.Run(); lg.Close(); done <- i }(i)
+	}
+
+	// Fake node 3: only equivocates, never relays anyone else's broadcasts.
+	fakeAddr, _ := net.ResolveUDPAddr("udp4", fmt.Sprintf("127.0.0.1:%d", cfg.Nodes[3].Port))
+	fake, err := net.ListenUDP("udp4", fakeAddr)
+	if err != nil {
+		t.Fatalf("fake node: %v", err)
+	}
+	defer fake.Close()
+	fakeKeys, _ := bracha.DeriveKeyring(secret, 3, M)
+	sendFake := func(to int, typ bracha.Type, seq uint32, payload []byte) {
+		fr := &bracha.Frame{Type: typ, Origin: 3, Seq: seq, Payload: payload}
+		fakeKeys.Sign(fr)
+		data, _ := fr.Marshal()
+		dest, _ := net.ResolveUDPAddr("udp4", fmt.Sprintf("127.0.0.1:%d", cfg.Nodes[to].Port))
+		fake.WriteToUDP(data, dest)
+	}
+	time.Sleep(startupWait)
+	for seq := uint32(0); seq < N; seq++ {
+		a := message.BuildMessage(3).Bytes()
+		b := message.BuildMessage(3).Bytes()
+		sendFake(0, bracha.Initial, seq, a)
+		sendFake(1, bracha.Initial, seq, a)
+		sendFake(2, bracha.Initial, seq, b)
+		sendFake(0, bracha.Echo, seq, a)
+		sendFake(0, bracha.Ready, seq, a)
+	}
+
+	timeout := time.After(60 * time.Second)
+	for i := 0; i < M-1; i++ {
+		select {
+		case <-done:
+		case <-timeout:
+			t.Fatal("timed out waiting for nodes")
+		}
+	}
+
+	var fakeDeliveries []map[string]bool
+	for i := 0; i < M-1; i++ {
+		data, err := os.ReadFile(filepath.Join("logs", fmt.Sprintf("node_%d_messages.log", i)))
+		if err != nil {
+			t.Fatalf("node %d: read log: %v", i, err)
+		}
+		perSource := map[string]int{}
+		fromFake := map[string]bool{}
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) != 4 || fields[0] != "OK" {
+				t.Errorf("node %d: unexpected log line %q", i, line)
+				continue
+			}
+			perSource[fields[1]]++
+			if fields[1] == "3" {
+				fromFake[fields[2]] = true
+			}
+		}
+		// Validity: every broadcast of a correct node is delivered.
+		for src := 0; src < M-1; src++ {
+			if got := perSource[fmt.Sprint(src)]; got != N {
+				t.Errorf("node %d: expected %d deliveries from node %d, got %d", i, N, src, got)
+			}
+		}
+		fakeDeliveries = append(fakeDeliveries, fromFake)
+	}
+
+	// Agreement: all correct nodes delivered the same payloads from the fake node (possibly none).
+	for i := 1; i < len(fakeDeliveries); i++ {
+		if len(fakeDeliveries[i]) != len(fakeDeliveries[0]) {
+			t.Fatalf("node %d delivered %d payloads from the fake node, node 0 delivered %d",
+				i, len(fakeDeliveries[i]), len(fakeDeliveries[0]))
+		}
+		for sha := range fakeDeliveries[i] {
+			if !fakeDeliveries[0][sha] {
+				t.Errorf("node %d delivered fake payload %s that node 0 did not", i, sha)
+			}
+		}
+	}
+	t.Logf("correct nodes agreed on %d of %d equivocated broadcasts", len(fakeDeliveries[0]), N)
+}
+
+// --- Fragment mode: multi-datagram payloads are reassembled and verified ---
+
+func TestFragmentation_TwoNodes(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test in short mode")
+	}
+
+	dir := t.TempDir()
+	origDir, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(origDir)
+
+	origWait := startupWait
+	startupWait = 500 * time.Millisecond
+	defer func() { startupWait = origWait }()
+
+	N := 3
+	cfg := &config.Config{
+		N: N,
+		Nodes: []config.NodeAddr{
+			{IP: "127.0.0.1", Port: getFreePort(t)},
+			{IP: "127.0.0.1", Port: getFreePort(t)},
+		},
+	}
+	M := len(cfg.Nodes)
+	payloads := [][]byte{make([]byte, 0), make([]byte, 5000), make([]byte, 200<<10)}
+	for _, p := range payloads {
+		for i := range p {
+			p[i] = byte(i * 7)
+		}
+	}
+
+	done := make(chan struct{}, M)
+	for i := 0; i < M; i++ {
+		lg, err := logger.NewMsgLogger(i)
+		if err != nil {
+			t.Fatalf("logger %d: %v", i, err)
+		}
+		n, err := NewNode(i, cfg, lg)
+		if err != nil {
+			t.Fatalf("node %d: %v", i, err)
+		}
+		n.SetFragmentation(FragmentOptions{Timeout: 5 * time.Second})
+		n.SetPayloads(func(seq int) []byte { return payloads[seq] })
+		go func() { n.Run(); lg.Close(); done <- struct{}{} }()
+	}
+	timeout := time.After(60 * time.Second)
+	for i := 0; i < M; i++ {
+		select {
+		case <-done:
+		case <-timeout:
+			t.Fatal("timed out waiting for nodes")
+		}
+	}
+
+	for i := 0; i < M; i++ {
+		data, _ := os.ReadFile(filepath.Join("logs", fmt.Sprintf("node_%d_messages.log", i)))
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(lines) != N*M {
+			t.Errorf("node %d: expected %d reassembled payloads, got %d", i, N*M, len(lines))
+		}
+		for _, line := range lines {
+			if !strings.HasPrefix(line, "OK ") {
+				t.Errorf("node %d: expected OK, got %q", i, line)
+			}
+		}
+		errs, _ := os.ReadFile(filepath.Join("logs", fmt.Sprintf("node_%d_errors.log", i)))
+		if len(strings.TrimSpace(string(errs))) > 0 {
+			t.Errorf("node %d: error log should be empty, got: %s", i, errs)
+		}
+	}
+}
+
+// --- MemNetwork partitions drop traffic between groups until healed ---
+
+func TestMemNetwork_Partition(t *testing.T) {
+	mem := NewMemNetwork(3)
+	ts := []Transport{mem.Transport(0), mem.Transport(1), mem.Transport(2)}
+	reaches := func(from, to int) bool {
+		ts[from].Send(to, []byte{byte(from)})
+		buf := make([]byte, 1)
+		done := make(chan bool, 1)
+		go func() {
+			_, _, err := ts[to].Recv(buf)
+			done <- err == nil
+		}()
+		select {
+		case ok := <-done:
+			return ok
+		case <-time.After(50 * time.Millisecond):
+			ts[to].Send(to, []byte{0xFF}) // unblock the reader
+			<-done
+			return false
+		}
+	}
+
+	mem.Partition([]int{0, 1}) // node 2 is isolated
+	if !reaches(0, 1) || reaches(0, 2) || reaches(2, 1) {
+		t.Error("partition {0, 1} | {2} not enforced")
+	}
+	mem.Heal()
+	if !reaches(0, 2) || !reaches(2, 1) {
+		t.Error("Heal did not reconnect the nodes")
+	}
+}
+
+// --- Snapshots: a Chandy-Lamport snapshot taken mid-broadcast is consistent ---
+
+func TestSnapshot_ConsistentMidBroadcast(t *testing.T) {
+	const M, N = 3, 300
+	dir := t.TempDir()
+	cfg := &config.Config{N: N}
+	for i := 0; i < M; i++ {
+		cfg.Nodes = append(cfg.Nodes, config.NodeAddr{IP: "127.0.0.1", Port: 5000 + i})
+	}
+	mem := NewMemNetwork(M)
+
+	locals := make(chan *snapshot.Local, M)
+	nodes := make([]*Node, M)
+	loggers := make([]*logger.MsgLogger, M)
+	for i := range nodes {
+		lg, err := logger.NewMsgLoggerDir(dir, i)
+		if err != nil {
+			t.Fatalf("logger %d: %v", i, err)
+		}
+		loggers[i] = lg
+		nodes[i] = NewNodeWithTransport(i, cfg, lg, mem.Transport(i))
+		nodes[i].SetSnapshots(SnapshotOptions{Timeout: 5 * time.Second, Done: func(l *snapshot.Local) { locals <- l }})
+		if _, err := nodes[i].InitiateSnapshot(); err == nil {
+			t.Fatal("InitiateSnapshot before Start should fail")
+		}
+		if err := nodes[i].Start(context.Background()); err != nil {
+			t.Fatalf("start %d: %v", i, err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i, n := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seq := 0; seq < N; seq++ {
+				if err := n.Broadcast(n.payload(seq)); err != nil {
+					t.Errorf("node %d: broadcast %d: %v", i, seq, err)
+				}
+				if i == 0 && seq == N/3 {
+					if _, err := n.InitiateSnapshot(); err != nil {
+						t.Errorf("InitiateSnapshot: %v", err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	g := &snapshot.Global{ID: 1, Initiator: 0}
+	timeout := time.After(10 * time.Second)
+	for len(g.Nodes) < M {
+		select {
+		case l := <-locals:
+			if !l.Complete {
+				t.Errorf("node %d: snapshot incomplete", l.Node)
+			}
+			g.Nodes = append(g.Nodes, l)
+		case <-timeout:
+			t.Fatalf("got %d of %d local snapshots", len(g.Nodes), M)
+		}
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		all := true
+		for _, n := range nodes {
+			all = all && n.recvCount.Load() == N*M
+		}
+		if all {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for deliveries")
+		}
+	}
+	for i, n := range nodes {
+		n.Close()
+		loggers[i].Close()
+	}
+
+	if problems := g.Validate(M); len(problems) > 0 {
+		t.Errorf("inconsistent snapshot:\n%s", strings.Join(problems, "\n"))
+	}
+	if problems := g.CheckLogs(dir); len(problems) > 0 {
+		t.Errorf("snapshot disagrees with the logs:\n%s", strings.Join(problems, "\n"))
+	}
+	var delivered uint64
+	for _, l := range g.Nodes {
+		delivered += l.Delivered
+	}
+	if delivered == 0 || delivered == N*M*M {
+		t.Errorf("snapshot not taken mid-broadcast: %d of %d delivered", delivered, N*M*M)
+	}
+}
+
+// --- Anti-entropy: nodes fetch what a lossy network dropped and converge ---
+
+// lossyTransport drops a third of the datagrams it sends, anti-entropy
+// traffic included.
+type lossyTransport struct {
+	Transport
+}
+
+func (t *lossyTransport) Send(to int, data []byte) error {
+	if rand.IntN(3) == 0 {
+		return nil
+	}
+	return t.Transport.Send(to, data)
+}
+
+// quiesce waits until the inboxes of mem stay empty for a few checks in a
+// row: the receive loops may still be answering the last datagrams they took.
+func quiesce(mem *MemNetwork) {
+	for quiet := 0; quiet < 3; time.Sleep(2 * time.Millisecond) {
+		quiet++
+		for _, in := range mem.inboxes {
+			if len(in) > 0 {
+				quiet = 0
+			}
+		}
+	}
+}
+
+func TestAntiEntropy_RecoversLostMessages(t *testing.T) {
+	for _, fragmented := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fragment=%v", fragmented), func(t *testing.T) {
+			const M, N = 3, 60
+			cfg := &config.Config{N: N}
+			for i := 0; i < M; i++ {
+				cfg.Nodes = append(cfg.Nodes, config.NodeAddr{IP: "127.0.0.1", Port: 5000 + i})
+			}
+			mem := NewMemNetwork(M)
+			dir := t.TempDir()
+
+			var mu sync.Mutex
+			delivered := make([]map[string]int, M)
+			recovered := make([]int, M)
+			nodes := make([]*Node, M)
+			for i := range nodes {
+				delivered[i] = map[string]int{}
+				lg, err := logger.NewMsgLoggerDir(dir, i)
+				if err != nil {
+					t.Fatalf("logger %d: %v", i, err)
+				}
+				defer lg.Close()
+				n := NewNodeWithTransport(i, cfg, lg, &lossyTransport{Transport: mem.Transport(i)})
+				if fragmented {
+					n.SetFragmentation(FragmentOptions{Timeout: 5 * time.Second})
+				}
+				n.SetDeliver(func(d Delivery) {
+					mu.Lock()
+					defer mu.Unlock()
+					if !d.OK {
+						t.Errorf("node %d: corrupted delivery from %d", i, d.From)
+					}
+					delivered[i][fmt.Sprintf("%d %s", d.From, d.SentHex)]++
+				})
+				n.SetAntiEntropy(AntiEntropyOptions{Interval: time.Millisecond, Recovered: func(r Recovery) {
+					mu.Lock()
+					recovered[i]++
+					mu.Unlock()
+				}})
+				if err := n.StartAntiEntropy(context.Background()); err == nil {
+					t.Fatal("StartAntiEntropy before Start should fail")
+				}
+				if err := n.Start(context.Background()); err != nil {
+					t.Fatalf("start %d: %v", i, err)
+				}
+				defer n.Close()
+				nodes[i] = n
+			}
+
+			for i, n := range nodes {
+				for seq := 0; seq < N; seq++ {
+					payload := make([]byte, message.PayloadSize)
+					if fragmented {
+						payload = make([]byte, 3000)
+					}
+					copy(payload, fmt.Sprintf("node %d payload %d", i, seq))
+					if err := n.Broadcast(payload); err != nil {
+						t.Fatalf("node %d: broadcast %d: %v", i, seq, err)
+					}
+				}
+			}
+			// The test drives the rounds, each once the previous one died
+			// down, so that convergence does not depend on how fast the
+			// receive loops keep up with a ticker: StartAntiEntropy runs a
+			// single round on a context already done.
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			for _, n := range nodes {
+				if err := n.StartAntiEntropy(ctx); err != nil {
+					t.Fatalf("StartAntiEntropy: %v", err)
+				}
+			}
+			for rounds := 0; ; rounds++ {
+				quiesce(mem)
+				all := true
+				for _, n := range nodes {
+					all = all && n.Converged()
+				}
+				if all {
+					t.Logf("converged after %d rounds", rounds)
+					break
+				}
+				if rounds == 1000 {
+					t.Fatal("not converged after 1000 rounds")
+				}
+				for _, n := range nodes {
+					n.round()
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			total := 0
+			for i := range nodes {
+				if len(delivered[i]) != N*M {
+					t.Errorf("node %d: delivered %d distinct payloads, want %d", i, len(delivered[i]), N*M)
+				}
+				for key, count := range delivered[i] {
+					if count > 1 {
+						t.Errorf("node %d: %s delivered %d times", i, key, count)
+					}
+				}
+				total += recovered[i]
+			}
+			if total == 0 {
+				t.Error("nothing recovered through anti-entropy despite the losses")
+			}
+		})
+	}
+}
+
+// --- Anti-entropy: captured REPAIR messages yield the datagrams they carry ---
+
+func TestRepairedUnits(t *testing.T) {
+	msg, err := message.NewMessage(1, make([]byte, message.PayloadSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	repair, err := encodeAE(&aeMessage{Type: aeRepair, From: 2, Units: [][]byte{msg.Bytes()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary, err := encodeAE(&aeMessage{Type: aeSummary, From: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsAntiEntropy(repair) || IsAntiEntropy(msg.Bytes()) {
+		t.Fatal("IsAntiEntropy does not tell reconciliation messages from data")
+	}
+	from, units, err := RepairedUnits(repair, 3)
+	if err != nil || from != 2 || len(units) != 1 || !bytes.Equal(units[0], msg.Bytes()) {
+		t.Errorf("RepairedUnits(repair) = %d, %d units, %v", from, len(units), err)
+	}
+	if _, units, err := RepairedUnits(summary, 3); err != nil || units != nil {
+		t.Errorf("RepairedUnits(summary) = %d units, %v", len(units), err)
+	}
+	if _, _, err := RepairedUnits(repair, 2); err == nil {
+		t.Error("RepairedUnits accepted a sender outside the group")
+	}
+}
+
+// --- FEC: receivers rebuild lost messages from parity, without feedback ---
+
+// groupDropTransport drops the messages (not the parity) it sends to node to
+// whose position within their FEC group of k is in lose.
+type groupDropTransport struct {
+	Transport
+	to, k int
+	lose  map[int]bool
+
+	mu   sync.Mutex
+	sent int
+}
+
+func (t *groupDropTransport) Send(to int, data []byte) error {
+	if to == t.to && len(data) == message.MessageSize {
+		t.mu.Lock()
+		drop := t.lose[t.sent%t.k]
+		t.sent++
+		t.mu.Unlock()
+		if drop {
+			return nil
+		}
+	}
+	return t.Transport.Send(to, data)
+}
+
+func TestFEC_RebuildsLostMessages(t *testing.T) {
+	for _, tc := range []struct {
+		opts FECOptions
+		lose map[int]bool
+	}{
+		{FECOptions{Scheme: fec.XOR, K: 4, R: 1}, map[int]bool{2: true}},
+		{FECOptions{Scheme: fec.ReedSolomon, K: 4, R: 2}, map[int]bool{0: true, 3: true}},
+	} {
+		t.Run(tc.opts.Scheme.String(), func(t *testing.T) {
+			const M, N = 3, 42 // the last group of each sender is partial
+			cfg := &config.Config{N: N}
+			for i := 0; i < M; i++ {
+				cfg.Nodes = append(cfg.Nodes, config.NodeAddr{IP: "127.0.0.1", Port: 5000 + i})
+			}
+			mem := NewMemNetwork(M)
+			dir := t.TempDir()
+
+			nodes := make([]*Node, M)
+			loggers := make([]*logger.MsgLogger, M)
+			for i := range nodes {
+				lg, err := logger.NewMsgLoggerDir(dir, i)
+				if err != nil {
+					t.Fatalf("logger %d: %v", i, err)
+				}
+				defer lg.Close()
+				var tr Transport = mem.Transport(i)
+				if i == 0 {
+					tr = &groupDropTransport{Transport: tr, to: 2, k: tc.opts.K, lose: tc.lose}
+				}
+				n := NewNodeWithTransport(i, cfg, lg, tr)
+				n.SetFEC(tc.opts)
+				if err := n.Start(context.Background()); err != nil {
+					t.Fatalf("start %d: %v", i, err)
+				}
+				defer n.Close()
+				nodes[i], loggers[i] = n, lg
+			}
+
+			for i, n := range nodes {
+				for seq := 0; seq < N; seq++ {
+					payload := make([]byte, message.PayloadSize)
+					copy(payload, fmt.Sprintf("node %d payload %d", i, seq))
+					if err := n.Broadcast(payload); err != nil {
+						t.Fatalf("node %d: broadcast %d: %v", i, seq, err)
+					}
+				}
+			}
+			for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+				all := true
+				for _, n := range nodes {
+					all = all && n.recvCount.Load() >= N*M
+				}
+				if all {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("timed out waiting for every message, rebuilt ones included")
+				}
+			}
+			time.Sleep(50 * time.Millisecond) // let late duplicates show up, if any
+
+			lost := 0
+			for seq := 0; seq < N; seq++ {
+				if tc.lose[seq%tc.opts.K] {
+					lost++
+				}
+			}
+			for i, n := range nodes {
+				n.Close()
+				loggers[i].Close()
+				entries, err := logger.ReadMessageLog(filepath.Join(dir, fmt.Sprintf("node_%d_messages.log", i)))
+				if err != nil {
+					t.Fatalf("node %d: %v", i, err)
+				}
+				seen := map[string]bool{}
+				recovered := 0
+				for _, e := range entries {
+					if !e.OK {
+						t.Errorf("node %d: corrupted message from %d", i, e.SourceIndex)
+					}
+					if seen[e.SentHex] {
+						t.Errorf("node %d: %s logged twice", i, e.SentHex)
+					}
+					seen[e.SentHex] = true
+					if e.Recovered {
+						recovered++
+						if e.SourceIndex != 0 {
+							t.Errorf("node %d: message from %d rebuilt though none was lost", i, e.SourceIndex)
+						}
+					}
+				}
+				if len(seen) != N*M {
+					t.Errorf("node %d: logged %d distinct messages, want %d", i, len(seen), N*M)
+				}
+				if want := map[bool]int{true: lost, false: 0}[i == 2]; recovered != want {
+					t.Errorf("node %d: %d messages rebuilt, want %d", i, recovered, want)
+				}
+			}
+		})
+	}
+
+	n := NewNodeWithTransport(0, &config.Config{Nodes: []config.NodeAddr{{IP: "127.0.0.1", Port: 5000}}}, nil, NewMemNetwork(1).Transport(0))
+	n.SetFragmentation(FragmentOptions{Timeout: time.Second})
+	n.SetFEC(FECOptions{Scheme: fec.XOR, K: 4, R: 1})
+	if err := n.Start(context.Background()); err == nil {
+		t.Error("expected FEC to be refused in fragment mode")
+	}
+}
+
+// --- AddPeers: a running node starts broadcasting to nodes added later ---
+
+func TestAddPeers_ReachesNewNode(t *testing.T) {
+	full := &config.Config{N: 1, Nodes: []config.NodeAddr{
+		{IP: "127.0.0.1", Port: getFreePort(t)},
+		{IP: "127.0.0.1", Port: getFreePort(t)},
+	}}
+	alone := &config.Config{N: 1, Nodes: full.Nodes[:1:1]}
+	dir := t.TempDir()
+	got := make([]chan Delivery, 2)
+	nodes := make([]*Node, 2)
+	for i, cfg := range []*config.Config{alone, full} {
+		lg, err := logger.NewMsgLoggerDir(dir, i)
+		if err != nil {
+			t.Fatalf("logger %d: %v", i, err)
+		}
+		defer lg.Close()
+		n, err := NewNode(i, cfg, lg)
+		if err != nil {
+			t.Fatalf("node %d: %v", i, err)
+		}
+		got[i] = make(chan Delivery, 4)
+		n.SetDeliver(func(d Delivery) { got[i] <- d })
+		if err := n.Start(context.Background()); err != nil {
+			t.Fatalf("start %d: %v", i, err)
+		}
+		defer n.Close()
+		nodes[i] = n
+	}
+
+	payload := make([]byte, message.PayloadSize)
+	if err := nodes[0].Broadcast(payload); err != nil {
+		t.Fatalf("broadcast: %v", err)
+	}
+	<-got[0]
+	bad := []config.NodeAddr{full.Nodes[1], {IP: "no such host.invalid", Port: 5000}}
+	if err := nodes[0].AddPeers(bad); err == nil {
+		t.Fatal("expected error for an address that does not resolve")
+	}
+	if size := nodes[0].size(); size != 1 {
+		t.Fatalf("%d nodes after a failed AddPeers, want 1", size)
+	}
+	if err := nodes[0].AddPeers(full.Nodes[1:]); err != nil {
+		t.Fatalf("AddPeers: %v", err)
+	}
+	if err := nodes[0].Broadcast(payload); err != nil {
+		t.Fatalf("broadcast: %v", err)
+	}
+	for i := range nodes {
+		select {
+		case d := <-got[i]:
+			if d.From != 0 || !d.OK {
+				t.Errorf("node %d: unexpected delivery %+v", i, d)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("node %d: broadcast after AddPeers not delivered", i)
+		}
+	}
+	select {
+	case d := <-got[1]:
+		t.Errorf("node 1 got a broadcast from before it was added: %+v", d)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	mem := NewNodeWithTransport(0, alone, nil, NewMemNetwork(1).Transport(0))
+	if err := mem.AddPeers(full.Nodes[1:]); err == nil {
+		t.Error("expected error for a transport that cannot add peers")
+	}
+}
+
+// --- Topics: streams sharing a socket are delivered and counted apart ---
+
+func TestTopics_SeparateStreams(t *testing.T) {
+	cfg := &config.Config{N: 1, Nodes: make([]config.NodeAddr, 3)}
+	mem := NewMemNetwork(3)
+	dir := t.TempDir()
+	var mu sync.Mutex
+	got := make([]map[string][]Delivery, 3)
+	nodes := make([]*Node, 3)
+	for i := range nodes {
+		lg, err := logger.NewMsgLoggerDir(dir, i)
+		if err != nil {
+			t.Fatalf("logger %d: %v", i, err)
+		}
+		defer lg.Close()
+		n := NewNodeWithTransport(i, cfg, lg, mem.Transport(i))
+		n.SetFragmentation(FragmentOptions{Timeout: time.Second})
+		n.SetFIFO()
+		got[i] = make(map[string][]Delivery)
+		collect := func(d Delivery) {
+			mu.Lock()
+			defer mu.Unlock()
+			got[i][d.Topic] = append(got[i][d.Topic], d)
+		}
+		n.SetDeliver(collect)
+		// Nodes 0 and 1 follow "orders", node 2 follows "audit".
+		name := "orders"
+		if i == 2 {
+			name = "audit"
+		}
+		if err := n.Subscribe(name, collect); err != nil {
+			t.Fatalf("subscribe %d: %v", i, err)
+		}
+		if err := n.Start(context.Background()); err != nil {
+			t.Fatalf("start %d: %v", i, err)
+		}
+		defer n.Close()
+		nodes[i] = n
+	}
+
+	payload := make([]byte, 2*message.FragmentDataSize+1) // 3 fragments
+	for seq := 0; seq < 3; seq++ {
+		if err := nodes[0].Publish("orders", payload); err != nil {
+			t.Fatalf("publish orders: %v", err)
+		}
+	}
+	for seq := 0; seq < 2; seq++ {
+		if err := nodes[1].Publish("audit", payload); err != nil {
+			t.Fatalf("publish audit: %v", err)
+		}
+	}
+	if err := nodes[2].Broadcast(payload); err != nil {
+		t.Fatalf("broadcast: %v", err)
+	}
+
+	want := []map[string]int{
+		{"": 1, "orders": 3},
+		{"": 1, "orders": 3},
+		{"": 1, "audit": 2},
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for i := range nodes {
+		for name, count := range want[i] {
+			for {
+				mu.Lock()
+				have := len(got[i][name])
+				mu.Unlock()
+				if have == count {
+					break
+				}
+				if have > count || time.Now().After(deadline) {
+					t.Fatalf("node %d topic %q: %d deliveries, want %d", i, name, have, count)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, topics := range got {
+		for name, ds := range topics {
+			for seq, d := range ds {
+				// Each topic numbers its payloads from 0.
+				if d.Topic != name || int(d.Seq) != seq || !d.OK {
+					t.Errorf("node %d topic %q: delivery %d = %+v", i, name, seq, d)
+				}
+			}
+		}
+		if s := nodes[i].Stats("orders"); i < 2 && (s.Delivered != 3 || s.Failed != 0) {
+			t.Errorf("node %d: orders stats %+v", i, s)
+		}
+	}
+	if s := nodes[0].Stats("orders"); s.Sent != 3 {
+		t.Errorf("node 0 sent %d on orders, want 3", s.Sent)
+	}
+	if s := nodes[1].Stats("audit"); s.Sent != 2 || s.Delivered != 0 {
+		t.Errorf("node 1 audit stats %+v, want 2 sent and none delivered", s)
+	}
+	if s := nodes[2].Stats(""); s.Sent != 1 || s.Delivered != 1 {
+		t.Errorf("node 2 default topic stats %+v", s)
+	}
+	// 3 fragments per payload on the topics a node does not follow.
+	for i, want := range []int64{2 * 3, 2 * 3, 3 * 3} {
+		if got := nodes[i].Unsubscribed(); got != want {
+			t.Errorf("node %d dropped %d unsubscribed datagrams, want %d", i, got, want)
+		}
+	}
+	if names := nodes[1].Topics(); !slices.Equal(names, []string{"", "audit", "orders"}) {
+		t.Errorf("node 1 topics = %q", names)
+	}
+}
+
+func TestTopics_Invalid(t *testing.T) {
+	cfg := &config.Config{N: 1, Nodes: make([]config.NodeAddr, 1)}
+	n := NewNodeWithTransport(0, cfg, nil, NewMemNetwork(1).Transport(0))
+	defer n.Close()
+	if err := n.Subscribe("a/b", func(Delivery) {}); err == nil {
+		t.Error("expected error for an invalid topic name")
+	}
+	if err := n.Subscribe("a", nil); err == nil {
+		t.Error("expected error for a nil handler")
+	}
+	if err := n.Subscribe("a", func(Delivery) {}); err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	n.SetFEC(FECOptions{Scheme: fec.XOR, K: 4, R: 1})
+	if err := n.Start(context.Background()); err == nil {
+		t.Error("expected error for topics with FEC")
+	}
+	if err := n.Publish("a", make([]byte, message.PayloadSize)); err == nil {
+		t.Error("expected error publishing on a topic with FEC")
+	}
+}
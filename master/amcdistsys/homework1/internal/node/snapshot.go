@@ -0,0 +1,263 @@
+package node
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/bracha"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/capture"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/message"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/snapshot"
+)
+
+// SnapshotOptions configures Chandy-Lamport snapshots.
+type SnapshotOptions struct {
+	// Timeout is how long a node waits, after recording its state, for the
+	// markers of every channel (10s if zero). A snapshot still open then is
+	// reported with Complete unset.
+	Timeout time.Duration
+	// Done receives every local snapshot once it is complete or timed out.
+	// It is called from the receive loop.
+	Done func(*snapshot.Local)
+}
+
+// snapshotKey identifies a snapshot across the nodes.
+type snapshotKey struct {
+	initiator uint8
+	id        uint32
+}
+
+// snapshots is the node's Chandy-Lamport state. The algorithm assumes FIFO
+// channels; UDP on one host practically is, and the validator reports when a
+// run was not.
+type snapshots struct {
+	opts SnapshotOptions
+	seq  atomic.Uint32 // ids of the snapshots this node initiates
+
+	// sendMu orders sends: a node's markers leave after everything it sent
+	// before recording its state and before anything it sends after.
+	sendMu sync.Mutex
+	sent   []uint64
+
+	mu        sync.Mutex
+	received  []uint64
+	delivered uint64
+	open      map[snapshotKey]*openSnapshot
+	finished  map[snapshotKey]bool // late markers of these are ignored
+}
+
+type openSnapshot struct {
+	local    *snapshot.Local
+	deadline time.Time
+}
+
+// SetSnapshots enables Chandy-Lamport snapshots: the node answers markers,
+// records the state of its incoming channels, and can initiate snapshots with
+// InitiateSnapshot. Must be called before Start.
+func (n *Node) SetSnapshots(opts SnapshotOptions) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	m := len(n.config.Nodes)
+	n.snaps = &snapshots{
+		opts:     opts,
+		sent:     make([]uint64, m),
+		received: make([]uint64, m),
+		open:     map[snapshotKey]*openSnapshot{},
+		finished: map[snapshotKey]bool{},
+	}
+}
+
+// InitiateSnapshot records the node's state and sends a marker to every
+// node, itself included, starting a new global snapshot. It returns the
+// snapshot's id; together with the node's index it names the snapshot.
+func (n *Node) InitiateSnapshot() (uint32, error) {
+	if n.snaps == nil {
+		return 0, fmt.Errorf("InitiateSnapshot: snapshots are not enabled")
+	}
+	if n.stopped == nil {
+		return 0, fmt.Errorf("InitiateSnapshot: node not started")
+	}
+	id := n.snaps.seq.Add(1)
+	n.snaps.mu.Lock()
+	n.recordState(snapshotKey{uint8(n.index), id}, -1)
+	n.snaps.mu.Unlock()
+	return id, nil
+}
+
+// mode names the kind of datagrams the channels carry.
+func (n *Node) mode() string {
+	switch {
+	case n.bracha != nil:
+		return "bracha"
+	case n.fragments != nil:
+		return "fragment"
+	}
+	return "plain"
+}
+
+// recordState takes the node's part of snapshot key, whose marker arrived
+// from node from (-1 when initiating), and sends the node's markers. The
+// caller holds snaps.mu.
+func (n *Node) recordState(key snapshotKey, from int) {
+	s := n.snaps
+	if s.open[key] != nil || s.finished[key] {
+		return
+	}
+	m := len(n.config.Nodes)
+	l := &snapshot.Local{
+		ID:        key.id,
+		Initiator: int(key.initiator),
+		Node:      n.index,
+		Mode:      n.mode(),
+		TakenAt:   time.Now(),
+		Received:  append([]uint64(nil), s.received...),
+		Delivered: s.delivered,
+		Channels:  make([]snapshot.Channel, m),
+	}
+	for i := range l.Channels {
+		l.Channels[i] = snapshot.Channel{From: i, InFlight: []string{}, Closed: i == from}
+	}
+
+	marker := message.Marker{Sender: uint8(n.index), Initiator: key.initiator, ID: key.id}.Bytes()
+	s.sendMu.Lock()
+	l.Sent = append([]uint64(nil), s.sent...)
+	for i := 0; i < m; i++ {
+		if err := n.transport.Send(i, marker); err != nil {
+			n.logger.LogError("snapshot %d/%d: send marker to node %d: %v", key.initiator, key.id, i, err)
+			continue
+		}
+		n.record(capture.Sent, n.transport.Addr(i), marker)
+	}
+	s.sendMu.Unlock()
+
+	s.open[key] = &openSnapshot{local: l, deadline: l.TakenAt.Add(s.opts.Timeout)}
+}
+
+// handleMarker processes a marker received by the receive loop.
+func (n *Node) handleMarker(data []byte) {
+	mk, err := message.ParseMarker(data)
+	if err != nil {
+		n.logger.LogError("receiveLoop: %v", err)
+		return
+	}
+	if int(mk.Sender) >= len(n.config.Nodes) || int(mk.Initiator) >= len(n.config.Nodes) {
+		n.logger.LogError("receiveLoop: marker from unknown node %d (initiator %d)", mk.Sender, mk.Initiator)
+		return
+	}
+	s := n.snaps
+	key := snapshotKey{mk.Initiator, mk.ID}
+	s.mu.Lock()
+	if s.open[key] == nil {
+		n.recordState(key, int(mk.Sender)) // first marker: the channel it came on is empty
+	} else {
+		s.open[key].local.Channels[mk.Sender].Closed = true
+	}
+	var done []*snapshot.Local
+	if o := s.open[key]; o != nil && allClosed(o.local) {
+		o.local.Complete = true
+		done = append(done, o.local)
+		delete(s.open, key)
+		s.finished[key] = true
+	}
+	s.mu.Unlock()
+	n.reportSnapshots(done)
+}
+
+func allClosed(l *snapshot.Local) bool {
+	for _, c := range l.Channels {
+		if !c.Closed {
+			return false
+		}
+	}
+	return true
+}
+
+// countReceived accounts for a data datagram: it is received on its sender's
+// channel, and in flight on that channel for every snapshot still open on it.
+func (n *Node) countReceived(data []byte) {
+	from := n.channelOf(data)
+	if from < 0 {
+		return
+	}
+	s := n.snaps
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.received[from]++
+	var digest string
+	for _, o := range s.open {
+		if c := &o.local.Channels[from]; !c.Closed {
+			if digest == "" {
+				digest = snapshot.Digest(data)
+			}
+			c.InFlight = append(c.InFlight, digest)
+		}
+	}
+}
+
+// countSent accounts for a data datagram sent to node to; the caller holds
+// snaps.sendMu.
+func (n *Node) countSent(to int) {
+	n.snaps.sent[to]++
+}
+
+// countDelivered accounts for one delivery.
+func (n *Node) countDelivered() {
+	n.snaps.mu.Lock()
+	n.snaps.delivered++
+	n.snaps.mu.Unlock()
+}
+
+// channelOf returns the node that sent a data datagram, -1 if unknown: the
+// signer of a Bracha frame, byte 0 of a message or fragment.
+func (n *Node) channelOf(data []byte) int {
+	from := -1
+	if n.bracha != nil {
+		if f, err := bracha.ParseFrame(data); err == nil {
+			from = int(f.From)
+		}
+	} else if len(data) > 0 {
+		from = int(data[0])
+	}
+	if from >= len(n.config.Nodes) {
+		return -1
+	}
+	return from
+}
+
+// expireSnapshots reports, incomplete, the snapshots whose markers are still
+// missing at now.
+func (n *Node) expireSnapshots(now time.Time) {
+	s := n.snaps
+	var done []*snapshot.Local
+	s.mu.Lock()
+	for key, o := range s.open {
+		if now.After(o.deadline) {
+			done = append(done, o.local)
+			delete(s.open, key)
+			s.finished[key] = true
+		}
+	}
+	s.mu.Unlock()
+	for _, l := range done {
+		var missing []int
+		for _, c := range l.Channels {
+			if !c.Closed {
+				missing = append(missing, c.From)
+			}
+		}
+		n.logger.LogError("snapshot %d/%d: gave up waiting for the markers of nodes %v", l.Initiator, l.ID, missing)
+	}
+	n.reportSnapshots(done)
+}
+
+func (n *Node) reportSnapshots(done []*snapshot.Local) {
+	if n.snaps.opts.Done == nil {
+		return
+	}
+	for _, l := range done {
+		n.snaps.opts.Done(l)
+	}
+}
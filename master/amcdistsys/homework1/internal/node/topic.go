@@ -0,0 +1,167 @@
+package node
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/message"
+)
+
+// TopicStats counts one topic's traffic at this node.
+type TopicStats struct {
+	Sent      int64 // broadcasts this node made on the topic
+	Delivered int64 // payloads delivered, FAIL ones included
+	Failed    int64 // payloads delivered whose SHA-1 did not match
+}
+
+// topic is one stream of broadcasts through the node's socket. Besides its
+// delivery handler, it has its own fragment ids, reassembly and FIFO order,
+// so that the streams do not hold each other up.
+type topic struct {
+	name      string
+	deliverFn func(Delivery)       // nil for a topic this node only publishes on
+	fifo      *fifoQueue           // optional, holds deliveries back until they are in sender order
+	reasm     *message.Reassembler // owned by the receive loop
+	nextID    atomic.Uint32
+
+	sent, delivered, failed atomic.Int64
+}
+
+// handle counts d and passes it to the topic's handler.
+func (t *topic) handle(d Delivery) {
+	t.delivered.Add(1)
+	if !d.OK {
+		t.failed.Add(1)
+	}
+	t.deliverFn(d)
+}
+
+// Subscribe makes the node deliver the broadcasts on the named topic to fn,
+// with Delivery.Topic set, alongside those on the default topic, which go to
+// the SetDeliver handler. Broadcasts on topics the node did not subscribe to
+// are dropped and counted by Unsubscribed. fn is called from the receive
+// loop, one delivery at a time. Named topics need plain or fragment mode,
+// without anti-entropy, FEC or snapshots. Must be called before Start.
+func (n *Node) Subscribe(name string, fn func(Delivery)) error {
+	if err := message.CheckTopic(name); err != nil {
+		return fmt.Errorf("Subscribe: %w", err)
+	}
+	if fn == nil {
+		return fmt.Errorf("Subscribe: topic %q: nil handler", name)
+	}
+	n.topic(name).deliverFn = fn
+	return nil
+}
+
+// Publish broadcasts payload, like Broadcast, on the named topic; "" is the
+// default topic. Every node receives it but only those subscribed to the
+// topic deliver it; the sender need not be one of them.
+func (n *Node) Publish(name string, payload []byte) error {
+	if name == "" {
+		return n.Broadcast(payload)
+	}
+	if err := message.CheckTopic(name); err != nil {
+		return fmt.Errorf("Publish: %w", err)
+	}
+	if err := n.checkTopics(); err != nil {
+		return fmt.Errorf("Publish: %w", err)
+	}
+	t := n.topic(name)
+	units, err := n.frame(t, payload)
+	if err != nil {
+		return fmt.Errorf("Publish: %w", err)
+	}
+	for _, unit := range units {
+		env, err := message.WrapTopic(name, unit)
+		if err != nil {
+			return fmt.Errorf("Publish: %w", err)
+		}
+		n.sendAll(env)
+	}
+	t.sent.Add(1)
+	return nil
+}
+
+// Stats returns the counters of the named topic; "" is the default topic.
+func (n *Node) Stats(name string) TopicStats {
+	n.topicsMu.RLock()
+	t := n.topics[name]
+	n.topicsMu.RUnlock()
+	if t == nil {
+		return TopicStats{}
+	}
+	return TopicStats{Sent: t.sent.Load(), Delivered: t.delivered.Load(), Failed: t.failed.Load()}
+}
+
+// Topics returns the names of the topics this node subscribed to or
+// published on, sorted, the default topic "" first.
+func (n *Node) Topics() []string {
+	n.topicsMu.RLock()
+	defer n.topicsMu.RUnlock()
+	names := make([]string, 0, len(n.topics))
+	for name := range n.topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Unsubscribed returns the number of datagrams dropped because they were
+// broadcast on a topic this node did not subscribe to.
+func (n *Node) Unsubscribed() int64 {
+	return n.unsubscribed.Load()
+}
+
+// topic returns the state of the named topic, creating it if needed.
+func (n *Node) topic(name string) *topic {
+	n.topicsMu.Lock()
+	defer n.topicsMu.Unlock()
+	t := n.topics[name]
+	if t == nil {
+		t = &topic{name: name}
+		n.topics[name] = t
+	}
+	return t
+}
+
+// subscribed returns the topics that have a delivery handler, the default
+// one included.
+func (n *Node) subscribed() []*topic {
+	n.topicsMu.RLock()
+	defer n.topicsMu.RUnlock()
+	var ts []*topic
+	for _, t := range n.topics {
+		if t.deliverFn != nil {
+			ts = append(ts, t)
+		}
+	}
+	return ts
+}
+
+// checkTopics rejects named topics in the modes whose per-message state
+// (Bracha instances, anti-entropy summaries, FEC groups, snapshot counters)
+// only knows the default topic.
+func (n *Node) checkTopics() error {
+	if n.bracha != nil || n.ae != nil || n.fec != nil || n.snaps != nil {
+		return fmt.Errorf("named topics need plain or fragment mode without anti-entropy, FEC or snapshots")
+	}
+	return nil
+}
+
+// handleTopic passes the unit of a topic envelope to the subscribed topic.
+func (n *Node) handleTopic(data []byte) {
+	name, unit, err := message.UnwrapTopic(data)
+	if err != nil {
+		n.logger.LogError("receiveLoop: %v", err)
+		return
+	}
+	n.topicsMu.RLock()
+	t := n.topics[name]
+	n.topicsMu.RUnlock()
+	if t == nil || t.deliverFn == nil {
+		n.unsubscribed.Add(1)
+		return
+	}
+	n.accept(t, unit, nil)
+}
@@ -0,0 +1,225 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/config"
+)
+
+// Transport carries datagrams between the nodes of a group, which are
+// addressed by their index in config.Config.Nodes.
+type Transport interface {
+	// Send writes one datagram to node to.
+	Send(to int, data []byte) error
+	// Recv reads one datagram into buf. It waits at most a transport-defined
+	// timeout (5 seconds for UDP) and then returns an error whose Timeout
+	// method reports true, so callers can notice a quiet network.
+	Recv(buf []byte) (int, *net.UDPAddr, error)
+	// Addr returns the address of node i for labelling captured datagrams,
+	// or nil if the transport has no addresses.
+	Addr(i int) *net.UDPAddr
+	// Close unblocks a pending Recv and releases the transport.
+	Close() error
+}
+
+// UDPTransport is the default Transport: one UDP socket bound on the node's
+// own address, sending to the addresses listed in the config.
+type UDPTransport struct {
+	conn *net.UDPConn
+
+	mu    sync.RWMutex
+	peers []*net.UDPAddr
+}
+
+// NewUDPTransport resolves every node address in cfg and binds the UDP socket
+// of node index.
+func NewUDPTransport(index int, cfg *config.Config) (*UDPTransport, error) {
+	peers := make([]*net.UDPAddr, len(cfg.Nodes))
+	for i, addr := range cfg.Nodes {
+		udpAddr, err := resolve(addr)
+		if err != nil {
+			return nil, fmt.Errorf("NewUDPTransport: %w", err)
+		}
+		peers[i] = udpAddr
+	}
+	self := cfg.Nodes[index]
+	conn, err := net.ListenUDP("udp4", peers[index])
+	if err != nil {
+		return nil, fmt.Errorf("NewUDPTransport: listen UDP on %s:%d: %w", self.IP, self.Port, err)
+	}
+	return &UDPTransport{conn: conn, peers: peers}, nil
+}
+
+func resolve(addr config.NodeAddr) (*net.UDPAddr, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp4", fmt.Sprintf("%s:%d", addr.IP, addr.Port))
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s:%d: %w", addr.IP, addr.Port, err)
+	}
+	return udpAddr, nil
+}
+
+// AddPeers resolves addrs and makes them the next node indices, all of them
+// or, if one does not resolve, none.
+func (t *UDPTransport) AddPeers(addrs []config.NodeAddr) error {
+	resolved := make([]*net.UDPAddr, len(addrs))
+	for i, addr := range addrs {
+		udpAddr, err := resolve(addr)
+		if err != nil {
+			return fmt.Errorf("AddPeers: %w", err)
+		}
+		resolved[i] = udpAddr
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.peers = append(t.peers, resolved...)
+	return nil
+}
+
+// Send writes data to node to with a 5-second deadline.
+func (t *UDPTransport) Send(to int, data []byte) error {
+	return insistWrite(t.conn, data, t.Addr(to))
+}
+
+// Recv reads one datagram with a 5-second deadline.
+func (t *UDPTransport) Recv(buf []byte) (int, *net.UDPAddr, error) {
+	return readDatagram(t.conn, buf)
+}
+
+// Addr returns the resolved address of node i.
+func (t *UDPTransport) Addr(i int) *net.UDPAddr {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.peers[i]
+}
+
+// SendTo writes data to an address outside the config, e.g. to reply to a client.
+func (t *UDPTransport) SendTo(addr *net.UDPAddr, data []byte) error {
+	return insistWrite(t.conn, data, addr)
+}
+
+// SetReadBuffer sets the size of the socket's receive buffer.
+func (t *UDPTransport) SetReadBuffer(bytes int) error {
+	return t.conn.SetReadBuffer(bytes)
+}
+
+// Close closes the socket.
+func (t *UDPTransport) Close() error {
+	return t.conn.Close()
+}
+
+// memInboxSize is the number of datagrams a MemNetwork node can hold unread
+// before further datagrams to it are dropped, like a full socket buffer.
+const memInboxSize = 4096
+
+// MemNetwork connects nodes of the same process through channels instead of
+// sockets, for tests and for embedding a group in a single service.
+type MemNetwork struct {
+	inboxes []chan []byte
+
+	mu    sync.RWMutex
+	group []int // partition group of each node; nil while fully connected
+}
+
+// NewMemNetwork creates an in-memory network of n nodes.
+func NewMemNetwork(n int) *MemNetwork {
+	m := &MemNetwork{inboxes: make([]chan []byte, n)}
+	for i := range m.inboxes {
+		m.inboxes[i] = make(chan []byte, memInboxSize)
+	}
+	return m
+}
+
+// Partition splits the network: from now on a node only reaches the nodes
+// listed in the same group as itself, and nodes not listed at all are isolated.
+// Datagrams between groups are silently dropped.
+func (m *MemNetwork) Partition(groups ...[]int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.group = make([]int, len(m.inboxes))
+	for i := range m.group {
+		m.group[i] = -1 - i // alone
+	}
+	for g, members := range groups {
+		for _, i := range members {
+			m.group[i] = g
+		}
+	}
+}
+
+// Heal reconnects every node.
+func (m *MemNetwork) Heal() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.group = nil
+}
+
+func (m *MemNetwork) connected(from, to int) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.group == nil || m.group[from] == m.group[to]
+}
+
+// Transport returns the transport of node i. Transports requested for the
+// same index share its inbox, so only one of them should receive.
+func (m *MemNetwork) Transport(i int) Transport {
+	return &memTransport{net: m, self: i, closed: make(chan struct{})}
+}
+
+type memTransport struct {
+	net    *MemNetwork
+	self   int
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (t *memTransport) Send(to int, data []byte) error {
+	select {
+	case <-t.closed:
+		return fmt.Errorf("memTransport: send to node %d: %w", to, net.ErrClosed)
+	default:
+	}
+	if to < 0 || to >= len(t.net.inboxes) {
+		return fmt.Errorf("memTransport: no node %d", to)
+	}
+	if !t.net.connected(t.self, to) {
+		return nil // partitioned: lost, as UDP would
+	}
+	select {
+	case t.net.inboxes[to] <- append([]byte(nil), data...):
+	default: // inbox full: dropped, as UDP would
+	}
+	return nil
+}
+
+func (t *memTransport) Recv(buf []byte) (int, *net.UDPAddr, error) {
+	timer := time.NewTimer(ioTimeout)
+	defer timer.Stop()
+	select {
+	case data := <-t.net.inboxes[t.self]:
+		return copy(buf, data), nil, nil
+	case <-t.closed:
+		return 0, nil, net.ErrClosed
+	case <-timer.C:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (t *memTransport) Addr(int) *net.UDPAddr {
+	return nil
+}
+
+func (t *memTransport) Close() error {
+	t.once.Do(func() { close(t.closed) })
+	return nil
+}
+
+// isTimeout reports whether err is a read timeout rather than a failure.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
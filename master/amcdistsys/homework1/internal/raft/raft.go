@@ -0,0 +1,834 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/config"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/node"
+)
+
+// Role is a node's part in the current term.
+type Role int
+
+const (
+	Follower Role = iota
+	Candidate
+	Leader
+)
+
+func (r Role) String() string {
+	switch r {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// Entry is one slot of the replicated log. An empty Command is the no-op a
+// new leader appends to commit the entries of earlier terms.
+type Entry struct {
+	Index   uint64
+	Term    uint64
+	Command []byte
+}
+
+// ApplyMsg is handed to the state machine, in log order. Either Command is
+// the committed command at Index (empty for a no-op), or Snapshot is not nil
+// and the state machine must replace its state with it: the snapshot covers
+// every entry up to Index.
+type ApplyMsg struct {
+	Index    uint64
+	Term     uint64
+	Command  []byte
+	Snapshot []byte
+}
+
+// Options configures a Raft node.
+type Options struct {
+	// ElectionTimeout: followers draw their timeout from
+	// [ElectionTimeout, 2*ElectionTimeout). Defaults to 300ms.
+	ElectionTimeout time.Duration
+	// Heartbeat is the interval of the leader's AppendEntries. Defaults to
+	// ElectionTimeout/5.
+	Heartbeat time.Duration
+	// Log receives one line per election, snapshot and restart; nil discards them.
+	Log io.Writer
+}
+
+const defaultElectionTimeout = 300 * time.Millisecond
+
+// ErrClosed is returned by Start after Close.
+var ErrClosed = errors.New("raft: closed")
+
+// Raft is one node of a replicated log among the nodes of a config, addressed
+// by their index in config.Config.Nodes, over a node transport.
+type Raft struct {
+	self      int
+	n         int
+	transport node.Transport
+	storage   Storage
+	opts      Options
+	log       *log.Logger
+	unhandled func(data []byte, from *net.UDPAddr)
+
+	mu      sync.Mutex
+	applied *sync.Cond // signalled when there is something to apply, or on Close
+
+	// Persistent state. entries[0] stands for the last entry covered by the
+	// snapshot (Index 0 and Term 0 before the first snapshot) and has no command.
+	term     uint64
+	votedFor int
+	entries  []Entry
+	snapshot []byte
+	saved    int // size of the last saved state
+
+	// Volatile state.
+	role             Role
+	leader           int
+	commitIndex      uint64
+	lastApplied      uint64
+	snapshotPending  bool // the snapshot has not been handed to the state machine yet
+	electionDeadline time.Time
+	lastHeartbeat    time.Time
+	votes            map[int]bool
+	incoming         *message // follower: snapshot being received, Data accumulating
+
+	// Leader state, indexed by node.
+	nextIndex  []uint64
+	matchIndex []uint64
+	snapOffset []uint64 // bytes of our snapshot the follower acknowledged
+	snapIndex  []uint64 // which snapshot snapOffset refers to
+
+	applyCh   chan ApplyMsg
+	started   bool
+	closed    bool
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// New creates node self of the cluster described by cfg, restoring whatever
+// st holds from a previous run. The node takes ownership of t.
+func New(self int, cfg *config.Config, t node.Transport, st Storage, opts Options) (*Raft, error) {
+	n := len(cfg.Nodes)
+	if n < 1 {
+		return nil, fmt.Errorf("raft.New: config has no nodes")
+	}
+	if self < 0 || self >= n {
+		return nil, fmt.Errorf("raft.New: node index %d out of range [0, %d)", self, n)
+	}
+	if opts.ElectionTimeout <= 0 {
+		opts.ElectionTimeout = defaultElectionTimeout
+	}
+	if opts.Heartbeat <= 0 {
+		opts.Heartbeat = opts.ElectionTimeout / 5
+	}
+	if opts.Heartbeat >= opts.ElectionTimeout {
+		return nil, fmt.Errorf("raft.New: heartbeat %v must be shorter than the election timeout %v",
+			opts.Heartbeat, opts.ElectionTimeout)
+	}
+	w := opts.Log
+	if w == nil {
+		w = io.Discard
+	}
+	r := &Raft{
+		self:      self,
+		n:         n,
+		transport: t,
+		storage:   st,
+		opts:      opts,
+		log:       log.New(w, fmt.Sprintf("node %d: ", self), log.LstdFlags|log.Lmicroseconds),
+		votedFor:  -1,
+		entries:   []Entry{{}},
+		leader:    -1,
+		applyCh:   make(chan ApplyMsg),
+	}
+	r.applied = sync.NewCond(&r.mu)
+	if err := r.restore(); err != nil {
+		return nil, fmt.Errorf("raft.New: %w", err)
+	}
+	return r, nil
+}
+
+// persistentState is what Storage holds besides the snapshot.
+type persistentState struct {
+	Term     uint64
+	VotedFor int
+	Entries  []Entry
+}
+
+func (r *Raft) restore() error {
+	state, snapshot, err := r.storage.Load()
+	if err != nil {
+		return err
+	}
+	if len(state) == 0 {
+		return nil
+	}
+	var ps persistentState
+	if err := gob.NewDecoder(bytes.NewReader(state)).Decode(&ps); err != nil {
+		return fmt.Errorf("restore: %w", err)
+	}
+	if len(ps.Entries) == 0 {
+		return fmt.Errorf("restore: saved log has no snapshot entry")
+	}
+	r.term, r.votedFor, r.entries, r.snapshot = ps.Term, ps.VotedFor, ps.Entries, snapshot
+	r.saved = len(state)
+	// Everything in the snapshot was committed; the rest is found out from the leader.
+	r.commitIndex = r.snapIndex0()
+	r.snapshotPending = snapshot != nil
+	r.log.Printf("restored term %d, log (%d, %d], snapshot of %d bytes",
+		r.term, r.snapIndex0(), r.lastIndex(), len(snapshot))
+	return nil
+}
+
+// persist saves the state; the caller holds mu. A node that cannot persist
+// must not answer anything, as it could forget a vote or an entry it
+// acknowledged, so a failure is fatal.
+func (r *Raft) persist() {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(persistentState{r.term, r.votedFor, r.entries}); err != nil {
+		panic(fmt.Sprintf("raft: encode state: %v", err))
+	}
+	if err := r.storage.Save(buf.Bytes(), r.snapshot); err != nil {
+		panic(fmt.Sprintf("raft: %v", err))
+	}
+	r.saved = buf.Len()
+}
+
+// SetUnhandled installs the handler of datagrams that are not Raft messages.
+// It must be called before Start.
+func (r *Raft) SetUnhandled(fn func(data []byte, from *net.UDPAddr)) {
+	r.unhandled = fn
+}
+
+// Apply returns the channel on which committed entries and snapshots are
+// delivered. It is closed once the node stops.
+func (r *Raft) Apply() <-chan ApplyMsg {
+	return r.applyCh
+}
+
+// Self returns the node's index.
+func (r *Raft) Self() int {
+	return r.self
+}
+
+// Size returns the number of nodes in the cluster.
+func (r *Raft) Size() int {
+	return r.n
+}
+
+// State returns the current term, the leader the node knows of (-1 if none),
+// and whether it is that leader.
+func (r *Raft) State() (term uint64, leader int, isLeader bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.term, r.leader, r.role == Leader
+}
+
+// StateSize returns the size of the persisted log, for the state machine to
+// decide when to snapshot.
+func (r *Raft) StateSize() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.saved
+}
+
+// Propose appends cmd to the log if this node is the leader, and returns the
+// index and term it will be committed at. There is no guarantee that it will
+// be: the state machine learns it when an ApplyMsg with that index and term
+// arrives, while an entry with another term at that index means it was lost.
+func (r *Raft) Propose(cmd []byte) (index, term uint64, isLeader bool) {
+	if len(cmd) == 0 || len(cmd) > MaxCommand {
+		return 0, 0, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.role != Leader || r.closed {
+		return 0, 0, false
+	}
+	e := r.appendEntry(cmd)
+	for i := range r.n {
+		if i != r.self && r.nextIndex[i] == e.Index {
+			r.sendAppend(i)
+		}
+	}
+	return e.Index, e.Term, true
+}
+
+// Snapshot tells the node that the state machine's state up to and including
+// index is captured by data, so the log up to index can be discarded. index
+// must have been applied.
+func (r *Raft) Snapshot(index uint64, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if index <= r.snapIndex0() || index > r.lastApplied || index > r.lastIndex() {
+		return
+	}
+	r.compact(index, r.termAt(index), data)
+	r.persist()
+	r.log.Printf("term %d: snapshot at index %d (%d bytes)", r.term, index, len(data))
+}
+
+// compact drops the log up to index, which the snapshot data covers.
+func (r *Raft) compact(index, term uint64, data []byte) {
+	var rest []Entry
+	if index <= r.lastIndex() && r.termAt(index) == term {
+		rest = r.entries[index-r.snapIndex0()+1:]
+	}
+	r.entries = append([]Entry{{Index: index, Term: term}}, rest...)
+	r.snapshot = data
+}
+
+// Start runs the node until ctx is done or Close is called.
+func (r *Raft) Start(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return ErrClosed
+	}
+	if r.started {
+		return fmt.Errorf("Start: node already started")
+	}
+	r.started = true
+	ctx, r.cancel = context.WithCancel(ctx)
+	r.resetElectionTimer()
+	r.log.Printf("started in term %d (%d nodes)", r.term, r.n)
+
+	r.wg.Add(3)
+	go func() {
+		defer r.wg.Done()
+		<-ctx.Done()
+		r.mu.Lock()
+		r.closed = true
+		r.applied.Broadcast()
+		r.mu.Unlock()
+		r.closeTransport()
+	}()
+	go func() {
+		defer r.wg.Done()
+		r.receiveLoop(ctx)
+	}()
+	go func() {
+		defer r.wg.Done()
+		r.tickLoop(ctx)
+	}()
+	go r.applyLoop(ctx)
+	return nil
+}
+
+// Close stops the node and closes its transport. To the other nodes it looks
+// exactly like a crash; the storage keeps what the node had saved.
+func (r *Raft) Close() error {
+	r.mu.Lock()
+	started, wasClosed := r.started, r.closed
+	r.closed = true
+	r.applied.Broadcast()
+	r.mu.Unlock()
+	if !started {
+		if !wasClosed {
+			close(r.applyCh)
+		}
+		return r.closeTransport()
+	}
+	r.cancel()
+	err := r.closeTransport()
+	r.wg.Wait()
+	return err
+}
+
+func (r *Raft) closeTransport() error {
+	r.closeOnce.Do(func() { r.closeErr = r.transport.Close() })
+	return r.closeErr
+}
+
+// --- Event loops ---
+
+func (r *Raft) receiveLoop(ctx context.Context) {
+	buf := make([]byte, maxDatagram)
+	for {
+		recvd, from, err := r.transport.Recv(buf)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue // timeouts are expected; tickLoop keeps its own time
+		}
+		if recvd > 0 && buf[0] != wireMagic {
+			if r.unhandled != nil {
+				r.unhandled(append([]byte(nil), buf[:recvd]...), from)
+			}
+			continue
+		}
+		m, err := parseMessage(buf[:recvd], r.n)
+		if err != nil {
+			r.log.Printf("dropping datagram from %v: %v", from, err)
+			continue
+		}
+		r.handle(m)
+	}
+}
+
+func (r *Raft) tickLoop(ctx context.Context) {
+	ticker := time.NewTicker(r.opts.Heartbeat / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			r.mu.Lock()
+			r.log.Printf("stopped in term %d", r.term)
+			r.mu.Unlock()
+			return
+		case now := <-ticker.C:
+			r.mu.Lock()
+			switch {
+			case r.role == Leader && now.Sub(r.lastHeartbeat) >= r.opts.Heartbeat:
+				r.broadcastAppend()
+			case r.role != Leader && now.After(r.electionDeadline):
+				r.startElection()
+			}
+			r.mu.Unlock()
+		}
+	}
+}
+
+// applyLoop hands committed entries, and installed snapshots, to the state
+// machine in order. It closes the apply channel when the node stops.
+func (r *Raft) applyLoop(ctx context.Context) {
+	defer close(r.applyCh)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for {
+		for !r.closed && !r.snapshotPending && r.lastApplied >= r.commitIndex {
+			r.applied.Wait()
+		}
+		if r.closed {
+			return
+		}
+		var msg ApplyMsg
+		if r.snapshotPending {
+			r.snapshotPending = false
+			msg = ApplyMsg{Index: r.snapIndex0(), Term: r.entries[0].Term, Snapshot: r.snapshot}
+			r.lastApplied = msg.Index
+		} else {
+			r.lastApplied++
+			e := r.entries[r.lastApplied-r.snapIndex0()]
+			msg = ApplyMsg{Index: e.Index, Term: e.Term, Command: e.Command}
+		}
+		r.mu.Unlock()
+		select {
+		case r.applyCh <- msg:
+		case <-ctx.Done():
+		}
+		r.mu.Lock()
+	}
+}
+
+// --- Log helpers; the caller holds mu ---
+
+func (r *Raft) snapIndex0() uint64 {
+	return r.entries[0].Index
+}
+
+func (r *Raft) lastIndex() uint64 {
+	return r.entries[len(r.entries)-1].Index
+}
+
+func (r *Raft) lastTerm() uint64 {
+	return r.entries[len(r.entries)-1].Term
+}
+
+// termAt returns the term of the entry at index, which must lie in
+// [snapIndex0, lastIndex].
+func (r *Raft) termAt(index uint64) uint64 {
+	return r.entries[index-r.snapIndex0()].Term
+}
+
+func (r *Raft) appendEntry(cmd []byte) Entry {
+	e := Entry{Index: r.lastIndex() + 1, Term: r.term, Command: cmd}
+	r.entries = append(r.entries, e)
+	r.matchIndex[r.self] = e.Index
+	r.persist()
+	r.advanceCommit() // a single node commits on its own
+	return e
+}
+
+func (r *Raft) hasMajority(count int) bool {
+	return 2*count > r.n
+}
+
+func (r *Raft) resetElectionTimer() {
+	t := r.opts.ElectionTimeout
+	r.electionDeadline = time.Now().Add(t + rand.N(t))
+}
+
+func (r *Raft) send(to int, m *message) {
+	m.From = r.self
+	if m.Term == 0 {
+		m.Term = r.term
+	}
+	data, err := m.marshal()
+	if err != nil {
+		r.log.Printf("%v", err)
+		return
+	}
+	if err := r.transport.Send(to, data); err != nil && !errors.Is(err, net.ErrClosed) {
+		r.log.Printf("send %v to %d: %v", m.Type, to, err)
+	}
+}
+
+// SendTo writes data to an address outside the cluster, e.g. a client reply,
+// if the transport can reach one.
+func (r *Raft) SendTo(addr *net.UDPAddr, data []byte) error {
+	t, ok := r.transport.(interface {
+		SendTo(*net.UDPAddr, []byte) error
+	})
+	if !ok || addr == nil {
+		return fmt.Errorf("SendTo: transport cannot reach %v", addr)
+	}
+	return t.SendTo(addr, data)
+}
+
+// --- Elections ---
+
+// stepDown moves to a newer term as a follower.
+func (r *Raft) stepDown(term uint64) {
+	if r.role == Leader {
+		r.log.Printf("term %d: stepping down, saw term %d", r.term, term)
+	}
+	r.term = term
+	r.votedFor = -1
+	r.role = Follower
+	r.leader = -1
+	r.persist()
+}
+
+func (r *Raft) startElection() {
+	if r.leader >= 0 {
+		r.log.Printf("term %d: leader %d timed out", r.term, r.leader)
+	}
+	r.term++
+	r.role = Candidate
+	r.leader = -1
+	r.votedFor = r.self
+	r.votes = map[int]bool{r.self: true}
+	r.persist()
+	r.resetElectionTimer()
+	r.log.Printf("term %d: candidate", r.term)
+	if r.hasMajority(len(r.votes)) {
+		r.becomeLeader()
+		return
+	}
+	for i := range r.n {
+		if i != r.self {
+			r.send(i, &message{Type: requestVote, LastLogIndex: r.lastIndex(), LastLogTerm: r.lastTerm()})
+		}
+	}
+}
+
+func (r *Raft) becomeLeader() {
+	r.role = Leader
+	r.leader = r.self
+	r.nextIndex = make([]uint64, r.n)
+	r.matchIndex = make([]uint64, r.n)
+	r.snapOffset = make([]uint64, r.n)
+	r.snapIndex = make([]uint64, r.n)
+	for i := range r.nextIndex {
+		r.nextIndex[i] = r.lastIndex() + 1
+	}
+	r.log.Printf("term %d: elected leader (log up to %d)", r.term, r.lastIndex())
+	r.appendEntry(nil)
+	r.broadcastAppend()
+}
+
+func (r *Raft) handle(m *message) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	if m.Term > r.term {
+		r.stepDown(m.Term)
+	}
+	switch m.Type {
+	case requestVote:
+		r.handleRequestVote(m)
+	case requestVoteReply:
+		if r.role == Candidate && m.Term == r.term && m.Granted {
+			r.votes[m.From] = true
+			if r.hasMajority(len(r.votes)) {
+				r.becomeLeader()
+			}
+		}
+	case appendEntries:
+		r.handleAppendEntries(m)
+	case appendEntriesReply:
+		r.handleAppendReply(m)
+	case installSnapshot:
+		r.handleInstallSnapshot(m)
+	case installSnapshotReply:
+		r.handleSnapshotReply(m)
+	}
+}
+
+func (r *Raft) handleRequestVote(m *message) {
+	upToDate := m.LastLogTerm > r.lastTerm() ||
+		(m.LastLogTerm == r.lastTerm() && m.LastLogIndex >= r.lastIndex())
+	granted := m.Term == r.term && (r.votedFor < 0 || r.votedFor == m.From) && upToDate
+	if granted {
+		if r.votedFor != m.From {
+			r.votedFor = m.From
+			r.persist()
+		}
+		r.resetElectionTimer()
+	}
+	r.send(m.From, &message{Type: requestVoteReply, Granted: granted})
+}
+
+// follow accepts m.From as the leader of the current term.
+func (r *Raft) follow(m *message) {
+	if r.role != Follower || r.leader != m.From {
+		r.role = Follower
+		r.leader = m.From
+		r.log.Printf("term %d: following leader %d", r.term, m.From)
+	}
+	r.resetElectionTimer()
+}
+
+// --- Replication ---
+
+// broadcastAppend sends AppendEntries, or a snapshot chunk, to every follower.
+func (r *Raft) broadcastAppend() {
+	r.lastHeartbeat = time.Now()
+	for i := range r.n {
+		if i != r.self {
+			r.sendAppend(i)
+		}
+	}
+}
+
+func (r *Raft) sendAppend(to int) {
+	next := r.nextIndex[to]
+	if next <= r.snapIndex0() {
+		r.sendSnapshot(to)
+		return
+	}
+	m := &message{
+		Type:         appendEntries,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  r.termAt(next - 1),
+		LeaderCommit: r.commitIndex,
+	}
+	size := 0
+	for _, e := range r.entries[next-r.snapIndex0():] {
+		size += len(e.Command) + 32
+		if size > maxEntriesBytes && len(m.Entries) > 0 {
+			break
+		}
+		m.Entries = append(m.Entries, e)
+	}
+	r.send(to, m)
+}
+
+func (r *Raft) handleAppendEntries(m *message) {
+	reply := &message{Type: appendEntriesReply}
+	if m.Term < r.term {
+		r.send(m.From, reply)
+		return
+	}
+	r.follow(m)
+
+	// Entries already covered by our snapshot are committed, hence identical.
+	prev, entries := m.PrevLogIndex, m.Entries
+	if prev < r.snapIndex0() {
+		skip := min(r.snapIndex0()-prev, uint64(len(entries)))
+		prev, entries = r.snapIndex0(), entries[skip:]
+		m.PrevLogTerm = r.entries[0].Term
+	}
+	if prev > r.lastIndex() {
+		reply.Conflict = r.lastIndex() + 1
+		r.send(m.From, reply)
+		return
+	}
+	if t := r.termAt(prev); t != m.PrevLogTerm {
+		// Skip back over the whole conflicting term at once.
+		i := prev
+		for i > r.snapIndex0()+1 && r.termAt(i-1) == t {
+			i--
+		}
+		reply.Conflict = i
+		r.send(m.From, reply)
+		return
+	}
+
+	changed := false
+	for k, e := range entries {
+		if e.Index <= r.lastIndex() {
+			if r.termAt(e.Index) == e.Term {
+				continue
+			}
+			r.entries = r.entries[:e.Index-r.snapIndex0()]
+		}
+		r.entries = append(r.entries, entries[k:]...)
+		changed = true
+		break
+	}
+	if changed {
+		r.persist()
+	}
+	match := prev + uint64(len(entries))
+	if m.LeaderCommit > r.commitIndex {
+		r.commitIndex = max(r.commitIndex, min(m.LeaderCommit, match))
+		r.applied.Broadcast()
+	}
+	reply.Success = true
+	reply.MatchIndex = match
+	r.send(m.From, reply)
+}
+
+func (r *Raft) handleAppendReply(m *message) {
+	if r.role != Leader || m.Term != r.term {
+		return
+	}
+	if m.Success {
+		if m.MatchIndex > r.matchIndex[m.From] {
+			r.matchIndex[m.From] = m.MatchIndex
+			r.advanceCommit()
+		}
+		r.nextIndex[m.From] = max(r.nextIndex[m.From], r.matchIndex[m.From]+1)
+		if r.nextIndex[m.From] <= r.lastIndex() {
+			r.sendAppend(m.From)
+		}
+		return
+	}
+	if m.Conflict > 0 && m.Conflict < r.nextIndex[m.From] {
+		r.nextIndex[m.From] = max(m.Conflict, r.matchIndex[m.From]+1)
+		r.sendAppend(m.From)
+	}
+}
+
+// advanceCommit commits the highest entry of the current term stored on a
+// majority; earlier entries are committed with it.
+func (r *Raft) advanceCommit() {
+	for idx := r.lastIndex(); idx > r.commitIndex && idx > r.snapIndex0(); idx-- {
+		if r.termAt(idx) != r.term {
+			break
+		}
+		count := 0
+		for i := range r.n {
+			if r.matchIndex[i] >= idx {
+				count++
+			}
+		}
+		if r.hasMajority(count) {
+			r.commitIndex = idx
+			r.applied.Broadcast()
+			return
+		}
+	}
+}
+
+// --- Snapshots ---
+
+func (r *Raft) sendSnapshot(to int) {
+	if r.snapIndex[to] != r.snapIndex0() {
+		r.snapIndex[to], r.snapOffset[to] = r.snapIndex0(), 0
+	}
+	off := min(r.snapOffset[to], uint64(len(r.snapshot)))
+	end := min(off+snapshotChunk, uint64(len(r.snapshot)))
+	r.send(to, &message{
+		Type:          installSnapshot,
+		SnapshotIndex: r.snapIndex0(),
+		SnapshotTerm:  r.entries[0].Term,
+		Offset:        off,
+		Data:          r.snapshot[off:end],
+		Done:          end == uint64(len(r.snapshot)),
+	})
+}
+
+func (r *Raft) handleInstallSnapshot(m *message) {
+	reply := &message{Type: installSnapshotReply, SnapshotIndex: m.SnapshotIndex}
+	if m.Term < r.term {
+		r.send(m.From, reply)
+		return
+	}
+	r.follow(m)
+	if m.SnapshotIndex <= r.snapIndex0() || m.SnapshotIndex <= r.commitIndex {
+		// Nothing to learn; report what we have so the leader moves on.
+		reply.Success = true
+		reply.MatchIndex = m.SnapshotIndex
+		r.send(m.From, reply)
+		return
+	}
+	in := r.incoming
+	if in == nil || in.SnapshotIndex != m.SnapshotIndex || in.SnapshotTerm != m.SnapshotTerm {
+		if m.Offset != 0 {
+			r.send(m.From, reply) // Offset 0: start over
+			return
+		}
+		in = &message{SnapshotIndex: m.SnapshotIndex, SnapshotTerm: m.SnapshotTerm}
+		r.incoming = in
+	}
+	if m.Offset != uint64(len(in.Data)) {
+		reply.Offset = uint64(len(in.Data))
+		r.send(m.From, reply)
+		return
+	}
+	in.Data = append(in.Data, m.Data...)
+	if !m.Done {
+		reply.Offset = uint64(len(in.Data))
+		r.send(m.From, reply)
+		return
+	}
+
+	r.incoming = nil
+	r.compact(in.SnapshotIndex, in.SnapshotTerm, in.Data)
+	r.commitIndex = max(r.commitIndex, in.SnapshotIndex)
+	if r.lastApplied < in.SnapshotIndex {
+		r.snapshotPending = true
+		r.applied.Broadcast()
+	}
+	r.persist()
+	r.log.Printf("term %d: installed snapshot at index %d from leader %d (%d bytes)",
+		r.term, in.SnapshotIndex, m.From, len(in.Data))
+	reply.Success = true
+	reply.MatchIndex = in.SnapshotIndex
+	r.send(m.From, reply)
+}
+
+func (r *Raft) handleSnapshotReply(m *message) {
+	if r.role != Leader || m.Term != r.term {
+		return
+	}
+	if m.Success {
+		if m.MatchIndex > r.matchIndex[m.From] {
+			r.matchIndex[m.From] = m.MatchIndex
+			r.advanceCommit()
+		}
+		r.nextIndex[m.From] = max(r.nextIndex[m.From], r.matchIndex[m.From]+1)
+		r.sendAppend(m.From)
+		return
+	}
+	if m.SnapshotIndex == r.snapIndex0() && r.nextIndex[m.From] <= r.snapIndex0() {
+		r.snapOffset[m.From] = m.Offset
+		r.sendSnapshot(m.From)
+	}
+}
@@ -0,0 +1,389 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/config"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/node"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/testutil"
+)
+
+// --- Harness: in-process cluster over a MemNetwork ---
+
+// The state machine of every node records the command applied at each index.
+// Each index must get the same command everywhere, which the cluster checks as
+// entries are applied.
+type cluster struct {
+	*testutil.Cluster[*Raft] // Nodes[i] is nil while killed
+	storage                  []*MemStorage
+	snapshot                 uint64 // snapshot every that many entries; 0 never
+
+	mu        sync.Mutex
+	committed map[uint64]string   // index -> command, across all nodes
+	state     []map[uint64]string // per node: what it applied
+	snapshots int                 // snapshots installed from a leader
+	done      []chan struct{}     // per node: its apply loop returned
+	applyErr  []string            // consistency violations
+}
+
+func newCluster(t *testing.T, n int, snapshotEvery uint64) *cluster {
+	c := &cluster{
+		storage:   make([]*MemStorage, n),
+		snapshot:  snapshotEvery,
+		committed: map[uint64]string{},
+		state:     make([]map[uint64]string, n),
+		done:      make([]chan struct{}, n),
+	}
+	// cleanups run last first: this one once every node was killed
+	t.Cleanup(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, e := range c.applyErr {
+			t.Error(e)
+		}
+	})
+	cfg := testutil.Config(n)
+	c.Cluster = testutil.NewCluster(t, n, func(i int, tr node.Transport) (*Raft, error) {
+		r, err := New(i, cfg, tr, c.storage[i], Options{
+			ElectionTimeout: 100 * time.Millisecond,
+			Heartbeat:       20 * time.Millisecond,
+			Log:             c.Log,
+		})
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		c.state[i] = map[uint64]string{}
+		c.done[i] = make(chan struct{})
+		c.mu.Unlock()
+		go c.applier(i, r)
+		return r, nil
+	})
+	c.Killed = func(i int) { <-c.done[i] }
+	for i := range n {
+		c.storage[i] = NewMemStorage()
+	}
+	c.StartAll()
+	return c
+}
+
+func (c *cluster) applier(i int, r *Raft) {
+	defer close(c.done[i])
+	for msg := range r.Apply() {
+		c.mu.Lock()
+		if msg.Snapshot != nil {
+			var st map[uint64]string
+			if err := gob.NewDecoder(bytes.NewReader(msg.Snapshot)).Decode(&st); err != nil {
+				c.applyErr = append(c.applyErr, fmt.Sprintf("node %d: bad snapshot: %v", i, err))
+			}
+			c.state[i] = st
+			c.snapshots++
+			c.mu.Unlock()
+			continue
+		}
+		cmd := string(msg.Command)
+		if prev, ok := c.committed[msg.Index]; ok && prev != cmd {
+			c.applyErr = append(c.applyErr,
+				fmt.Sprintf("node %d applied %q at index %d, another node applied %q", i, cmd, msg.Index, prev))
+		}
+		if _, ok := c.state[i][msg.Index-1]; !ok && msg.Index > 1 {
+			c.applyErr = append(c.applyErr, fmt.Sprintf("node %d applied index %d out of order", i, msg.Index))
+		}
+		c.committed[msg.Index] = cmd
+		c.state[i][msg.Index] = cmd
+		var snap []byte
+		if c.snapshot > 0 && msg.Index%c.snapshot == 0 {
+			var buf bytes.Buffer
+			gob.NewEncoder(&buf).Encode(c.state[i])
+			snap = buf.Bytes()
+		}
+		c.mu.Unlock()
+		if snap != nil {
+			r.Snapshot(msg.Index, snap)
+		}
+	}
+}
+
+// leader waits for one of the given nodes to consider itself the leader.
+func (c *cluster) leader(among ...int) int {
+	c.T.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, i := range among {
+			if r := c.Nodes[i]; r != nil {
+				if _, _, ok := r.State(); ok {
+					return i
+				}
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.T.Fatalf("no leader among %v after 5s\n%s", among, c.Log.String())
+	return -1
+}
+
+func (c *cluster) all() []int {
+	ids := make([]int, len(c.Nodes))
+	for i := range ids {
+		ids[i] = i
+	}
+	return ids
+}
+
+// propose submits cmd through whichever of the nodes leads, retrying until
+// it is applied by the given nodes.
+func (c *cluster) propose(cmd string, among []int, appliedBy ...int) {
+	c.T.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		l := c.leader(among...)
+		index, _, ok := c.Nodes[l].Propose([]byte(cmd))
+		if !ok {
+			time.Sleep(5 * time.Millisecond)
+			continue
+		}
+		for wait := time.Now().Add(time.Second); time.Now().Before(wait); time.Sleep(5 * time.Millisecond) {
+			if c.appliedAt(index, cmd, appliedBy) {
+				return
+			}
+		}
+	}
+	c.T.Fatalf("%q not applied by %v after 10s\n%s", cmd, appliedBy, c.Log.String())
+}
+
+func (c *cluster) appliedAt(index uint64, cmd string, nodes []int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, i := range nodes {
+		if c.state[i][index] != cmd {
+			return false
+		}
+	}
+	return true
+}
+
+// --- Committed entries reach every node, in the same order ---
+
+func TestRaft_ReplicatesAndCommits(t *testing.T) {
+	c := newCluster(t, 3, 0)
+	for k := range 20 {
+		c.propose(fmt.Sprintf("cmd-%d", k), c.all(), c.all()...)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, st := range c.state {
+		got := 0
+		for _, cmd := range st {
+			if strings.HasPrefix(cmd, "cmd-") {
+				got++
+			}
+		}
+		if got != 20 {
+			t.Errorf("node %d applied %d of 20 commands", i, got)
+		}
+	}
+}
+
+// --- A partitioned leader cannot commit; the majority carries on ---
+
+func TestRaft_PartitionedLeader(t *testing.T) {
+	c := newCluster(t, 5, 0)
+	c.propose("before", c.all(), c.all()...)
+	old := c.leader(c.all()...)
+	minority := []int{old, (old + 1) % 5}
+	var majority []int
+	for i := range 5 {
+		if i != minority[0] && i != minority[1] {
+			majority = append(majority, i)
+		}
+	}
+	c.Mem.Partition(minority, majority)
+
+	lostIndex, _, ok := c.Nodes[old].Propose([]byte("lost"))
+	if !ok {
+		t.Fatal("old leader refused a proposal right after the partition")
+	}
+	c.propose("during", majority, majority...)
+	time.Sleep(100 * time.Millisecond)
+	c.mu.Lock()
+	for i := range 5 {
+		if c.state[i][lostIndex] == "lost" {
+			t.Errorf("node %d applied an entry the minority leader could not commit", i)
+		}
+	}
+	c.mu.Unlock()
+
+	c.Mem.Heal()
+	c.propose("after", c.all(), c.all()...)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for index, cmd := range c.committed {
+		if cmd == "lost" {
+			t.Errorf("uncommitted entry %q applied at index %d", cmd, index)
+		}
+	}
+}
+
+// --- Snapshots compact the log; a lagging node catches up from one ---
+
+func TestRaft_SnapshotCatchUp(t *testing.T) {
+	c := newCluster(t, 3, 10)
+	c.propose("first", c.all(), c.all()...)
+	lagging := (c.leader(c.all()...) + 1) % 3
+	c.Kill(lagging)
+
+	var live []int
+	for i := range 3 {
+		if i != lagging {
+			live = append(live, i)
+		}
+	}
+	for k := range 45 {
+		c.propose(fmt.Sprintf("cmd-%d", k), live, live...)
+	}
+	l := c.leader(live...)
+	c.Nodes[l].mu.Lock()
+	snapAt, logLen := c.Nodes[l].snapIndex0(), len(c.Nodes[l].entries)
+	c.Nodes[l].mu.Unlock()
+	if snapAt < 40 || logLen > 15 {
+		t.Fatalf("leader did not compact its log: snapshot at %d, %d entries kept", snapAt, logLen)
+	}
+
+	c.Start(lagging)
+	c.propose("last", c.all(), c.all()...)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.snapshots == 0 {
+		t.Errorf("restarted node caught up without a snapshot\n%s", c.Log.String())
+	}
+	for k := range 45 {
+		found := false
+		for _, cmd := range c.state[lagging] {
+			found = found || cmd == fmt.Sprintf("cmd-%d", k)
+		}
+		if !found {
+			t.Errorf("restarted node is missing cmd-%d", k)
+		}
+	}
+}
+
+// --- Terms, votes and the log survive a restart of the whole cluster ---
+
+func TestRaft_RestartPersists(t *testing.T) {
+	c := newCluster(t, 3, 0)
+	for k := range 5 {
+		c.propose(fmt.Sprintf("cmd-%d", k), c.all(), c.all()...)
+	}
+	term, _, _ := c.Nodes[c.leader(c.all()...)].State()
+	for i := range 3 {
+		c.Kill(i)
+	}
+	for i := range 3 {
+		c.Start(i)
+	}
+	c.propose("after restart", c.all(), c.all()...)
+	newTerm, _, _ := c.Nodes[c.leader(c.all()...)].State()
+	if newTerm <= term {
+		t.Errorf("term went from %d to %d across the restart", term, newTerm)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, st := range c.state {
+		for k := range 5 {
+			found := false
+			for _, cmd := range st {
+				found = found || cmd == fmt.Sprintf("cmd-%d", k)
+			}
+			if !found {
+				t.Errorf("node %d did not re-apply cmd-%d after restart", i, k)
+			}
+		}
+	}
+}
+
+// --- A single node commits on its own ---
+
+func TestRaft_SingleNode(t *testing.T) {
+	c := newCluster(t, 1, 0)
+	c.propose("alone", c.all(), 0)
+}
+
+// --- Storage and wire format ---
+
+func TestFileStorage_RoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatalf("NewFileStorage: %v", err)
+	}
+	if state, snap, err := s.Load(); err != nil || state != nil || snap != nil {
+		t.Fatalf("empty Load: %q, %q, %v", state, snap, err)
+	}
+	for _, snap := range [][]byte{nil, []byte("snapshot")} {
+		if err := s.Save([]byte("state"), snap); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		state, got, err := s.Load()
+		if err != nil || string(state) != "state" || !bytes.Equal(got, snap) {
+			t.Errorf("Load: %q, %q, %v", state, got, err)
+		}
+	}
+}
+
+func TestMessage_RoundTrip(t *testing.T) {
+	m := &message{Type: appendEntries, From: 2, Term: 7, PrevLogIndex: 3,
+		Entries: []Entry{{Index: 4, Term: 7, Command: []byte("x")}}, LeaderCommit: 3}
+	data, err := m.marshal()
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	got, err := parseMessage(data, 3)
+	if err != nil || got.From != 2 || got.Term != 7 || len(got.Entries) != 1 || string(got.Entries[0].Command) != "x" {
+		t.Fatalf("round-trip: %+v, %v", got, err)
+	}
+	bad := map[string][]byte{
+		"empty":      nil,
+		"bad magic":  append([]byte{0}, data[1:]...),
+		"truncated":  data[:len(data)/2],
+		"bad sender": mustMarshal(t, &message{Type: requestVote, From: 5}),
+		"bad type":   mustMarshal(t, &message{Type: 99}),
+	}
+	for name, buf := range bad {
+		if _, err := parseMessage(buf, 3); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func mustMarshal(t *testing.T, m *message) []byte {
+	t.Helper()
+	data, err := m.marshal()
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	return data
+}
+
+func TestNew_Invalid(t *testing.T) {
+	mem := node.NewMemNetwork(2)
+	cases := []struct {
+		self int
+		cfg  *config.Config
+		opts Options
+	}{
+		{2, testutil.Config(2), Options{}},
+		{0, testutil.Config(0), Options{}},
+		{0, testutil.Config(2), Options{ElectionTimeout: time.Second, Heartbeat: 2 * time.Second}},
+	}
+	for _, tc := range cases {
+		if _, err := New(tc.self, tc.cfg, mem.Transport(0), NewMemStorage(), tc.opts); err == nil {
+			t.Errorf("New(%d, %d nodes, %+v): expected error", tc.self, len(tc.cfg.Nodes), tc.opts)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package raft
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Storage keeps a node's persistent state across restarts: the encoded term,
+// vote and log, and the latest snapshot of the state machine. Save must not
+// return before both are durable, and must replace them atomically.
+type Storage interface {
+	Save(state, snapshot []byte) error
+	Load() (state, snapshot []byte, err error)
+}
+
+// MemStorage keeps the state in memory. It survives a Raft node being closed
+// and recreated, which is how tests simulate a crash and restart.
+type MemStorage struct {
+	mu       sync.Mutex
+	state    []byte
+	snapshot []byte
+}
+
+func NewMemStorage() *MemStorage {
+	return &MemStorage{}
+}
+
+func (s *MemStorage) Save(state, snapshot []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = append([]byte(nil), state...)
+	s.snapshot = snapshot // never modified once handed to Save
+	return nil
+}
+
+func (s *MemStorage) Load() ([]byte, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state, s.snapshot, nil
+}
+
+// FileStorage keeps the state in a single file, raft.state, in its directory.
+// Each Save writes a new file and renames it over the old one.
+type FileStorage struct {
+	path string
+}
+
+// NewFileStorage creates dir if needed and returns a storage in it.
+func NewFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("NewFileStorage: %w", err)
+	}
+	return &FileStorage{path: filepath.Join(dir, "raft.state")}, nil
+}
+
+// Save writes [state length uint32][state][snapshot].
+func (s *FileStorage) Save(state, snapshot []byte) error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("FileStorage.Save: %w", err)
+	}
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(state)))
+	for _, b := range [][]byte{hdr[:], state, snapshot} {
+		if _, err := f.Write(b); err != nil {
+			f.Close()
+			return fmt.Errorf("FileStorage.Save: %w", err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("FileStorage.Save: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("FileStorage.Save: %w", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("FileStorage.Save: %w", err)
+	}
+	return nil
+}
+
+// Load returns empty state if nothing was saved yet.
+func (s *FileStorage) Load() ([]byte, []byte, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("FileStorage.Load: %w", err)
+	}
+	if len(data) < 4 || uint64(binary.BigEndian.Uint32(data))+4 > uint64(len(data)) {
+		return nil, nil, fmt.Errorf("FileStorage.Load: %s is truncated", s.path)
+	}
+	n := 4 + binary.BigEndian.Uint32(data)
+	var snapshot []byte
+	if int(n) < len(data) {
+		snapshot = data[n:]
+	}
+	return data[4:n], snapshot, nil
+}
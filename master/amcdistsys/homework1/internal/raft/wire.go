@@ -0,0 +1,110 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+)
+
+// Raft messages are a magic byte followed by a gob-encoded message. Datagrams
+// with any other first byte are handed to Options.Unhandled, so an application
+// (e.g. the key-value service) can share the node's socket with Raft.
+const wireMagic = 0xAF
+
+const (
+	// maxEntriesBytes bounds the commands carried by one AppendEntries, and
+	// snapshotChunk the snapshot bytes carried by one InstallSnapshot, so that
+	// every message fits in a UDP datagram.
+	maxEntriesBytes = 32 << 10
+	snapshotChunk   = 32 << 10
+	// MaxCommand is the largest command Propose accepts.
+	MaxCommand = 16 << 10
+	// maxDatagram is the receive buffer size: the UDP maximum.
+	maxDatagram = 64 << 10
+)
+
+type msgType uint8
+
+const (
+	requestVote msgType = iota + 1
+	requestVoteReply
+	appendEntries
+	appendEntriesReply
+	installSnapshot
+	installSnapshotReply
+)
+
+func (t msgType) String() string {
+	switch t {
+	case requestVote:
+		return "RequestVote"
+	case requestVoteReply:
+		return "RequestVoteReply"
+	case appendEntries:
+		return "AppendEntries"
+	case appendEntriesReply:
+		return "AppendEntriesReply"
+	case installSnapshot:
+		return "InstallSnapshot"
+	case installSnapshotReply:
+		return "InstallSnapshotReply"
+	}
+	return fmt.Sprintf("msgType(%d)", uint8(t))
+}
+
+// message is the union of all Raft RPCs and their replies; each type uses a
+// subset of the fields.
+type message struct {
+	Type msgType
+	From int
+	Term uint64
+
+	// RequestVote
+	LastLogIndex uint64
+	LastLogTerm  uint64
+	Granted      bool
+
+	// AppendEntries
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+
+	// AppendEntriesReply and InstallSnapshotReply
+	Success    bool
+	MatchIndex uint64 // last index known to match the leader's log
+	Conflict   uint64 // on failure: where the leader should retry from
+
+	// InstallSnapshot; Offset is also the next offset wanted in the reply.
+	SnapshotIndex uint64
+	SnapshotTerm  uint64
+	Offset        uint64
+	Data          []byte
+	Done          bool
+}
+
+func (m *message) marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(wireMagic)
+	if err := gob.NewEncoder(&buf).Encode(m); err != nil {
+		return nil, fmt.Errorf("marshal %v: %w", m.Type, err)
+	}
+	return buf.Bytes(), nil
+}
+
+func parseMessage(data []byte, n int) (*message, error) {
+	if len(data) == 0 || data[0] != wireMagic {
+		return nil, fmt.Errorf("parseMessage: not a Raft message")
+	}
+	var m message
+	if err := gob.NewDecoder(bytes.NewReader(data[1:])).Decode(&m); err != nil {
+		return nil, fmt.Errorf("parseMessage: %w", err)
+	}
+	if m.Type < requestVote || m.Type > installSnapshotReply {
+		return nil, fmt.Errorf("parseMessage: unknown type %v", m.Type)
+	}
+	if m.From < 0 || m.From >= n {
+		return nil, fmt.Errorf("parseMessage: sender %d out of range [0, %d)", m.From, n)
+	}
+	return &m, nil
+}
@@ -0,0 +1,243 @@
+package snapshot
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/logger"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/message"
+)
+
+// Channel is the recorded state of the channel from node From to the node
+// that recorded it: the datagrams that arrived after the node recorded its
+// own state and before From's marker.
+type Channel struct {
+	From     int      `json:"from"`
+	InFlight []string `json:"in_flight"` // Digest of each datagram, in arrival order
+	Closed   bool     `json:"closed"`    // From's marker arrived before the snapshot timed out
+}
+
+// Local is one node's part of a Chandy-Lamport snapshot. Counters are in
+// datagrams (messages, fragments or Bracha frames, markers excluded) and
+// indexed by node.
+type Local struct {
+	ID        uint32    `json:"id"`
+	Initiator int       `json:"initiator"`
+	Node      int       `json:"node"`
+	Mode      string    `json:"mode"` // "plain", "fragment" or "bracha"
+	TakenAt   time.Time `json:"taken_at"`
+	Sent      []uint64  `json:"sent"`      // sent to each node before the local state was recorded
+	Received  []uint64  `json:"received"`  // received from each node before it
+	Delivered uint64    `json:"delivered"` // messages delivered (logged) before it
+	Channels  []Channel `json:"channels"`  // indexed by sender
+	Complete  bool      `json:"complete"`  // every channel closed
+}
+
+// Digest identifies a datagram in a channel state: for 1024-byte messages
+// and fragments the SHA-1 trailer they carry, which is what the message log
+// records, otherwise the SHA-1 of the whole datagram.
+func Digest(datagram []byte) string {
+	if len(datagram) == message.MessageSize {
+		return hex.EncodeToString(datagram[message.MessageSize-sha1.Size:])
+	}
+	sum := sha1.Sum(datagram)
+	return hex.EncodeToString(sum[:])
+}
+
+// FileName is the name of the file WriteLocal stores l in.
+func (l *Local) FileName() string {
+	return fmt.Sprintf("node_%d_snapshot_%d_%d.json", l.Node, l.Initiator, l.ID)
+}
+
+// WriteLocal stores l as JSON in dir, which is created if needed.
+func WriteLocal(dir string, l *Local) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("WriteLocal: %w", err)
+	}
+	return writeJSON(filepath.Join(dir, l.FileName()), l)
+}
+
+func writeJSON(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode %s: %w", path, err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	return nil
+}
+
+// Global is the consistent global state assembled from every node's Local.
+type Global struct {
+	ID        uint32   `json:"id"`
+	Initiator int      `json:"initiator"`
+	Nodes     []*Local `json:"nodes"` // by node index
+}
+
+// Collect reads every local snapshot in dir and groups them into global
+// snapshots, ordered by initiator and id.
+func Collect(dir string) ([]*Global, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "node_*_snapshot_*_*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("Collect: %w", err)
+	}
+	type key struct {
+		initiator int
+		id        uint32
+	}
+	byKey := map[key]*Global{}
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("Collect: %w", err)
+		}
+		var l Local
+		if err := json.Unmarshal(data, &l); err != nil {
+			return nil, fmt.Errorf("Collect: %s: %w", p, err)
+		}
+		k := key{l.Initiator, l.ID}
+		if byKey[k] == nil {
+			byKey[k] = &Global{ID: l.ID, Initiator: l.Initiator}
+		}
+		byKey[k].Nodes = append(byKey[k].Nodes, &l)
+	}
+	var out []*Global
+	for _, g := range byKey {
+		sort.Slice(g.Nodes, func(i, j int) bool { return g.Nodes[i].Node < g.Nodes[j].Node })
+		out = append(out, g)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Initiator != out[j].Initiator {
+			return out[i].Initiator < out[j].Initiator
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out, nil
+}
+
+// FileName is the name of the file WriteGlobal stores g in.
+func (g *Global) FileName() string {
+	return fmt.Sprintf("global_snapshot_%d_%d.json", g.Initiator, g.ID)
+}
+
+// WriteGlobal stores g as JSON in dir and returns the file's path.
+func WriteGlobal(dir string, g *Global) (string, error) {
+	path := filepath.Join(dir, g.FileName())
+	if err := writeJSON(path, g); err != nil {
+		return "", fmt.Errorf("WriteGlobal: %w", err)
+	}
+	return path, nil
+}
+
+// InFlight returns the number of datagrams recorded on all channels.
+func (g *Global) InFlight() int {
+	total := 0
+	for _, l := range g.Nodes {
+		for _, c := range l.Channels {
+			total += len(c.InFlight)
+		}
+	}
+	return total
+}
+
+// Validate checks that g is a consistent cut of m nodes: every node took part
+// and closed every channel, and on every channel j->i whatever j had sent
+// before its snapshot was either received by i before i's snapshot or
+// recorded in flight. That holds when channels are FIFO and lossless, so a
+// violation on a UDP run also reveals reordered or dropped datagrams.
+func (g *Global) Validate(m int) []string {
+	var problems []string
+	byNode := make([]*Local, m)
+	for _, l := range g.Nodes {
+		switch {
+		case l.Node < 0 || l.Node >= m:
+			problems = append(problems, fmt.Sprintf("node %d: index out of range [0, %d)", l.Node, m))
+		case byNode[l.Node] != nil:
+			problems = append(problems, fmt.Sprintf("node %d: two local snapshots", l.Node))
+		case len(l.Sent) != m || len(l.Received) != m || len(l.Channels) != m:
+			problems = append(problems, fmt.Sprintf("node %d: snapshot is not for %d nodes", l.Node, m))
+		default:
+			byNode[l.Node] = l
+		}
+	}
+	for i, l := range byNode {
+		if l == nil {
+			problems = append(problems, fmt.Sprintf("node %d: no local snapshot", i))
+			continue
+		}
+		for _, c := range l.Channels {
+			if !c.Closed {
+				problems = append(problems, fmt.Sprintf("channel %d->%d: no marker arrived", c.From, i))
+			}
+		}
+	}
+	for j, sender := range byNode {
+		for i, receiver := range byNode {
+			if sender == nil || receiver == nil {
+				continue
+			}
+			sent := sender.Sent[i]
+			accounted := receiver.Received[j] + uint64(len(receiver.Channels[j].InFlight))
+			switch {
+			case receiver.Received[j] > sent:
+				problems = append(problems, fmt.Sprintf(
+					"channel %d->%d: %d received before the snapshot but only %d sent (inconsistent cut)",
+					j, i, receiver.Received[j], sent))
+			case !receiver.Channels[j].Closed:
+				// Already reported: its in-flight record ran on past the cut.
+			case accounted != sent:
+				problems = append(problems, fmt.Sprintf(
+					"channel %d->%d: %d sent, %d received and %d in flight: %d datagrams lost or reordered",
+					j, i, sent, receiver.Received[j], len(receiver.Channels[j].InFlight), int64(sent)-int64(accounted)))
+			}
+		}
+	}
+	return problems
+}
+
+// CheckLogs compares g with the final message logs of the run in logsDir
+// (node_<i>_messages.log): each node must have logged at least the messages
+// it had delivered at its snapshot and, in plain mode, every message recorded
+// in flight to it must appear in its log after that point.
+func (g *Global) CheckLogs(logsDir string) []string {
+	var problems []string
+	for _, l := range g.Nodes {
+		path := filepath.Join(logsDir, fmt.Sprintf("node_%d_messages.log", l.Node))
+		entries, err := logger.ReadMessageLog(path)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("node %d: %v", l.Node, err))
+			continue
+		}
+		if uint64(len(entries)) < l.Delivered {
+			problems = append(problems, fmt.Sprintf("node %d: %d messages delivered at the snapshot, but only %d in the final log",
+				l.Node, l.Delivered, len(entries)))
+			continue
+		}
+		if l.Mode != "plain" {
+			continue // channels carry fragments or frames, not logged messages
+		}
+		later := map[string]int{}
+		for _, e := range entries[l.Delivered:] {
+			later[fmt.Sprintf("%d %s", e.SourceIndex, e.SentHex)]++
+		}
+		for _, c := range l.Channels {
+			for _, d := range c.InFlight {
+				k := fmt.Sprintf("%d %s", c.From, d)
+				if later[k] == 0 {
+					problems = append(problems, fmt.Sprintf("node %d: message %s in flight from node %d never logged after the snapshot",
+						l.Node, d, c.From))
+					continue
+				}
+				later[k]--
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,139 @@
+package snapshot
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/logger"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/message"
+)
+
+// twoNodes is a consistent snapshot of two nodes: node 1 had sent 3 messages
+// to node 0, which received 2 before its snapshot and 1 on the channel.
+func twoNodes() *Global {
+	channel := func(from int, inFlight ...string) Channel {
+		return Channel{From: from, InFlight: append([]string{}, inFlight...), Closed: true}
+	}
+	return &Global{ID: 1, Initiator: 0, Nodes: []*Local{
+		{ID: 1, Initiator: 0, Node: 0, Mode: "plain", Sent: []uint64{2, 2}, Received: []uint64{2, 2}, Delivered: 4,
+			Channels: []Channel{channel(0), channel(1, "aa")}, Complete: true},
+		{ID: 1, Initiator: 0, Node: 1, Mode: "plain", Sent: []uint64{3, 3}, Received: []uint64{2, 3}, Delivered: 5,
+			Channels: []Channel{channel(0), channel(1)}, Complete: true},
+	}}
+}
+
+// --- Validate: consistent cuts pass, lost datagrams and open channels do not ---
+
+func TestValidate(t *testing.T) {
+	if problems := twoNodes().Validate(2); len(problems) > 0 {
+		t.Fatalf("consistent snapshot reported: %v", problems)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(g *Global)
+		want   string
+	}{
+		{"lost", func(g *Global) { g.Nodes[0].Channels[1].InFlight = nil }, "channel 1->0: 3 sent, 2 received and 0 in flight"},
+		{"future", func(g *Global) { g.Nodes[1].Received[0] = 3 }, "channel 0->1: 3 received before the snapshot but only 2 sent"},
+		{"open", func(g *Global) { g.Nodes[1].Channels[0].Closed = false }, "channel 0->1: no marker arrived"},
+		{"missing", func(g *Global) { g.Nodes = g.Nodes[:1] }, "node 1: no local snapshot"},
+		{"duplicate", func(g *Global) { g.Nodes[1] = g.Nodes[0] }, "node 0: two local snapshots"},
+		{"size", func(g *Global) { g.Nodes[1].Sent = g.Nodes[1].Sent[:1] }, "node 1: snapshot is not for 2 nodes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := twoNodes()
+			tt.modify(g)
+			problems := strings.Join(g.Validate(2), "\n")
+			if !strings.Contains(problems, tt.want) {
+				t.Errorf("want %q among the problems, got:\n%s", tt.want, problems)
+			}
+		})
+	}
+}
+
+// --- Collect: local snapshot files are grouped into global snapshots ---
+
+func TestCollect_RoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	other := twoNodes()
+	for _, l := range other.Nodes {
+		l.Initiator = 1
+	}
+	for _, g := range []*Global{twoNodes(), other} {
+		for _, l := range g.Nodes {
+			if err := WriteLocal(dir, l); err != nil {
+				t.Fatalf("WriteLocal: %v", err)
+			}
+		}
+	}
+
+	globals, err := Collect(dir)
+	if err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	if len(globals) != 2 || globals[0].Initiator != 0 || globals[1].Initiator != 1 {
+		t.Fatalf("expected snapshots 0/1 and 1/1, got %+v", globals)
+	}
+	for _, g := range globals {
+		if len(g.Nodes) != 2 || g.Nodes[0].Node != 0 || g.Nodes[1].Node != 1 {
+			t.Errorf("snapshot %d/%d: nodes not grouped in order", g.Initiator, g.ID)
+		}
+		if g.InFlight() != 1 {
+			t.Errorf("snapshot %d/%d: expected 1 datagram in flight, got %d", g.Initiator, g.ID, g.InFlight())
+		}
+		if _, err := WriteGlobal(dir, g); err != nil {
+			t.Fatalf("WriteGlobal: %v", err)
+		}
+	}
+	if again, err := Collect(dir); err != nil || len(again) != 2 {
+		t.Errorf("global files should not be collected again: %d snapshots, %v", len(again), err)
+	}
+}
+
+// --- CheckLogs: in-flight messages must be logged after the snapshot ---
+
+func TestCheckLogs(t *testing.T) {
+	msg := message.BuildMessage(1)
+	digest := Digest(msg.Bytes())
+	sentHex, calcHex, _ := msg.Verify()
+	if digest != sentHex {
+		t.Fatalf("Digest %s differs from the logged SHA-1 %s", digest, sentHex)
+	}
+
+	write := func(dir string, node int, lines int, last uint8) {
+		lg, err := logger.NewMsgLoggerDir(dir, node)
+		if err != nil {
+			t.Fatalf("logger: %v", err)
+		}
+		for i := 0; i < lines; i++ {
+			lg.LogMessage(true, 0, strings.Repeat("0", 40), strings.Repeat("0", 40))
+		}
+		lg.LogMessage(true, last, sentHex, calcHex)
+		lg.Close()
+	}
+
+	g := twoNodes()
+	g.Nodes[0].Channels[1].InFlight = []string{digest}
+
+	dir := t.TempDir()
+	write(dir, 0, 4, 1)
+	write(dir, 1, 5, 0)
+	if problems := g.CheckLogs(dir); len(problems) > 0 {
+		t.Errorf("logs agree with the snapshot, got: %v", problems)
+	}
+
+	dir = t.TempDir()
+	write(dir, 0, 4, 0) // right message, wrong sender
+	write(dir, 1, 3, 0)
+	problems := strings.Join(g.CheckLogs(dir), "\n")
+	for _, want := range []string{
+		"node 0: message " + digest + " in flight from node 1 never logged",
+		"node 1: 5 messages delivered at the snapshot, but only 4 in the final log",
+	} {
+		if !strings.Contains(problems, want) {
+			t.Errorf("want %q among the problems, got:\n%s", want, problems)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+// Package status carries the progress of running nodes to a dashboard: every
+// node sends its Report as a datagram at a fixed interval, and a Board keeps
+// the latest one of each node.
+package status
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// magic starts every status datagram, so that stray traffic is told apart.
+const magic = "ST"
+
+// maxDatagram bounds a status datagram: a report carries one counter per node.
+const maxDatagram = 64 << 10
+
+// Report is the progress of one node.
+type Report struct {
+	Node     int
+	N        int   // broadcasts the node sends
+	M        int   // nodes in the cluster
+	Sent     int   // broadcasts sent so far
+	Received int   // deliveries so far, OK and FAIL
+	OK       int   // deliveries whose SHA-1 matched
+	Fail     int   // deliveries whose SHA-1 did not match
+	Errors   int   // lines written to the error log
+	From     []int // deliveries by sender index
+	Done     bool  // the node finished its run
+}
+
+// Marshal encodes the report as a status datagram.
+func (r *Report) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(magic)
+	if err := json.NewEncoder(&buf).Encode(r); err != nil {
+		return nil, fmt.Errorf("Marshal: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Parse decodes a status datagram.
+func Parse(data []byte) (*Report, error) {
+	if !bytes.HasPrefix(data, []byte(magic)) {
+		return nil, fmt.Errorf("Parse: not a status datagram")
+	}
+	var r Report
+	if err := json.Unmarshal(data[len(magic):], &r); err != nil {
+		return nil, fmt.Errorf("Parse: %w", err)
+	}
+	if r.Node < 0 || r.M < 0 || r.Node >= max(r.M, 1) || len(r.From) > r.M {
+		return nil, fmt.Errorf("Parse: node %d of %d with %d senders", r.Node, r.M, len(r.From))
+	}
+	return &r, nil
+}
+
+// Counters is the live Report of a node, safe for concurrent use. A nil
+// *Counters ignores updates, so that callers need not check whether status
+// reporting is on.
+type Counters struct {
+	mu sync.Mutex
+	r  Report
+}
+
+// NewCounters returns the counters of node index of an m-node cluster in
+// which every node sends n broadcasts.
+func NewCounters(index, n, m int) *Counters {
+	return &Counters{r: Report{Node: index, N: n, M: m, From: make([]int, m)}}
+}
+
+// Sent counts one broadcast.
+func (c *Counters) Sent() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.r.Sent++
+}
+
+// Delivered counts one delivery from node from.
+func (c *Counters) Delivered(from int, ok bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.r.Received++
+	if ok {
+		c.r.OK++
+	} else {
+		c.r.Fail++
+	}
+	if from >= 0 && from < len(c.r.From) {
+		c.r.From[from]++
+	}
+}
+
+// Error counts one error.
+func (c *Counters) Error() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.r.Errors++
+}
+
+// Finish marks the run as over.
+func (c *Counters) Finish() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.r.Done = true
+}
+
+// Grow records that the cluster now has m nodes, if more than before.
+func (c *Counters) Grow(m int) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if m > c.r.M {
+		c.r.M = m
+		c.r.From = append(c.r.From, make([]int, m-len(c.r.From))...)
+	}
+}
+
+// Report returns a copy of the counters.
+func (c *Counters) Report() Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.r
+	r.From = append([]int(nil), c.r.From...)
+	return r
+}
+
+// Send reports c to the dashboard at addr every interval until ctx is done,
+// then one last time.
+func Send(ctx context.Context, addr string, interval time.Duration, c *Counters) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return fmt.Errorf("Send: %w", err)
+	}
+	defer conn.Close()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		r := c.Report()
+		data, err := r.Marshal()
+		if err != nil {
+			return fmt.Errorf("Send: %w", err)
+		}
+		// A dashboard that is not running yet refuses the datagram; later
+		// reports reach it once it is.
+		conn.Write(data)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			r = c.Report()
+			if data, err = r.Marshal(); err == nil {
+				conn.Write(data)
+			}
+			return nil
+		}
+	}
+}
+
+// Row is what a Board knows of one node.
+type Row struct {
+	Report
+	Seen time.Time // arrival of the latest report
+	// Loss is the fraction of the broadcasts sent so far, by the nodes
+	// that reported, that did not reach this node.
+	Loss float64
+}
+
+// Board keeps the latest report of every node, safe for concurrent use.
+type Board struct {
+	mu      sync.Mutex
+	reports map[int]*Report
+	seen    map[int]time.Time
+}
+
+// NewBoard returns an empty board.
+func NewBoard() *Board {
+	return &Board{reports: map[int]*Report{}, seen: map[int]time.Time{}}
+}
+
+// Update records the latest report of r.Node, received at now.
+func (b *Board) Update(r *Report, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reports[r.Node] = r
+	b.seen[r.Node] = now
+}
+
+// Serve reads status datagrams from conn into the board until conn is
+// closed. Datagrams that are not status reports are ignored.
+func (b *Board) Serve(conn net.PacketConn) error {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("Serve: %w", err)
+		}
+		if r, err := Parse(buf[:n]); err == nil {
+			b.Update(r, time.Now())
+		}
+	}
+}
+
+// Size returns the number of nodes in the cluster, as the reports say.
+func (b *Board) Size() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	m := 0
+	for _, r := range b.reports {
+		m = max(m, r.M)
+	}
+	return m
+}
+
+// Rows returns the nodes that reported, by index.
+func (b *Board) Rows() []Row {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	rows := make([]Row, 0, len(b.reports))
+	for i, r := range b.reports {
+		row := Row{Report: *r, Seen: b.seen[i]}
+		sent, got := 0, 0
+		for s, sr := range b.reports {
+			if s < len(r.From) {
+				sent += sr.Sent
+				got += r.From[s]
+			}
+		}
+		if sent > 0 && got < sent {
+			row.Loss = 1 - float64(got)/float64(sent)
+		}
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Node < rows[j].Node })
+	return rows
+}
+
+// Delivered returns the fraction of the broadcasts node from sent so far
+// that node to delivered; ok is false until both reported and from sent one.
+func (b *Board) Delivered(from, to int) (frac float64, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, r := b.reports[from], b.reports[to]
+	if s == nil || r == nil || s.Sent == 0 || from >= len(r.From) {
+		return 0, false
+	}
+	return min(float64(r.From[from])/float64(s.Sent), 1), true
+}
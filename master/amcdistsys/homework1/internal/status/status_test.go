@@ -0,0 +1,131 @@
+package status
+
+import (
+	"context"
+	"math"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// --- Reports travel as datagrams ---
+
+func TestReport_RoundTrip(t *testing.T) {
+	c := NewCounters(1, 10, 3)
+	c.Sent()
+	c.Delivered(0, true)
+	c.Delivered(2, false)
+	c.Error()
+	c.Finish()
+	r := c.Report()
+	data, err := r.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	got, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	want := Report{Node: 1, N: 10, M: 3, Sent: 1, Received: 2, OK: 1, Fail: 1, Errors: 1, From: []int{1, 0, 1}, Done: true}
+	if !reflect.DeepEqual(*got, want) {
+		t.Errorf("round-trip: got %+v, want %+v", *got, want)
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for name, data := range map[string]string{
+		"no magic":          `{"Node":0,"M":1}`,
+		"bad json":          `ST{"Node":`,
+		"node out of range": `ST{"Node":3,"M":3}`,
+		"too many senders":  `ST{"Node":0,"M":1,"From":[1,2]}`,
+	} {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestCounters_Grow(t *testing.T) {
+	c := NewCounters(0, 5, 2)
+	c.Grow(4)
+	c.Delivered(3, true)
+	c.Grow(3)
+	if r := c.Report(); r.M != 4 || !reflect.DeepEqual(r.From, []int{0, 0, 0, 1}) {
+		t.Errorf("after Grow: M=%d From=%v", r.M, r.From)
+	}
+}
+
+func TestCounters_NilIgnoresUpdates(t *testing.T) {
+	var c *Counters
+	c.Sent()
+	c.Delivered(0, true)
+	c.Error()
+	c.Grow(3)
+	c.Finish()
+}
+
+// --- The board derives loss and the sender x receiver matrix ---
+
+func TestBoard_LossAndDelivered(t *testing.T) {
+	b := NewBoard()
+	now := time.Now()
+	b.Update(&Report{Node: 0, N: 10, M: 2, Sent: 10, Received: 15, From: []int{10, 5}}, now)
+	b.Update(&Report{Node: 1, N: 10, M: 2, Sent: 10, Received: 20, From: []int{10, 10}}, now)
+
+	rows := b.Rows()
+	if len(rows) != 2 || rows[0].Node != 0 || rows[1].Node != 1 {
+		t.Fatalf("rows: %+v", rows)
+	}
+	if math.Abs(rows[0].Loss-0.25) > 1e-9 || rows[1].Loss != 0 {
+		t.Errorf("loss: %v, %v; want 0.25, 0", rows[0].Loss, rows[1].Loss)
+	}
+	if f, ok := b.Delivered(1, 0); !ok || f != 0.5 {
+		t.Errorf("Delivered(1, 0) = %v, %v; want 0.5", f, ok)
+	}
+	if _, ok := b.Delivered(2, 0); ok {
+		t.Error("Delivered from a node that never reported")
+	}
+	if b.Size() != 2 {
+		t.Errorf("Size = %d, want 2", b.Size())
+	}
+}
+
+// --- Nodes report to a dashboard over UDP ---
+
+func TestSend_ReachesBoard(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	b := NewBoard()
+	served := make(chan error, 1)
+	go func() { served <- b.Serve(conn) }()
+
+	c := NewCounters(0, 5, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	sent := make(chan error, 1)
+	go func() { sent <- Send(ctx, conn.LocalAddr().String(), 10*time.Millisecond, c) }()
+	for i := 0; i < 5; i++ {
+		c.Sent()
+		c.Delivered(0, true)
+	}
+	c.Finish()
+	cancel()
+	if err := <-sent; err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if rows := b.Rows(); len(rows) == 1 && rows[0].Done && rows[0].Received == 5 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("board never got the final report: %+v", b.Rows())
+		}
+	}
+	conn.Close()
+	if err := <-served; err != nil {
+		t.Errorf("Serve: %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+// Package testutil holds the harness shared by the tests of the protocols
+// built on node.Transport: an in-process cluster over a MemNetwork and a log
+// destination its nodes can share.
+package testutil
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/config"
+	"github.com/cosmintimis/learning-go/master/amcdistsys/homework1/internal/node"
+)
+
+// SyncBuffer is a log destination that several goroutines can write to
+// while the test reads it.
+type SyncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *SyncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *SyncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// Config returns a config of n nodes on 127.0.0.1, for the protocols that
+// take one; the addresses are never used over a MemNetwork.
+func Config(n int) *config.Config {
+	cfg := &config.Config{}
+	for i := range n {
+		cfg.Nodes = append(cfg.Nodes, config.NodeAddr{IP: "127.0.0.1", Port: 7000 + i})
+	}
+	return cfg
+}
+
+// Node is a cluster member: an Elector, a Raft, a Mutex...
+type Node interface {
+	comparable
+	Start(ctx context.Context) error
+	Close() error
+}
+
+// Cluster is an in-process cluster of n nodes over a MemNetwork. Nodes[i] is
+// the zero T (nil) while node i is killed. Every live node is killed when the
+// test ends.
+type Cluster[T Node] struct {
+	T     *testing.T
+	Mem   *node.MemNetwork
+	Nodes []T
+	Log   *SyncBuffer // for the nodes' Options.Log
+
+	// Killed, if set, is called once node i was closed, for instance to wait
+	// for the goroutines the test runs next to it.
+	Killed func(i int)
+
+	create func(i int, tr node.Transport) (T, error)
+}
+
+// NewCluster prepares a cluster of n nodes, created by create on the
+// transport of their index. No node runs before Start or StartAll.
+func NewCluster[T Node](t *testing.T, n int, create func(i int, tr node.Transport) (T, error)) *Cluster[T] {
+	c := &Cluster[T]{T: t, Mem: node.NewMemNetwork(n), Nodes: make([]T, n), Log: &SyncBuffer{}, create: create}
+	t.Cleanup(func() {
+		for i := range c.Nodes {
+			if c.Live(i) {
+				c.Kill(i)
+			}
+		}
+	})
+	return c
+}
+
+// StartAll starts every node.
+func (c *Cluster[T]) StartAll() {
+	c.T.Helper()
+	for i := range c.Nodes {
+		c.Start(i)
+	}
+}
+
+// Start creates and starts node i, again if it was killed.
+func (c *Cluster[T]) Start(i int) {
+	c.T.Helper()
+	n, err := c.create(i, c.Mem.Transport(i))
+	if err != nil {
+		c.T.Fatalf("New(%d): %v", i, err)
+	}
+	if err := n.Start(context.Background()); err != nil {
+		c.T.Fatalf("Start(%d): %v", i, err)
+	}
+	c.Nodes[i] = n
+}
+
+// Kill closes node i.
+func (c *Cluster[T]) Kill(i int) {
+	c.Nodes[i].Close()
+	if c.Killed != nil {
+		c.Killed(i)
+	}
+	var zero T
+	c.Nodes[i] = zero
+}
+
+// Live reports whether node i runs.
+func (c *Cluster[T]) Live(i int) bool {
+	var zero T
+	return c.Nodes[i] != zero
+}
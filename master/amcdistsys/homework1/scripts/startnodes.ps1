@@ -1,5 +1,8 @@
 # Usage: .\scripts\startnodes.ps1 <config_file> <first_index> <last_index>
 # Example: .\scripts\startnodes.ps1 config.txt 0 2
+#
+# Thin wrapper around cmd/bcastctl, which does the actual launching, output
+# prefixing, timeout handling and exit status reporting.
 
 param(
     [Parameter(Mandatory)][string]$Config,
@@ -9,21 +12,16 @@ param(
 
 $Root = Split-Path -Parent $PSScriptRoot
 $Binary = Join-Path $Root "bcastnode.exe"
+$Ctl = Join-Path $Root "bcastctl.exe"
 
-Write-Host "Building bcastnode..."
+Write-Host "Building bcastnode and bcastctl..."
 Push-Location $Root
 go build -o bcastnode.exe ./cmd/bcastnode
-if ($LASTEXITCODE -ne 0) { Write-Error "Build failed"; exit 1 }
+if ($LASTEXITCODE -ne 0) { Write-Error "Build failed"; Pop-Location; exit 1 }
+go build -o bcastctl.exe ./cmd/bcastctl
+if ($LASTEXITCODE -ne 0) { Write-Error "Build failed"; Pop-Location; exit 1 }
 Pop-Location
 Write-Host "Build complete."
 
-$jobs = @()
-for ($idx = $First; $idx -le $Last; $idx++) {
-    $job = Start-Process -FilePath $Binary -ArgumentList $Config, $idx -PassThru -NoNewWindow
-    $jobs += $job
-    Write-Host "Started node $idx (pid $($job.Id))"
-}
-
-Write-Host "All nodes launched. Waiting for completion..."
-$jobs | ForEach-Object { $_.WaitForExit() }
-Write-Host "All nodes done."
+& $Ctl -bin $Binary $Config $First $Last
+exit $LASTEXITCODE
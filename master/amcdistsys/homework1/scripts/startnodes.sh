@@ -1,40 +1,28 @@
 #!/usr/bin/env bash
 set -euo pipefail
 
-# Usage: ./scripts/startnodes.sh <config_file> <first_index> <last_index>
+# Usage: ./scripts/startnodes.sh <config_file> <first_index> <last_index> [-- node flags...]
 # Example: bash scripts/startnodes.sh config.txt 0 2
+#
+# Thin wrapper around cmd/bcastctl, which does the actual launching, output
+# prefixing, timeout handling and exit status reporting.
 
-if [ "$#" -ne 3 ]; then
-    echo "Usage: $0 <config_file> <first_index> <last_index>" >&2
+if [ "$#" -lt 3 ]; then
+    echo "Usage: $0 <config_file> <first_index> <last_index> [-- node flags...]" >&2
     exit 1
 fi
 
-CONFIG="$1"
-FIRST="$2"
-LAST="$3"
-
 ROOT="$(cd "$(dirname "${BASH_SOURCE[0]}")/.." && pwd)"
 
-# Determine binary name (platform-aware)
+# Determine binary names (platform-aware)
 if [[ "$OSTYPE" == "msys" || "$OSTYPE" == "cygwin" ]]; then
-    BINARY="$ROOT/bcastnode.exe"
+    EXT=".exe"
 else
-    BINARY="$ROOT/bcastnode"
+    EXT=""
 fi
 
-echo "Building bcastnode..."
-(cd "$ROOT" && go build -o "$(basename "$BINARY")" ./cmd/bcastnode)
+echo "Building bcastnode and bcastctl..."
+(cd "$ROOT" && go build -o "bcastnode$EXT" ./cmd/bcastnode && go build -o "bcastctl$EXT" ./cmd/bcastctl)
 echo "Build complete."
 
-pids=()
-for idx in $(seq "$FIRST" "$LAST"); do
-    "$BINARY" "$CONFIG" "$idx" &
-    pids+=($!)
-    echo "Started node $idx (pid ${pids[-1]})"
-done
-
-echo "All nodes launched. Waiting for completion..."
-for pid in "${pids[@]}"; do
-    wait "$pid"
-done
-echo "All nodes done."
+exec "$ROOT/bcastctl$EXT" -bin "$ROOT/bcastnode$EXT" "$@"